@@ -3,6 +3,7 @@ package main
 import (
 	appconfig "awesomeProject/internal/config"
 	"awesomeProject/internal/handler"
+	"awesomeProject/internal/keypool"
 	"awesomeProject/internal/middleware"
 	"awesomeProject/internal/model"
 	"awesomeProject/internal/modelstate"
@@ -28,6 +29,13 @@ func main() {
 	if err := modelstate.SetDisableTTL(cfg.ModelDisable.DisableTTL); err != nil {
 		log.Printf("warning: failed to set disable_ttl: %v, using default", err)
 	}
+	cb := cfg.ModelDisable.CircuitBreaker
+	if err := modelstate.ConfigureBreaker(cb.Enabled, cb.Window, cb.OpenDuration, cb.MaxOpenDuration, cb.MinRequests, cb.FailureRate); err != nil {
+		log.Printf("warning: %v, circuit breaker disabled", err)
+	}
+	if err := keypool.Configure(cfg.KeyPool.AuthBench, cfg.KeyPool.RateLimitBench); err != nil {
+		log.Printf("warning: %v, using default key bench durations", err)
+	}
 	if cfg.Server.Debug {
 		gin.SetMode(gin.DebugMode)
 	} else {
@@ -103,11 +111,17 @@ func main() {
 	if err != nil {
 		log.Fatalf("failed to init database: %v", err)
 	}
-	if err := db.AutoMigrate(&model.Model{}, &model.Combo{}, &model.ComboItem{}, &model.User{}, &model.UsageLog{}, &model.ErrorLog{}, &model.RedeemCode{}, &model.RedeemLog{}); err != nil {
+	if err := db.AutoMigrate(&model.Model{}, &model.Combo{}, &model.ComboItem{}, &model.User{}, &model.UsageLog{}, &model.ErrorLog{}, &model.RedeemCode{}, &model.RedeemLog{}, &model.ComboWeightHistory{}, &model.ModelDisableState{}, &model.ConversationState{}, &model.ModelHealthCheck{}, &model.QuotaHold{}); err != nil {
 		log.Fatalf("failed to migrate database: %v", err)
 	}
+	if st, err := modelstate.NewStore(cfg.ModelDisable.Store, db); err != nil {
+		log.Printf("warning: %v, using memory store", err)
+	} else {
+		modelstate.SetStore(st)
+	}
 
-	// 启动后台定时任务
+	// 启动后台定时任务（健康检查复用 /v1/messages 的上游调用逻辑）
+	task.SetModelProber(handler.NewMessagesHandler(cfg).ProbeModel)
 	task.StartTasks(cfg)
 
 	apiRoot := router.Group("/back")
@@ -0,0 +1,61 @@
+package combo
+
+import (
+	"fmt"
+	"strings"
+
+	"awesomeProject/internal/model"
+)
+
+// CapabilityError combo 中所有可用子模型都无法处理当前请求（上下文过长、不支持图片/工具、不在生效时间窗口等）。
+type CapabilityError struct {
+	ComboID string
+	Reasons []string // 每个被跳过的模型一条，形如 "model-a: context window 8000 < ~12000 prompt tokens"
+}
+
+func (e *CapabilityError) Error() string {
+	return fmt.Sprintf("no model in %s can serve this request: %s", e.ComboID, strings.Join(e.Reasons, "; "))
+}
+
+// ContextExceeded 返回是否所有模型都因上下文窗口或最大输出被跳过。
+func (e *CapabilityError) ContextExceeded() bool {
+	if len(e.Reasons) == 0 {
+		return false
+	}
+	for _, r := range e.Reasons {
+		if !strings.Contains(r, "context window") && !strings.Contains(r, "max output") {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckCapability 判断模型能否处理请求，不能时返回原因。未配置的能力按支持处理。
+func CheckCapability(m *model.Model, req *Request) (bool, string) {
+	if m == nil || req == nil {
+		return true, ""
+	}
+	if m.ContextWindow > 0 && req.PromptTokens > m.ContextWindow {
+		return false, fmt.Sprintf("context window %d < ~%d prompt tokens", m.ContextWindow, req.PromptTokens)
+	}
+	if m.MaxOutputTokens > 0 && req.MaxTokens > m.MaxOutputTokens {
+		return false, fmt.Sprintf("max output %d < requested %d tokens", m.MaxOutputTokens, req.MaxTokens)
+	}
+	if req.HasImages && unsupported(m.SupportsVision) {
+		return false, "vision not supported"
+	}
+	if req.HasTools && unsupported(m.SupportsTools) {
+		return false, "tools not supported"
+	}
+	if req.HasThinking && unsupported(m.SupportsThinking) {
+		return false, "thinking not supported"
+	}
+	if req.HasPDF && unsupported(m.SupportsPDF) {
+		return false, "pdf not supported"
+	}
+	return true, ""
+}
+
+func unsupported(flag *bool) bool {
+	return flag != nil && !*flag
+}
@@ -0,0 +1,38 @@
+package combo
+
+import (
+	"testing"
+
+	"awesomeProject/internal/model"
+)
+
+func TestCheckCapability(t *testing.T) {
+	no := false
+	m := &model.Model{ID: "small", ContextWindow: 8000, MaxOutputTokens: 4096, SupportsVision: &no}
+	cases := []struct {
+		req  *Request
+		want bool
+	}{
+		{&Request{PromptTokens: 1000}, true},
+		{&Request{PromptTokens: 9000}, false},
+		{&Request{MaxTokens: 8192}, false},
+		{&Request{HasImages: true}, false},
+		{&Request{HasTools: true, HasThinking: true, HasPDF: true}, true}, // 未配置的能力按支持处理
+	}
+	for _, tc := range cases {
+		if ok, reason := CheckCapability(m, tc.req); ok != tc.want {
+			t.Errorf("req=%+v expect %v, got %v (%s)", tc.req, tc.want, ok, reason)
+		}
+	}
+}
+
+func TestCapabilityError_ContextExceeded(t *testing.T) {
+	err := &CapabilityError{ComboID: "combo:x", Reasons: []string{"a: context window 8000 < ~9000 prompt tokens"}}
+	if !err.ContextExceeded() {
+		t.Fatal("expect context exceeded")
+	}
+	err.Reasons = append(err.Reasons, "b: vision not supported")
+	if err.ContextExceeded() {
+		t.Fatal("expect mixed reasons not to be reported as context exceeded")
+	}
+}
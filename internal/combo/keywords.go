@@ -0,0 +1,106 @@
+package combo
+
+import (
+	"bytes"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"awesomeProject/internal/model"
+)
+
+// Keywords 返回 cb（含嵌套引用的 combo）中所有 item 配置的 "!keyword"，已去重。
+func Keywords(cb *model.Combo) []string {
+	var out []string
+	collectKeywords(cb, nil, &out)
+	return out
+}
+
+func collectKeywords(cb *model.Combo, path []string, out *[]string) {
+	if cb == nil || containsString(path, cb.ID) || len(path) >= MaxComboDepth {
+		return
+	}
+	path = append(path, cb.ID)
+	for _, it := range cb.Items {
+		for _, kw := range it.Keywords {
+			kw = strings.TrimSpace(kw)
+			if strings.HasPrefix(kw, "!") && !containsString(*out, kw) {
+				*out = append(*out, kw)
+			}
+		}
+		if id := strings.TrimSpace(it.ModelID); id != "" && isComboID(id) {
+			if nested, err := getCombo(id); err == nil {
+				collectKeywords(nested, path, out)
+			}
+		}
+	}
+}
+
+// StripBangKeywords 从 text 中删除 keywords 里出现的 "!keyword"，其余内容保持不变。
+// 命中规则与 HasCustomBangKeyword 一致：关键词后面是结尾、空白、标点或符号（如 "(!fast"、"!fast," 都会命中）。
+// 只整理被删除关键词两侧的空白：关键词独占一行时删除整行，否则删除其后（没有时为其前）的空格。
+// 单独的 "!" 关键词不会被删除，以免误删正常的感叹号。删除后文本只剩空白时返回原文。
+func StripBangKeywords(text string, keywords []string) string {
+	out := text
+	for _, kw := range keywords {
+		kw = strings.TrimSpace(kw)
+		if len(kw) < 2 || !strings.HasPrefix(kw, "!") {
+			continue
+		}
+		out = stripBangKeyword(out, kw)
+	}
+	if out == text || strings.TrimSpace(out) == "" {
+		return text
+	}
+	return out
+}
+
+func stripBangKeyword(text, kw string) string {
+	var out []byte
+	cursor := 0
+	for from := 0; ; {
+		i := strings.Index(text[from:], kw)
+		if i < 0 {
+			break
+		}
+		start, end := from+i, from+i+len(kw)
+		from = end
+		if r, _ := utf8.DecodeRuneInString(text[end:]); end < len(text) && !unicode.IsSpace(r) && !unicode.IsPunct(r) && !unicode.IsSymbol(r) {
+			continue
+		}
+		out = append(out, text[cursor:start]...)
+		// 关键词前后的空格：前面看已输出的内容（可能刚删过关键词），后面看原文
+		left := len(bytes.TrimRight(out, " \t"))
+		re := end
+		for re < len(text) && (text[re] == ' ' || text[re] == '\t') {
+			re++
+		}
+		lineStart := left == 0 || out[left-1] == '\n'
+		lineEnd := re == len(text) || text[re] == '\n' || text[re] == '\r'
+		switch {
+		case lineStart && lineEnd:
+			// 关键词独占一行：连同换行一起删除
+			out = out[:left]
+			switch {
+			case strings.HasPrefix(text[re:], "\r\n"):
+				re += 2
+			case re < len(text):
+				re++
+			default:
+				out = bytes.TrimSuffix(bytes.TrimSuffix(out, []byte("\n")), []byte("\r"))
+			}
+			cursor = re
+		case re > end:
+			cursor = re
+		default:
+			// 关键词后是行尾或标点：删除其前的空格
+			out = out[:left]
+			cursor = end
+		}
+		from = cursor
+	}
+	if cursor == 0 && out == nil {
+		return text
+	}
+	return string(append(out, text[cursor:]...))
+}
@@ -0,0 +1,50 @@
+package combo
+
+import (
+	"testing"
+
+	"awesomeProject/internal/model"
+)
+
+func TestStripBangKeywords(t *testing.T) {
+	kws := []string{"!opus", "!fast", "!"}
+	cases := []struct{ in, want string }{
+		{"!opus write a poem", "write a poem"},
+		{"please !opus write", "please write"},
+		{"write a poem !opus", "write a poem"},
+		{"!opus, hi", ", hi"},
+		{"!opus", "!opus"},
+		{"hello!", "hello!"},
+		{"see !opusx and a!opus", "see !opusx and a"},
+		{"!fast\n!opus go", "go"},
+		// 与 HasCustomBangKeyword 相同的命中规则：前面可以是任意字符
+		{"(!fast) go", "() go"},
+		{"try (!fast go", "try (go"},
+		{"hi !fast !fast", "hi"},
+		{"!fast !fast hi", "hi"},
+		// 只整理关键词两侧的空白，消息其余部分的空白保持不变
+		{"  keep\n!opus\nbody  ", "  keep\nbody  "},
+		{"line one !opus\nline two", "line one\nline two"},
+		{"code:\n    x = 1 !fast\n", "code:\n    x = 1\n"},
+		{"a\r\n!opus\r\nb", "a\r\nb"},
+		{"text\n!opus", "text"},
+	}
+	for _, tc := range cases {
+		if got := StripBangKeywords(tc.in, kws); got != tc.want {
+			t.Errorf("%q: expect %q, got %q", tc.in, tc.want, got)
+		}
+	}
+}
+
+func TestKeywords_Nested(t *testing.T) {
+	inner := &model.Combo{ID: "combo:kw-inner", Items: []model.ComboItem{{ModelID: "a", Keywords: keywords("!a", "!shared")}}}
+	outer := &model.Combo{ID: "combo:kw-outer", Items: []model.ComboItem{
+		{ModelID: "combo:kw-inner"},
+		{ModelID: "b", Keywords: keywords("!shared", "plain")},
+	}}
+	stubStore(t, []*model.Combo{inner, outer}, []string{"a", "b"})
+	got := Keywords(outer)
+	if len(got) != 2 || got[0] != "!a" || got[1] != "!shared" {
+		t.Fatalf("unexpected keywords %v", got)
+	}
+}
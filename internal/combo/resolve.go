@@ -0,0 +1,274 @@
+package combo
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"awesomeProject/internal/model"
+	"awesomeProject/internal/modelstate"
+	"awesomeProject/pkg/utils"
+)
+
+var (
+	// ErrNoAvailableModels combo 中没有任何可用（启用且未被临时禁用）的子模型。
+	ErrNoAvailableModels = errors.New("combo has no available models")
+	// ErrNoSelectableItems 选择策略未能选出子模型。
+	ErrNoSelectableItems = errors.New("combo has no selectable items")
+)
+
+// ResolveOptions 控制一次 combo 解析。
+type ResolveOptions struct {
+	// Request 请求特征，用于关键词与路由规则匹配；为 nil 时只按策略选择。
+	Request *Request
+	// Exclude 本次请求中已尝试失败的模型（故障转移时使用），不会再被选中。
+	Exclude map[string]struct{}
+	// Accept 额外的模型过滤条件（如 /v1/responses 仅接受 codex 候选），为 nil 时不过滤。
+	Accept func(m *model.Model) bool
+	// Now 判断时间窗口（ComboItem.Schedule / Model.Schedule）使用的时刻，为零值时取当前时间。
+	Now time.Time
+	// Trace 不为 nil 时记录解析过程，并且不会清除临时禁用状态（用于路由解释，不影响线上状态）。
+	Trace *Trace
+}
+
+func (o ResolveOptions) now() time.Time {
+	if o.Now.IsZero() {
+		return time.Now()
+	}
+	return o.Now
+}
+
+// MaxComboDepth combo 嵌套引用的最大深度（最外层为 1）。
+const MaxComboDepth = 4
+
+// 数据访问入口，测试中可替换。
+var (
+	isComboID = model.IsComboID
+	getCombo  = model.GetCombo
+	getModel  = model.GetModel
+)
+
+// Resolve 过滤掉被禁用、临时禁用、已排除、不在生效时间窗口以及能力不足的子模型后，按关键词、路由规则与 combo 策略选出一个模型。
+// ComboItem.ModelID 也可以引用另一个 combo：选中该 item 后在被引用的 combo 内继续选择，
+// 权重、关键词与规则逐层生效；出现循环引用或超过 MaxComboDepth 的引用会被跳过。
+// 仅因能力不足或时间窗口关闭而没有候选时返回 *CapabilityError。
+// 若所有子模型都被临时禁用且没有排除项，会清除全部临时禁用状态后再选一次（保持原有行为）；
+// 故障转移时（Exclude 非空）不会清除，避免把刚失败的模型重新放出来。
+func Resolve(cb *model.Combo, opts ResolveOptions) (*model.Model, error) {
+	if cb == nil {
+		return nil, ErrNoAvailableModels
+	}
+
+	skipTemporarilyDisabled := true
+	filtered, rejected := filterComboItems(cb, opts, skipTemporarilyDisabled, nil)
+	if len(filtered) == 0 && len(rejected) == 0 && len(opts.Exclude) == 0 {
+		// 如果没有可用模型，清除所有临时禁用状态并重试一次
+		if opts.Trace == nil {
+			modelstate.ClearAllTemporarilyDisabledModels()
+		} else {
+			opts.Trace.TempDisabledIgnored = true
+		}
+		skipTemporarilyDisabled = false
+		filtered, rejected = filterComboItems(cb, opts, skipTemporarilyDisabled, nil)
+	}
+	if len(filtered) == 0 {
+		if len(rejected) > 0 {
+			return nil, &CapabilityError{ComboID: cb.ID, Reasons: rejected}
+		}
+		return nil, ErrNoAvailableModels
+	}
+	return chooseFromFiltered(cb, filtered, opts, skipTemporarilyDisabled, []string{cb.ID})
+}
+
+// chooseFromFiltered 在已过滤的 items 中选择；选中嵌套 combo 时在其中继续选择直到叶子模型。
+func chooseFromFiltered(cb *model.Combo, filtered []model.ComboItem, opts ResolveOptions, skipTemporarilyDisabled bool, path []string) (*model.Model, error) {
+	tmp := &model.Combo{ID: cb.ID, Name: cb.Name, Description: cb.Description, Enabled: cb.Enabled, Strategy: cb.Strategy, Items: filtered}
+	chosenID := chooseForRequest(tmp, opts.Request, opts.Trace)
+	if strings.TrimSpace(chosenID) == "" {
+		return nil, ErrNoSelectableItems
+	}
+	if isComboID(chosenID) {
+		nested, err := getCombo(chosenID)
+		if err != nil || nested == nil {
+			return nil, fmt.Errorf("combo item combo not found: %s", chosenID)
+		}
+		path = append(path, nested.ID)
+		items, _ := filterComboItems(nested, opts, skipTemporarilyDisabled, path)
+		if len(items) == 0 {
+			return nil, ErrNoAvailableModels
+		}
+		return chooseFromFiltered(nested, items, opts, skipTemporarilyDisabled, path)
+	}
+	m, err := getModel(chosenID)
+	if err != nil || m == nil {
+		return nil, fmt.Errorf("combo item model not found: %s", chosenID)
+	}
+	return m, nil
+}
+
+// filterComboItems 返回可用的 items，以及因能力不足（见 CheckCapability）或时间窗口关闭被跳过的原因。
+// path 为从最外层到 cb 的 combo 引用链（不含 cb 时为 nil），用于循环检测与深度限制。
+// 引用其它 combo 的 item 只要被引用 combo 中仍有可用的叶子模型即视为可用。
+// 需要排队等待 QPS 令牌或达到 MaxTPM / MaxConcurrency 的模型只在没有其它可用 item 时才返回（请求会排队等待其额度）。
+func filterComboItems(cb *model.Combo, opts ResolveOptions, skipTemporarilyDisabled bool, path []string) ([]model.ComboItem, []string) {
+	if path == nil {
+		path = []string{cb.ID}
+	}
+	filtered := make([]model.ComboItem, 0, len(cb.Items))
+	var rejected []string
+	var saturated []model.ComboItem
+	now := opts.now()
+	trace := opts.Trace
+	for _, it := range cb.Items {
+		modelID := strings.TrimSpace(it.ModelID)
+		if modelID == "" {
+			continue
+		}
+		if _, excluded := opts.Exclude[modelID]; excluded {
+			trace.item(cb.ID, modelID, TraceExcluded, "")
+			continue
+		}
+		if !ScheduleOpen(it.Schedule, now) {
+			rejected = append(rejected, modelID+": outside item schedule")
+			trace.item(cb.ID, modelID, TraceSchedule, "outside item schedule")
+			continue
+		}
+		if isComboID(modelID) {
+			if containsString(path, modelID) {
+				utils.Logger.Warnf("[ClaudeRouter] combo: cycle detected path=%s -> %s", strings.Join(path, " -> "), modelID)
+				trace.item(cb.ID, modelID, TraceCycle, strings.Join(path, " -> ")+" -> "+modelID)
+				continue
+			}
+			if len(path) >= MaxComboDepth {
+				utils.Logger.Warnf("[ClaudeRouter] combo: nesting too deep path=%s -> %s", strings.Join(path, " -> "), modelID)
+				trace.item(cb.ID, modelID, TraceTooDeep, strings.Join(path, " -> ")+" -> "+modelID)
+				continue
+			}
+			nested, err := getCombo(modelID)
+			if err != nil || nested == nil {
+				trace.item(cb.ID, modelID, TraceNotFound, "")
+				continue
+			}
+			if !nested.Enabled {
+				trace.item(cb.ID, modelID, TraceDisabled, "combo disabled")
+				continue
+			}
+			items, nestedRejected := filterComboItems(nested, opts, skipTemporarilyDisabled, append(append([]string(nil), path...), nested.ID))
+			rejected = append(rejected, nestedRejected...)
+			if len(items) > 0 {
+				filtered = append(filtered, it)
+				trace.item(cb.ID, modelID, TraceAvailable, "")
+			} else {
+				trace.item(cb.ID, modelID, TraceNoNestedModel, "")
+			}
+			continue
+		}
+		if skipTemporarilyDisabled && modelstate.IsModelTemporarilyDisabled(modelID) {
+			trace.item(cb.ID, modelID, TraceTempDisabled, "")
+			continue
+		}
+		m, err := getModel(modelID)
+		if err != nil || m == nil {
+			trace.item(cb.ID, modelID, TraceNotFound, "")
+			continue
+		}
+		if !m.Enabled {
+			trace.item(cb.ID, modelID, TraceDisabled, "")
+			continue
+		}
+		if _, excluded := opts.Exclude[m.ID]; excluded {
+			trace.item(cb.ID, modelID, TraceExcluded, "")
+			continue
+		}
+		if opts.Accept != nil && !opts.Accept(m) {
+			trace.item(cb.ID, modelID, TraceNotAccepted, "not supported by this endpoint")
+			continue
+		}
+		if !ScheduleOpen(m.Schedule, now) {
+			rejected = append(rejected, m.ID+": outside model schedule")
+			trace.item(cb.ID, modelID, TraceSchedule, "outside model schedule")
+			continue
+		}
+		if ok, reason := CheckCapability(m, opts.Request); !ok {
+			rejected = append(rejected, m.ID+": "+reason)
+			trace.item(cb.ID, modelID, TraceCapability, reason)
+			continue
+		}
+		if !modelstate.HasQPSHeadroom(m.ID, m.MaxQPS) || !modelstate.HasModelCapacity(m.ID, m.MaxTPM, m.MaxConcurrency, opts.Request.EstimatedTokens()) {
+			saturated = append(saturated, it)
+			trace.item(cb.ID, modelID, TraceSaturated, "")
+			continue
+		}
+		filtered = append(filtered, it)
+		trace.item(cb.ID, modelID, TraceAvailable, "")
+	}
+	if len(filtered) == 0 {
+		filtered = saturated
+	}
+	return filtered, rejected
+}
+
+// ContainsModel 返回 cb（含嵌套引用的 combo）是否包含叶子模型 modelID。
+func ContainsModel(cb *model.Combo, modelID string) bool {
+	return containsModel(cb, strings.TrimSpace(modelID), []string{})
+}
+
+func containsModel(cb *model.Combo, modelID string, path []string) bool {
+	if cb == nil || modelID == "" || containsString(path, cb.ID) || len(path) >= MaxComboDepth {
+		return false
+	}
+	path = append(path, cb.ID)
+	for _, it := range cb.Items {
+		id := strings.TrimSpace(it.ModelID)
+		if strings.EqualFold(id, modelID) {
+			return true
+		}
+		if id != "" && isComboID(id) {
+			if nested, err := getCombo(id); err == nil && containsModel(nested, modelID, path) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ValidateNesting 校验 cb 引用的 combo 存在，且不会形成循环或超过 MaxComboDepth。
+func ValidateNesting(cb *model.Combo) error {
+	if cb == nil {
+		return nil
+	}
+	return validateNesting(cb, []string{cb.ID})
+}
+
+func validateNesting(cb *model.Combo, path []string) error {
+	for _, it := range cb.Items {
+		id := strings.TrimSpace(it.ModelID)
+		if id == "" || !isComboID(id) {
+			continue
+		}
+		if containsString(path, id) {
+			return fmt.Errorf("combo reference cycle: %s -> %s", strings.Join(path, " -> "), id)
+		}
+		if len(path) >= MaxComboDepth {
+			return fmt.Errorf("combo nesting exceeds depth %d: %s -> %s", MaxComboDepth, strings.Join(path, " -> "), id)
+		}
+		nested, err := getCombo(id)
+		if err != nil || nested == nil {
+			return fmt.Errorf("combo item combo not found: %s", id)
+		}
+		if err := validateNesting(nested, append(append([]string(nil), path...), id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
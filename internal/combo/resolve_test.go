@@ -0,0 +1,134 @@
+package combo
+
+import (
+	"context"
+	"testing"
+
+	"awesomeProject/internal/model"
+	"awesomeProject/internal/modelstate"
+)
+
+// stubStore 用内存数据替换 combo/model 查询。
+func stubStore(t *testing.T, combos []*model.Combo, models []string) {
+	t.Helper()
+	prevIsCombo, prevGetCombo, prevGetModel := isComboID, getCombo, getModel
+	t.Cleanup(func() { isComboID, getCombo, getModel = prevIsCombo, prevGetCombo, prevGetModel })
+
+	cm := make(map[string]*model.Combo, len(combos))
+	for _, c := range combos {
+		cm[c.ID] = c
+	}
+	mm := make(map[string]*model.Model, len(models))
+	for _, id := range models {
+		mm[id] = &model.Model{ID: id, Enabled: true}
+	}
+	isComboID = func(id string) bool { _, ok := cm[id]; return ok }
+	getCombo = func(id string) (*model.Combo, error) {
+		if c, ok := cm[id]; ok {
+			return c, nil
+		}
+		return nil, model.ErrNotFound
+	}
+	getModel = func(id string) (*model.Model, error) {
+		if m, ok := mm[id]; ok {
+			return m, nil
+		}
+		return nil, model.ErrNotFound
+	}
+}
+
+func TestResolve_NestedCombo(t *testing.T) {
+	inner := &model.Combo{ID: "combo:inner", Enabled: true, Strategy: StrategyPriority, Items: []model.ComboItem{
+		{ModelID: "leaf-a", Weight: 0.2},
+		{ModelID: "leaf-b", Weight: 0.8},
+	}}
+	outer := &model.Combo{ID: "combo:outer", Enabled: true, Strategy: StrategyPriority, Items: []model.ComboItem{
+		{ModelID: "combo:inner", Weight: 0.9},
+		{ModelID: "leaf-c", Weight: 0.1, Keywords: keywords("!c")},
+	}}
+	stubStore(t, []*model.Combo{inner, outer}, []string{"leaf-a", "leaf-b", "leaf-c"})
+
+	m, err := Resolve(outer, ResolveOptions{Request: &Request{InputText: "hello"}})
+	if err != nil || m.ID != "leaf-b" {
+		t.Fatalf("expect leaf-b through inner combo, got %v %v", m, err)
+	}
+	m, err = Resolve(outer, ResolveOptions{Request: &Request{InputText: "!c"}})
+	if err != nil || m.ID != "leaf-c" {
+		t.Fatalf("expect keyword hit leaf-c, got %v %v", m, err)
+	}
+	m, err = Resolve(outer, ResolveOptions{Exclude: map[string]struct{}{"leaf-b": {}}})
+	if err != nil || m.ID != "leaf-a" {
+		t.Fatalf("expect excluded leaf to be skipped inside inner combo, got %v %v", m, err)
+	}
+	if !ContainsModel(outer, "leaf-a") || ContainsModel(outer, "leaf-x") {
+		t.Fatal("ContainsModel should follow nested combos")
+	}
+}
+
+func TestResolve_CycleIsSkipped(t *testing.T) {
+	a := &model.Combo{ID: "combo:a", Enabled: true, Items: []model.ComboItem{{ModelID: "combo:b", Weight: 1}, {ModelID: "leaf", Weight: 0.1}}}
+	b := &model.Combo{ID: "combo:b", Enabled: true, Items: []model.ComboItem{{ModelID: "combo:a", Weight: 1}}}
+	stubStore(t, []*model.Combo{a, b}, []string{"leaf"})
+
+	m, err := Resolve(a, ResolveOptions{})
+	if err != nil || m.ID != "leaf" {
+		t.Fatalf("expect cyclic branch to be skipped, got %v %v", m, err)
+	}
+	if err := ValidateNesting(a); err == nil {
+		t.Fatal("expect cycle to be rejected by ValidateNesting")
+	}
+}
+
+func TestResolve_Trace(t *testing.T) {
+	outer := &model.Combo{ID: "combo:trace", Enabled: true, Strategy: StrategyPriority, Items: []model.ComboItem{
+		{ModelID: "big", Weight: 0.9},
+		{ModelID: "small", Weight: 0.5, Keywords: keywords("!s")},
+		{ModelID: "off", Weight: 0.1},
+	}}
+	stubStore(t, []*model.Combo{outer}, []string{"big", "small"})
+
+	trace := &Trace{}
+	m, err := Resolve(outer, ResolveOptions{Request: &Request{InputText: "!s hi"}, Trace: trace})
+	if err != nil || m.ID != "small" {
+		t.Fatalf("expect small, got %v %v", m, err)
+	}
+	if len(trace.Steps) != 1 || len(trace.Steps[0].KeywordHits) != 1 || trace.Steps[0].Chosen != "small" {
+		t.Fatalf("unexpected steps %+v", trace.Steps)
+	}
+	status := make(map[string]string)
+	for _, it := range trace.Items {
+		status[it.ModelID] = it.Status
+	}
+	if status["big"] != TraceAvailable || status["small"] != TraceAvailable || status["off"] != TraceNotFound {
+		t.Fatalf("unexpected item status %+v", trace.Items)
+	}
+}
+
+func TestResolve_PrefersModelsWithHeadroom(t *testing.T) {
+	cb := &model.Combo{ID: "combo:cap", Enabled: true, Strategy: StrategyPriority, Items: []model.ComboItem{
+		{ModelID: "cap-busy", Weight: 0.9},
+		{ModelID: "cap-free", Weight: 0.1},
+	}}
+	stubStore(t, []*model.Combo{cb}, nil)
+	models := map[string]*model.Model{
+		"cap-busy": {ID: "cap-busy", Enabled: true, MaxConcurrency: 1},
+		"cap-free": {ID: "cap-free", Enabled: true},
+	}
+	getModel = func(id string) (*model.Model, error) {
+		if m, ok := models[id]; ok {
+			return m, nil
+		}
+		return nil, model.ErrNotFound
+	}
+
+	r, _ := modelstate.ReserveModelCapacity(context.Background(), "cap-busy", 0, 1, 0)
+	defer r.Release()
+	m, err := Resolve(cb, ResolveOptions{})
+	if err != nil || m.ID != "cap-free" {
+		t.Fatalf("expect saturated cap-busy to be skipped, got %v %v", m, err)
+	}
+	m, err = Resolve(cb, ResolveOptions{Exclude: map[string]struct{}{"cap-free": {}}})
+	if err != nil || m.ID != "cap-busy" {
+		t.Fatalf("expect saturated model as the last resort, got %v %v", m, err)
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"awesomeProject/internal/model"
 	"awesomeProject/pkg/utils"
 	"regexp"
-	"sort"
 	"strings"
 )
 
@@ -39,46 +38,75 @@ func HasCustomBangKeyword(text string, keywords []string) bool {
 }
 
 // ChooseModelID 根据 combo 的 items、权重和关键词，从输入文本中选择一个子模型。
-//
-// 策略（先简单可用，后续可升级）：
-// - **关键词命中优先**：若某个 item 的任一 keyword 命中输入文本，则只在命中的 items 中选择权重最高的
-// - **否则按权重随机**：按 weight 做加权随机（weight<=0 视为 0）
 func ChooseModelID(c *model.Combo, inputText string) string {
+	return ChooseModelIDForRequest(c, &Request{InputText: inputText})
+}
+
+// ChooseModelIDForRequest 根据 combo 的 items、关键词、路由规则与策略选择一个子模型。
+//
+// 策略（依次）：
+// - **关键词命中优先**：若某些 item 的任一 "!keyword" 命中输入文本，则只在命中的 items 中选择
+// - **路由规则其次**：按规则优先级评估（见 rules.go），只在最高命中优先级的 items 中选择
+// - **按 combo 策略选择**：在候选 items 中按 Combo.Strategy 选择（默认加权随机，见 strategy.go）
+func ChooseModelIDForRequest(c *model.Combo, req *Request) string {
+	return chooseForRequest(c, req, nil)
+}
+
+// chooseForRequest 同 ChooseModelIDForRequest，trace 不为 nil 时记录关键词/规则命中与候选项。
+func chooseForRequest(c *model.Combo, req *Request, trace *Trace) string {
 	if c == nil || len(c.Items) == 0 {
 		return ""
 	}
+	if req == nil {
+		req = &Request{}
+	}
 
-	text := strings.TrimSpace(inputText)
+	text := strings.TrimSpace(req.InputText)
 	utils.Logger.Printf("Input Text: %s\n", text)
 
-	// 1) 关键词命中优先
-	var (
-		bestID string
-
-		found bool
-	)
-	sort.Slice(c.Items, func(i, j int) bool {
-		return c.Items[i].Weight > c.Items[j].Weight
-	})
+	// 不对 c.Items 原地排序，避免影响调用方持有的 combo
+	candidates := make([]model.ComboItem, 0, len(c.Items))
 	for _, it := range c.Items {
-		if it.ModelID == "" {
-			continue
-		}
-		if len(it.Keywords) == 0 {
+		if strings.TrimSpace(it.ModelID) == "" {
 			continue
 		}
+		candidates = append(candidates, it)
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
 
-		if HasCustomBangKeyword(text, it.Keywords) {
-
-			bestID = it.ModelID
-			found = true
-			break
+	// 1) 关键词命中优先
+	hits := make([]model.ComboItem, 0, len(candidates))
+	for _, it := range candidates {
+		if len(it.Keywords) > 0 && HasCustomBangKeyword(text, it.Keywords) {
+			hits = append(hits, it)
 		}
-
 	}
-	if found && bestID != "" {
-		return bestID
+	step := TraceStep{ComboID: c.ID, Strategy: strategyName(c.Strategy)}
+	if len(hits) > 0 {
+		candidates = hits
+		step.KeywordHits = itemIDs(hits)
+	} else if ruleHits := matchRules(candidates, req); len(ruleHits) > 0 {
+		// 2) 路由规则
+		candidates = ruleHits
+		step.RuleHits = itemIDs(ruleHits)
 	}
 
-	return c.Items[0].ModelID
+	// 3) 按策略选择
+	chosen := GetStrategy(c.Strategy).Choose(c, candidates).ModelID
+	if trace != nil {
+		step.Candidates = itemIDs(candidates)
+		step.Chosen = chosen
+		trace.step(step)
+	}
+	return chosen
+}
+
+func itemIDs(items []model.ComboItem) []string {
+	ids := make([]string, 0, len(items))
+	for _, it := range items {
+		ids = append(ids, it.ModelID)
+	}
+	return ids
 }
@@ -0,0 +1,185 @@
+package combo
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"awesomeProject/internal/model"
+)
+
+// 路由规则类型（model.ComboRule.Type）。
+const (
+	RuleLastUserRegex = "last_user_regex"
+	RuleSystemRegex   = "system_regex"
+	RuleHasImages     = "has_images"
+	RuleHasTools      = "has_tools"
+	RuleHasThinking   = "has_thinking"
+	RuleTokensAbove   = "tokens_above"
+	RuleTokensBelow   = "tokens_below"
+	RuleHeader        = "header"
+)
+
+// Request 路由时可见的请求特征，由各协议入口从 payload 中提取。
+type Request struct {
+	InputText    string      `json:"input_text"`    // 最后一条 user 消息文本（关键词与 last_user_regex 使用）
+	SystemText   string      `json:"system_text"`   // 系统提示词
+	HasImages    bool        `json:"has_images"`    // 消息中包含图片
+	ImageCount   int         `json:"image_count"`   // 最新一条 user 消息中的图片数，供按张计费使用
+	HasTools     bool        `json:"has_tools"`     // 请求带有工具定义
+	HasThinking  bool        `json:"has_thinking"`  // 请求带有 thinking / reasoning 配置
+	HasPDF       bool        `json:"has_pdf"`       // 消息中包含 PDF / 文件
+	PromptTokens int         `json:"prompt_tokens"` // 估算的 prompt token 数
+	MaxTokens    int         `json:"max_tokens"`    // 请求的最大输出 token（max_tokens 等），0 表示未指定
+	Header       http.Header `json:"-"`             // 原始请求头
+}
+
+// EstimatedTokens 请求可能占用的 token 数（prompt + max_tokens），用于模型 TPM 预占；req 为 nil 时返回 0。
+func (req *Request) EstimatedTokens() int64 {
+	if req == nil {
+		return 0
+	}
+	return int64(req.PromptTokens) + int64(req.MaxTokens)
+}
+
+var ruleRegexCache sync.Map // pattern -> *regexp.Regexp
+
+func compileRulePattern(pattern string) (*regexp.Regexp, error) {
+	if re, ok := ruleRegexCache.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	ruleRegexCache.Store(pattern, re)
+	return re, nil
+}
+
+// ValidateRules 校验 items 中的路由规则类型与正则是否合法。
+func ValidateRules(items []model.ComboItem) error {
+	for _, it := range items {
+		for _, r := range it.Rules {
+			switch strings.ToLower(strings.TrimSpace(r.Type)) {
+			case RuleHasImages, RuleHasTools, RuleHasThinking:
+			case RuleTokensAbove, RuleTokensBelow:
+				if r.Threshold <= 0 {
+					return fmt.Errorf("rule %s of %s requires a positive threshold", r.Type, it.ModelID)
+				}
+			case RuleLastUserRegex, RuleSystemRegex:
+				if strings.TrimSpace(r.Pattern) == "" {
+					return fmt.Errorf("rule %s of %s requires a pattern", r.Type, it.ModelID)
+				}
+				if _, err := compileRulePattern(r.Pattern); err != nil {
+					return fmt.Errorf("invalid pattern in rule %s of %s: %v", r.Type, it.ModelID, err)
+				}
+			case RuleHeader:
+				if strings.TrimSpace(r.Header) == "" {
+					return fmt.Errorf("rule header of %s requires a header name", it.ModelID)
+				}
+				if r.Pattern != "" {
+					if _, err := compileRulePattern(r.Pattern); err != nil {
+						return fmt.Errorf("invalid pattern in rule header of %s: %v", it.ModelID, err)
+					}
+				}
+			default:
+				return fmt.Errorf("unsupported rule type: %s", r.Type)
+			}
+		}
+	}
+	return nil
+}
+
+// MatchRule 判断单条规则是否命中请求；非法规则视为不命中。
+func MatchRule(r model.ComboRule, req *Request) bool {
+	if req == nil {
+		return false
+	}
+	switch strings.ToLower(strings.TrimSpace(r.Type)) {
+	case RuleLastUserRegex:
+		return matchRulePattern(r.Pattern, req.InputText)
+	case RuleSystemRegex:
+		return matchRulePattern(r.Pattern, req.SystemText)
+	case RuleHasImages:
+		return req.HasImages
+	case RuleHasTools:
+		return req.HasTools
+	case RuleHasThinking:
+		return req.HasThinking
+	case RuleTokensAbove:
+		return r.Threshold > 0 && req.PromptTokens > r.Threshold
+	case RuleTokensBelow:
+		return r.Threshold > 0 && req.PromptTokens < r.Threshold
+	case RuleHeader:
+		name := strings.TrimSpace(r.Header)
+		if name == "" || req.Header == nil {
+			return false
+		}
+		values, ok := req.Header[http.CanonicalHeaderKey(name)]
+		if !ok {
+			return false
+		}
+		if r.Pattern == "" {
+			return true
+		}
+		for _, v := range values {
+			if matchRulePattern(r.Pattern, v) {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+func matchRulePattern(pattern, text string) bool {
+	if strings.TrimSpace(pattern) == "" {
+		return false
+	}
+	re, err := compileRulePattern(pattern)
+	if err != nil {
+		return false
+	}
+	return re.MatchString(text)
+}
+
+type rankedRule struct {
+	item int
+	rule model.ComboRule
+}
+
+// matchRules 按优先级（Priority 降序，相同时按 item 与规则的声明顺序）评估所有规则，
+// 返回最高命中优先级上所有命中的 items；没有任何规则命中时返回 nil。
+func matchRules(items []model.ComboItem, req *Request) []model.ComboItem {
+	ranked := make([]rankedRule, 0)
+	for i, it := range items {
+		for _, r := range it.Rules {
+			ranked = append(ranked, rankedRule{item: i, rule: r})
+		}
+	}
+	if len(ranked) == 0 {
+		return nil
+	}
+	sort.SliceStable(ranked, func(a, b int) bool {
+		return ranked[a].rule.Priority > ranked[b].rule.Priority
+	})
+
+	var hits []model.ComboItem
+	seen := make(map[int]struct{})
+	for idx, rr := range ranked {
+		if len(hits) > 0 && rr.rule.Priority < ranked[idx-1].rule.Priority {
+			break
+		}
+		if _, ok := seen[rr.item]; ok {
+			continue
+		}
+		if MatchRule(rr.rule, req) {
+			seen[rr.item] = struct{}{}
+			hits = append(hits, items[rr.item])
+		}
+	}
+	return hits
+}
@@ -0,0 +1,63 @@
+package combo
+
+import (
+	"net/http"
+	"testing"
+
+	"awesomeProject/internal/model"
+)
+
+func ruleCombo() *model.Combo {
+	return &model.Combo{
+		ID:       "combo:rules",
+		Strategy: StrategyPriority,
+		Items: []model.ComboItem{
+			{ModelID: "general", Weight: 0.9},
+			{ModelID: "vision", Weight: 0.1, Rules: model.RuleSlice{{Type: RuleHasImages, Priority: 10}}},
+			{ModelID: "long", Weight: 0.1, Keywords: keywords("!long"), Rules: model.RuleSlice{{Type: RuleTokensAbove, Threshold: 100000, Priority: 20}}},
+			{ModelID: "sql", Weight: 0.1, Rules: model.RuleSlice{
+				{Type: RuleLastUserRegex, Pattern: `(?i)\bselect\b.+\bfrom\b`},
+				{Type: RuleHeader, Header: "X-Route", Pattern: "^sql$"},
+			}},
+		},
+	}
+}
+
+func TestChooseModelIDForRequest_Rules(t *testing.T) {
+	c := ruleCombo()
+	cases := []struct {
+		name string
+		req  *Request
+		want string
+	}{
+		{"no match falls back to strategy", &Request{InputText: "hi"}, "general"},
+		{"images", &Request{HasImages: true}, "vision"},
+		{"higher priority wins", &Request{HasImages: true, PromptTokens: 200000}, "long"},
+		{"bang keyword beats rules", &Request{InputText: "!long please", HasImages: true}, "long"},
+		{"regex on last user message", &Request{InputText: "Select id FROM users"}, "sql"},
+		{"header", &Request{Header: http.Header{"X-Route": []string{"sql"}}}, "sql"},
+		{"header value mismatch", &Request{Header: http.Header{"X-Route": []string{"nosql"}}}, "general"},
+	}
+	for _, tc := range cases {
+		if got := ChooseModelIDForRequest(c, tc.req); got != tc.want {
+			t.Errorf("%s: expect %s, got %s", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestValidateRules(t *testing.T) {
+	if err := ValidateRules(ruleCombo().Items); err != nil {
+		t.Fatalf("expect valid rules, got %v", err)
+	}
+	bad := [][]model.ComboRule{
+		{{Type: "unknown"}},
+		{{Type: RuleSystemRegex, Pattern: "("}},
+		{{Type: RuleTokensBelow}},
+		{{Type: RuleHeader}},
+	}
+	for _, rules := range bad {
+		if err := ValidateRules([]model.ComboItem{{ModelID: "m", Rules: rules}}); err == nil {
+			t.Errorf("expect error for %+v", rules)
+		}
+	}
+}
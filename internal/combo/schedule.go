@@ -0,0 +1,209 @@
+package combo
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"awesomeProject/internal/model"
+)
+
+var scheduleLocCache sync.Map // timezone -> *time.Location
+
+func loadScheduleLocation(name string) (*time.Location, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return time.Local, nil
+	}
+	if loc, ok := scheduleLocCache.Load(name); ok {
+		return loc.(*time.Location), nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	scheduleLocCache.Store(name, loc)
+	return loc, nil
+}
+
+// parseClock 解析 "HH:MM" 为当天的分钟数，允许 "24:00"。
+func parseClock(s string) (int, error) {
+	h, m, ok := strings.Cut(strings.TrimSpace(s), ":")
+	if !ok {
+		return 0, fmt.Errorf("invalid time %q, expect HH:MM", s)
+	}
+	hour, err1 := strconv.Atoi(h)
+	minute, err2 := strconv.Atoi(m)
+	if err1 != nil || err2 != nil || hour < 0 || minute < 0 || minute > 59 || hour > 24 || (hour == 24 && minute != 0) {
+		return 0, fmt.Errorf("invalid time %q, expect HH:MM", s)
+	}
+	return hour*60 + minute, nil
+}
+
+// ValidateSchedule 校验时间窗口的星期、时间与时区是否合法。
+func ValidateSchedule(windows model.ScheduleSlice) error {
+	for _, w := range windows {
+		for _, d := range w.Days {
+			if d < 0 || d > 6 {
+				return fmt.Errorf("invalid weekday %d, expect 0 (Sunday) - 6 (Saturday)", d)
+			}
+		}
+		if (w.Start == "") != (w.End == "") {
+			return fmt.Errorf("schedule window requires both start and end")
+		}
+		if w.Start != "" {
+			if _, err := parseClock(w.Start); err != nil {
+				return err
+			}
+			if _, err := parseClock(w.End); err != nil {
+				return err
+			}
+		}
+		if _, err := loadScheduleLocation(w.Timezone); err != nil {
+			return fmt.Errorf("invalid timezone %q: %v", w.Timezone, err)
+		}
+	}
+	return nil
+}
+
+// ScheduleOpen 返回 now 时刻是否处于任一窗口内；未配置窗口表示始终开放，非法窗口视为关闭。
+func ScheduleOpen(windows model.ScheduleSlice, now time.Time) bool {
+	if len(windows) == 0 {
+		return true
+	}
+	for _, w := range windows {
+		if windowOpen(w, now) {
+			return true
+		}
+	}
+	return false
+}
+
+func windowOpen(w model.ScheduleWindow, now time.Time) bool {
+	loc, err := loadScheduleLocation(w.Timezone)
+	if err != nil {
+		return false
+	}
+	t := now.In(loc)
+	dayAllowed := func(d time.Weekday) bool {
+		if len(w.Days) == 0 {
+			return true
+		}
+		for _, x := range w.Days {
+			if time.Weekday(x) == d {
+				return true
+			}
+		}
+		return false
+	}
+	if w.Start == "" && w.End == "" {
+		return dayAllowed(t.Weekday())
+	}
+	start, err1 := parseClock(w.Start)
+	end, err2 := parseClock(w.End)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	minute := t.Hour()*60 + t.Minute()
+	if start < end {
+		return dayAllowed(t.Weekday()) && minute >= start && minute < end
+	}
+	// 跨零点：前半段属于当天，后半段属于前一天的窗口
+	if minute >= start && dayAllowed(t.Weekday()) {
+		return true
+	}
+	return minute < end && dayAllowed((t.Weekday()+6)%7)
+}
+
+// CheckSchedule 判断 cb 中的模型 m 在 now 时刻是否可用：模型自身与 cb（含嵌套 combo）中引用它的 item 的窗口都需开放。
+// 用于会话缓存命中时确认缓存的模型仍在窗口内。
+func CheckSchedule(cb *model.Combo, m *model.Model, now time.Time) (bool, string) {
+	if m == nil {
+		return true, ""
+	}
+	if !ScheduleOpen(m.Schedule, now) {
+		return false, "outside model schedule"
+	}
+	if cb != nil && !itemScheduleOpen(cb, m.ID, now, nil) {
+		return false, "outside combo item schedule"
+	}
+	return true, ""
+}
+
+// itemScheduleOpen 查找 cb（含嵌套 combo）中通往 modelID 的 item，任一路径上的窗口全部开放即返回 true；找不到时返回 true。
+func itemScheduleOpen(cb *model.Combo, modelID string, now time.Time, path []string) bool {
+	if containsString(path, cb.ID) || len(path) >= MaxComboDepth {
+		return false
+	}
+	path = append(path, cb.ID)
+	found := false
+	for _, it := range cb.Items {
+		id := strings.TrimSpace(it.ModelID)
+		if strings.EqualFold(id, modelID) {
+			found = true
+			if ScheduleOpen(it.Schedule, now) {
+				return true
+			}
+			continue
+		}
+		if id == "" || !isComboID(id) {
+			continue
+		}
+		nested, err := getCombo(id)
+		if err != nil || nested == nil || !containsModel(nested, modelID, nil) {
+			continue
+		}
+		found = true
+		if ScheduleOpen(it.Schedule, now) && itemScheduleOpen(nested, modelID, now, path) {
+			return true
+		}
+	}
+	return !found
+}
+
+// ScheduleStatus 某个 item 在指定时刻的窗口状态（预览接口使用）。
+type ScheduleStatus struct {
+	ModelID string `json:"model_id"`
+	Active  bool   `json:"active"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// PreviewSchedule 返回 cb 的每个 item 在 at 时刻是否处于窗口内。
+// 引用其它 combo 的 item 需自身窗口开放，且被引用的 combo 中至少有一个 item 处于窗口内。
+// 只考虑时间窗口，不考虑启用状态、临时禁用与请求能力。
+func PreviewSchedule(cb *model.Combo, at time.Time) []ScheduleStatus {
+	return previewSchedule(cb, at, []string{cb.ID})
+}
+
+func previewSchedule(cb *model.Combo, at time.Time, path []string) []ScheduleStatus {
+	out := make([]ScheduleStatus, 0, len(cb.Items))
+	for _, it := range cb.Items {
+		id := strings.TrimSpace(it.ModelID)
+		st := ScheduleStatus{ModelID: id, Active: true}
+		switch {
+		case !ScheduleOpen(it.Schedule, at):
+			st.Active, st.Reason = false, "outside item schedule"
+		case isComboID(id):
+			nested, err := getCombo(id)
+			if err != nil || nested == nil || containsString(path, id) || len(path) >= MaxComboDepth {
+				st.Active, st.Reason = false, "combo not resolvable"
+				break
+			}
+			st.Active, st.Reason = false, "no nested item in schedule"
+			for _, ns := range previewSchedule(nested, at, append(append([]string(nil), path...), id)) {
+				if ns.Active {
+					st.Active, st.Reason = true, ""
+					break
+				}
+			}
+		default:
+			if m, err := getModel(id); err == nil && m != nil && !ScheduleOpen(m.Schedule, at) {
+				st.Active, st.Reason = false, "outside model schedule"
+			}
+		}
+		out = append(out, st)
+	}
+	return out
+}
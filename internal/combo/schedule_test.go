@@ -0,0 +1,90 @@
+package combo
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"awesomeProject/internal/model"
+)
+
+func TestScheduleOpen(t *testing.T) {
+	offPeak := model.ScheduleSlice{{Days: []int{1, 2, 3, 4, 5}, Start: "22:00", End: "06:00", Timezone: "Asia/Shanghai"}}
+	weekend := model.ScheduleSlice{{Days: []int{0, 6}, Timezone: "UTC"}}
+	at := func(s string) time.Time {
+		tm, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	cases := []struct {
+		name    string
+		windows model.ScheduleSlice
+		at      string
+		want    bool
+	}{
+		{"no window", nil, "2026-03-02T12:00:00Z", true},
+		{"monday night", offPeak, "2026-03-02T23:30:00+08:00", true},
+		{"tuesday early morning belongs to monday", offPeak, "2026-03-03T05:59:00+08:00", true},
+		{"monday noon", offPeak, "2026-03-02T12:00:00+08:00", false},
+		{"saturday early morning belongs to friday", offPeak, "2026-03-07T03:00:00+08:00", true},
+		{"sunday early morning belongs to saturday", offPeak, "2026-03-08T03:00:00+08:00", false},
+		{"timezone conversion", offPeak, "2026-03-02T15:00:00Z", true},
+		{"whole day", weekend, "2026-03-07T10:00:00Z", true},
+		{"whole day closed", weekend, "2026-03-09T10:00:00Z", false},
+	}
+	for _, tc := range cases {
+		if got := ScheduleOpen(tc.windows, at(tc.at)); got != tc.want {
+			t.Errorf("%s: expect %v, got %v", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestValidateSchedule(t *testing.T) {
+	bad := []model.ScheduleSlice{
+		{{Days: []int{7}}},
+		{{Start: "09:00"}},
+		{{Start: "25:00", End: "26:00"}},
+		{{Start: "9", End: "10:00"}},
+		{{Timezone: "Mars/Olympus"}},
+	}
+	for _, ws := range bad {
+		if err := ValidateSchedule(ws); err == nil {
+			t.Errorf("expect error for %+v", ws)
+		}
+	}
+	if err := ValidateSchedule(model.ScheduleSlice{{Start: "00:00", End: "24:00", Timezone: "UTC"}}); err != nil {
+		t.Fatalf("expect valid, got %v", err)
+	}
+}
+
+func TestResolve_Schedule(t *testing.T) {
+	night := model.ScheduleSlice{{Start: "22:00", End: "06:00", Timezone: "UTC"}}
+	cb := &model.Combo{ID: "combo:sched", Enabled: true, Strategy: StrategyPriority, Items: []model.ComboItem{
+		{ModelID: "cheap-night", Weight: 0.9, Schedule: night},
+		{ModelID: "always", Weight: 0.1},
+	}}
+	stubStore(t, []*model.Combo{cb}, []string{"cheap-night", "always"})
+
+	m, err := Resolve(cb, ResolveOptions{Now: time.Date(2026, 3, 2, 23, 0, 0, 0, time.UTC)})
+	if err != nil || m.ID != "cheap-night" {
+		t.Fatalf("expect cheap-night at night, got %v %v", m, err)
+	}
+	m, err = Resolve(cb, ResolveOptions{Now: time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC)})
+	if err != nil || m.ID != "always" {
+		t.Fatalf("expect always at noon, got %v %v", m, err)
+	}
+
+	preview := PreviewSchedule(cb, time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC))
+	if len(preview) != 2 || preview[0].Active || !preview[1].Active {
+		t.Fatalf("unexpected preview %+v", preview)
+	}
+
+	only := &model.Combo{ID: "combo:night-only", Enabled: true, Items: []model.ComboItem{{ModelID: "cheap-night", Weight: 1, Schedule: night}}}
+	_, err = Resolve(only, ResolveOptions{Now: time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC)})
+	var capErr *CapabilityError
+	if !errors.As(err, &capErr) {
+		t.Fatalf("expect CapabilityError when all windows are closed, got %v", err)
+	}
+}
@@ -0,0 +1,218 @@
+package combo
+
+import (
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+
+	"awesomeProject/internal/model"
+	"awesomeProject/internal/modelstate"
+)
+
+// 组合模型的子模型选择策略（Combo.Strategy），为空时使用加权随机。
+const (
+	StrategyWeightedRandom   = "weighted_random"    // 按权重加权随机
+	StrategySmoothWeightedRR = "smooth_weighted_rr" // 平滑加权轮询（nginx 算法）
+	StrategyLeastInFlight    = "least_in_flight"    // 在途请求最少
+	StrategyLowestLatency    = "lowest_latency"     // 观测延迟最低
+	StrategyCheapest         = "cheapest"           // 单价最低
+	StrategyPriority         = "priority"           // 权重最高者优先（旧行为）
+)
+
+// Strategy 从候选 items（已完成关键词筛选，且非空）中选择一个。
+type Strategy interface {
+	Choose(c *model.Combo, items []model.ComboItem) model.ComboItem
+}
+
+var strategies = map[string]Strategy{
+	StrategyWeightedRandom:   weightedRandomStrategy{},
+	StrategySmoothWeightedRR: smoothWeightedRR,
+	StrategyLeastInFlight:    leastInFlightStrategy{},
+	StrategyLowestLatency:    lowestLatencyStrategy{},
+	StrategyCheapest:         cheapestStrategy{},
+	StrategyPriority:         priorityStrategy{},
+}
+
+// modelPrice 返回模型的单价（输入+输出），用于 cheapest 策略；测试中可替换。
+var modelPrice = func(modelID string) (float64, bool) {
+	m, err := model.GetModel(modelID)
+	if err != nil || m == nil {
+		return 0, false
+	}
+	return m.InputPrice + m.OutputPrice, true
+}
+
+// GetStrategy 按名称获取策略，未知或为空时返回加权随机。
+func GetStrategy(name string) Strategy {
+	if s, ok := strategies[strings.ToLower(strings.TrimSpace(name))]; ok {
+		return s
+	}
+	return strategies[StrategyWeightedRandom]
+}
+
+// strategyName 返回实际生效的策略名（未知或为空时为加权随机）。
+func strategyName(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if _, ok := strategies[name]; ok {
+		return name
+	}
+	return StrategyWeightedRandom
+}
+
+// IsValidStrategy 返回 name 是否为已支持的策略（空字符串视为默认策略）。
+func IsValidStrategy(name string) bool {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return true
+	}
+	_, ok := strategies[name]
+	return ok
+}
+
+func itemWeight(it model.ComboItem) float64 {
+	if it.Weight <= 0 {
+		return 0
+	}
+	return it.Weight
+}
+
+// pickBest 返回 less 意义下最优的 item；相同时取权重更高者，再相同时取靠前者。
+func pickBest(items []model.ComboItem, less func(a, b model.ComboItem) bool) model.ComboItem {
+	best := items[0]
+	for _, it := range items[1:] {
+		switch {
+		case less(it, best):
+			best = it
+		case less(best, it):
+		case itemWeight(it) > itemWeight(best):
+			best = it
+		}
+	}
+	return best
+}
+
+type weightedRandomStrategy struct{}
+
+func (weightedRandomStrategy) Choose(_ *model.Combo, items []model.ComboItem) model.ComboItem {
+	total := 0.0
+	for _, it := range items {
+		total += itemWeight(it)
+	}
+	if total <= 0 {
+		return items[rand.Intn(len(items))]
+	}
+	r := rand.Float64() * total
+	for _, it := range items {
+		r -= itemWeight(it)
+		if r < 0 {
+			return it
+		}
+	}
+	return items[len(items)-1]
+}
+
+var smoothWeightedRR = &smoothWeightedRRStrategy{states: make(map[string]*smoothWeightedRRState)}
+
+// smoothWeightedRRStrategy 每个 combo 维护一组 current weight，保证短窗口内也按权重比例分配。
+type smoothWeightedRRStrategy struct {
+	mu     sync.Mutex
+	states map[string]*smoothWeightedRRState // combo_id -> 状态
+}
+
+// smoothWeightedRRState 一个 combo 当前候选集合的 current weight；候选集合（item 增删、筛选结果变化）改变时整体重置，
+// 已移除 item 的 current weight 不会残留。
+type smoothWeightedRRState struct {
+	itemsKey string
+	current  map[string]float64 // model_id -> current weight
+}
+
+// ForgetCombo 丢弃 combo 的策略状态（combo 删除时调用）。
+func ForgetCombo(comboID string) {
+	smoothWeightedRR.mu.Lock()
+	delete(smoothWeightedRR.states, strings.TrimSpace(comboID))
+	smoothWeightedRR.mu.Unlock()
+}
+
+func (s *smoothWeightedRRStrategy) Choose(c *model.Combo, items []model.ComboItem) model.ComboItem {
+	comboID := ""
+	if c != nil {
+		comboID = c.ID
+	}
+	total := 0.0
+	ids := make([]string, 0, len(items))
+	for _, it := range items {
+		total += itemWeight(it)
+		ids = append(ids, it.ModelID)
+	}
+	sort.Strings(ids)
+	itemsKey := strings.Join(ids, "\x00")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.states[comboID]
+	if st == nil || st.itemsKey != itemsKey {
+		st = &smoothWeightedRRState{itemsKey: itemsKey, current: make(map[string]float64, len(items))}
+		s.states[comboID] = st
+	}
+	cur := st.current
+
+	bestIdx := -1
+	for i, it := range items {
+		w := itemWeight(it)
+		if total <= 0 {
+			w = 1
+		}
+		cur[it.ModelID] += w
+		if bestIdx < 0 || cur[it.ModelID] > cur[items[bestIdx].ModelID] {
+			bestIdx = i
+		}
+	}
+	if total <= 0 {
+		total = float64(len(items))
+	}
+	cur[items[bestIdx].ModelID] -= total
+	return items[bestIdx]
+}
+
+type leastInFlightStrategy struct{}
+
+func (leastInFlightStrategy) Choose(_ *model.Combo, items []model.ComboItem) model.ComboItem {
+	return pickBest(items, func(a, b model.ComboItem) bool {
+		return modelstate.InFlight(a.ModelID) < modelstate.InFlight(b.ModelID)
+	})
+}
+
+// lowestLatencyStrategy 尚无延迟样本的模型优先，以便尽快获得观测值。
+type lowestLatencyStrategy struct{}
+
+func (lowestLatencyStrategy) Choose(_ *model.Combo, items []model.ComboItem) model.ComboItem {
+	return pickBest(items, func(a, b model.ComboItem) bool {
+		la, okA := modelstate.ModelLatency(a.ModelID)
+		lb, okB := modelstate.ModelLatency(b.ModelID)
+		if okA != okB {
+			return !okA
+		}
+		return la < lb
+	})
+}
+
+// cheapestStrategy 价格未知的模型排在最后。
+type cheapestStrategy struct{}
+
+func (cheapestStrategy) Choose(_ *model.Combo, items []model.ComboItem) model.ComboItem {
+	return pickBest(items, func(a, b model.ComboItem) bool {
+		pa, okA := modelPrice(a.ModelID)
+		pb, okB := modelPrice(b.ModelID)
+		if okA != okB {
+			return okA
+		}
+		return pa < pb
+	})
+}
+
+type priorityStrategy struct{}
+
+func (priorityStrategy) Choose(_ *model.Combo, items []model.ComboItem) model.ComboItem {
+	return pickBest(items, func(a, b model.ComboItem) bool { return false })
+}
@@ -0,0 +1,143 @@
+package combo
+
+import (
+	"testing"
+	"time"
+
+	"awesomeProject/internal/model"
+	"awesomeProject/internal/modelstate"
+	"awesomeProject/pkg/utils"
+)
+
+func init() {
+	utils.InitLogger("error")
+}
+
+func testCombo(strategy string) *model.Combo {
+	return &model.Combo{
+		ID:       "combo:test-" + strategy,
+		Strategy: strategy,
+		Items: []model.ComboItem{
+			{ModelID: "m-a", Weight: 0.6},
+			{ModelID: "m-b", Weight: 0.3, Keywords: keywords("!fast")},
+			{ModelID: "m-c", Weight: 0.1, Keywords: keywords("!fast")},
+		},
+	}
+}
+
+func keywords(s ...string) model.StringSlice { return model.StringSlice(s) }
+
+func TestChooseModelID_WeightedRandomSpreadsLoad(t *testing.T) {
+	c := testCombo(StrategyWeightedRandom)
+	counts := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		counts[ChooseModelID(c, "hello")]++
+	}
+	for _, id := range []string{"m-a", "m-b", "m-c"} {
+		if counts[id] == 0 {
+			t.Fatalf("expect %s to be chosen at least once, counts=%v", id, counts)
+		}
+	}
+	if counts["m-a"] <= counts["m-b"] || counts["m-b"] <= counts["m-c"] {
+		t.Fatalf("expect counts ordered by weight, got %v", counts)
+	}
+	if c.Items[0].ModelID != "m-a" || c.Items[2].ModelID != "m-c" {
+		t.Fatalf("combo items must not be reordered, got %+v", c.Items)
+	}
+}
+
+func TestChooseModelID_SmoothWeightedRRIsExact(t *testing.T) {
+	c := testCombo(StrategySmoothWeightedRR)
+	counts := map[string]int{}
+	for i := 0; i < 10; i++ {
+		counts[ChooseModelID(c, "")]++
+	}
+	if counts["m-a"] != 6 || counts["m-b"] != 3 || counts["m-c"] != 1 {
+		t.Fatalf("expect 6/3/1 split over one cycle, got %v", counts)
+	}
+}
+
+func TestSmoothWeightedRRResetsWhenItemsChange(t *testing.T) {
+	c := &model.Combo{ID: "combo:test-swrr-reset", Strategy: StrategySmoothWeightedRR, Items: []model.ComboItem{
+		{ModelID: "m-a", Weight: 1}, {ModelID: "m-b", Weight: 1}, {ModelID: "m-old", Weight: 5},
+	}}
+	for i := 0; i < 4; i++ {
+		ChooseModelID(c, "")
+	}
+
+	// 移除 m-old 后状态按新的 item 集合重置，不残留已移除 item 的 current weight
+	c.Items = c.Items[:2]
+	counts := map[string]int{}
+	for i := 0; i < 4; i++ {
+		counts[ChooseModelID(c, "")]++
+	}
+	if counts["m-a"] != 2 || counts["m-b"] != 2 {
+		t.Fatalf("expect even split after reset, got %v", counts)
+	}
+	smoothWeightedRR.mu.Lock()
+	st := smoothWeightedRR.states[c.ID]
+	_, stale := st.current["m-old"]
+	smoothWeightedRR.mu.Unlock()
+	if stale || len(st.current) != 2 {
+		t.Fatalf("expect only current items in state, got %v", st.current)
+	}
+
+	ForgetCombo(c.ID)
+	smoothWeightedRR.mu.Lock()
+	_, kept := smoothWeightedRR.states[c.ID]
+	smoothWeightedRR.mu.Unlock()
+	if kept {
+		t.Fatal("expect state dropped for deleted combo")
+	}
+}
+
+func TestChooseModelID_KeywordHitsRestrictCandidates(t *testing.T) {
+	c := testCombo(StrategyPriority)
+	if got := ChooseModelID(c, "please !fast answer"); got != "m-b" {
+		t.Fatalf("expect highest-weight keyword hit m-b, got %s", got)
+	}
+	if got := ChooseModelID(c, "no keyword"); got != "m-a" {
+		t.Fatalf("expect highest-weight item m-a, got %s", got)
+	}
+}
+
+func TestChooseModelID_LeastInFlight(t *testing.T) {
+	c := testCombo(StrategyLeastInFlight)
+	releaseA := modelstate.BeginModelRequest("m-a")
+	defer releaseA()
+	releaseB := modelstate.BeginModelRequest("m-b")
+	defer releaseB()
+	if got := ChooseModelID(c, ""); got != "m-c" {
+		t.Fatalf("expect idle m-c, got %s", got)
+	}
+}
+
+func TestChooseModelID_LowestLatency(t *testing.T) {
+	c := &model.Combo{
+		ID:       "combo:latency",
+		Strategy: StrategyLowestLatency,
+		Items: []model.ComboItem{
+			{ModelID: "lat-slow", Weight: 0.9},
+			{ModelID: "lat-fast", Weight: 0.1},
+		},
+	}
+	modelstate.ObserveModelLatency("lat-slow", 800*time.Millisecond)
+	modelstate.ObserveModelLatency("lat-fast", 120*time.Millisecond)
+	if got := ChooseModelID(c, ""); got != "lat-fast" {
+		t.Fatalf("expect lat-fast, got %s", got)
+	}
+}
+
+func TestChooseModelID_CheapestFirst(t *testing.T) {
+	prev := modelPrice
+	defer func() { modelPrice = prev }()
+	prices := map[string]float64{"m-a": 30, "m-b": 2, "m-c": 5}
+	modelPrice = func(id string) (float64, bool) {
+		p, ok := prices[id]
+		return p, ok
+	}
+	c := testCombo(StrategyCheapest)
+	if got := ChooseModelID(c, ""); got != "m-b" {
+		t.Fatalf("expect cheapest m-b, got %s", got)
+	}
+}
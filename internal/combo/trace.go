@@ -0,0 +1,65 @@
+package combo
+
+// 子模型在解析中的状态（TraceItem.Status）。
+const (
+	TraceAvailable     = "available"
+	TraceExcluded      = "excluded"
+	TraceDisabled      = "disabled"
+	TraceTempDisabled  = "temp_disabled"
+	TraceNotFound      = "not_found"
+	TraceNotAccepted   = "not_accepted"
+	TraceSchedule      = "schedule"
+	TraceCapability    = "capability"
+	TraceSaturated     = "saturated" // 需要排队（max_qps）或达到 max_tpm / max_concurrency，仅在没有其它候选时使用
+	TraceCycle         = "cycle"
+	TraceTooDeep       = "too_deep"
+	TraceNoNestedModel = "no_available_nested_model"
+)
+
+// Trace 记录一次 combo 解析的决策过程，供路由解释接口使用；ResolveOptions.Trace 为 nil 时不记录。
+type Trace struct {
+	// Items 每个 combo 中每个 item 的过滤结果；同一 item 被多次评估时保留最后一次
+	Items []TraceItem `json:"items"`
+	// Steps 从外到内每一层 combo 的选择过程
+	Steps []TraceStep `json:"steps"`
+	// TempDisabledIgnored 所有子模型都被临时禁用时，实际请求会清除临时禁用后重选；解释时只忽略、不清除
+	TempDisabledIgnored bool `json:"temp_disabled_ignored,omitempty"`
+}
+
+// TraceItem 单个 item 的过滤结果。
+type TraceItem struct {
+	ComboID string `json:"combo_id"`
+	ModelID string `json:"model_id"`
+	Status  string `json:"status"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// TraceStep 在某一层 combo 中的选择过程。
+type TraceStep struct {
+	ComboID     string   `json:"combo_id"`
+	Strategy    string   `json:"strategy"`
+	KeywordHits []string `json:"keyword_hits,omitempty"` // 命中 "!keyword" 的 items
+	RuleHits    []string `json:"rule_hits,omitempty"`    // 关键词未命中时，命中最高优先级路由规则的 items
+	Candidates  []string `json:"candidates"`             // 最终参与策略选择的 items
+	Chosen      string   `json:"chosen"`
+}
+
+func (t *Trace) item(comboID, modelID, status, reason string) {
+	if t == nil {
+		return
+	}
+	for i := range t.Items {
+		if t.Items[i].ComboID == comboID && t.Items[i].ModelID == modelID {
+			t.Items[i].Status, t.Items[i].Reason = status, reason
+			return
+		}
+	}
+	t.Items = append(t.Items, TraceItem{ComboID: comboID, ModelID: modelID, Status: status, Reason: reason})
+}
+
+func (t *Trace) step(s TraceStep) {
+	if t == nil {
+		return
+	}
+	t.Steps = append(t.Steps, s)
+}
@@ -5,6 +5,8 @@ import (
 	"os"
 
 	"gopkg.in/yaml.v3"
+
+	"awesomeProject/internal/keypool"
 )
 
 // OperatorEndpoint 运营商转发所需端点配置（仅配置层使用，不暴露给 API）。
@@ -15,6 +17,16 @@ type OperatorEndpoint struct {
 	BaseURL     string `yaml:"base_url"`
 	APIKey      string `yaml:"api_key"`
 	Interface   string `yaml:"interface_type"`
+	// APIKeys 运营商的上游 key 池（模型未配置自己的 key 时使用），APIKey 不为空时作为池中的第一个 key
+	APIKeys     []keypool.Key `yaml:"api_keys"`
+	KeyStrategy string        `yaml:"key_strategy"` // round_robin（默认）/ least_used
+}
+
+// UserLimit 用户限流，0 表示不限制。
+type UserLimit struct {
+	RPM         int   `yaml:"rpm"`         // 每分钟请求数
+	TPM         int64 `yaml:"tpm"`         // 每分钟 token 数（输入+输出）
+	Concurrency int   `yaml:"concurrency"` // 同时进行中的请求数
 }
 
 // Config 定义了应用的顶层配置结构，对应 configs/config.yaml。
@@ -68,14 +80,69 @@ type Config struct {
 			// 严重错误（429/404/403/400）的惩罚倍率，默认 3.0；其他错误倍率默认 0.3
 			SevereErrorWeight float64  `yaml:"severe_error_weight"` // 429/404/403/400 错误的权重倍率
 			MildErrorWeight   float64  `yaml:"mild_error_weight"`   // 其他错误的权重倍率
+			// 目标权重的组成比例，按比例混合；都不配置时只看错误数（与旧行为一致）
+			Blend struct {
+				Errors  float64 `yaml:"errors"`  // 加权错误数，score=1/(err+1)
+				TTFT    float64 `yaml:"ttft"`    // 平均首字节耗时，越快越高
+				Latency float64 `yaml:"latency"` // 平均总耗时，越快越高
+				Success float64 `yaml:"success"` // 成功率 = 成功请求 / (成功请求 + 错误)
+			} `yaml:"blend"`
+			MinSamples int64 `yaml:"min_samples"` // 使用延迟/成功率前每个模型至少需要的请求数，默认 5
+			DryRun     *bool `yaml:"dry_run"`     // 只把建议的权重写入权重历史，不实际修改
 		} `yaml:"combo_weight"`
+
+		// HealthCheck 定期向每个启用的模型发送探测请求，结果写入健康记录并反馈到模型禁用状态；
+		// 间隔、超时与提示词可在模型上单独覆盖
+		HealthCheck struct {
+			Enabled     *bool  `yaml:"enabled"`
+			Interval    string `yaml:"interval"`    // 每个模型的探测间隔，默认 5m
+			Timeout     string `yaml:"timeout"`     // 单次探测超时，默认 30s
+			Prompt      string `yaml:"prompt"`      // 探测提示词，默认 "ping"
+			Concurrency int    `yaml:"concurrency"` // 同时探测的模型数，默认 4
+			Retention   string `yaml:"retention"`   // 探测记录保留时间，默认 72h
+		} `yaml:"health_check"`
 	} `yaml:"tasks"`
 
 	// Operators 系统内置运营商，key 为运营商 ID，选择运营商即使用此处配置的转发逻辑（BaseURL/APIKey/Interface）。
 	Operators map[string]OperatorEndpoint `yaml:"operators"`
 
+	// ModelQueue 模型排队上限的默认值（模型上的 queue_max_wait_ms / queue_max_depth 为 0 时使用），都为空表示不限制
+	ModelQueue struct {
+		MaxWait  string `yaml:"max_wait"`  // 最长等待，例如 10s
+		MaxDepth int    `yaml:"max_depth"` // 每个模型最多排队的请求数
+	} `yaml:"model_queue"`
+
+	// UserLimits 用户限流的分组默认值；用户自己的 rpm_limit 等字段不为 0 时覆盖分组默认值
+	UserLimits struct {
+		Groups map[string]UserLimit `yaml:"groups"` // key 为 User.Group，未设置分组的用户使用 "default"
+	} `yaml:"user_limits"`
+
+	// QuotaHold 请求开始时按估算的最大费用预占用户额度，结束时按实际费用结算
+	QuotaHold struct {
+		TTL              string `yaml:"ttl"`                // 预占最长保留时间，超时未结算（如实例崩溃）由清理任务释放，默认 30m
+		DefaultMaxTokens int    `yaml:"default_max_tokens"` // 请求未指定 max_tokens 时按该值估算输出 token，默认 4096
+	} `yaml:"quota_hold"`
+
+	// KeyPool 上游 key 池中单个 key 被暂停的时长
+	KeyPool struct {
+		AuthBench      string `yaml:"auth_bench"`       // 401/403 后暂停时长，默认 30m
+		RateLimitBench string `yaml:"rate_limit_bench"` // 429 后暂停时长，默认 1m
+	} `yaml:"key_pool"`
+
 	ModelDisable struct {
 		DisableTTL string `yaml:"disable_ttl"` // 模型临时禁用的 TTL，如 "1m"，默认 "1m"
+		// Store 临时禁用与对话缓存的存储：memory（默认，进程内）或 sql（使用 database，多实例共享）
+		Store string `yaml:"store"`
+		// CircuitBreaker 按失败率熔断模型（代替失败一次即按 disable_ttl 禁用）：
+		// 窗口内失败率达到阈值时打开，打开时长按连续打开次数翻倍，到期后半开放行一个试探请求，成功即关闭
+		CircuitBreaker struct {
+			Enabled         bool    `yaml:"enabled"`
+			Window          string  `yaml:"window"`            // 失败率统计窗口，默认 1m
+			MinRequests     int     `yaml:"min_requests"`      // 窗口内最少请求数，默认 5
+			FailureRate     float64 `yaml:"failure_rate"`      // 打开阈值(0~1]，默认 0.5
+			OpenDuration    string  `yaml:"open_duration"`     // 第一次打开时长，默认 disable_ttl
+			MaxOpenDuration string  `yaml:"max_open_duration"` // 打开时长上限，默认 10m
+		} `yaml:"circuit_breaker"`
 	} `yaml:"model_disable"`
 }
 
@@ -0,0 +1,113 @@
+// Package errclass 对上游调用失败进行分类，决定失败是否禁用模型、是否计入 combo 权重惩罚。
+package errclass
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+)
+
+// Class 失败类别，写入 ErrorLog.ErrorClass。
+type Class string
+
+const (
+	// Client 客户端请求本身的问题（参数错误、上下文过长、无权限等），换模型也无济于事
+	Client Class = "client"
+	// Auth 上游 key 无效、被封禁或额度不足
+	Auth Class = "auth"
+	// RateLimit 上游限流
+	RateLimit Class = "rate_limit"
+	// Upstream 上游故障：5xx、过载、超时、连接失败
+	Upstream Class = "upstream"
+	// Protocol 协议转换失败（请求或响应无法在两种接口格式之间转换）
+	Protocol Class = "protocol"
+)
+
+// DisablesModel 该类失败是否应临时禁用模型（计入熔断）。
+func (c Class) DisablesModel() bool {
+	switch c {
+	case Auth, RateLimit, Upstream:
+		return true
+	}
+	return false
+}
+
+// PenalizesWeight 该类失败是否计入 combo 权重调整的错误数。
+func (c Class) PenalizesWeight() bool {
+	return c.DisablesModel() || c == Protocol
+}
+
+// PenalizedClasses 计入权重惩罚的类别；空字符串对应分类之前的历史错误日志。
+func PenalizedClasses() []string {
+	return []string{"", string(Auth), string(RateLimit), string(Upstream), string(Protocol)}
+}
+
+type protocolError struct {
+	err error
+}
+
+func (e *protocolError) Error() string { return e.err.Error() }
+func (e *protocolError) Unwrap() error { return e.err }
+
+// WrapProtocol 把协议转换错误标记为 Protocol 类，err 为 nil 时返回 nil。
+func WrapProtocol(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &protocolError{err: err}
+}
+
+var (
+	authMarkers = [][]byte{
+		[]byte("invalid_api_key"), []byte("invalid x-api-key"), []byte("authentication_error"),
+		[]byte("permission_error"), []byte("insufficient_quota"), []byte("billing"), []byte("credit balance"),
+	}
+	rateLimitMarkers = [][]byte{[]byte("rate_limit"), []byte("rate limit"), []byte("too many requests")}
+	overloadMarkers  = [][]byte{[]byte("overloaded"), []byte("server_error")}
+)
+
+// Classify 按上游状态码、错误与响应体判断失败类别。
+func Classify(statusCode int, err error, body []byte) Class {
+	var pe *protocolError
+	if errors.As(err, &pe) {
+		return Protocol
+	}
+	if errors.Is(err, context.Canceled) {
+		return Client
+	}
+	lower := bytes.ToLower(body)
+	switch {
+	case statusCode == http.StatusTooManyRequests:
+		return RateLimit
+	case statusCode == http.StatusUnauthorized, statusCode == http.StatusPaymentRequired, statusCode == http.StatusForbidden:
+		return Auth
+	case statusCode == http.StatusNotFound, statusCode == http.StatusRequestTimeout:
+		// 上游没有该模型/接口，或上游超时：是模型配置或上游的问题
+		return Upstream
+	case statusCode >= http.StatusInternalServerError:
+		return Upstream
+	case statusCode >= http.StatusBadRequest:
+		// 400 等：多数是请求体的问题，但有些上游用 400 返回 key/额度/过载错误
+		switch {
+		case containsAny(lower, authMarkers):
+			return Auth
+		case containsAny(lower, rateLimitMarkers):
+			return RateLimit
+		case containsAny(lower, overloadMarkers):
+			return Upstream
+		}
+		return Client
+	}
+	// 没有错误状态码：连接失败、超时、读取中断等
+	return Upstream
+}
+
+func containsAny(body []byte, markers [][]byte) bool {
+	for _, m := range markers {
+		if bytes.Contains(body, m) {
+			return true
+		}
+	}
+	return false
+}
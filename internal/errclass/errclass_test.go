@@ -0,0 +1,40 @@
+package errclass
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	cases := []struct {
+		name   string
+		status int
+		err    error
+		body   string
+		want   Class
+	}{
+		{"invalid request", 400, nil, `{"type":"error","error":{"type":"invalid_request_error","message":"prompt is too long"}}`, Client},
+		{"unprocessable", 422, nil, `{}`, Client},
+		{"bad key", 401, nil, `{"error":{"type":"authentication_error"}}`, Auth},
+		{"quota as 400", 400, nil, `{"error":{"code":"insufficient_quota"}}`, Auth},
+		{"rate limited", 429, nil, ``, RateLimit},
+		{"overloaded", 529, nil, `{"error":{"type":"overloaded_error"}}`, Upstream},
+		{"model missing upstream", 404, nil, ``, Upstream},
+		{"connection refused", 0, errors.New("dial tcp: connection refused"), ``, Upstream},
+		{"client cancel", 0, context.Canceled, ``, Client},
+		{"translation", 0, WrapProtocol(fmt.Errorf("convert: %w", errors.New("bad block"))), ``, Protocol},
+	}
+	for _, tc := range cases {
+		if got := Classify(tc.status, tc.err, []byte(tc.body)); got != tc.want {
+			t.Errorf("%s: expect %s, got %s", tc.name, tc.want, got)
+		}
+	}
+	if Client.DisablesModel() || Protocol.DisablesModel() || !RateLimit.DisablesModel() {
+		t.Fatal("unexpected DisablesModel")
+	}
+	if Client.PenalizesWeight() || !Protocol.PenalizesWeight() {
+		t.Fatal("unexpected PenalizesWeight")
+	}
+}
@@ -3,6 +3,7 @@ package handler
 import (
 	"awesomeProject/internal/combo"
 	appconfig "awesomeProject/internal/config"
+	"awesomeProject/internal/errclass"
 	"awesomeProject/internal/middleware"
 	"awesomeProject/internal/model"
 	"awesomeProject/internal/modelstate"
@@ -154,6 +155,7 @@ func (h *ChatHandler) handleChatCompletions(c *gin.Context) {
 
 	conversationID := extractChatMetadataUserID(payload)
 	inputText := extractChatInputText(payload)
+	routeReq := buildRouteRequest(c, payload, inputText)
 
 	// 校验用户是否有权限使用该 combo/model
 	currentUser := middleware.CurrentUser(c)
@@ -163,10 +165,15 @@ func (h *ChatHandler) handleChatCompletions(c *gin.Context) {
 			return
 		}
 	}
+	releaseUserLimit, ok := checkUserLimits(c, h.cfg, currentUser, routeReq, openaiRateLimit)
+	if !ok {
+		return
+	}
+	defer releaseUserLimit()
 
-	targetModel, usedCache, err := resolveChatTargetModel(requestedModel, conversationID, inputText)
+	targetModel, usedCache, err := resolveChatTargetModel(requestedModel, conversationID, routeReq)
 	if err != nil {
-		openaiError(c, http.StatusBadRequest, "invalid_request_error", err.Error())
+		openaiResolveError(c, err)
 		return
 	}
 
@@ -178,7 +185,6 @@ func (h *ChatHandler) handleChatCompletions(c *gin.Context) {
 		}
 	}
 
-	c.Set("real_model_id", targetModel.ID)
 	if conversationID != "" {
 		c.Set("real_conversation_id", conversationID)
 	}
@@ -189,89 +195,116 @@ func (h *ChatHandler) handleChatCompletions(c *gin.Context) {
 	//	}
 	//}
 
-	upstreamModel := strings.TrimSpace(targetModel.UpstreamID)
-	if upstreamModel == "" {
-		upstreamModel = targetModel.ID
-	}
-
-	interfaceType, baseURL, apiKey, resolveErr := h.resolveChatEndpoint(targetModel)
-	if resolveErr != nil {
-		openaiError(c, http.StatusBadRequest, "invalid_request_error", resolveErr.Error())
+	// 按估算的最大费用预占用户额度，可用额度不足时拒绝；计费时结算，失败时释放
+	releaseQuotaHold, ok := holdUserQuota(c, h.cfg, currentUser, targetModel, originalComboID, routeReq, openaiError, "insufficient_quota")
+	if !ok {
 		return
 	}
+	defer releaseQuotaHold()
 
-	payloadToSend := applyChatForwardExtendedFields(payload, targetModel.ForwardMetadata, targetModel.ForwardThinking)
-	payloadToSend["model"] = upstreamModel
-	if comboDesc := resolveComboDescriptionForPrompt(originalComboID); comboDesc != "" {
-		if injectComboDescriptionIntoOpenAIChatPayload(payloadToSend, comboDesc) {
-			utils.Logger.Debugf("[ClaudeRouter] chat: step=inject_combo_description combo=%s", originalComboID)
-		}
-	}
-
-	waitModelQPS(c.Request.Context(), targetModel.ID, targetModel.MaxQPS)
-	if c.Request.Context().Err() != nil {
-		return
-	}
+	// 路由已完成，按 combo 配置删除用于选模型的 "!keyword"
+	stripComboKeywords(originalComboID, payload)
 
-	utils.Logger.Debugf("[ClaudeRouter] chat: step=execute interface=%s model=%s upstream=%s stream=%v", interfaceType, targetModel.ID, upstreamModel, stream)
+	maybeMirrorShadow(c, originalComboID, targetModel.ID, payload, func(m *model.Model, p map[string]any) (*upstreamCall, error) {
+		return h.prepareUpstreamCall(m, p, originalComboID, false)
+	})
 
-	statusCode, contentType, body, streamBody, execErr := h.executeChatRequest(
-		c.Request.Context(),
-		payloadToSend,
-		messages.ExecuteOptions{
-			UpstreamModel: upstreamModel,
-			APIKey:        apiKey,
-			BaseURL:       baseURL,
-			Stream:        stream,
-		},
-		interfaceType,
+	// 上游失败且尚未向客户端写出任何内容时，按 combo 配置换下一个子模型重试
+	failover := newFailoverPolicy(originalComboID)
+	var (
+		statusCode  int
+		contentType string
+		body        []byte
+		streamBody  io.ReadCloser
 	)
+	for attempt := 1; ; attempt++ {
+		c.Set("real_model_id", targetModel.ID)
 
-	if execErr != nil {
-		// 客户端主动取消请求，不记录错误日志，不封禁模型
-		if c.Request.Context().Err() != nil {
+		call, prepErr := h.prepareUpstreamCall(targetModel, payload, originalComboID, stream)
+		if prepErr != nil {
+			openaiError(c, http.StatusBadRequest, "invalid_request_error", prepErr.Error())
 			return
 		}
-		if conversationID != "" {
-			modelstate.ClearConversationModel(conversationID)
-		}
-		if shouldTemporarilyDisableChatModel(statusCode, execErr) {
-			modelstate.DisableModelTemporarily(targetModel.ID, modelstate.DisableTTL)
+
+		// 按模型的 QPS 排队并预占 TPM / 并发额度；排队超过上限时换 combo 中的其它子模型，没有则立即返回 429
+		reservation, admitErr := admitModelRequest(c, h.cfg, targetModel, routeReq)
+		if admitErr != nil {
+			var full *modelstate.QueueFullError
+			if !errors.As(admitErr, &full) {
+				return
+			}
+			utils.Logger.Warnf("[ClaudeRouter] chat: step=queue_full err=%v", full)
+			if next := failover.next(c.Request.Context(), targetModel.ID, attempt, routeReq, nil); next != nil && coverQuotaHold(c, next) {
+				targetModel = next
+				if conversationID != "" {
+					modelstate.SetConversationModelWithCombo(conversationID, next.ID, failover.combo.ID)
+				}
+				continue
+			}
+			openaiRateLimit.reject(c, full.RetryAfter, full.Error())
+			return
 		}
-		// 写入错误日志
-		username := ""
-		if u := middleware.CurrentUser(c); u != nil {
-			username = u.Username
+
+		// 开启对冲时，主请求迟迟没有首个 token 则向下一个子模型发出同样的请求，先响应者胜出；备份模型须先补足额度预占
+		hedge := failover.hedge(targetModel.ID, payload, routeReq, nil, func(m *model.Model, p map[string]any) (*upstreamCall, error) {
+			if !coverQuotaHold(c, m) {
+				return nil, errQuotaNotCovered
+			}
+			return h.prepareUpstreamCall(m, p, originalComboID, stream)
+		}, func(a *upstreamAttempt) {
+			recordAttemptFailure(c, a.model.ID, a.statusCode, attempt, a.err, a.body)
+		})
+
+		utils.Logger.Debugf("[ClaudeRouter] chat: step=execute interface=%s model=%s stream=%v attempt=%d", call.interfaceType, targetModel.ID, stream, attempt)
+
+		res := runUpstreamAttempt(c.Request.Context(), targetModel, call, reservation, hedge)
+		statusCode, contentType, body, streamBody = res.statusCode, res.contentType, res.body, res.streamBody
+		execErr := res.err
+		if res.model != targetModel {
+			// 主请求的预占已在 runUpstreamAttempt 中撤销，计费校正改用胜出模型的预占
+			c.Set(ctxCapacityReservation, res.reservation)
+			// 对冲的备份请求胜出
+			targetModel = res.model
+			c.Set("real_model_id", targetModel.ID)
+			if conversationID != "" {
+				modelstate.SetConversationModelWithCombo(conversationID, targetModel.ID, failover.combo.ID)
+			}
 		}
-		_ = model.RecordErrorLog(targetModel.ID, username, statusCode, execErr.Error())
-		if statusCode >= 400 {
-			openaiErrorFromBody(c, statusCode, body, originalComboID)
+
+		// 客户端主动取消请求，不记录错误日志，不封禁模型
+		if c.Request.Context().Err() != nil {
+			res.discard()
 			return
 		}
-		openaiError(c, http.StatusBadGateway, "api_error", execErr.Error())
-		return
-	}
 
-	if c.Request.Context().Err() != nil {
-		if streamBody != nil {
-			_ = streamBody.Close()
+		if res.ok() {
+			defer res.release()
+			defer res.reservation.Release()
+			modelstate.ObserveModelLatency(targetModel.ID, res.elapsed)
+			modelstate.RecordModelSuccess(targetModel.ID)
+			markUpstreamStarted(c, res.elapsed)
+			break
 		}
-		return
-	}
+		res.discard()
 
-	if statusCode < 200 || statusCode >= 300 {
 		if conversationID != "" {
 			modelstate.ClearConversationModel(conversationID)
 		}
-		if shouldTemporarilyDisableChatModel(statusCode, nil) {
-			modelstate.DisableModelTemporarily(targetModel.ID, modelstate.DisableTTL)
+		recordAttemptFailure(c, targetModel.ID, statusCode, attempt, execErr, body)
+
+		if isRetryableUpstreamFailure(statusCode, execErr, body) {
+			if next := failover.next(c.Request.Context(), targetModel.ID, attempt, routeReq, nil); next != nil && coverQuotaHold(c, next) {
+				targetModel = next
+				if conversationID != "" {
+					modelstate.SetConversationModelWithCombo(conversationID, next.ID, failover.combo.ID)
+				}
+				continue
+			}
 		}
-		// 写入错误日志
-		username := ""
-		if u := middleware.CurrentUser(c); u != nil {
-			username = u.Username
+		if execErr != nil && statusCode < 400 {
+			openaiError(c, http.StatusBadGateway, "api_error", execErr.Error())
+			return
 		}
-		_ = model.RecordErrorLog(targetModel.ID, username, statusCode, fmt.Sprintf("upstream error status=%d", statusCode))
 		openaiErrorFromBody(c, statusCode, body, originalComboID)
 		return
 	}
@@ -293,13 +326,18 @@ func (h *ChatHandler) handleChatCompletions(c *gin.Context) {
 	c.Data(statusCode, contentType, body)
 }
 
-func resolveChatTargetModel(requestedModel, conversationID, inputText string) (*model.Model, bool, error) {
+func resolveChatTargetModel(requestedModel, conversationID string, routeReq *combo.Request) (*model.Model, bool, error) {
 	if model.IsComboID(requestedModel) && conversationID != "" {
 		if cachedID, ok := modelstate.GetConversationModel(conversationID); ok {
 			cb, cbErr := model.GetCombo(requestedModel)
 			m, err := model.GetModel(cachedID)
-			if cbErr == nil && cb != nil && comboContainsModelID(cb, cachedID) && err == nil && m != nil && m.Enabled && !modelstate.IsModelTemporarilyDisabled(m.ID) {
-				return m, true, nil
+			if cbErr == nil && cb != nil && combo.ContainsModel(cb, cachedID) && err == nil && m != nil && m.Enabled && !modelstate.IsModelTemporarilyDisabled(m.ID) {
+				// 缓存的模型无法处理本轮请求（如新增了图片、上下文变长）或已不在生效时间窗口时重新选择
+				capOK, _ := combo.CheckCapability(m, routeReq)
+				schedOK, _ := combo.CheckSchedule(cb, m, time.Now())
+				if capOK && schedOK {
+					return m, true, nil
+				}
 			}
 			modelstate.ClearConversationModel(conversationID)
 		}
@@ -327,51 +365,59 @@ func resolveChatTargetModel(requestedModel, conversationID, inputText string) (*
 		return nil, false, fmt.Errorf("model disabled: %s", requestedModel)
 	}
 
-	filtered := make([]model.ComboItem, 0, len(cb.Items))
-	for _, it := range cb.Items {
-		modelID := strings.TrimSpace(it.ModelID)
-		if modelID == "" {
-			continue
-		}
-		m, err := model.GetModel(modelID)
-		if err != nil || m == nil || !m.Enabled || modelstate.IsModelTemporarilyDisabled(m.ID) {
-			continue
-		}
-		filtered = append(filtered, it)
-	}
-	if len(filtered) == 0 {
-		// 如果没有可用模型，清除所有临时禁用状态并重试一次
-		modelstate.ClearAllTemporarilyDisabledModels()
-		for _, it := range cb.Items {
-			modelID := strings.TrimSpace(it.ModelID)
-			if modelID == "" {
-				continue
-			}
-			m, err := model.GetModel(modelID)
-			if err != nil || m == nil || !m.Enabled {
-				continue
-			}
-			filtered = append(filtered, it)
-		}
-		if len(filtered) == 0 {
-			return nil, false, fmt.Errorf("combo has no available models")
-		}
+	m, err := combo.Resolve(cb, combo.ResolveOptions{Request: routeReq})
+	if err != nil {
+		return nil, false, err
+	}
+	if conversationID != "" {
+		modelstate.SetConversationModelWithCombo(conversationID, m.ID, requestedModel)
 	}
+	return m, false, nil
+}
 
-	tmp := &model.Combo{ID: cb.ID, Name: cb.Name, Description: cb.Description, Enabled: cb.Enabled, Items: filtered}
-	chosenID := combo.ChooseModelID(tmp, inputText)
-	if chosenID == "" {
-		return nil, false, fmt.Errorf("combo has no selectable items")
+// prepareUpstreamCall 确定模型的 endpoint 并生成发往上游的 OpenAI Chat payload。
+func (h *ChatHandler) prepareUpstreamCall(targetModel *model.Model, payload map[string]any, originalComboID string, stream bool) (*upstreamCall, error) {
+	upstreamModel := strings.TrimSpace(targetModel.UpstreamID)
+	if upstreamModel == "" {
+		upstreamModel = targetModel.ID
 	}
 
-	m, err := model.GetModel(chosenID)
-	if err != nil || m == nil {
-		return nil, false, fmt.Errorf("combo item model not found: %s", chosenID)
+	interfaceType, baseURL, apiKey, err := h.resolveChatEndpoint(targetModel)
+	if err != nil {
+		return nil, err
 	}
-	if conversationID != "" {
-		modelstate.SetConversationModelWithCombo(conversationID, m.ID, requestedModel)
+
+	payloadToSend := applyChatForwardExtendedFields(payload, targetModel.ForwardMetadata, targetModel.ForwardThinking)
+	payloadToSend["model"] = upstreamModel
+	if !stream {
+		payloadToSend["stream"] = false
 	}
-	return m, false, nil
+	if comboDesc := resolveComboDescriptionForPrompt(originalComboID); comboDesc != "" {
+		if injectComboDescriptionIntoOpenAIChatPayload(payloadToSend, comboDesc) {
+			utils.Logger.Debugf("[ClaudeRouter] chat: step=inject_combo_description combo=%s", originalComboID)
+		}
+	}
+
+	opts := messages.ExecuteOptions{
+		UpstreamModel: upstreamModel,
+		APIKey:        apiKey,
+		BaseURL:       baseURL,
+		Stream:        stream,
+	}
+	keyPool := resolveKeyPool(targetModel, h.cfg)
+	return &upstreamCall{
+		interfaceType: interfaceType,
+		execute: func(ctx context.Context) (int, string, []byte, io.ReadCloser, error) {
+			return executeWithKeyPool(ctx, targetModel.ID, keyPool, opts, func(ctx context.Context, opts messages.ExecuteOptions) (int, string, []byte, io.ReadCloser, error) {
+				return h.executeChatRequest(ctx, payloadToSend, opts, interfaceType)
+			})
+		},
+		operatorID:    strings.TrimSpace(targetModel.OperatorID),
+		upstreamModel: upstreamModel,
+		baseURL:       baseURL,
+		adapter:       "chat:" + interfaceType,
+		payload:       payloadToSend,
+	}, nil
 }
 
 func (h *ChatHandler) resolveChatEndpoint(targetModel *model.Model) (interfaceType, baseURL, apiKey string, err error) {
@@ -491,6 +537,7 @@ func executeOpenAIChatPassthrough(ctx context.Context, payload map[string]any, o
 	if err != nil {
 		return 0, "", nil, nil, fmt.Errorf("chat: upstream request: %w", err)
 	}
+	opts.ReportResponse(resp)
 
 	if opts.Stream && resp.StatusCode >= 200 && resp.StatusCode < 300 {
 		return resp.StatusCode, "text/event-stream", nil, resp.Body, nil
@@ -523,7 +570,7 @@ func executeOpenAIChatViaAnthropic(ctx context.Context, payload map[string]any,
 		Stream:        opts.Stream,
 	})
 	if err != nil {
-		return 0, "", nil, nil, fmt.Errorf("chat: convert openai->anthropic request: %w", err)
+		return 0, "", nil, nil, errclass.WrapProtocol(fmt.Errorf("chat: convert openai->anthropic request: %w", err))
 	}
 
 	upstreamURL := buildAnthropicMessagesURL(opts.BaseURL)
@@ -545,6 +592,7 @@ func executeOpenAIChatViaAnthropic(ctx context.Context, payload map[string]any,
 	if err != nil {
 		return 0, "", nil, nil, fmt.Errorf("chat: upstream request: %w", err)
 	}
+	opts.ReportResponse(resp)
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		defer resp.Body.Close()
@@ -585,7 +633,7 @@ func executeOpenAIChatViaAnthropic(ctx context.Context, payload map[string]any,
 
 	convertedBody, err := messages.ConvertAnthropicToOpenAIChatResponse(ctx, opts.UpstreamModel, originalReq, translatedReq, upstreamBody)
 	if err != nil {
-		return 0, "", nil, nil, fmt.Errorf("chat: convert anthropic->openai response: %w", err)
+		return 0, "", nil, nil, errclass.WrapProtocol(fmt.Errorf("chat: convert anthropic->openai response: %w", err))
 	}
 
 	// 打印转换后的 OpenAI 响应
@@ -609,7 +657,7 @@ func executeOpenAIChatViaOpenAIResponses(ctx context.Context, payload map[string
 		Stream:        opts.Stream,
 	})
 	if err != nil {
-		return 0, "", nil, nil, fmt.Errorf("chat: convert openai->responses request: %w", err)
+		return 0, "", nil, nil, errclass.WrapProtocol(fmt.Errorf("chat: convert openai->responses request: %w", err))
 	}
 
 	upstreamURL := buildCodexResponsesURL(opts.BaseURL)
@@ -634,6 +682,7 @@ func executeOpenAIChatViaOpenAIResponses(ctx context.Context, payload map[string
 	if err != nil {
 		return 0, "", nil, nil, fmt.Errorf("chat: upstream request: %w", err)
 	}
+	opts.ReportResponse(resp)
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		defer resp.Body.Close()
@@ -811,39 +860,6 @@ func extractChatMetadataUserID(payload map[string]any) string {
 	return strings.TrimSpace(uid)
 }
 
-func shouldTemporarilyDisableChatModel(statusCode int, err error) bool {
-	if statusCode == http.StatusTooManyRequests || statusCode >= http.StatusInternalServerError {
-		return true
-	}
-	if err == nil {
-		return false
-	}
-	if errors.Is(err, context.DeadlineExceeded) {
-		return true
-	}
-	var netErr net.Error
-	if errors.As(err, &netErr) {
-		return true
-	}
-	return false
-}
-
-func comboContainsModelID(cb *model.Combo, modelID string) bool {
-	if cb == nil {
-		return false
-	}
-	needle := strings.TrimSpace(modelID)
-	if needle == "" {
-		return false
-	}
-	for _, it := range cb.Items {
-		if strings.EqualFold(strings.TrimSpace(it.ModelID), needle) {
-			return true
-		}
-	}
-	return false
-}
-
 func looksLikeSSEPayload(body []byte) bool {
 	trimmed := bytes.TrimSpace(body)
 	if len(trimmed) == 0 {
@@ -87,6 +87,7 @@ func (h *CodexProxyHandler) handleResponses(c *gin.Context) {
 
 	conversationID := extractResponsesMetadataUserID(payload)
 	inputText := extractResponsesInputText(payload)
+	routeReq := buildRouteRequest(c, payload, inputText)
 
 	// 校验用户是否有权限使用该 combo/model
 	currentUser := middleware.CurrentUser(c)
@@ -96,10 +97,15 @@ func (h *CodexProxyHandler) handleResponses(c *gin.Context) {
 			return
 		}
 	}
+	releaseUserLimit, ok := checkUserLimits(c, h.cfg, currentUser, routeReq, openaiRateLimit)
+	if !ok {
+		return
+	}
+	defer releaseUserLimit()
 
-	targetModel, usedCache, err := resolveResponseTargetModel(requestedModel, conversationID, inputText)
+	targetModel, usedCache, err := resolveResponseTargetModel(requestedModel, conversationID, routeReq)
 	if err != nil {
-		openaiError(c, http.StatusBadRequest, "invalid_request_error", err.Error())
+		openaiResolveError(c, err)
 		return
 	}
 
@@ -111,7 +117,6 @@ func (h *CodexProxyHandler) handleResponses(c *gin.Context) {
 		}
 	}
 
-	c.Set("real_model_id", targetModel.ID)
 	if conversationID != "" {
 		c.Set("real_conversation_id", conversationID)
 	}
@@ -122,110 +127,116 @@ func (h *CodexProxyHandler) handleResponses(c *gin.Context) {
 	//	}
 	//}
 
-	interfaceType, baseURL, apiKey, resolveErr := h.resolveResponsesEndpoint(targetModel)
-	if resolveErr != nil {
-		openaiError(c, http.StatusBadRequest, "invalid_request_error", resolveErr.Error())
+	// 按估算的最大费用预占用户额度，可用额度不足时拒绝；计费时结算，失败时释放
+	releaseQuotaHold, ok := holdUserQuota(c, h.cfg, currentUser, targetModel, originalComboID, routeReq, openaiError, "insufficient_quota")
+	if !ok {
 		return
 	}
+	defer releaseQuotaHold()
 
-	upstreamModel := strings.TrimSpace(targetModel.UpstreamID)
-	if upstreamModel == "" {
-		upstreamModel = targetModel.ID
-	}
+	// 路由已完成，按 combo 配置删除用于选模型的 "!keyword"
+	stripComboKeywords(originalComboID, payload)
 
-	payloadToSend := applyResponsesAdapter(payload, upstreamModel, targetModel)
-	//if comboDesc := resolveComboDescriptionForPrompt(originalComboID); comboDesc != "" {
-	//	if injectComboDescriptionIntoResponsesPayload(payloadToSend, comboDesc) {
-	//		utils.Logger.Debugf("[ClaudeRouter] responses: step=inject_combo_description combo=%s", originalComboID)
-	//	}
-	//}
+	maybeMirrorShadow(c, originalComboID, targetModel.ID, payload, func(m *model.Model, p map[string]any) (*upstreamCall, error) {
+		return h.prepareUpstreamCall(m, p, false)
+	})
 
-	waitModelQPS(c.Request.Context(), targetModel.ID, targetModel.MaxQPS)
-	if c.Request.Context().Err() != nil {
-		return
-	}
+	// 上游失败且尚未向客户端写出任何内容时，按 combo 配置换下一个子模型重试
+	failover := newFailoverPolicy(originalComboID)
+	var (
+		statusCode  int
+		contentType string
+		body        []byte
+		streamBody  io.ReadCloser
+	)
+	for attempt := 1; ; attempt++ {
+		c.Set("real_model_id", targetModel.ID)
 
-	adapterMode := "passthrough_unknown"
-	if targetModel != nil {
-		switch {
-		case isDirectResponsesPassthroughModel(targetModel):
-			adapterMode = "passthrough_direct"
-		case isOpenAICompatibleModel(targetModel):
-			adapterMode = "adapt_openai_compatible_sdk"
-		case isAnthropicModel(targetModel):
-			adapterMode = "adapt_anthropic_sdk"
-		default:
-			adapterMode = "passthrough_other"
+		call, prepErr := h.prepareUpstreamCall(targetModel, payload, stream)
+		if prepErr != nil {
+			openaiError(c, http.StatusBadRequest, "invalid_request_error", prepErr.Error())
+			return
 		}
-	}
 
-	utils.Logger.Debugf("[ClaudeRouter] responses: step=execute interface=%s model=%s upstream=%s stream=%v adapter=%s",
-		interfaceType, targetModel.ID, upstreamModel, stream, adapterMode)
-
-	// 根据 interfaceType 选择 User-Agent
-	userAgent := cherryStudioUserAgent
-	if strings.EqualFold(interfaceType, "openai_responses") {
-		userAgent = codexUserAgent
-	}
+		// 按模型的 QPS 排队并预占 TPM / 并发额度；排队超过上限时换 combo 中的其它子模型，没有则立即返回 429
+		reservation, admitErr := admitModelRequest(c, h.cfg, targetModel, routeReq)
+		if admitErr != nil {
+			var full *modelstate.QueueFullError
+			if !errors.As(admitErr, &full) {
+				return
+			}
+			utils.Logger.Warnf("[ClaudeRouter] responses: step=queue_full err=%v", full)
+			if next := failover.next(c.Request.Context(), targetModel.ID, attempt, routeReq, isCodexResponsesCandidate); next != nil && coverQuotaHold(c, next) {
+				targetModel = next
+				if conversationID != "" {
+					modelstate.SetConversationModelWithCombo(conversationID, next.ID, failover.combo.ID)
+				}
+				continue
+			}
+			openaiRateLimit.reject(c, full.RetryAfter, full.Error())
+			return
+		}
 
-	statusCode, contentType, body, streamBody, execErr := h.executeResponsesRequest(
-		c.Request.Context(),
-		payloadToSend,
-		messages.ExecuteOptions{
-			UpstreamModel: upstreamModel,
-			APIKey:        apiKey,
-			BaseURL:       baseURL,
-			Stream:        stream,
-		},
-		adapterMode,
-		userAgent,
-	)
+		// 开启对冲时，主请求迟迟没有首个 token 则向下一个子模型发出同样的请求，先响应者胜出；备份模型须先补足额度预占
+		hedge := failover.hedge(targetModel.ID, payload, routeReq, isCodexResponsesCandidate, func(m *model.Model, p map[string]any) (*upstreamCall, error) {
+			if !coverQuotaHold(c, m) {
+				return nil, errQuotaNotCovered
+			}
+			return h.prepareUpstreamCall(m, p, stream)
+		}, func(a *upstreamAttempt) {
+			recordAttemptFailure(c, a.model.ID, a.statusCode, attempt, a.err, a.body)
+		})
+
+		utils.Logger.Debugf("[ClaudeRouter] responses: step=execute interface=%s model=%s stream=%v attempt=%d", call.interfaceType, targetModel.ID, stream, attempt)
+
+		res := runUpstreamAttempt(c.Request.Context(), targetModel, call, reservation, hedge)
+		statusCode, contentType, body, streamBody = res.statusCode, res.contentType, res.body, res.streamBody
+		execErr := res.err
+		if res.model != targetModel {
+			// 主请求的预占已在 runUpstreamAttempt 中撤销，计费校正改用胜出模型的预占
+			c.Set(ctxCapacityReservation, res.reservation)
+			// 对冲的备份请求胜出
+			targetModel = res.model
+			c.Set("real_model_id", targetModel.ID)
+			if conversationID != "" {
+				modelstate.SetConversationModelWithCombo(conversationID, targetModel.ID, failover.combo.ID)
+			}
+		}
 
-	if execErr != nil {
 		// 客户端主动取消请求，不记录错误日志，不封禁模型
 		if c.Request.Context().Err() != nil {
+			res.discard()
 			return
 		}
-		if conversationID != "" {
-			modelstate.ClearConversationModel(conversationID)
-		}
-		if shouldTemporarilyDisableResponsesModel(statusCode, execErr) {
-			modelstate.DisableModelTemporarily(targetModel.ID, modelstate.DisableTTL)
-		}
-		// 写入错误日志
-		username := ""
-		if u := middleware.CurrentUser(c); u != nil {
-			username = u.Username
-		}
-		_ = model.RecordErrorLog(targetModel.ID, username, statusCode, execErr.Error())
-		if statusCode >= 400 {
-			openaiErrorFromBody(c, statusCode, body, originalComboID)
-			return
-		}
-		openaiError(c, http.StatusBadGateway, "api_error", execErr.Error())
-		return
-	}
 
-	if c.Request.Context().Err() != nil {
-		if streamBody != nil {
-			_ = streamBody.Close()
+		if res.ok() {
+			defer res.release()
+			defer res.reservation.Release()
+			modelstate.ObserveModelLatency(targetModel.ID, res.elapsed)
+			modelstate.RecordModelSuccess(targetModel.ID)
+			markUpstreamStarted(c, res.elapsed)
+			break
 		}
-		return
-	}
+		res.discard()
 
-	if statusCode < 200 || statusCode >= 300 {
 		if conversationID != "" {
 			modelstate.ClearConversationModel(conversationID)
 		}
-		if shouldTemporarilyDisableResponsesModel(statusCode, nil) {
-			modelstate.DisableModelTemporarily(targetModel.ID, modelstate.DisableTTL)
+		recordAttemptFailure(c, targetModel.ID, statusCode, attempt, execErr, body)
+
+		if isRetryableUpstreamFailure(statusCode, execErr, body) {
+			if next := failover.next(c.Request.Context(), targetModel.ID, attempt, routeReq, isCodexResponsesCandidate); next != nil && coverQuotaHold(c, next) {
+				targetModel = next
+				if conversationID != "" {
+					modelstate.SetConversationModelWithCombo(conversationID, next.ID, failover.combo.ID)
+				}
+				continue
+			}
 		}
-		// 写入错误日志
-		username := ""
-		if u := middleware.CurrentUser(c); u != nil {
-			username = u.Username
+		if execErr != nil && statusCode < 400 {
+			openaiError(c, http.StatusBadGateway, "api_error", execErr.Error())
+			return
 		}
-		_ = model.RecordErrorLog(targetModel.ID, username, statusCode, fmt.Sprintf("upstream error status=%d", statusCode))
 		openaiErrorFromBody(c, statusCode, body, originalComboID)
 		return
 	}
@@ -247,13 +258,22 @@ func (h *CodexProxyHandler) handleResponses(c *gin.Context) {
 	c.Data(statusCode, contentType, body)
 }
 
-func resolveResponseTargetModel(requestedModel, conversationID, inputText string) (*model.Model, bool, error) {
+func resolveResponseTargetModel(requestedModel, conversationID string, routeReq *combo.Request) (*model.Model, bool, error) {
 	// 1) 会话缓存优先（仅 combo 路由后写入）
 	if conversationID != "" {
 		if modelID, ok := modelstate.GetConversationModel(conversationID); ok {
 			m, err := model.GetModel(modelID)
 			if err == nil && m.Enabled && !modelstate.IsModelTemporarilyDisabled(m.ID) && isCodexResponsesCandidate(m) {
-				return m, true, nil
+				// 缓存的模型无法处理本轮请求（如新增了图片、上下文变长）或已不在生效时间窗口时重新选择
+				var cb *model.Combo
+				if model.IsComboID(requestedModel) {
+					cb, _ = model.GetCombo(requestedModel)
+				}
+				capOK, _ := combo.CheckCapability(m, routeReq)
+				schedOK, _ := combo.CheckSchedule(cb, m, time.Now())
+				if capOK && schedOK {
+					return m, true, nil
+				}
 			}
 			modelstate.ClearConversationModel(conversationID)
 		}
@@ -267,45 +287,12 @@ func resolveResponseTargetModel(requestedModel, conversationID, inputText string
 				return nil, false, errors.New("model disabled: " + requestedModel)
 			}
 
-			filtered := make([]model.ComboItem, 0, len(cb.Items))
-			for _, it := range cb.Items {
-				modelID := strings.TrimSpace(it.ModelID)
-				if modelID == "" || modelstate.IsModelTemporarilyDisabled(modelID) {
-					continue
-				}
-				m, err := model.GetModel(modelID)
-				if err != nil || m == nil || !m.Enabled || modelstate.IsModelTemporarilyDisabled(m.ID) || !isCodexResponsesCandidate(m) {
-					continue
-				}
-				filtered = append(filtered, it)
+			m, err := combo.Resolve(cb, combo.ResolveOptions{Request: routeReq, Accept: isCodexResponsesCandidate})
+			if errors.Is(err, combo.ErrNoAvailableModels) {
+				return nil, false, errors.New("combo has no selectable codex/openai_responses items")
 			}
-			if len(filtered) == 0 {
-				// 如果没有可用模型，清除所有临时禁用状态并重试一次
-				modelstate.ClearAllTemporarilyDisabledModels()
-				for _, it := range cb.Items {
-					modelID := strings.TrimSpace(it.ModelID)
-					if modelID == "" {
-						continue
-					}
-					m, err := model.GetModel(modelID)
-					if err != nil || m == nil || !m.Enabled || !isCodexResponsesCandidate(m) {
-						continue
-					}
-					filtered = append(filtered, it)
-				}
-				if len(filtered) == 0 {
-					return nil, false, errors.New("combo has no selectable codex/openai_responses items")
-				}
-			}
-
-			tmp := &model.Combo{ID: cb.ID, Name: cb.Name, Description: cb.Description, Enabled: cb.Enabled, Items: filtered}
-			chosenID := combo.ChooseModelID(tmp, inputText)
-			if strings.TrimSpace(chosenID) == "" {
-				return nil, false, errors.New("combo has no selectable items")
-			}
-			m, err := model.GetModel(chosenID)
-			if err != nil || m == nil || !m.Enabled || !isCodexResponsesCandidate(m) {
-				return nil, false, errors.New("combo item model not found: " + chosenID)
+			if err != nil {
+				return nil, false, err
 			}
 
 			if conversationID != "" {
@@ -1145,21 +1132,70 @@ func debugBodySnippet(body []byte, max int) string {
 
 var responsesVersionSuffixPattern = regexp.MustCompile(`/v\d+[a-z]*$`)
 
-func shouldTemporarilyDisableResponsesModel(statusCode int, err error) bool {
-	if statusCode == http.StatusTooManyRequests || statusCode >= http.StatusInternalServerError {
-		return true
+// prepareUpstreamCall 确定模型的 endpoint 与适配模式，并生成发往上游的 Responses payload。
+func (h *CodexProxyHandler) prepareUpstreamCall(targetModel *model.Model, payload map[string]any, stream bool) (*upstreamCall, error) {
+	interfaceType, baseURL, apiKey, err := h.resolveResponsesEndpoint(targetModel)
+	if err != nil {
+		return nil, err
 	}
-	if err == nil {
-		return false
+
+	upstreamModel := strings.TrimSpace(targetModel.UpstreamID)
+	if upstreamModel == "" {
+		upstreamModel = targetModel.ID
 	}
-	if errors.Is(err, context.DeadlineExceeded) {
-		return true
+
+	payloadToSend := applyResponsesAdapter(payload, upstreamModel, targetModel)
+	if !stream {
+		payloadToSend["stream"] = false
 	}
-	var netErr net.Error
-	if errors.As(err, &netErr) {
-		return true
+	//if comboDesc := resolveComboDescriptionForPrompt(originalComboID); comboDesc != "" {
+	//	if injectComboDescriptionIntoResponsesPayload(payloadToSend, comboDesc) {
+	//		utils.Logger.Debugf("[ClaudeRouter] responses: step=inject_combo_description combo=%s", originalComboID)
+	//	}
+	//}
+
+	adapterMode := "passthrough_unknown"
+	if targetModel != nil {
+		switch {
+		case isDirectResponsesPassthroughModel(targetModel):
+			adapterMode = "passthrough_direct"
+		case isOpenAICompatibleModel(targetModel):
+			adapterMode = "adapt_openai_compatible_sdk"
+		case isAnthropicModel(targetModel):
+			adapterMode = "adapt_anthropic_sdk"
+		default:
+			adapterMode = "passthrough_other"
+		}
 	}
-	return false
+	utils.Logger.Debugf("[ClaudeRouter] responses: step=prepare_call interface=%s model=%s upstream=%s adapter=%s",
+		interfaceType, targetModel.ID, upstreamModel, adapterMode)
+
+	// 根据 interfaceType 选择 User-Agent
+	userAgent := cherryStudioUserAgent
+	if strings.EqualFold(interfaceType, "openai_responses") {
+		userAgent = codexUserAgent
+	}
+
+	opts := messages.ExecuteOptions{
+		UpstreamModel: upstreamModel,
+		APIKey:        apiKey,
+		BaseURL:       baseURL,
+		Stream:        stream,
+	}
+	keyPool := resolveKeyPool(targetModel, h.cfg)
+	return &upstreamCall{
+		interfaceType: interfaceType,
+		execute: func(ctx context.Context) (int, string, []byte, io.ReadCloser, error) {
+			return executeWithKeyPool(ctx, targetModel.ID, keyPool, opts, func(ctx context.Context, opts messages.ExecuteOptions) (int, string, []byte, io.ReadCloser, error) {
+				return h.executeResponsesRequest(ctx, payloadToSend, opts, adapterMode, userAgent)
+			})
+		},
+		operatorID:    strings.TrimSpace(targetModel.OperatorID),
+		upstreamModel: upstreamModel,
+		baseURL:       baseURL,
+		adapter:       "responses:" + adapterMode,
+		payload:       payloadToSend,
+	}, nil
 }
 
 func (h *CodexProxyHandler) resolveResponsesEndpoint(m *model.Model) (interfaceType, baseURL, apiKey string, err error) {
@@ -1281,6 +1317,7 @@ func executeResponsesPassthrough(ctx context.Context, payload map[string]any, op
 	if lastErr != nil || resp == nil {
 		return 0, "", nil, nil, fmt.Errorf("responses: upstream request: %w", lastErr)
 	}
+	opts.ReportResponse(resp)
 
 	if opts.Stream && resp.StatusCode >= 200 && resp.StatusCode < 300 {
 		return resp.StatusCode, "text/event-stream", nil, resp.Body, nil
@@ -1372,6 +1409,7 @@ func executeResponsesViaSDKAdapter(
 	if respErr != nil {
 		return 0, "", nil, nil, fmt.Errorf("responses: upstream request: %w", respErr)
 	}
+	opts.ReportResponse(resp)
 
 	statusCode = resp.StatusCode
 	contentType = resp.Header.Get("Content-Type")
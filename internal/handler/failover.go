@@ -0,0 +1,128 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"awesomeProject/internal/combo"
+	"awesomeProject/internal/errclass"
+	"awesomeProject/internal/middleware"
+	"awesomeProject/internal/model"
+	"awesomeProject/internal/modelstate"
+	"awesomeProject/pkg/utils"
+)
+
+const (
+	defaultFailoverMaxAttempts = 3
+	defaultFailoverTimeout     = 90 * time.Second
+)
+
+// failoverPolicy 一次请求在 combo 子模型之间故障转移的约束：最多尝试次数、总截止时间与已失败的模型。
+// 仅当请求路由到 combo 时才会重试；直接请求具体模型时 maxAttempts 为 1。
+type failoverPolicy struct {
+	combo       *model.Combo
+	maxAttempts int
+	deadline    time.Time
+	tried       map[string]struct{}
+}
+
+func newFailoverPolicy(comboID string) *failoverPolicy {
+	p := &failoverPolicy{maxAttempts: 1, tried: make(map[string]struct{})}
+	comboID = strings.TrimSpace(comboID)
+	if !model.IsComboID(comboID) {
+		return p
+	}
+	cb, err := model.GetCombo(comboID)
+	if err != nil || cb == nil || !cb.Enabled {
+		return p
+	}
+	p.combo = cb
+	p.maxAttempts = cb.MaxAttempts
+	if p.maxAttempts <= 0 {
+		p.maxAttempts = defaultFailoverMaxAttempts
+	}
+	timeout := time.Duration(cb.FailoverTimeoutMs) * time.Millisecond
+	if timeout <= 0 {
+		timeout = defaultFailoverTimeout
+	}
+	p.deadline = time.Now().Add(timeout)
+	return p
+}
+
+// next 在允许重试时返回下一个候选子模型（排除本次请求已失败的模型），否则返回 nil。
+// attempt 为刚失败的尝试序号（从 1 开始）。
+func (p *failoverPolicy) next(ctx context.Context, failedModelID string, attempt int, req *combo.Request, accept func(m *model.Model) bool) *model.Model {
+	p.tried[failedModelID] = struct{}{}
+	if p.combo == nil || attempt >= p.maxAttempts || ctx.Err() != nil || time.Now().After(p.deadline) {
+		return nil
+	}
+	m, err := combo.Resolve(p.combo, combo.ResolveOptions{
+		Request: req,
+		Exclude: p.tried,
+		Accept:  accept,
+	})
+	if err != nil {
+		utils.Logger.Debugf("[ClaudeRouter] failover: combo=%s attempt=%d no_candidate err=%v", p.combo.ID, attempt, err)
+		return nil
+	}
+	utils.Logger.Infof("[ClaudeRouter] failover: combo=%s attempt=%d failed=%s next=%s", p.combo.ID, attempt, failedModelID, m.ID)
+	return m
+}
+
+// isRetryableUpstreamFailure 判断上游失败是否可以换下一个子模型重试：
+// 连接错误（无响应）、5xx、429 以及 overloaded（Anthropic 529 / overloaded_error）。
+func isRetryableUpstreamFailure(statusCode int, err error, body []byte) bool {
+	if statusCode == http.StatusTooManyRequests || statusCode >= http.StatusInternalServerError {
+		return true
+	}
+	if bytes.Contains(body, []byte("overloaded_error")) {
+		return true
+	}
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	// 未拿到任何上游响应（状态码为 0）的错误按连接错误处理
+	return statusCode == 0
+}
+
+// recordAttemptFailure 对一次失败尝试分类：只有上游/key/限流类失败计入模型禁用（熔断），
+// 并写入带分类的错误日志。分类同时写入上下文，ErrorHandler 据此不再重复处理。
+func recordAttemptFailure(c *gin.Context, modelID string, statusCode, attempt int, err error, body []byte) errclass.Class {
+	class := errclass.Classify(statusCode, err, body)
+	c.Set(middleware.ErrorClassKey, class)
+	switch {
+	case class == errclass.RateLimit:
+		modelstate.RecordRateLimitFailure(modelID)
+	case class.DisablesModel():
+		modelstate.RecordModelFailure(modelID)
+	}
+	username := ""
+	if u := middleware.CurrentUser(c); u != nil {
+		username = u.Username
+	}
+	msg := fmt.Sprintf("upstream error status=%d", statusCode)
+	if err != nil {
+		msg = err.Error()
+	}
+	_ = model.RecordErrorLogWithClass(modelID, username, statusCode, attempt, string(class), msg)
+	return class
+}
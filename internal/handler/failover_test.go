@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"awesomeProject/internal/combo"
+	"awesomeProject/internal/errclass"
+	"awesomeProject/internal/middleware"
+	"awesomeProject/internal/model"
+)
+
+func TestIsRetryableUpstreamFailure(t *testing.T) {
+	cases := []struct {
+		name   string
+		status int
+		err    error
+		body   string
+		want   bool
+	}{
+		{"ok", http.StatusOK, nil, "", false},
+		{"bad request", http.StatusBadRequest, nil, `{"error":{"type":"invalid_request_error"}}`, false},
+		{"unauthorized", http.StatusUnauthorized, nil, "", false},
+		{"rate limited", http.StatusTooManyRequests, nil, "", true},
+		{"server error", http.StatusInternalServerError, nil, "", true},
+		{"bad gateway", http.StatusBadGateway, nil, "", true},
+		{"anthropic overloaded", 529, nil, "", true},
+		{"overloaded body on 400", http.StatusBadRequest, nil, `{"error":{"type":"overloaded_error"}}`, true},
+		{"client cancelled", 0, context.Canceled, "", false},
+		{"deadline exceeded", 0, context.DeadlineExceeded, "", true},
+		{"unexpected eof", http.StatusOK, io.ErrUnexpectedEOF, "", true},
+		{"net error", 0, &net.OpError{Op: "dial", Err: errors.New("connection refused")}, "", true},
+		{"no response", 0, errors.New("upstream closed"), "", true},
+		{"error with response", http.StatusOK, errors.New("decode failed"), "", false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := isRetryableUpstreamFailure(tc.status, tc.err, []byte(tc.body)); got != tc.want {
+				t.Fatalf("isRetryableUpstreamFailure(%d, %v, %q) = %v, want %v", tc.status, tc.err, tc.body, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestFailoverPolicyNext(t *testing.T) {
+	// CreateCombo 会回写 item 的 ID 与 ComboID，每个 combo 需要独立的 item
+	items := func() []model.ComboItem {
+		return []model.ComboItem{{ModelID: "fo-a", Weight: 3}, {ModelID: "fo-b", Weight: 2}, {ModelID: "fo-c", Weight: 1}}
+	}
+	setupHandlerTestDB(t,
+		[]*model.Model{{ID: "fo-a", Name: "fo-a", Enabled: true}, {ID: "fo-b", Name: "fo-b", Enabled: true}, {ID: "fo-c", Name: "fo-c", Enabled: true}},
+		&model.Combo{ID: "combo:fo", Name: "fo", Enabled: true, Strategy: combo.StrategyPriority, MaxAttempts: 3, Items: items()},
+		&model.Combo{ID: "combo:fo-default", Name: "fo-default", Enabled: true, Strategy: combo.StrategyPriority, Items: items()},
+		&model.Combo{ID: "combo:fo-timeout", Name: "fo-timeout", Enabled: true, Strategy: combo.StrategyPriority, FailoverTimeoutMs: 1, Items: items()},
+	)
+	ctx := context.Background()
+
+	cases := []struct {
+		name    string
+		comboID string
+		failed  []string // 依次失败的模型
+		want    []string // 每次失败后 next 返回的模型，"" 表示不再重试
+		sleep   time.Duration
+	}{
+		{"excludes tried models until max attempts", "combo:fo", []string{"fo-a", "fo-b", "fo-c"}, []string{"fo-b", "fo-c", ""}, 0},
+		{"default max attempts", "combo:fo-default", []string{"fo-a", "fo-b", "fo-c"}, []string{"fo-b", "fo-c", ""}, 0},
+		{"plain model never retries", "fo-a", []string{"fo-a"}, []string{""}, 0},
+		{"failover timeout", "combo:fo-timeout", []string{"fo-a"}, []string{""}, 5 * time.Millisecond},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newFailoverPolicy(tc.comboID)
+			time.Sleep(tc.sleep)
+			for i, failed := range tc.failed {
+				got := ""
+				if m := p.next(ctx, failed, i+1, &combo.Request{}, nil); m != nil {
+					got = m.ID
+				}
+				if got != tc.want[i] {
+					t.Fatalf("attempt %d failed=%s: next=%q, want %q", i+1, failed, got, tc.want[i])
+				}
+			}
+		})
+	}
+
+	t.Run("cancelled request stops failover", func(t *testing.T) {
+		cctx, cancel := context.WithCancel(ctx)
+		cancel()
+		if m := newFailoverPolicy("combo:fo").next(cctx, "fo-a", 1, &combo.Request{}, nil); m != nil {
+			t.Fatalf("expect no retry after cancel, got %s", m.ID)
+		}
+	})
+
+	t.Run("accept filter", func(t *testing.T) {
+		m := newFailoverPolicy("combo:fo").next(ctx, "fo-a", 1, &combo.Request{}, func(m *model.Model) bool { return m.ID != "fo-b" })
+		if m == nil || m.ID != "fo-c" {
+			t.Fatalf("expect fo-c, got %v", m)
+		}
+	})
+}
+
+func TestRecordAttemptFailureWritesErrorLogPerAttempt(t *testing.T) {
+	setupHandlerTestDB(t, nil)
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+
+	attempts := []struct {
+		modelID string
+		status  int
+		err     error
+		class   errclass.Class
+	}{
+		{"fo-log-a", http.StatusServiceUnavailable, nil, errclass.Upstream},
+		{"fo-log-b", http.StatusTooManyRequests, nil, errclass.RateLimit},
+		{"fo-log-c", 0, errors.New("connection reset"), errclass.Upstream},
+	}
+	for i, a := range attempts {
+		if got := recordAttemptFailure(c, a.modelID, a.status, i+1, a.err, nil); got != a.class {
+			t.Fatalf("attempt %d: class=%s, want %s", i+1, got, a.class)
+		}
+		if v, _ := c.Get(middleware.ErrorClassKey); v != a.class {
+			t.Fatalf("attempt %d: context class=%v, want %s", i+1, v, a.class)
+		}
+	}
+
+	logs, total, err := model.ListErrorLogs("", 1, 10)
+	if err != nil || total != int64(len(attempts)) {
+		t.Fatalf("expect one error log per attempt, total=%d err=%v", total, err)
+	}
+	byModel := make(map[string]model.ErrorLog, len(logs))
+	for _, l := range logs {
+		byModel[l.ModelID] = l
+	}
+	for i, a := range attempts {
+		l, ok := byModel[a.modelID]
+		if !ok || l.Attempt != i+1 || l.StatusCode != a.status || l.ErrorClass != string(a.class) {
+			t.Fatalf("attempt %d: unexpected log %+v", i+1, l)
+		}
+	}
+	if l := byModel["fo-log-c"]; l.ErrorMsg != "connection reset" {
+		t.Fatalf("expect error message recorded, got %q", l.ErrorMsg)
+	}
+}
@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"awesomeProject/internal/model"
+	"awesomeProject/internal/task"
+)
+
+// ProbeModel 向模型发送一条最小的非流式 Anthropic Messages 请求，走与真实请求相同的
+// prepareUpstreamCall（适配器/运营商转发、协议转换），供健康检查任务使用（见 task.SetModelProber）。
+func (h *MessagesHandler) ProbeModel(ctx context.Context, m *model.Model, prompt string) (int, []byte, io.ReadCloser, error) {
+	payload := map[string]any{
+		"model":      m.ID,
+		"max_tokens": 16,
+		"stream":     false,
+		"messages": []any{
+			map[string]any{"role": "user", "content": prompt},
+		},
+	}
+	call, err := h.prepareUpstreamCall(m, payload, "", false)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	statusCode, _, body, streamBody, err := call.execute(ctx)
+	return statusCode, body, streamBody, err
+}
+
+// listModelHealth 返回各模型最近一次探测结果与最近 24 小时（window 可调）的探测成功率。
+func listModelHealth(c *gin.Context) {
+	window := 24 * time.Hour
+	if v := strings.TrimSpace(c.Query("window")); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid window"})
+			return
+		}
+		window = d
+	}
+	items, err := model.ListModelHealth(time.Now().Add(-window))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"models": items})
+}
+
+// getModelHealthHistory 返回单个模型最近的探测记录。
+func getModelHealthHistory(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	rows, err := model.ListModelHealthHistory(c.Param("id"), limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"history": rows})
+}
+
+// probeModelNow 立即探测一次模型并返回结果。
+func probeModelNow(c *gin.Context) {
+	m, err := model.GetModel(c.Param("id"))
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == model.ErrNotFound {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	rec, err := task.ProbeModelNow(m)
+	if err != nil && rec == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, rec)
+}
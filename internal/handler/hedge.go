@@ -0,0 +1,294 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"awesomeProject/internal/combo"
+	"awesomeProject/internal/model"
+	"awesomeProject/internal/modelstate"
+	"awesomeProject/pkg/utils"
+)
+
+// upstreamAttempt 一次上游尝试（可能包含对冲的备份请求）的结果。
+type upstreamAttempt struct {
+	model       *model.Model
+	call        *upstreamCall
+	statusCode  int
+	contentType string
+	body        []byte
+	streamBody  io.ReadCloser
+	err         error
+	elapsed     time.Duration // 非流式为完整响应时间；对冲模式下流式为首个 token 的时间
+	backup      bool          // 胜出的是对冲发出的备份请求
+
+	// reservation 该路模型的 TPM / 并发预占；成功时由调用方在响应写完后 Release，discard 时撤销
+	reservation *modelstate.CapacityReservation
+	release     func() // 释放在途计数并取消该路 context，成功时须在响应写完后调用
+}
+
+func (a *upstreamAttempt) ok() bool {
+	return a.err == nil && a.statusCode >= 200 && a.statusCode < 300
+}
+
+// discard 关闭未被使用的响应、撤销额度预占并释放资源。
+func (a *upstreamAttempt) discard() {
+	if a.streamBody != nil {
+		_ = a.streamBody.Close()
+	}
+	a.reservation.Cancel()
+	a.release()
+}
+
+// hedgePlan 对冲配置：主请求 after 内没有首个 token 时，调用 backup 选出、准入并准备下一个子模型。
+type hedgePlan struct {
+	comboID   string
+	after     time.Duration
+	backup    func() (*model.Model, *upstreamCall, *modelstate.CapacityReservation)
+	onFailure func(a *upstreamAttempt) // 未被返回给调用方的失败尝试（如失败的备份请求），用于记录错误与临时禁用
+}
+
+// hedge 在 combo 开启对冲时返回本次尝试的对冲配置，否则返回 nil。
+// 备份请求使用 payload 的深拷贝，避免与正在执行的主请求共享可变的 map；
+// 备份模型须此刻就有 QPS 令牌与 TPM / 并发额度（不排队），否则本次不对冲。
+func (p *failoverPolicy) hedge(primaryID string, payload map[string]any, req *combo.Request, accept func(m *model.Model) bool,
+	prepare func(m *model.Model, payload map[string]any) (*upstreamCall, error), onFailure func(a *upstreamAttempt)) *hedgePlan {
+	if p.combo == nil || p.combo.HedgeAfterMs <= 0 {
+		return nil
+	}
+	backupPayload, err := clonePayload(payload)
+	if err != nil {
+		return nil
+	}
+	return &hedgePlan{
+		comboID: p.combo.ID,
+		after:   time.Duration(p.combo.HedgeAfterMs) * time.Millisecond,
+		backup: func() (*model.Model, *upstreamCall, *modelstate.CapacityReservation) {
+			exclude := make(map[string]struct{}, len(p.tried)+1)
+			for id := range p.tried {
+				exclude[id] = struct{}{}
+			}
+			exclude[primaryID] = struct{}{}
+			m, err := combo.Resolve(p.combo, combo.ResolveOptions{Request: req, Exclude: exclude, Accept: accept})
+			if err != nil {
+				utils.Logger.Debugf("[ClaudeRouter] hedge: combo=%s primary=%s no_backup err=%v", p.combo.ID, primaryID, err)
+				return nil, nil, nil
+			}
+			call, err := prepare(m, backupPayload)
+			if err != nil {
+				utils.Logger.Debugf("[ClaudeRouter] hedge: combo=%s backup=%s prepare err=%v", p.combo.ID, m.ID, err)
+				return nil, nil, nil
+			}
+			reservation, ok := tryAdmitModelRequest(m, req)
+			if !ok {
+				utils.Logger.Debugf("[ClaudeRouter] hedge: combo=%s backup=%s no_capacity", p.combo.ID, m.ID)
+				return nil, nil, nil
+			}
+			return m, call, reservation
+		},
+		onFailure: func(a *upstreamAttempt) {
+			p.tried[a.model.ID] = struct{}{}
+			if onFailure != nil {
+				onFailure(a)
+			}
+		},
+	}
+}
+
+// runUpstreamAttempt 执行一次上游尝试并维护在途计数，reservation 为主请求模型的额度预占（可为 nil）。plan 为 nil 时直接调用；
+// 否则主请求超过 plan.after 仍没有首个 token 时向备份模型发出同样的请求，先成功响应者胜出，另一路被取消并撤销其预占。
+// 两路都失败时返回主请求的失败结果。返回结果的 reservation 属于胜出的模型。
+func runUpstreamAttempt(ctx context.Context, m *model.Model, call *upstreamCall, reservation *modelstate.CapacityReservation, plan *hedgePlan) *upstreamAttempt {
+	if plan == nil {
+		release := modelstate.BeginModelRequest(m.ID)
+		start := time.Now()
+		a := &upstreamAttempt{model: m, call: call, reservation: reservation, release: release}
+		a.statusCode, a.contentType, a.body, a.streamBody, a.err = call.execute(ctx)
+		a.elapsed = time.Since(start)
+		return a
+	}
+
+	results := make(chan *upstreamAttempt, 2)
+	var (
+		cancelsMu sync.Mutex
+		cancels   = make(map[*upstreamAttempt]context.CancelFunc)
+	)
+	launch := func(m *model.Model, call *upstreamCall, reservation *modelstate.CapacityReservation, backup bool) *upstreamAttempt {
+		a := &upstreamAttempt{model: m, call: call, reservation: reservation, backup: backup}
+		attemptCtx, cancel := context.WithCancel(ctx)
+		releaseInFlight := modelstate.BeginModelRequest(m.ID)
+		a.release = func() {
+			cancel()
+			releaseInFlight()
+		}
+		cancelsMu.Lock()
+		cancels[a] = cancel
+		cancelsMu.Unlock()
+		go func() {
+			start := time.Now()
+			a.statusCode, a.contentType, a.body, a.streamBody, a.err = call.execute(attemptCtx)
+			if a.ok() && a.streamBody != nil {
+				a.streamBody, a.err = waitFirstToken(a.streamBody)
+			}
+			a.elapsed = time.Since(start)
+			results <- a
+		}()
+		return a
+	}
+	cancelOthers := func(winner *upstreamAttempt) {
+		cancelsMu.Lock()
+		defer cancelsMu.Unlock()
+		for a, cancel := range cancels {
+			if a != winner {
+				cancel()
+			}
+		}
+	}
+
+	primary := launch(m, call, reservation, false)
+	pending := 1
+	hedged := false
+	timer := time.NewTimer(plan.after)
+	defer timer.Stop()
+
+	var failed *upstreamAttempt
+	for pending > 0 {
+		select {
+		case a := <-results:
+			pending--
+			if a.ok() {
+				if pending > 0 {
+					cancelOthers(a)
+					go func() { (<-results).discard() }()
+				}
+				if failed != nil {
+					plan.onFailure(failed)
+					failed.discard()
+				}
+				modelstate.RecordHedge(plan.comboID, hedged, a.backup)
+				if a.backup {
+					utils.Logger.Infof("[ClaudeRouter] hedge: combo=%s primary=%s backup=%s won", plan.comboID, primary.model.ID, a.model.ID)
+				}
+				return a
+			}
+			if a.backup && ctx.Err() == nil {
+				// 备份请求失败：单独记录，继续等待主请求
+				plan.onFailure(a)
+				a.discard()
+				continue
+			}
+			if failed != nil {
+				a.discard()
+				continue
+			}
+			// 主请求失败：已发出备份时等备份的结果，否则交给故障转移处理
+			failed = a
+		case <-timer.C:
+			if hedged || failed != nil {
+				continue
+			}
+			bm, bcall, breservation := plan.backup()
+			if bm == nil {
+				continue
+			}
+			hedged = true
+			utils.Logger.Debugf("[ClaudeRouter] hedge: combo=%s primary=%s no first token after %s, firing backup=%s", plan.comboID, m.ID, plan.after, bm.ID)
+			launch(bm, bcall, breservation, true)
+			pending++
+		}
+	}
+	modelstate.RecordHedge(plan.comboID, hedged, false)
+	return failed
+}
+
+// maxFirstTokenPrefix 等待首个 token 时最多缓存的流前缀，超过后不再等待。
+const maxFirstTokenPrefix = 1 << 20
+
+// waitFirstToken 阻塞到上游流返回首个内容增量（Anthropic 的 content_block_delta、OpenAI Chat 的非空 delta、
+// Responses 的 *.delta 事件），message_start、ping 等前置事件不算；流结束或出现错误事件时也返回。
+// 返回的流先重放已读取的前缀，再继续读取剩余内容。
+func waitFirstToken(rc io.ReadCloser) (io.ReadCloser, error) {
+	br := bufio.NewReader(rc)
+	var prefix bytes.Buffer
+	for prefix.Len() < maxFirstTokenPrefix {
+		line, err := br.ReadBytes('\n')
+		prefix.Write(line)
+		if isFirstTokenLine(line) {
+			break
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			_ = rc.Close()
+			return nil, err
+		}
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(&prefix, br), rc}, nil
+}
+
+// isFirstTokenLine 判断一行 SSE 是否携带首个 token（或意味着不会再有 token，如 [DONE] 与错误事件）。
+// 无法识别的 data 行按内容处理，避免未知格式的流一直等到结束。
+func isFirstTokenLine(line []byte) bool {
+	line = bytes.TrimSpace(line)
+	data, ok := bytes.CutPrefix(line, []byte("data:"))
+	if !ok {
+		return false
+	}
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return false
+	}
+	if bytes.Equal(data, []byte("[DONE]")) {
+		return true
+	}
+	var ev struct {
+		Type    string `json:"type"`
+		Error   any    `json:"error"`
+		Choices []struct {
+			Delta map[string]any `json:"delta"`
+		} `json:"choices"`
+		Candidates []any `json:"candidates"`
+	}
+	if json.Unmarshal(data, &ev) != nil {
+		return true
+	}
+	switch {
+	case ev.Error != nil || ev.Type == "error" || ev.Type == "response.failed":
+		return true
+	case ev.Type == "content_block_delta" || strings.HasSuffix(ev.Type, ".delta"):
+		return true
+	case len(ev.Candidates) > 0:
+		return true
+	}
+	for _, ch := range ev.Choices {
+		for _, key := range []string{"content", "reasoning_content", "tool_calls", "function_call"} {
+			if v, ok := ch.Delta[key]; ok && v != nil && v != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// clonePayload 深拷贝请求体：上游适配器可能原地修改 payload，并发的多路请求不能共享同一个 map。
+func clonePayload(payload map[string]any) (map[string]any, error) {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	var out map[string]any
+	if err := json.Unmarshal(raw, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
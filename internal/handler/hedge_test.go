@@ -0,0 +1,259 @@
+package handler
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+
+	"awesomeProject/internal/combo"
+	"awesomeProject/internal/model"
+	"awesomeProject/internal/modelstate"
+	"awesomeProject/internal/storage"
+	"awesomeProject/pkg/utils"
+)
+
+// setupHandlerTestDB 使用内存 SQLite 作为 storage.DB，并写入给定的模型与 combo。
+func setupHandlerTestDB(t *testing.T, models []*model.Model, combos ...*model.Combo) {
+	t.Helper()
+	utils.InitLogger("error")
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	// 内存库每个连接各自独立，后台 goroutine 写日志时也必须复用同一个连接
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatalf("db: %v", err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	if err := db.AutoMigrate(&model.User{}, &model.Model{}, &model.Combo{}, &model.ComboItem{}, &model.UsageLog{}, &model.ErrorLog{}, &model.QuotaHold{}); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	storage.DB = db
+	for _, m := range models {
+		if err := model.CreateModel(m); err != nil {
+			t.Fatalf("create model %s: %v", m.ID, err)
+		}
+	}
+	for _, cb := range combos {
+		if err := model.CreateCombo(cb); err != nil {
+			t.Fatalf("create combo %s: %v", cb.ID, err)
+		}
+	}
+}
+
+// fakeCall 延迟 delay 后返回 status 与流式响应；ctx 取消时返回 ctx.Err()。
+func fakeCall(delay time.Duration, status int, cancelled chan<- string, id string) *upstreamCall {
+	return &upstreamCall{
+		interfaceType: "anthropic",
+		execute: func(ctx context.Context) (int, string, []byte, io.ReadCloser, error) {
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				if cancelled != nil {
+					cancelled <- id
+				}
+				return 0, "", nil, nil, ctx.Err()
+			}
+			if status != http.StatusOK {
+				return status, "application/json", []byte(`{"error":{"type":"overloaded_error"}}`), nil, nil
+			}
+			return status, "text/event-stream", nil, io.NopCloser(strings.NewReader("data: " + id + "\n\n")), nil
+		},
+	}
+}
+
+func testHedgePlan(comboID string, backup *model.Model, call *upstreamCall, failures *[]string) *hedgePlan {
+	return &hedgePlan{
+		comboID: comboID,
+		after:   20 * time.Millisecond,
+		backup: func() (*model.Model, *upstreamCall, *modelstate.CapacityReservation) {
+			return backup, call, nil
+		},
+		onFailure: func(a *upstreamAttempt) {
+			*failures = append(*failures, a.model.ID)
+		},
+	}
+}
+
+func TestRunUpstreamAttempt_Hedge(t *testing.T) {
+	utils.InitLogger("error")
+	primary := &model.Model{ID: "slow"}
+	backup := &model.Model{ID: "fast"}
+
+	t.Run("backup wins and primary is cancelled", func(t *testing.T) {
+		cancelled := make(chan string, 2)
+		var failures []string
+		plan := testHedgePlan("combo:hedge-a", backup, fakeCall(0, http.StatusOK, cancelled, "fast"), &failures)
+		reservation, _ := modelstate.ReserveModelCapacity(context.Background(), primary.ID, 0, 1, 0)
+		res := runUpstreamAttempt(context.Background(), primary, fakeCall(time.Second, http.StatusOK, cancelled, "slow"), reservation, plan)
+		if !res.ok() || res.model != backup || !res.backup {
+			t.Fatalf("expect backup to win, got model=%s status=%d err=%v", res.model.ID, res.statusCode, res.err)
+		}
+		data, _ := io.ReadAll(res.streamBody)
+		res.discard()
+		if string(data) != "data: fast\n\n" {
+			t.Fatalf("unexpected stream body %q", data)
+		}
+		select {
+		case id := <-cancelled:
+			if id != "slow" {
+				t.Fatalf("expect primary cancelled, got %s", id)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("primary was not cancelled")
+		}
+		if len(failures) != 0 {
+			t.Fatalf("cancelled loser must not be recorded as failure: %v", failures)
+		}
+		// 落败的主请求的并发预占被撤销
+		deadline := time.Now().Add(time.Second)
+		for inFlight, _ := modelstate.ModelCapacityUsage(primary.ID); inFlight != 0; inFlight, _ = modelstate.ModelCapacityUsage(primary.ID) {
+			if time.Now().After(deadline) {
+				t.Fatal("primary reservation was not cancelled")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		st := findHedgeStat("combo:hedge-a")
+		if st.Requests != 1 || st.Hedged != 1 || st.BackupWins != 1 {
+			t.Fatalf("unexpected stats %+v", st)
+		}
+	})
+
+	t.Run("fast primary does not hedge", func(t *testing.T) {
+		var failures []string
+		plan := testHedgePlan("combo:hedge-b", backup, fakeCall(0, http.StatusOK, nil, "fast"), &failures)
+		res := runUpstreamAttempt(context.Background(), primary, fakeCall(0, http.StatusOK, nil, "slow"), nil, plan)
+		defer res.discard()
+		if !res.ok() || res.model != primary {
+			t.Fatalf("expect primary, got %s", res.model.ID)
+		}
+		if st := findHedgeStat("combo:hedge-b"); st.Requests != 1 || st.Hedged != 0 {
+			t.Fatalf("unexpected stats %+v", st)
+		}
+	})
+
+	t.Run("failed backup keeps waiting for primary", func(t *testing.T) {
+		var failures []string
+		plan := testHedgePlan("combo:hedge-c", backup, fakeCall(0, http.StatusServiceUnavailable, nil, "fast"), &failures)
+		res := runUpstreamAttempt(context.Background(), primary, fakeCall(80*time.Millisecond, http.StatusOK, nil, "slow"), nil, plan)
+		defer res.discard()
+		if !res.ok() || res.model != primary {
+			t.Fatalf("expect primary, got %s status=%d", res.model.ID, res.statusCode)
+		}
+		if len(failures) != 1 || failures[0] != "fast" {
+			t.Fatalf("expect backup failure recorded, got %v", failures)
+		}
+	})
+}
+
+// sseCall 立即返回流式响应：先写出 prelude，delay 后再写出 content；ctx 取消时关闭流。
+func sseCall(prelude, content string, delay time.Duration) *upstreamCall {
+	return &upstreamCall{
+		interfaceType: "anthropic",
+		execute: func(ctx context.Context) (int, string, []byte, io.ReadCloser, error) {
+			pr, pw := io.Pipe()
+			go func() {
+				_, _ = io.WriteString(pw, prelude)
+				select {
+				case <-time.After(delay):
+					_, _ = io.WriteString(pw, content)
+					_ = pw.Close()
+				case <-ctx.Done():
+					_ = pw.CloseWithError(ctx.Err())
+				}
+			}()
+			return http.StatusOK, "text/event-stream", nil, pr, nil
+		},
+	}
+}
+
+func TestHedgeWaitsForFirstContentDelta(t *testing.T) {
+	utils.InitLogger("error")
+	const (
+		messageStart = "event: message_start\ndata: {\"type\":\"message_start\",\"message\":{}}\n\nevent: ping\ndata: {\"type\":\"ping\"}\n\n"
+		contentDelta = "event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"delta\":{\"type\":\"text_delta\",\"text\":\"hi\"}}\n\n"
+		openaiRole   = "data: {\"choices\":[{\"delta\":{\"role\":\"assistant\",\"content\":\"\"}}]}\n\n"
+		openaiDelta  = "data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\n"
+	)
+	primary := &model.Model{ID: "first-token-slow"}
+	backup := &model.Model{ID: "first-token-fast"}
+
+	cases := []struct {
+		name             string
+		prelude, content string
+	}{
+		{"anthropic message_start is not a token", messageStart, contentDelta},
+		{"openai role chunk is not a token", openaiRole, openaiDelta},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var failures []string
+			plan := testHedgePlan("combo:hedge-ft", backup, sseCall(tc.prelude, tc.content, 30*time.Millisecond), &failures)
+			res := runUpstreamAttempt(context.Background(), primary, sseCall(tc.prelude, tc.content, 500*time.Millisecond), nil, plan)
+			if !res.ok() || res.model != backup {
+				t.Fatalf("expect backup with earlier content to win, got model=%s err=%v", res.model.ID, res.err)
+			}
+			data, _ := io.ReadAll(res.streamBody)
+			res.discard()
+			if string(data) != tc.prelude+tc.content {
+				t.Fatalf("stream must replay the buffered prefix, got %q", data)
+			}
+		})
+	}
+}
+
+func TestHedgeSkipsBackupWithoutCapacity(t *testing.T) {
+	setupHandlerTestDB(t,
+		[]*model.Model{{ID: "hedge-p", Name: "hedge-p", Enabled: true}, {ID: "hedge-b", Name: "hedge-b", Enabled: true, MaxConcurrency: 1}},
+		&model.Combo{ID: "combo:hedge-cap", Name: "hedge-cap", Enabled: true, HedgeAfterMs: 20,
+			Items: []model.ComboItem{{ModelID: "hedge-p", Weight: 1}, {ModelID: "hedge-b", Weight: 1}}})
+	primary, _ := model.GetModel("hedge-p")
+	prepare := func(m *model.Model, _ map[string]any) (*upstreamCall, error) {
+		return fakeCall(0, http.StatusOK, nil, m.ID), nil
+	}
+
+	// 备份模型的并发名额已被占满：不发备份请求，主请求照常完成
+	held, _ := modelstate.ReserveModelCapacity(context.Background(), "hedge-b", 0, 1, 0)
+	var failures []string
+	plan := newFailoverPolicy("combo:hedge-cap").hedge(primary.ID, map[string]any{}, &combo.Request{}, nil, prepare, func(a *upstreamAttempt) {
+		failures = append(failures, a.model.ID)
+	})
+	if plan == nil {
+		t.Fatal("expect hedge plan")
+	}
+	res := runUpstreamAttempt(context.Background(), primary, fakeCall(80*time.Millisecond, http.StatusOK, nil, "hedge-p"), nil, plan)
+	res.discard()
+	if !res.ok() || res.model.ID != "hedge-p" || len(failures) != 0 {
+		t.Fatalf("expect primary without backup, got model=%s failures=%v", res.model.ID, failures)
+	}
+	if st := findHedgeStat("combo:hedge-cap"); st.Requests != 1 || st.Hedged != 0 {
+		t.Fatalf("backup without capacity must not count as hedged: %+v", st)
+	}
+	if inFlight, _ := modelstate.ModelCapacityUsage("hedge-b"); inFlight != 1 {
+		t.Fatalf("expect only the held slot in flight, got %d", inFlight)
+	}
+
+	// 名额归还后备份请求先预占额度再发出
+	held.Cancel()
+	m, call, reservation := plan.backup()
+	if m == nil || m.ID != "hedge-b" || call == nil || reservation == nil || reservation.ModelID() != "hedge-b" {
+		t.Fatalf("expect admitted backup, got model=%v reservation=%v", m, reservation)
+	}
+	reservation.Cancel()
+}
+
+func findHedgeStat(comboID string) modelstate.HedgeStat {
+	for _, st := range modelstate.HedgeStats() {
+		if st.ComboID == comboID {
+			return st
+		}
+	}
+	return modelstate.HedgeStat{}
+}
@@ -0,0 +1,137 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	appconfig "awesomeProject/internal/config"
+	"awesomeProject/internal/keypool"
+	"awesomeProject/internal/model"
+	"awesomeProject/internal/translator/messages"
+	"awesomeProject/pkg/utils"
+)
+
+// upstreamKeyPool 一次上游调用使用的 key 池；只有一个 key 时为 nil，直接使用 ExecuteOptions.APIKey。
+type upstreamKeyPool struct {
+	id       string
+	strategy string
+	keys     []keypool.Key
+}
+
+// resolveKeyPool 模型配置了 api_keys 时使用模型的 key 池；模型没有任何 key 时使用运营商的 key 池。
+// 与单 key 的优先级一致：模型的 key 优先于运营商的 key。
+func resolveKeyPool(m *model.Model, cfg *appconfig.Config) *upstreamKeyPool {
+	if m == nil {
+		return nil
+	}
+	if len(m.APIKeys) > 0 {
+		return newUpstreamKeyPool("model:"+m.ID, m.KeyStrategy, m.APIKey, m.APIKeys)
+	}
+	if strings.TrimSpace(m.APIKey) != "" || cfg == nil {
+		return nil
+	}
+	opID := strings.TrimSpace(m.OperatorID)
+	if opID == "" {
+		return nil
+	}
+	if op, ok := cfg.Operators[opID]; ok && len(op.APIKeys) > 0 {
+		return newUpstreamKeyPool("operator:"+opID, op.KeyStrategy, op.APIKey, op.APIKeys)
+	}
+	return nil
+}
+
+func newUpstreamKeyPool(id, strategy, primary string, keys []keypool.Key) *upstreamKeyPool {
+	all := make([]keypool.Key, 0, len(keys)+1)
+	if primary = strings.TrimSpace(primary); primary != "" {
+		all = append(all, keypool.Key{Key: primary})
+	}
+	all = append(all, keys...)
+	if len(all) < 2 {
+		return nil
+	}
+	return &upstreamKeyPool{id: id, strategy: strategy, keys: all}
+}
+
+// executeWithKeyPool 从池中取 key 执行上游调用；key 因 401/403/429 被暂停时换下一个 key 重试，
+// 所有 key 都不可用时返回最后一次的上游结果（由调用方按普通失败处理，可能禁用模型）。
+// 每次调用的响应头中的限流信息都记录到 modelstate；429 时 key 暂停到上游给出的恢复时间。
+func executeWithKeyPool(ctx context.Context, modelID string, pool *upstreamKeyPool, opts messages.ExecuteOptions,
+	exec func(ctx context.Context, opts messages.ExecuteOptions) (int, string, []byte, io.ReadCloser, error),
+) (int, string, []byte, io.ReadCloser, error) {
+	if isShadowCall(ctx) {
+		// 影子请求不占用 key 的 QPS、失败时不暂停 key，也不记录限流信息，避免影响主请求
+		if pool != nil {
+			key, _, err := keypool.Peek(pool.id, pool.keys)
+			if err != nil {
+				return http.StatusTooManyRequests, "application/json", nil, nil, err
+			}
+			opts.APIKey = key
+		}
+		return exec(ctx, opts)
+	}
+	if pool == nil {
+		obs := &rateLimitObserver{modelID: modelID}
+		statusCode, contentType, body, streamBody, err := exec(ctx, obs.attach(opts))
+		obs.record()
+		return statusCode, contentType, body, streamBody, err
+	}
+	var (
+		statusCode  int
+		contentType string
+		body        []byte
+		streamBody  io.ReadCloser
+		err         error
+		tried       bool
+	)
+	for range pool.keys {
+		lease, acqErr := keypool.Acquire(ctx, pool.id, pool.strategy, pool.keys)
+		if acqErr != nil {
+			if tried {
+				break
+			}
+			if errors.Is(acqErr, keypool.ErrNoAvailableKey) {
+				return http.StatusTooManyRequests, "application/json", nil, nil, acqErr
+			}
+			return 0, "", nil, nil, acqErr
+		}
+		tried = true
+		opts.APIKey = lease.Key()
+		obs := &rateLimitObserver{modelID: modelID, key: lease.Label()}
+		statusCode, contentType, body, streamBody, err = exec(ctx, obs.attach(opts))
+		if !lease.DoneUntil(statusCode, err, obs.record()) {
+			break
+		}
+		utils.Logger.Warnf("[ClaudeRouter] key_pool: pool=%s key=%s status=%d benched, rotating", pool.id, lease.Label(), statusCode)
+		if streamBody != nil {
+			_ = streamBody.Close()
+			streamBody = nil
+		}
+	}
+	return statusCode, contentType, body, streamBody, err
+}
+
+// listKeyPools 返回各 key 池中 key 的状态与用量（key 已打码）。
+func listKeyPools(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"pools": keypool.Statuses()})
+}
+
+type unbenchKeyRequest struct {
+	PoolID string `json:"pool_id"`
+	Key    string `json:"key"` // key 的展示名（label），为空表示池中所有 key
+}
+
+// unbenchKeys 手动解除 key 的暂停。
+func unbenchKeys(c *gin.Context) {
+	var req unbenchKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil || strings.TrimSpace(req.PoolID) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "pool_id required"})
+		return
+	}
+	n := keypool.Unbench(strings.TrimSpace(req.PoolID), strings.TrimSpace(req.Key))
+	c.JSON(http.StatusOK, gin.H{"unbenched": n})
+}
@@ -3,13 +3,14 @@ package handler
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
-	"fmt"
-	"math/rand"
+	"errors"
 	"net/http"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"io"
@@ -183,6 +184,13 @@ func (h *MessagesHandler) handleMessages(c *gin.Context) {
 			return
 		}
 	}
+	inputText := extractAnthropicInputText(payload)
+	routeReq := buildRouteRequest(c, payload, inputText)
+	releaseUserLimit, ok := checkUserLimits(c, h.cfg, currentUser, routeReq, anthropicRateLimit)
+	if !ok {
+		return
+	}
+	defer releaseUserLimit()
 
 	stream := false
 	if v, ok := payload["stream"].(bool); ok {
@@ -190,9 +198,25 @@ func (h *MessagesHandler) handleMessages(c *gin.Context) {
 	}
 	utils.Logger.Debugf("[ClaudeRouter] messages: step=resolve_model requested=%s stream=%v", requestedModel, stream)
 
-	inputText := extractAnthropicInputText(payload)
 	var targetModel *model.Model
 
+	// 缓存的模型无法处理本轮请求（如新增了图片、上下文变长）或已不在生效时间窗口时，丢弃缓存并重新从 combo 中选择
+	if cachedModelID != "" && model.IsComboID(originalComboID) {
+		if m, err := model.GetModel(cachedModelID); err == nil {
+			ok, reason := combo.CheckCapability(m, routeReq)
+			if ok {
+				cb, _ := model.GetCombo(originalComboID)
+				ok, reason = combo.CheckSchedule(cb, m, time.Now())
+			}
+			if !ok {
+				utils.Logger.Debugf("[ClaudeRouter] messages: step=conversation_model reselect model=%s reason=%s", m.ID, reason)
+				modelstate.ClearConversationModel(conversationID)
+				cachedModelID = ""
+				requestedModel = originalComboID
+			}
+		}
+	}
+
 	if cachedModelID != "" {
 		// 同一对话后续请求：直接用缓存的模型 id 取模型，不再查 combo
 		m, err := model.GetModel(requestedModel)
@@ -228,54 +252,14 @@ func (h *MessagesHandler) handleMessages(c *gin.Context) {
 			return
 		}
 
-		// 过滤掉被禁用和临时禁用的模型
-		filtered := make([]model.ComboItem, 0, len(cb.Items))
-		for _, it := range cb.Items {
-			modelID := strings.TrimSpace(it.ModelID)
-			if modelID == "" || modelstate.IsModelTemporarilyDisabled(modelID) {
-				continue
-			}
-			m, err := model.GetModel(modelID)
-			if err != nil || m == nil || !m.Enabled || modelstate.IsModelTemporarilyDisabled(m.ID) {
-				continue
-			}
-			filtered = append(filtered, it)
-		}
-		if len(filtered) == 0 {
-			// 如果没有可用模型，清除所有临时禁用状态并重试一次
-			modelstate.ClearAllTemporarilyDisabledModels()
-			for _, it := range cb.Items {
-				modelID := strings.TrimSpace(it.ModelID)
-				if modelID == "" {
-					continue
-				}
-				m, err := model.GetModel(modelID)
-				if err != nil || m == nil || !m.Enabled {
-					continue
-				}
-				filtered = append(filtered, it)
-			}
-			if len(filtered) == 0 {
-				utils.Logger.Warnf("[ClaudeRouter] messages: step=resolve_model err=no_available_models combo=%s", requestedModel)
-				anthropicError(c, http.StatusBadRequest, "invalid_request_error", "Combo has no available models")
-				return
-			}
-		}
-
-		// 使用过滤后的 combo 进行选择
-		tmp := &model.Combo{ID: cb.ID, Name: cb.Name, Description: cb.Description, Enabled: cb.Enabled, Items: filtered}
-		chosenID := combo.ChooseModelID(tmp, inputText)
-		if chosenID == "" {
-			anthropicError(c, http.StatusBadRequest, "invalid_request_error", "Combo has no selectable items")
-			return
-		}
-		m, err := model.GetModel(chosenID)
+		m, err := combo.Resolve(cb, combo.ResolveOptions{Request: routeReq})
 		if err != nil {
-			anthropicError(c, http.StatusBadRequest, "invalid_request_error", "Combo item model not found: "+chosenID)
+			utils.Logger.Warnf("[ClaudeRouter] messages: step=resolve_model err=%v combo=%s", err, requestedModel)
+			anthropicError(c, http.StatusBadRequest, "invalid_request_error", err.Error())
 			return
 		}
 		targetModel = m
-		utils.Logger.Debugf("[ClaudeRouter] messages: step=resolve_model combo chosen=%s", chosenID)
+		utils.Logger.Debugf("[ClaudeRouter] messages: step=resolve_model combo chosen=%s", targetModel.ID)
 		if conversationID != "" {
 			modelstate.SetConversationModelWithCombo(conversationID, targetModel.ID, originalComboID)
 			c.Set("real_conversation_id", conversationID)
@@ -286,11 +270,7 @@ func (h *MessagesHandler) handleMessages(c *gin.Context) {
 		anthropicError(c, http.StatusBadRequest, "invalid_request_error", "Model disabled: "+originalComboID)
 		return
 	}
-	if modelstate.IsModelTemporarilyDisabled(targetModel.ID) {
-		utils.Logger.Warnf("[ClaudeRouter] messages: step=resolve_model err=model_temp_disabled model=%s", targetModel.ID)
-		anthropicError(c, http.StatusBadRequest, "invalid_request_error", "Model temporarily disabled: "+originalComboID)
-		return
-	}
+	// 临时禁用与熔断已由缓存检查或 combo.Resolve 处理（子模型全部不可用时 Resolve 会放行），与 chat 一致不再重复判断
 
 	//if matched, isGreet := matchesInterceptPattern(inputText); matched {
 	//	if interceptAnthropicReply(c, originalComboID, stream, isGreet) {
@@ -298,195 +278,129 @@ func (h *MessagesHandler) handleMessages(c *gin.Context) {
 	//	}
 	//}
 
-	upstreamID := strings.TrimSpace(targetModel.UpstreamID)
-	if upstreamID == "" {
-		upstreamID = requestedModel
-	}
-
-	interfaceType := strings.TrimSpace(targetModel.Interface)
-	apiKey := strings.TrimSpace(targetModel.APIKey)
-	baseURL := strings.TrimRight(strings.TrimSpace(targetModel.BaseURL), "/")
-
-	// 若模型归属运营商，仅使用该运营商的转发逻辑；BaseURL/APIKey 优先用模型自身的，缺省时才用运营商配置
-	if operatorID := strings.TrimSpace(targetModel.OperatorID); operatorID != "" {
-		if h.cfg == nil || h.cfg.Operators == nil {
-			utils.Logger.Warnf("[ClaudeRouter] messages: step=operator err=no_config operator=%s", operatorID)
-			anthropicError(c, http.StatusBadRequest, "invalid_request_error", "Operator config not available")
-			return
-		}
-		ep, ok := h.cfg.Operators[operatorID]
-		if !ok {
-			utils.Logger.Warnf("[ClaudeRouter] messages: step=operator err=not_found operator=%s", operatorID)
-			anthropicError(c, http.StatusBadRequest, "invalid_request_error", "Operator not found: "+operatorID)
-			return
-		}
-		if !ep.Enabled {
-			anthropicError(c, http.StatusBadRequest, "invalid_request_error", "Operator disabled: "+operatorID)
-			return
-		}
-		if apiKey == "" {
-			apiKey = strings.TrimSpace(ep.APIKey)
-		}
-		if baseURL == "" {
-			baseURL = strings.TrimRight(strings.TrimSpace(ep.BaseURL), "/")
-		}
-		if t := strings.TrimSpace(ep.Interface); t != "" {
-			interfaceType = t
-			//if t == strings.TrimSpace("codex") {
-			//	interfaceType = "openai_compatible"
-			//}
-		}
-		utils.Logger.Debugf("[ClaudeRouter] messages: step=operator using operator=%s (forwarding only, url/key from model when set)", operatorID)
-	}
-	if interfaceType == "" {
-		interfaceType = "anthropic"
-	}
-	if baseURL == "" {
-		switch interfaceType {
-		case "openai", "openai_compatible":
-			baseURL = "https://api.openai.com"
-		case "openai_responses":
-			baseURL = "https://api.openai.com"
-		default:
-			baseURL = "https://api.anthropic.com"
-		}
-	}
-
-	// 按模型配置决定是否保留扩展字段（metadata、thinking），避免上游 422
-	payloadToSend := applyForwardExtendedFields(payload, targetModel.ForwardMetadata, targetModel.ForwardThinking)
-	if comboDesc := resolveComboDescriptionForPrompt(originalComboID); comboDesc != "" {
-		if injectComboDescriptionIntoAnthropicPayload(payloadToSend, comboDesc) {
-			utils.Logger.Debugf("[ClaudeRouter] messages: step=inject_combo_description combo=%s", originalComboID)
-		}
-	}
-
-	// 功能1：去掉关键字，将 payload 中的 model 替换为实际的模型 ID
-	// 这样上游收到的是真实模型 ID，而不是 combo ID
-	if cachedModelID == "" && requestedModel != targetModel.ID {
-		// 首次请求：requestedModel 是 combo ID，需要替换为实际的 targetModel.ID
-		payloadToSend["model"] = targetModel.ID
-		utils.Logger.Debugf("[ClaudeRouter] messages: step=replace_model_in_payload from=%s to=%s", requestedModel, targetModel.ID)
-	} else if cachedModelID != "" {
-		// 后续请求：requestedModel 已经是缓存的模型 ID，保持不变
-		payloadToSend["model"] = targetModel.ID
-	}
-
-	// 调试输出：Anthropic 转换后的消息
-	if payloadJSON, err := json.Marshal(payloadToSend); err == nil {
-		utils.Logger.Debugf("[ClaudeRouter] messages: payload_to_send=%s", string(payloadJSON))
-	} else {
-		utils.Logger.Errorf("[ClaudeRouter] messages: payload_to_send marshal err=%v", err)
-	}
-
-	// 按模型配置的 QPS 限流
-	waitModelQPS(c.Request.Context(), targetModel.ID, targetModel.MaxQPS)
-	if c.Request.Context().Err() != nil {
-		utils.Logger.Debugf("[ClaudeRouter] messages: client_gone during qps wait")
+	// 按估算的最大费用预占用户额度，可用额度不足时拒绝；计费时结算，失败时释放
+	releaseQuotaHold, ok := holdUserQuota(c, h.cfg, currentUser, targetModel, originalComboID, routeReq, anthropicError, "permission_error")
+	if !ok {
 		return
 	}
+	defer releaseQuotaHold()
 
-	opts := messages.ExecuteOptions{
-		UpstreamModel: upstreamID,
-		APIKey:        apiKey,
-		BaseURL:       baseURL,
-		Stream:        stream,
-		// 根据 interfaceType 选择 User-Agent
-		UserAgent: cherryStudioUserAgent,
-	}
-	if strings.EqualFold(interfaceType, "openai_responses") {
-		opts.UserAgent = codexUserAgent
-	}
+	// 路由已完成，按 combo 配置删除用于选模型的 "!keyword"
+	stripComboKeywords(originalComboID, payload)
 
-	// 策略分发：有运营商则走该运营商的独立转发策略，否则走 interface_type 适配器（openai/anthropic）
-	var statusCode int
-	var contentType string
-	var body []byte
-	var streamBody io.ReadCloser
+	maybeMirrorShadow(c, originalComboID, targetModel.ID, payload, func(m *model.Model, p map[string]any) (*upstreamCall, error) {
+		return h.prepareUpstreamCall(m, p, originalComboID, false)
+	})
 
-	operatorID := strings.TrimSpace(targetModel.OperatorID)
-	if operatorID != "" {
-		strategy := messages.OperatorRegistry.Get(operatorID)
-		if strategy == nil {
-			utils.Logger.Warnf("[ClaudeRouter] messages: step=operator err=strategy_not_registered operator=%s", operatorID)
-			anthropicError(c, http.StatusBadRequest, "invalid_request_error", "Operator strategy not registered: "+operatorID)
-			return
-		}
-		if strings.EqualFold(operatorID, "codex") {
-			utils.Logger.Debugf("[ClaudeRouter] messages: step=execute_call operator=%s mode=sdk_translator_claude_to_codex", operatorID)
-		} else {
-			utils.Logger.Debugf("[ClaudeRouter] messages: step=execute_call operator=%s", operatorID)
+	// 上游失败且尚未向客户端写出任何内容时，按 combo 配置换下一个子模型重试
+	failover := newFailoverPolicy(originalComboID)
+	var (
+		statusCode    int
+		contentType   string
+		body          []byte
+		streamBody    io.ReadCloser
+		interfaceType string
+	)
+	for attempt := 1; ; attempt++ {
+		c.Set("real_model_id", targetModel.ID)
+
+		if requestedModel != targetModel.ID {
+			utils.Logger.Debugf("[ClaudeRouter] messages: step=replace_model_in_payload from=%s to=%s", requestedModel, targetModel.ID)
 		}
-		statusCode, contentType, body, streamBody, err = strategy.Execute(c.Request.Context(), payloadToSend, opts)
-	} else {
-		adapter := messages.Registry.GetOrDefault(interfaceType)
-		if adapter == nil {
-			utils.Logger.Warnf("[ClaudeRouter] messages: step=adapter err=unsupported type=%s", interfaceType)
-			anthropicError(c, http.StatusBadRequest, "invalid_request_error", "Unsupported interface_type: "+interfaceType)
+		call, prepErr := h.prepareUpstreamCall(targetModel, payload, originalComboID, stream)
+		if prepErr != nil {
+			anthropicError(c, http.StatusBadRequest, "invalid_request_error", prepErr.Error())
 			return
 		}
-		if strings.EqualFold(interfaceType, "openai_compatible") {
-			utils.Logger.Debugf("[ClaudeRouter] messages: step=execute_call adapter=%s mode=sdk_translator_claude_to_openai upstream_model=%s", interfaceType, upstreamID)
-		} else {
-			utils.Logger.Debugf("[ClaudeRouter] messages: step=execute_call adapter=%s upstream_model=%s", interfaceType, upstreamID)
-		}
-		statusCode, contentType, body, streamBody, err = adapter.Execute(c.Request.Context(), payloadToSend, opts)
-	}
-	utils.Logger.Debugf("[ClaudeRouter] messages: step=execute_done status=%d contentType=%s bodyLen=%d streamBody=%v err=%v", statusCode, contentType, len(body), streamBody != nil, err)
+		interfaceType = call.interfaceType
 
-	if err != nil {
-		utils.Logger.Errorf("[ClaudeRouter] messages: step=execute_err err=%v", err)
-
-		// 客户端主动取消请求，不记录错误日志，不封禁模型
-		if c.Request.Context().Err() != nil {
-			utils.Logger.Debugf("[ClaudeRouter] messages: client_gone, skip error response")
+		// 按模型的 QPS 排队并预占 TPM / 并发额度；排队超过上限时换 combo 中的其它子模型，没有则立即返回 429
+		reservation, admitErr := admitModelRequest(c, h.cfg, targetModel, routeReq)
+		if admitErr != nil {
+			var full *modelstate.QueueFullError
+			if !errors.As(admitErr, &full) {
+				utils.Logger.Debugf("[ClaudeRouter] messages: client_gone during queue wait")
+				return
+			}
+			utils.Logger.Warnf("[ClaudeRouter] messages: step=queue_full err=%v", full)
+			if next := failover.next(c.Request.Context(), targetModel.ID, attempt, routeReq, nil); next != nil && coverQuotaHold(c, next) {
+				targetModel = next
+				if conversationID != "" {
+					modelstate.SetConversationModelWithCombo(conversationID, next.ID, failover.combo.ID)
+				}
+				continue
+			}
+			anthropicRateLimit.reject(c, full.RetryAfter, full.Error())
 			return
 		}
 
-		// 功能2：模型报错时删除缓存
-		if conversationID != "" {
-			modelstate.ClearConversationModel(conversationID)
-		}
-		modelstate.DisableModelTemporarily(targetModel.ID, modelstate.DisableTTL)
-
-		// 写入错误日志
-		username := ""
-		if u := middleware.CurrentUser(c); u != nil {
-			username = u.Username
+		// 开启对冲时，主请求迟迟没有首个 token 则向下一个子模型发出同样的请求，先响应者胜出；备份模型须先补足额度预占
+		hedge := failover.hedge(targetModel.ID, payload, routeReq, nil, func(m *model.Model, p map[string]any) (*upstreamCall, error) {
+			if !coverQuotaHold(c, m) {
+				return nil, errQuotaNotCovered
+			}
+			return h.prepareUpstreamCall(m, p, originalComboID, stream)
+		}, func(a *upstreamAttempt) {
+			recordAttemptFailure(c, a.model.ID, a.statusCode, attempt, a.err, a.body)
+		})
+
+		// 记录在途请求与上游延迟，供 least_in_flight / lowest_latency 策略使用
+		utils.Logger.Debugf("[ClaudeRouter] messages: step=execute_call model=%s attempt=%d", targetModel.ID, attempt)
+		res := runUpstreamAttempt(c.Request.Context(), targetModel, call, reservation, hedge)
+		statusCode, contentType, body, streamBody, err = res.statusCode, res.contentType, res.body, res.streamBody, res.err
+		utils.Logger.Debugf("[ClaudeRouter] messages: step=execute_done status=%d contentType=%s bodyLen=%d streamBody=%v err=%v", statusCode, contentType, len(body), streamBody != nil, err)
+		if res.model != targetModel {
+			// 主请求的预占已在 runUpstreamAttempt 中撤销，计费校正改用胜出模型的预占
+			c.Set(ctxCapacityReservation, res.reservation)
+			// 对冲的备份请求胜出，后续响应转换与计费都以胜出的模型为准
+			targetModel = res.model
+			interfaceType = res.call.interfaceType
+			c.Set("real_model_id", targetModel.ID)
+			if conversationID != "" {
+				modelstate.SetConversationModelWithCombo(conversationID, targetModel.ID, failover.combo.ID)
+			}
 		}
-		_ = model.RecordErrorLog(targetModel.ID, username, statusCode, err.Error())
 
-		if statusCode >= 400 {
-			upstreamMsg := extractUpstreamErrorMessage(body)
-			utils.Logger.Warnf("[ClaudeRouter] messages: step=upstream_error status=%d message=%s", statusCode, upstreamMsg)
-			anthropicErrorFromBody(c, statusCode, body, originalComboID)
+		// 客户端主动取消请求，不记录错误日志，不封禁模型
+		if c.Request.Context().Err() != nil {
+			utils.Logger.Debugf("[ClaudeRouter] messages: client_gone, skip response")
+			res.discard()
 			return
 		}
-		anthropicError(c, http.StatusBadGateway, "api_error", err.Error())
-		return
-	}
 
-	if c.Request.Context().Err() != nil {
-		utils.Logger.Debugf("[ClaudeRouter] messages: client_gone, skip response")
-		if streamBody != nil {
-			_ = streamBody.Close()
+		if res.ok() {
+			defer res.release()
+			defer res.reservation.Release()
+			modelstate.ObserveModelLatency(targetModel.ID, res.elapsed)
+			modelstate.RecordModelSuccess(targetModel.ID)
+			markUpstreamStarted(c, res.elapsed)
+			break
+		}
+		res.discard()
+		if err != nil {
+			utils.Logger.Errorf("[ClaudeRouter] messages: step=execute_err err=%v", err)
 		}
-		return
-	}
 
-	if statusCode < 200 || statusCode >= 300 {
-		// 功能2：上游返回错误状态码时也删除缓存
+		// 功能2：模型报错时删除缓存
 		if conversationID != "" {
 			modelstate.ClearConversationModel(conversationID)
 		}
-		modelstate.DisableModelTemporarily(targetModel.ID, modelstate.DisableTTL)
+		recordAttemptFailure(c, targetModel.ID, statusCode, attempt, err, body)
 
-		// 写入错误日志
-		username := ""
-		if u := middleware.CurrentUser(c); u != nil {
-			username = u.Username
+		if isRetryableUpstreamFailure(statusCode, err, body) {
+			if next := failover.next(c.Request.Context(), targetModel.ID, attempt, routeReq, nil); next != nil && coverQuotaHold(c, next) {
+				targetModel = next
+				if conversationID != "" {
+					modelstate.SetConversationModelWithCombo(conversationID, next.ID, failover.combo.ID)
+				}
+				continue
+			}
 		}
-		_ = model.RecordErrorLog(targetModel.ID, username, statusCode, fmt.Sprintf("upstream error status=%d", statusCode))
 
+		if err != nil && statusCode < 400 {
+			anthropicError(c, http.StatusBadGateway, "api_error", err.Error())
+			return
+		}
 		upstreamMsg := extractUpstreamErrorMessage(body)
 		utils.Logger.Warnf("[ClaudeRouter] messages: step=upstream_error status=%d message=%s", statusCode, upstreamMsg)
 		anthropicErrorFromBody(c, statusCode, body, originalComboID)
@@ -557,6 +471,154 @@ func (h *MessagesHandler) handleMessages(c *gin.Context) {
 	c.Data(statusCode, ct, body)
 }
 
+// upstreamCall 针对某个具体模型准备好的一次上游调用（endpoint、payload、适配器均已确定）。
+type upstreamCall struct {
+	interfaceType string
+	execute       func(ctx context.Context) (int, string, []byte, io.ReadCloser, error)
+
+	// 以下仅用于路由解释（/api/route/explain），不参与执行
+	operatorID    string
+	upstreamModel string
+	baseURL       string
+	adapter       string         // 转发方式，如 adapter:openai_compatible、operator:codex
+	payload       map[string]any // 实际发往适配器的 payload（协议转换前）
+}
+
+// prepareUpstreamCall 按模型/运营商配置确定 endpoint 与转发策略，并生成发往上游的 payload。
+// 返回的错误为配置错误（运营商不存在、接口类型不支持等），不应重试。
+func (h *MessagesHandler) prepareUpstreamCall(targetModel *model.Model, payload map[string]any, originalComboID string, stream bool) (*upstreamCall, error) {
+	upstreamID := strings.TrimSpace(targetModel.UpstreamID)
+	if upstreamID == "" {
+		upstreamID = targetModel.ID
+	}
+
+	interfaceType := strings.TrimSpace(targetModel.Interface)
+	apiKey := strings.TrimSpace(targetModel.APIKey)
+	baseURL := strings.TrimRight(strings.TrimSpace(targetModel.BaseURL), "/")
+
+	// 若模型归属运营商，仅使用该运营商的转发逻辑；BaseURL/APIKey 优先用模型自身的，缺省时才用运营商配置
+	if operatorID := strings.TrimSpace(targetModel.OperatorID); operatorID != "" {
+		if h.cfg == nil || h.cfg.Operators == nil {
+			utils.Logger.Warnf("[ClaudeRouter] messages: step=operator err=no_config operator=%s", operatorID)
+			return nil, errors.New("Operator config not available")
+		}
+		ep, ok := h.cfg.Operators[operatorID]
+		if !ok {
+			utils.Logger.Warnf("[ClaudeRouter] messages: step=operator err=not_found operator=%s", operatorID)
+			return nil, errors.New("Operator not found: " + operatorID)
+		}
+		if !ep.Enabled {
+			return nil, errors.New("Operator disabled: " + operatorID)
+		}
+		if apiKey == "" {
+			apiKey = strings.TrimSpace(ep.APIKey)
+		}
+		if baseURL == "" {
+			baseURL = strings.TrimRight(strings.TrimSpace(ep.BaseURL), "/")
+		}
+		if t := strings.TrimSpace(ep.Interface); t != "" {
+			interfaceType = t
+			//if t == strings.TrimSpace("codex") {
+			//	interfaceType = "openai_compatible"
+			//}
+		}
+		utils.Logger.Debugf("[ClaudeRouter] messages: step=operator using operator=%s (forwarding only, url/key from model when set)", operatorID)
+	}
+	if interfaceType == "" {
+		interfaceType = "anthropic"
+	}
+	if baseURL == "" {
+		switch interfaceType {
+		case "openai", "openai_compatible":
+			baseURL = "https://api.openai.com"
+		case "openai_responses":
+			baseURL = "https://api.openai.com"
+		default:
+			baseURL = "https://api.anthropic.com"
+		}
+	}
+
+	// 按模型配置决定是否保留扩展字段（metadata、thinking），避免上游 422
+	payloadToSend := applyForwardExtendedFields(payload, targetModel.ForwardMetadata, targetModel.ForwardThinking)
+	if comboDesc := resolveComboDescriptionForPrompt(originalComboID); comboDesc != "" {
+		if injectComboDescriptionIntoAnthropicPayload(payloadToSend, comboDesc) {
+			utils.Logger.Debugf("[ClaudeRouter] messages: step=inject_combo_description combo=%s", originalComboID)
+		}
+	}
+
+	// 功能1：将 payload 中的 model 替换为实际的模型 ID，上游收到的是真实模型 ID，而不是 combo ID
+	payloadToSend["model"] = targetModel.ID
+	if !stream {
+		payloadToSend["stream"] = false
+	}
+
+	// 调试输出：Anthropic 转换后的消息
+	if payloadJSON, err := json.Marshal(payloadToSend); err == nil {
+		utils.Logger.Debugf("[ClaudeRouter] messages: payload_to_send=%s", string(payloadJSON))
+	} else {
+		utils.Logger.Errorf("[ClaudeRouter] messages: payload_to_send marshal err=%v", err)
+	}
+
+	opts := messages.ExecuteOptions{
+		UpstreamModel: upstreamID,
+		APIKey:        apiKey,
+		BaseURL:       baseURL,
+		Stream:        stream,
+		// 根据 interfaceType 选择 User-Agent
+		UserAgent: cherryStudioUserAgent,
+	}
+	if strings.EqualFold(interfaceType, "openai_responses") {
+		opts.UserAgent = codexUserAgent
+	}
+
+	// 策略分发：有运营商则走该运营商的独立转发策略，否则走 interface_type 适配器（openai/anthropic）
+	operatorID := strings.TrimSpace(targetModel.OperatorID)
+	keyPool := resolveKeyPool(targetModel, h.cfg)
+	call := &upstreamCall{
+		interfaceType: interfaceType,
+		operatorID:    operatorID,
+		upstreamModel: upstreamID,
+		baseURL:       baseURL,
+		adapter:       "adapter:" + interfaceType,
+		payload:       payloadToSend,
+	}
+	if operatorID != "" {
+		strategy := messages.OperatorRegistry.Get(operatorID)
+		if strategy == nil {
+			utils.Logger.Warnf("[ClaudeRouter] messages: step=operator err=strategy_not_registered operator=%s", operatorID)
+			return nil, errors.New("Operator strategy not registered: " + operatorID)
+		}
+		if strings.EqualFold(operatorID, "codex") {
+			utils.Logger.Debugf("[ClaudeRouter] messages: step=prepare_call operator=%s mode=sdk_translator_claude_to_codex", operatorID)
+		} else {
+			utils.Logger.Debugf("[ClaudeRouter] messages: step=prepare_call operator=%s", operatorID)
+		}
+		call.adapter = "operator:" + operatorID
+		call.execute = func(ctx context.Context) (int, string, []byte, io.ReadCloser, error) {
+			return executeWithKeyPool(ctx, targetModel.ID, keyPool, opts, func(ctx context.Context, opts messages.ExecuteOptions) (int, string, []byte, io.ReadCloser, error) {
+				return strategy.Execute(ctx, payloadToSend, opts)
+			})
+		}
+		return call, nil
+	}
+	adapter := messages.Registry.GetOrDefault(interfaceType)
+	if adapter == nil {
+		utils.Logger.Warnf("[ClaudeRouter] messages: step=adapter err=unsupported type=%s", interfaceType)
+		return nil, errors.New("Unsupported interface_type: " + interfaceType)
+	}
+	if strings.EqualFold(interfaceType, "openai_compatible") {
+		utils.Logger.Debugf("[ClaudeRouter] messages: step=prepare_call adapter=%s mode=sdk_translator_claude_to_openai upstream_model=%s", interfaceType, upstreamID)
+	} else {
+		utils.Logger.Debugf("[ClaudeRouter] messages: step=prepare_call adapter=%s upstream_model=%s", interfaceType, upstreamID)
+	}
+	call.execute = func(ctx context.Context) (int, string, []byte, io.ReadCloser, error) {
+		return executeWithKeyPool(ctx, targetModel.ID, keyPool, opts, func(ctx context.Context, opts messages.ExecuteOptions) (int, string, []byte, io.ReadCloser, error) {
+			return adapter.Execute(ctx, payloadToSend, opts)
+		})
+	}
+	return call, nil
+}
+
 // handleCountTokens 实现 Anthropic 兼容的 POST /v1/messages/count_tokens（桩实现）。
 func (h *MessagesHandler) handleCountTokens(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"input_tokens": 0})
@@ -808,9 +870,10 @@ func extractAnthropicInputText(payload map[string]any) string {
 }
 
 func recordUsageFromBodyWithModel(c *gin.Context, body []byte, modelID string, comboName string) {
-	input, output := extractUsageFromJSON(body)
-	utils.Logger.Debugf("[ClaudeRouter] usage: upstream model=%s input=%d output=%d", modelID, input, output)
-	recordUsageWithModel(c, input, output, modelID, comboName)
+	usage := extractUsageFromJSON(body)
+	utils.Logger.Debugf("[ClaudeRouter] usage: upstream model=%s input=%d output=%d cache_write=%d cache_read=%d",
+		modelID, usage.InputTokens, usage.OutputTokens, usage.CacheWriteTokens, usage.CacheReadTokens)
+	recordUsageWithModel(c, usage, modelID, comboName)
 }
 
 func trackUsageStream(c *gin.Context, src io.ReadCloser, modelID string, comboName string) io.ReadCloser {
@@ -825,20 +888,22 @@ func trackUsageStream(c *gin.Context, src io.ReadCloser, modelID string, comboNa
 		scanner := bufio.NewScanner(src)
 		buf := make([]byte, 0, 64*1024)
 		scanner.Buffer(buf, 1024*1024)
-		var inputTokens int64
-		var outputTokens int64
+		var usage model.TokenUsage
 
+		firstByte := true
 		for scanner.Scan() {
 			line := scanner.Text()
+			if firstByte {
+				c.Set(ctxUpstreamFirstByteAt, time.Now())
+				firstByte = false
+			}
 			if strings.HasPrefix(line, "data:") {
 				payload := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
 				if payload != "" && payload != "[DONE]" {
 					if !looksLikeJSONPayload([]byte(payload)) {
 						continue
 					}
-					in, out := extractUsageFromJSON([]byte(payload))
-					inputTokens += in
-					outputTokens += out
+					usage = maxTokenUsage(usage, extractUsageFromJSON([]byte(payload)))
 				}
 			}
 			if _, err := pw.Write([]byte(line + "\n")); err != nil {
@@ -849,8 +914,9 @@ func trackUsageStream(c *gin.Context, src io.ReadCloser, modelID string, comboNa
 			_ = pw.CloseWithError(err)
 			return
 		}
-		utils.Logger.Debugf("[ClaudeRouter] usage: upstream model=%s stream input=%d output=%d", modelID, inputTokens, outputTokens)
-		recordUsageWithModel(c, inputTokens, outputTokens, modelID, comboName)
+		utils.Logger.Debugf("[ClaudeRouter] usage: upstream model=%s stream input=%d output=%d cache_write=%d cache_read=%d",
+			modelID, usage.InputTokens, usage.OutputTokens, usage.CacheWriteTokens, usage.CacheReadTokens)
+		recordUsageWithModel(c, usage, modelID, comboName)
 	}()
 	return pr
 }
@@ -950,47 +1016,46 @@ func setModelInErrorObject(container map[string]any, responseModel string) bool
 	return true
 }
 
-func extractUsageFromJSON(body []byte) (int64, int64) {
+func extractUsageFromJSON(body []byte) model.TokenUsage {
 	trimmed := bytes.TrimSpace(body)
 	if len(trimmed) == 0 {
-		return 0, 0
+		return model.TokenUsage{}
 	}
 	if !looksLikeJSONPayload(trimmed) {
-		return 0, 0
+		return model.TokenUsage{}
 	}
 
 	var payload map[string]any
 	if err := json.Unmarshal(trimmed, &payload); err == nil {
-		input, output, found := extractUsageFromPayload(payload)
+		usage, found := extractUsageFromPayload(payload)
 		if found {
-			utils.Logger.Debugf("[ClaudeRouter] usage: extracted input=%d output=%d", input, output)
-			return input, output
+			utils.Logger.Debugf("[ClaudeRouter] usage: extracted input=%d output=%d", usage.InputTokens, usage.OutputTokens)
+			return usage
 		}
 	} else {
-		if input, output, found := extractUsageFromSSEBody(trimmed); found {
-			utils.Logger.Debugf("[ClaudeRouter] usage: extracted input=%d output=%d", input, output)
-			return input, output
+		if usage, found := extractUsageFromSSEBody(trimmed); found {
+			utils.Logger.Debugf("[ClaudeRouter] usage: extracted input=%d output=%d", usage.InputTokens, usage.OutputTokens)
+			return usage
 		}
-		return 0, 0
+		return model.TokenUsage{}
 	}
 
-	usage := findUsageMap(payload)
-	if usage == nil {
+	usageMap := findUsageMap(payload)
+	if usageMap == nil {
 		utils.Logger.Debugf("[ClaudeRouter] usage: no usage field in response")
-		return 0, 0
+		return model.TokenUsage{}
 	}
-	input, output := extractUsageFromMap(usage)
-	utils.Logger.Debugf("[ClaudeRouter] usage: extracted input=%d output=%d", input, output)
-	return input, output
+	usage := extractUsageFromMap(usageMap)
+	utils.Logger.Debugf("[ClaudeRouter] usage: extracted input=%d output=%d", usage.InputTokens, usage.OutputTokens)
+	return usage
 }
 
-func extractUsageFromPayload(payload map[string]any) (int64, int64, bool) {
+func extractUsageFromPayload(payload map[string]any) (model.TokenUsage, bool) {
 	usage := findUsageMap(payload)
 	if usage == nil {
-		return 0, 0, false
+		return model.TokenUsage{}, false
 	}
-	input, output := extractUsageFromMap(usage)
-	return input, output, true
+	return extractUsageFromMap(usage), true
 }
 
 func looksLikeJSONPayload(body []byte) bool {
@@ -1001,12 +1066,11 @@ func looksLikeJSONPayload(body []byte) bool {
 	return trimmed[0] == '{' || trimmed[0] == '['
 }
 
-func extractUsageFromSSEBody(body []byte) (int64, int64, bool) {
+func extractUsageFromSSEBody(body []byte) (model.TokenUsage, bool) {
 	scanner := bufio.NewScanner(bytes.NewReader(body))
 	scanner.Buffer(make([]byte, 0, 64*1024), 8*1024*1024)
 
-	var inputTokens int64
-	var outputTokens int64
+	var usage model.TokenUsage
 	var found bool
 
 	for scanner.Scan() {
@@ -1023,19 +1087,30 @@ func extractUsageFromSSEBody(body []byte) (int64, int64, bool) {
 		if err := json.Unmarshal([]byte(payload), &event); err != nil {
 			continue
 		}
-		input, output, ok := extractUsageFromPayload(event)
+		eventUsage, ok := extractUsageFromPayload(event)
 		if !ok {
 			continue
 		}
 		found = true
-		inputTokens += input
-		outputTokens += output
+		usage = maxTokenUsage(usage, eventUsage)
 	}
 	if err := scanner.Err(); err != nil {
 		utils.Logger.Errorf("[ClaudeRouter] usage: scan sse body error: %v", err)
 	}
 
-	return inputTokens, outputTokens, found
+	return usage, found
+}
+
+// maxTokenUsage 合并流式响应中多个事件的 usage。各协议流中的 usage 都是累计值
+// （Anthropic 的 message_start / message_delta，OpenAI 末尾 chunk，Responses 的 response.completed），按字段取最大值而不是相加。
+func maxTokenUsage(a, b model.TokenUsage) model.TokenUsage {
+	return model.TokenUsage{
+		InputTokens:      max(a.InputTokens, b.InputTokens),
+		OutputTokens:     max(a.OutputTokens, b.OutputTokens),
+		CacheWriteTokens: max(a.CacheWriteTokens, b.CacheWriteTokens),
+		CacheReadTokens:  max(a.CacheReadTokens, b.CacheReadTokens),
+		ReasoningTokens:  max(a.ReasoningTokens, b.ReasoningTokens),
+	}
 }
 
 func findUsageMap(payload map[string]any) map[string]any {
@@ -1055,7 +1130,11 @@ func findUsageMap(payload map[string]any) map[string]any {
 	return nil
 }
 
-func extractUsageFromMap(usage map[string]any) (int64, int64) {
+// extractUsageFromMap 读取 usage 中的各类 token。Anthropic 的 cache_creation_input_tokens / cache_read_input_tokens
+// 不包含在 input_tokens 中；OpenAI 的 prompt_tokens_details.cached_tokens（Responses 为 input_tokens_details）
+// 包含在 prompt_tokens 中，计为缓存读取并从普通输入中扣除；completion_tokens_details / output_tokens_details 中的
+// reasoning_tokens 包含在输出中，单独记为推理 token。
+func extractUsageFromMap(usage map[string]any) model.TokenUsage {
 	input := numToInt64(usage["input_tokens"])
 	if input == 0 {
 		input = numToInt64(usage["prompt_tokens"])
@@ -1075,7 +1154,29 @@ func extractUsageFromMap(usage map[string]any) (int64, int64) {
 		output = sumNumericMap(usage["output_tokens_details"])
 	}
 
-	return input, output
+	cacheWrite := numToInt64(usage["cache_creation_input_tokens"])
+	cacheRead := numToInt64(usage["cache_read_input_tokens"])
+	for _, key := range []string{"prompt_tokens_details", "input_tokens_details"} {
+		if details, _ := usage[key].(map[string]any); details != nil {
+			if cached := numToInt64(details["cached_tokens"]); cached > 0 {
+				cacheRead += cached
+				input = max(input-cached, 0)
+				break
+			}
+		}
+	}
+
+	var reasoning int64
+	for _, key := range []string{"completion_tokens_details", "output_tokens_details"} {
+		if details, _ := usage[key].(map[string]any); details != nil {
+			if r := numToInt64(details["reasoning_tokens"]); r > 0 {
+				reasoning = min(r, output)
+				break
+			}
+		}
+	}
+
+	return model.TokenUsage{InputTokens: input, OutputTokens: output, CacheWriteTokens: cacheWrite, CacheReadTokens: cacheRead, ReasoningTokens: reasoning}
 }
 
 func sumNumericMap(v any) int64 {
@@ -1115,32 +1216,56 @@ func numToInt64(v any) int64 {
 	}
 }
 
-func recordUsage(c *gin.Context, input, output int64, combo string) {
-	recordUsageWithModel(c, input, output, "", combo)
+const (
+	ctxUpstreamStartedAt   = "upstream_started_at"    // 胜出的上游尝试开始时间
+	ctxUpstreamFirstByteAt = "upstream_first_byte_at" // 流式响应读到首个字节的时间
+)
+
+// markUpstreamStarted 记录胜出的上游尝试的开始时间（elapsed 为该尝试到目前为止的耗时），用于使用日志中的延迟统计。
+func markUpstreamStarted(c *gin.Context, elapsed time.Duration) {
+	c.Set(ctxUpstreamStartedAt, time.Now().Add(-elapsed))
 }
 
-func recordUsageWithModel(c *gin.Context, input, output int64, modelID string, combo string) {
+// upstreamTiming 返回首字节耗时与总耗时（毫秒）；非流式请求没有首字节时间，两者相同。未记录开始时间时返回 0。
+func upstreamTiming(c *gin.Context) (ttftMs, latencyMs int64) {
+	start := c.GetTime(ctxUpstreamStartedAt)
+	if start.IsZero() {
+		return 0, 0
+	}
+	latencyMs = time.Since(start).Milliseconds()
+	ttftMs = latencyMs
+	if first := c.GetTime(ctxUpstreamFirstByteAt); !first.IsZero() && first.After(start) {
+		ttftMs = first.Sub(start).Milliseconds()
+	}
+	return ttftMs, latencyMs
+}
+
+func recordUsage(c *gin.Context, usage model.TokenUsage, combo string) {
+	recordUsageWithModel(c, usage, "", combo)
+}
+
+// recordUsageWithModel 按上游返回的各类 token 用量计费：combo 请求使用 combo 单价，否则使用模型单价；
+// 缓存写入与缓存读取按各自单价（未配置时按输入单价）计费，并按 pricing_rule 计算阶梯、推理 token、图片与最低费用。
+func recordUsageWithModel(c *gin.Context, usage model.TokenUsage, modelID string, combo string) {
 	u := middleware.CurrentUser(c)
 	if u == nil || strings.TrimSpace(u.Username) == "" {
 		return
 	}
 	utils.Logger.Debugf("user:%v", u.Username)
-	if input <= 0 && output <= 0 {
+	if usage.Total() <= 0 {
 		return
 	}
 
 	var (
 		selectedModel *model.Model
 		selectedCombo *model.Combo
-		baseInput     float64
-		baseOutput    float64
+		pricing       model.Pricing
 	)
 
 	if strings.TrimSpace(modelID) != "" {
 		if m, err := model.GetModel(modelID); err == nil && m != nil {
 			selectedModel = m
-			baseInput = m.InputPrice
-			baseOutput = m.OutputPrice
+			pricing = model.ModelPricing(m)
 		}
 	}
 
@@ -1148,28 +1273,29 @@ func recordUsageWithModel(c *gin.Context, input, output int64, modelID string, c
 	if comboID != "" {
 		if cb, err := model.GetCombo(comboID); err == nil && cb != nil {
 			selectedCombo = cb
-			baseInput = cb.InputPrice
-			baseOutput = cb.OutputPrice
+			pricing = model.ComboPricing(cb)
 		}
 	}
 
-	// 模拟缓存：价格按 75%-125% 随机浮动
-	fluctuation := 0.75 + rand.Float64()*0.5
-	billingInputPrice := baseInput * fluctuation
-	billingOutputPrice := baseOutput * fluctuation
+	if c != nil {
+		usage.Images = int64(c.GetInt(ctxRequestImages))
+	}
 
-	if err := model.AddUserUsage(u.Username, input, output, billingInputPrice, billingOutputPrice); err == nil {
-		u.InputTokens += input
-		u.OutputTokens += output
-		u.TotalTokens += input + output
+	settleUserTokens(c, u.Username, usage.Total())
+	settleModelCapacity(c, modelID, usage.Total())
+	if err := model.AddUserTokenUsage(u.Username, usage, pricing); err == nil {
+		u.InputTokens += usage.PromptTokens()
+		u.OutputTokens += usage.OutputTokens
+		u.TotalTokens += usage.Total()
 	}
+	settleQuotaHold(c)
 
 	if selectedModel != nil {
 		comboForLog := model.GetComboIgnoreError(combo)
 		if selectedCombo != nil {
 			comboForLog = selectedCombo
 		}
-		// 日志中记录原始单价，用于对账：combo 请求优先记录 combo 单价
-		_ = model.RecordUsageLog(u.Username, *selectedModel, input, output, baseInput, baseOutput, *comboForLog)
+		ttftMs, latencyMs := upstreamTiming(c)
+		_ = model.RecordUsageLogWithTiming(u.Username, *selectedModel, usage, pricing, *comboForLog, ttftMs, latencyMs)
 	}
 }
@@ -0,0 +1,57 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"awesomeProject/internal/combo"
+	appconfig "awesomeProject/internal/config"
+	"awesomeProject/internal/model"
+	"awesomeProject/internal/modelstate"
+)
+
+// 所有子模型都处于熔断中时 combo.Resolve 会放行其中一个，messages 不能再以“临时禁用”拒绝（与 chat 一致）。
+func TestMessagesAllBreakersOpen(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"msg_1","type":"message","role":"assistant","content":[{"type":"text","text":"hi"}],"usage":{"input_tokens":3,"output_tokens":1}}`))
+	}))
+	defer upstream.Close()
+
+	models := []*model.Model{
+		{ID: "br-a", Name: "br-a", Enabled: true, Interface: "anthropic", BaseURL: upstream.URL, APIKey: "k"},
+		{ID: "br-b", Name: "br-b", Enabled: true, Interface: "anthropic", BaseURL: upstream.URL, APIKey: "k"},
+	}
+	setupHandlerTestDB(t, models, &model.Combo{ID: "combo:br", Name: "br", Enabled: true, Strategy: combo.StrategyPriority,
+		Items: []model.ComboItem{{ModelID: "br-a", Weight: 2}, {ModelID: "br-b", Weight: 1}}})
+
+	if err := modelstate.ConfigureBreaker(true, "", "", "", 1, 0.5); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = modelstate.ConfigureBreaker(false, "", "", "", 0, 0)
+		for _, m := range models {
+			modelstate.ResetBreaker(m.ID)
+		}
+	})
+	for _, m := range models {
+		modelstate.RecordModelFailure(m.ID)
+		if !modelstate.IsModelTemporarilyDisabled(m.ID) {
+			t.Fatalf("expect breaker of %s to be open", m.ID)
+		}
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	NewMessagesHandler(&appconfig.Config{}).RegisterRoutes(r)
+	w := httptest.NewRecorder()
+	body := `{"model":"combo:br","max_tokens":16,"messages":[{"role":"user","content":"hello"}]}`
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(body)))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"hi"`) {
+		t.Fatalf("expect request served by a combo item, got %d %s", w.Code, w.Body.String())
+	}
+}
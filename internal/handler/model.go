@@ -4,6 +4,7 @@ import (
 	"awesomeProject/pkg/utils"
 	"crypto/rand"
 	"errors"
+	"fmt"
 	"math/big"
 	"net/http"
 	"strconv"
@@ -12,9 +13,11 @@ import (
 
 	"github.com/gin-gonic/gin"
 
+	"awesomeProject/internal/combo"
 	appconfig "awesomeProject/internal/config"
 	"awesomeProject/internal/middleware"
 	"awesomeProject/internal/model"
+	"awesomeProject/internal/modelstate"
 )
 
 const apiKeyChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
@@ -63,6 +66,12 @@ func RegisterModelRoutes(r gin.IRouter, cfg *appconfig.Config) {
 	admin.GET("/models/:id", getModel)
 	admin.PUT("/models/:id", updateModel)
 	admin.DELETE("/models/:id", deleteModel)
+	admin.GET("/models/:id/health", getModelHealthHistory)
+	admin.POST("/models/:id/health/probe", probeModelNow)
+	admin.GET("/model-health", listModelHealth)
+	admin.GET("/key-pools", listKeyPools)
+	admin.POST("/key-pools/unbench", unbenchKeys)
+	admin.GET("/rate-limits", listRateLimits)
 
 	admin.GET("/operators", listOperators(cfg))
 	admin.GET("/operators/:id", getOperator(cfg))
@@ -72,6 +81,19 @@ func RegisterModelRoutes(r gin.IRouter, cfg *appconfig.Config) {
 	admin.GET("/combos/:id", getCombo)
 	admin.PUT("/combos/:id", updateCombo)
 	admin.DELETE("/combos/:id", deleteCombo)
+	admin.GET("/combos/:id/schedule", previewComboSchedule)
+	admin.GET("/combos/:id/weight-history", listComboWeightHistory)
+	admin.POST("/combos/:id/weight-history/:batch/restore", restoreComboWeights)
+	admin.GET("/hedge-stats", listHedgeStats)
+	admin.GET("/circuit-breakers", listCircuitBreakers)
+	admin.POST("/circuit-breakers/:id/reset", resetCircuitBreaker)
+	admin.GET("/routing/disabled-models", listDisabledModels)
+	admin.POST("/routing/disabled-models", disableModel)
+	admin.DELETE("/routing/disabled-models/:id", enableModel)
+	admin.GET("/routing/conversations", listConversationPins)
+	admin.PUT("/routing/conversations/:id", pinConversation)
+	admin.DELETE("/routing/conversations/:id", dropConversationPin)
+	admin.POST("/route/explain", explainRoute(cfg))
 
 	admin.GET("/users", listUsers)
 	admin.POST("/users", createUser)
@@ -239,6 +261,11 @@ type userCreateRequest struct {
 	// 计费模式：token=按token计费，request=按次数计费
 	BillingMode  string  `json:"billing_mode"`
 	RequestPrice float64 `json:"request_price"`
+	// 限流：0 使用分组默认值，<0 表示不限制
+	Group            string `json:"group"`
+	RPMLimit         int    `json:"rpm_limit"`
+	TPMLimit         int64  `json:"tpm_limit"`
+	ConcurrencyLimit int    `json:"concurrency_limit"`
 }
 
 func createUser(c *gin.Context) {
@@ -275,6 +302,11 @@ func createUser(c *gin.Context) {
 			AllowedCombos: *(req.AllowedCombos),
 			BillingMode:   billingMode,
 			RequestPrice:  req.RequestPrice,
+
+			Group:            strings.TrimSpace(req.Group),
+			RPMLimit:         req.RPMLimit,
+			TPMLimit:         req.TPMLimit,
+			ConcurrencyLimit: req.ConcurrencyLimit,
 		}
 		if err := model.CreateUser(u); err != nil {
 			if strings.Contains(strings.ToLower(err.Error()), "unique") {
@@ -299,6 +331,11 @@ type userUpdateRequest struct {
 	// 计费模式：token=按token计费，request=按次数计费
 	BillingMode  *string  `json:"billing_mode"`
 	RequestPrice *float64 `json:"request_price"`
+	// 限流：0 使用分组默认值，<0 表示不限制
+	Group            *string `json:"group"`
+	RPMLimit         *int    `json:"rpm_limit"`
+	TPMLimit         *int64  `json:"tpm_limit"`
+	ConcurrencyLimit *int    `json:"concurrency_limit"`
 }
 
 func updateUser(c *gin.Context) {
@@ -337,6 +374,18 @@ func updateUser(c *gin.Context) {
 	if req.RequestPrice != nil {
 		update["request_price"] = *req.RequestPrice
 	}
+	if req.Group != nil {
+		update["user_group"] = strings.TrimSpace(*req.Group)
+	}
+	if req.RPMLimit != nil {
+		update["rpm_limit"] = *req.RPMLimit
+	}
+	if req.TPMLimit != nil {
+		update["tpm_limit"] = *req.TPMLimit
+	}
+	if req.ConcurrencyLimit != nil {
+		update["concurrency_limit"] = *req.ConcurrencyLimit
+	}
 	utils.Logger.Printf("[ClaudeRouter] updateUser: update map=%+v", update)
 	if len(update) == 0 {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "empty update"})
@@ -419,6 +468,27 @@ func listErrorLogs(c *gin.Context) {
 	})
 }
 
+// listHedgeStats 返回各 combo 的对冲统计（进程内，重启清零），用于调整 hedge_after_ms。
+func listHedgeStats(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"stats": modelstate.HedgeStats()})
+}
+
+// listCircuitBreakers 返回各模型熔断器的状态（进程内）。
+func listCircuitBreakers(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"breakers": modelstate.BreakerStatuses()})
+}
+
+// resetCircuitBreaker 手动关闭模型的熔断并清除其临时禁用状态。
+func resetCircuitBreaker(c *gin.Context) {
+	id := strings.TrimSpace(c.Param("id"))
+	if id == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "model id is required"})
+		return
+	}
+	found := modelstate.ResetBreaker(id)
+	c.JSON(http.StatusOK, gin.H{"model_id": id, "found": found})
+}
+
 type usageResponse struct {
 	Username      string     `json:"username"`
 	APIKey        string     `json:"api_key"`
@@ -519,6 +589,14 @@ func createModel(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
 		return
 	}
+	if err := combo.ValidateSchedule(m.Schedule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "schedule: " + err.Error()})
+		return
+	}
+	if err := m.PricingRule.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "pricing_rule: " + err.Error()})
+		return
+	}
 	if err := model.CreateModel(&m); err != nil {
 		status := http.StatusBadRequest
 		if err == model.ErrNotFound {
@@ -537,6 +615,14 @@ func updateModel(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
 		return
 	}
+	if err := combo.ValidateSchedule(m.Schedule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "schedule: " + err.Error()})
+		return
+	}
+	if err := m.PricingRule.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "pricing_rule: " + err.Error()})
+		return
+	}
 	if err := model.UpdateModel(id, &m); err != nil {
 		status := http.StatusBadRequest
 		if err == model.ErrNotFound {
@@ -610,12 +696,55 @@ func getCombo(c *gin.Context) {
 	c.JSON(http.StatusOK, cb)
 }
 
+// validateCombo 校验 combo 的路由配置（策略、故障转移参数、路由规则、嵌套引用、影子流量等）。
+func validateCombo(cb *model.Combo) error {
+	if !combo.IsValidStrategy(cb.Strategy) {
+		return fmt.Errorf("unsupported strategy: %s", cb.Strategy)
+	}
+	if cb.MaxAttempts < 0 {
+		return errors.New("max_attempts must be >= 0")
+	}
+	if cb.FailoverTimeoutMs < 0 {
+		return errors.New("failover_timeout_ms must be >= 0")
+	}
+	if cb.HedgeAfterMs < 0 {
+		return errors.New("hedge_after_ms must be >= 0")
+	}
+	if err := combo.ValidateRules(cb.Items); err != nil {
+		return err
+	}
+	if err := combo.ValidateNesting(cb); err != nil {
+		return err
+	}
+	for _, it := range cb.Items {
+		if err := combo.ValidateSchedule(it.Schedule); err != nil {
+			return fmt.Errorf("schedule of %s: %v", it.ModelID, err)
+		}
+	}
+	if err := cb.PricingRule.Validate(); err != nil {
+		return fmt.Errorf("pricing_rule: %v", err)
+	}
+	if cb.ShadowPercent < 0 || cb.ShadowPercent > 100 {
+		return errors.New("shadow_percent must be between 0 and 100")
+	}
+	if id := strings.TrimSpace(cb.ShadowModelID); id != "" {
+		if _, err := model.GetModel(id); err != nil {
+			return fmt.Errorf("shadow model not found: %s", id)
+		}
+	}
+	return nil
+}
+
 func createCombo(c *gin.Context) {
 	var cb model.Combo
 	if err := c.ShouldBindJSON(&cb); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
 		return
 	}
+	if err := validateCombo(&cb); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	if err := model.CreateCombo(&cb); err != nil {
 		status := http.StatusBadRequest
 		if err == model.ErrNotFound {
@@ -627,6 +756,34 @@ func createCombo(c *gin.Context) {
 	c.JSON(http.StatusCreated, cb)
 }
 
+// previewComboSchedule 预览 combo 各 item 在指定时刻（?at=RFC3339，默认当前时间）是否处于生效时间窗口。
+func previewComboSchedule(c *gin.Context) {
+	id := c.Param("id")
+	at := time.Now()
+	if v := strings.TrimSpace(c.Query("at")); v != "" {
+		parsed, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid at, expect RFC3339"})
+			return
+		}
+		at = parsed
+	}
+	cb, err := model.GetCombo(id)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == model.ErrNotFound {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"combo_id": cb.ID,
+		"at":       at,
+		"items":    combo.PreviewSchedule(cb, at),
+	})
+}
+
 func updateCombo(c *gin.Context) {
 	id := c.Param("id")
 	var cb model.Combo
@@ -634,6 +791,12 @@ func updateCombo(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
 		return
 	}
+	cb.ID = strings.TrimSpace(id)
+	if err := validateCombo(&cb); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	old, _ := model.GetCombo(cb.ID)
 	if err := model.UpdateCombo(id, &cb); err != nil {
 		status := http.StatusBadRequest
 		if err == model.ErrNotFound {
@@ -642,9 +805,79 @@ func updateCombo(c *gin.Context) {
 		c.JSON(status, gin.H{"error": err.Error()})
 		return
 	}
+	if old != nil {
+		reason := "updated via admin api"
+		if u := middleware.CurrentUser(c); u != nil {
+			reason = "updated by " + u.Username
+		}
+		changes := model.ComboWeightChanges(cb.ID, old.Items, cb.Items, model.WeightSourceManual, reason)
+		if err := model.RecordComboWeightHistory(changes); err != nil {
+			utils.Logger.Printf("[WARN] record weight history failed combo=%s: %v", cb.ID, err)
+		}
+	}
 	c.JSON(http.StatusOK, cb)
 }
 
+// listComboWeightHistory 分页返回 combo 的权重变更记录；dry_run=true/false 可只看建议值或实际变更。
+func listComboWeightHistory(c *gin.Context) {
+	id := c.Param("id")
+	page := 1
+	pageSize := 50
+	if p := c.Query("page"); p != "" {
+		if parsed, err := strconv.Atoi(p); err == nil && parsed > 0 {
+			page = parsed
+		}
+	}
+	if ps := c.Query("page_size"); ps != "" {
+		if parsed, err := strconv.Atoi(ps); err == nil && parsed > 0 && parsed <= 200 {
+			pageSize = parsed
+		}
+	}
+	var dryRun *bool
+	if v := strings.TrimSpace(c.Query("dry_run")); v != "" {
+		parsed, err := strconv.ParseBool(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid dry_run"})
+			return
+		}
+		dryRun = &parsed
+	}
+	rows, total, err := model.ListComboWeightHistory(id, dryRun, page, pageSize)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"history": rows,
+		"total":   total,
+	})
+}
+
+// restoreComboWeights 把 combo 的权重恢复到某个批次的快照：to=after（默认）为该批次变更后的权重，
+// to=before 为变更前的权重。
+func restoreComboWeights(c *gin.Context) {
+	id := c.Param("id")
+	before := false
+	switch strings.TrimSpace(c.DefaultQuery("to", "after")) {
+	case "after":
+	case "before":
+		before = true
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "to must be before or after"})
+		return
+	}
+	restored, err := model.RestoreComboWeights(id, c.Param("batch"), before)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == model.ErrNotFound {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"restored": restored})
+}
+
 func deleteCombo(c *gin.Context) {
 	id := c.Param("id")
 	if err := model.DeleteCombo(id); err != nil {
@@ -655,5 +888,6 @@ func deleteCombo(c *gin.Context) {
 		c.JSON(status, gin.H{"error": err.Error()})
 		return
 	}
+	combo.ForgetCombo(id)
 	c.Status(http.StatusNoContent)
 }
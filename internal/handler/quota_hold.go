@@ -0,0 +1,186 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"awesomeProject/internal/combo"
+	appconfig "awesomeProject/internal/config"
+	"awesomeProject/internal/errclass"
+	"awesomeProject/internal/middleware"
+	"awesomeProject/internal/model"
+	"awesomeProject/pkg/utils"
+)
+
+const (
+	defaultQuotaHoldTTL       = 30 * time.Minute
+	defaultQuotaHoldMaxTokens = 4096
+)
+
+// errQuotaNotCovered 用户的可用额度不足以覆盖对冲备份模型的估算费用，不发出备份请求。
+var errQuotaNotCovered = errors.New("insufficient quota for backup model")
+
+// ctxQuotaHold 本次请求的额度预占（*quotaHoldLease），计费时结算。
+const ctxQuotaHold = "quota_hold"
+
+// quotaHoldLease 本次请求的额度预占。故障转移或对冲换到估算费用更高的模型时补充预占差额，因此可能由多笔组成；
+// 保证只释放一次（计费结算与请求结束时都会调用 release）。
+type quotaHoldLease struct {
+	mu       sync.Mutex
+	username string
+	ttl      time.Duration
+	estimate func(m *model.Model) float64 // 模型 m 处理本次请求的估算最大费用
+	amount   float64                      // 已预占的总额
+	holds    []*model.QuotaHold
+	released bool
+}
+
+// cover 确保已预占的额度不少于模型 m 的估算最大费用，不足时预占差额，返回估算值。
+// 可用额度不足时返回 model.ErrInsufficientQuota；其它预占失败（如数据库错误）只记录日志，不阻断请求。
+func (l *quotaHoldLease) cover(m *model.Model) (float64, error) {
+	amount := l.estimate(m)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.released || amount <= l.amount {
+		return amount, nil
+	}
+	hold, err := model.ReserveQuota(l.username, amount-l.amount, l.ttl)
+	if err != nil {
+		if errors.Is(err, model.ErrInsufficientQuota) {
+			return amount, err
+		}
+		utils.Logger.Warnf("[ClaudeRouter] quota_hold: reserve failed user=%s err=%v", l.username, err)
+		return amount, nil
+	}
+	if hold != nil {
+		l.holds = append(l.holds, hold)
+	}
+	l.amount = amount
+	return amount, nil
+}
+
+func (l *quotaHoldLease) release() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.released {
+		return
+	}
+	l.released = true
+	for _, h := range l.holds {
+		if err := model.ReleaseQuotaHold(h.ID); err != nil {
+			utils.Logger.Warnf("[ClaudeRouter] quota_hold: release failed user=%s id=%d err=%v", h.Username, h.ID, err)
+		}
+	}
+}
+
+// quotaHoldOptions 预占保留时长与未指定 max_tokens 时估算的输出 token 数。
+func quotaHoldOptions(cfg *appconfig.Config) (ttl time.Duration, defaultMaxTokens int) {
+	ttl, defaultMaxTokens = defaultQuotaHoldTTL, defaultQuotaHoldMaxTokens
+	if cfg != nil {
+		if d, err := time.ParseDuration(strings.TrimSpace(cfg.QuotaHold.TTL)); err == nil && d > 0 {
+			ttl = d
+		}
+		if cfg.QuotaHold.DefaultMaxTokens > 0 {
+			defaultMaxTokens = cfg.QuotaHold.DefaultMaxTokens
+		}
+	}
+	return ttl, defaultMaxTokens
+}
+
+// estimateMaxCost 估算本次请求的最大费用，单价的选取与 recordUsageWithModel 一致（combo 请求用 combo 单价，否则用模型单价）。
+// 按次计费为单次价格；按 token 计费为 prompt 估算 + max_tokens（未指定时为 defaultMaxTokens）按 pricing_rule 计算，
+// prompt 是否命中缓存、输出中推理 token 的占比事先未知，按费用最高的组合估算。
+func estimateMaxCost(u *model.User, m *model.Model, comboID string, req *combo.Request, defaultMaxTokens int) float64 {
+	if strings.EqualFold(u.BillingMode, "request") {
+		return u.RequestPrice
+	}
+	pricing := model.ModelPricing(m)
+	if id := strings.TrimSpace(comboID); id != "" {
+		if cb, err := model.GetCombo(id); err == nil && cb != nil {
+			pricing = model.ComboPricing(cb)
+		}
+	}
+	var promptTokens, maxTokens, images int
+	if req != nil {
+		promptTokens, maxTokens, images = req.PromptTokens, req.MaxTokens, req.ImageCount
+	}
+	if maxTokens <= 0 {
+		maxTokens = defaultMaxTokens
+	}
+	// prompt 分别按普通输入与缓存写入、输出分别按普通输出与推理 token 计算，取最高者
+	var cost float64
+	for _, cacheWrite := range []bool{false, true} {
+		for _, reasoning := range []bool{false, true} {
+			usage := model.TokenUsage{OutputTokens: int64(maxTokens), Images: int64(images)}
+			if cacheWrite {
+				usage.CacheWriteTokens = int64(promptTokens)
+			} else {
+				usage.InputTokens = int64(promptTokens)
+			}
+			if reasoning {
+				usage.ReasoningTokens = usage.OutputTokens
+			}
+			cost = max(cost, pricing.Quote(usage).Cost)
+		}
+	}
+	return cost
+}
+
+// holdUserQuota 为非管理员、额度有限的用户预占本次请求的最大费用；可用额度（余额减去进行中请求的预占）不足时
+// 按入口协议返回 403 并返回 false。返回的 release 在请求结束时调用，计费时已结算则不做任何事。
+func holdUserQuota(c *gin.Context, cfg *appconfig.Config, u *model.User, m *model.Model, comboID string, req *combo.Request,
+	writeErr func(c *gin.Context, status int, errorType, message string, responseModel ...string), errorType string,
+) (release func(), ok bool) {
+	noop := func() {}
+	if u == nil || u.IsAdmin || u.Quota < 0 || strings.TrimSpace(u.Username) == "" {
+		return noop, true
+	}
+	ttl, defaultMaxTokens := quotaHoldOptions(cfg)
+	lease := &quotaHoldLease{
+		username: u.Username,
+		ttl:      ttl,
+		estimate: func(m *model.Model) float64 { return estimateMaxCost(u, m, comboID, req, defaultMaxTokens) },
+	}
+	if amount, err := lease.cover(m); err != nil {
+		c.Set(middleware.ErrorClassKey, errclass.Client)
+		writeErr(c, http.StatusForbidden, errorType, fmt.Sprintf("insufficient quota: this request may cost up to %.4f", amount))
+		return noop, false
+	}
+	c.Set(ctxQuotaHold, lease)
+	return lease.release, true
+}
+
+// coverQuotaHold 故障转移或对冲换到模型 m 前调用：按 m 补足本次请求的额度预占，可用额度不足时返回 false（不换到 m）。
+func coverQuotaHold(c *gin.Context, m *model.Model) bool {
+	v, ok := c.Get(ctxQuotaHold)
+	if !ok {
+		return true
+	}
+	l, _ := v.(*quotaHoldLease)
+	if l == nil {
+		return true
+	}
+	if amount, err := l.cover(m); err != nil {
+		utils.Logger.Warnf("[ClaudeRouter] quota_hold: user=%s cannot cover %.4f for model=%s, skip", l.username, amount, m.ID)
+		return false
+	}
+	return true
+}
+
+// settleQuotaHold 计费完成后释放本次请求的预占（实际费用已由 AddUserTokenUsage 扣除）。
+func settleQuotaHold(c *gin.Context) {
+	if v, ok := c.Get(ctxQuotaHold); ok {
+		if l, _ := v.(*quotaHoldLease); l != nil {
+			l.release()
+		}
+	}
+}
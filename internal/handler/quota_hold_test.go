@@ -0,0 +1,57 @@
+package handler
+
+import (
+	"math"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"awesomeProject/internal/combo"
+	"awesomeProject/internal/model"
+)
+
+func TestQuotaHoldCoversModelSwitch(t *testing.T) {
+	cheap := &model.Model{ID: "qh-cheap", Name: "qh-cheap", Enabled: true, InputPrice: 1, OutputPrice: 1}
+	pricey := &model.Model{ID: "qh-pricey", Name: "qh-pricey", Enabled: true, InputPrice: 10, OutputPrice: 10}
+	huge := &model.Model{ID: "qh-huge", Name: "qh-huge", Enabled: true, InputPrice: 10000, OutputPrice: 10000}
+	setupHandlerTestDB(t, []*model.Model{cheap, pricey, huge})
+	u := &model.User{Username: "qh-user", APIKey: "sk-qh", Quota: 1}
+	if err := model.CreateUser(u); err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	req := &combo.Request{PromptTokens: 1000, MaxTokens: 1000}
+	held := func() float64 {
+		t.Helper()
+		got, err := model.GetUser(u.Username)
+		if err != nil {
+			t.Fatalf("get user: %v", err)
+		}
+		return got.QuotaHeld
+	}
+	near := func(a, b float64) bool { return math.Abs(a-b) < 1e-9 }
+
+	release, ok := holdUserQuota(c, nil, u, cheap, "", req, anthropicError, "permission_error")
+	if !ok || !near(held(), 0.002) {
+		t.Fatalf("expect cheap estimate held, ok=%v held=%v", ok, held())
+	}
+	// 换到更贵的模型：补足差额
+	if !coverQuotaHold(c, pricey) || !near(held(), 0.02) {
+		t.Fatalf("expect hold raised to pricey estimate, held=%v", held())
+	}
+	// 换回便宜的模型不减少预占
+	if !coverQuotaHold(c, cheap) || !near(held(), 0.02) {
+		t.Fatalf("expect hold unchanged, held=%v", held())
+	}
+	// 可用额度不足以覆盖的模型不能换过去，已有预占保持不变
+	if coverQuotaHold(c, huge) || !near(held(), 0.02) {
+		t.Fatalf("expect huge model rejected, held=%v", held())
+	}
+	release()
+	release()
+	if !near(held(), 0) {
+		t.Fatalf("expect all holds released, held=%v", held())
+	}
+}
@@ -1,58 +1,114 @@
 package handler
 
 import (
-	"context"
-	"sync"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
 	"time"
 
-	"golang.org/x/time/rate"
+	"github.com/gin-gonic/gin"
+
+	"awesomeProject/internal/combo"
+	appconfig "awesomeProject/internal/config"
+	"awesomeProject/internal/errclass"
+	"awesomeProject/internal/middleware"
+	"awesomeProject/internal/model"
+	"awesomeProject/internal/modelstate"
 )
 
-// modelLimiters 按模型 ID 的 QPS 限流器；MaxQPS 变更时重建对应 limiter。
+// rateLimitResponder 按入口协议写出 429：Anthropic 为 rate_limit_error，OpenAI 为 rate_limit_exceeded。
+type rateLimitResponder struct {
+	writeErr  func(c *gin.Context, status int, errorType, message string, responseModel ...string)
+	errorType string
+}
+
 var (
-	modelLimitersMu sync.Mutex
-	modelLimiters   = make(map[string]*modelLimiterEntry)
+	anthropicRateLimit = rateLimitResponder{writeErr: anthropicError, errorType: "rate_limit_error"}
+	openaiRateLimit    = rateLimitResponder{writeErr: openaiError, errorType: "rate_limit_exceeded"}
 )
 
-type modelLimiterEntry struct {
-	limiter  *rate.Limiter
-	qps      float64
-	lastUsed time.Time
+// reject 写出 429 与 Retry-After（向上取整到秒，至少 1 秒）。本地限流不是上游失败，不计入模型禁用与错误日志。
+func (r rateLimitResponder) reject(c *gin.Context, retryAfter time.Duration, message string) {
+	secs := max(int(math.Ceil(retryAfter.Seconds())), 1)
+	c.Header("Retry-After", strconv.Itoa(secs))
+	c.Set(middleware.ErrorClassKey, errclass.Client)
+	r.writeErr(c, http.StatusTooManyRequests, r.errorType, fmt.Sprintf("%s, retry after %ds", message, secs))
 }
 
-// waitModelQPS 若该模型配置了 MaxQPS > 0，则阻塞直到获得令牌或 ctx 取消。
-func waitModelQPS(ctx context.Context, modelID string, maxQPS float64) {
-	if maxQPS <= 0 {
-		return
-	}
-	modelLimitersMu.Lock()
-	entry, ok := modelLimiters[modelID]
-	if !ok || entry.qps != maxQPS {
-		entry = &modelLimiterEntry{
-			limiter: rate.NewLimiter(rate.Limit(maxQPS), 1),
-			qps:     maxQPS,
+// modelQueueLimits 模型的排队上限：模型上的值为 0 时使用 model_queue 配置，<0 表示不限制。
+func modelQueueLimits(cfg *appconfig.Config, m *model.Model) (maxWait time.Duration, maxDepth int) {
+	if cfg != nil {
+		if d, err := time.ParseDuration(cfg.ModelQueue.MaxWait); err == nil && d > 0 {
+			maxWait = d
 		}
-		modelLimiters[modelID] = entry
+		maxDepth = cfg.ModelQueue.MaxDepth
+	}
+	switch {
+	case m.QueueMaxWaitMs > 0:
+		maxWait = time.Duration(m.QueueMaxWaitMs) * time.Millisecond
+	case m.QueueMaxWaitMs < 0:
+		maxWait = 0
 	}
-	entry.lastUsed = time.Now()
-	lim := entry.limiter
-	modelLimitersMu.Unlock()
-	_ = lim.Wait(ctx)
+	switch {
+	case m.QueueMaxDepth > 0:
+		maxDepth = m.QueueMaxDepth
+	case m.QueueMaxDepth < 0:
+		maxDepth = 0
+	}
+	return maxWait, max(maxDepth, 0)
 }
 
-// cleanupLimiters 定期清理超过 1 小时未使用的 limiter 以防内存泄漏。
-func init() {
-	go func() {
-		for {
-			time.Sleep(10 * time.Minute)
-			modelLimitersMu.Lock()
-			now := time.Now()
-			for id, entry := range modelLimiters {
-				if now.Sub(entry.lastUsed) > time.Hour {
-					delete(modelLimiters, id)
-				}
-			}
-			modelLimitersMu.Unlock()
-		}
-	}()
+// ctxCapacityReservation 当前尝试的模型额度预占（*modelstate.CapacityReservation），计费时据此校正 token 用量。
+const ctxCapacityReservation = "model_capacity_reservation"
+
+// admitModelRequest 按模型的 MaxQPS 排队，再按 MaxTPM / MaxConcurrency 预占额度（估算 prompt + max_tokens）。
+// 两段等待合计不超过排队上限、各自的排队数不超过 maxDepth，超出时返回 *modelstate.QueueFullError；ctx 取消时返回 ctx.Err()。
+// 模型未配置 TPM / 并发限制时返回的预占为 nil。
+func admitModelRequest(c *gin.Context, cfg *appconfig.Config, m *model.Model, req *combo.Request) (*modelstate.CapacityReservation, error) {
+	ctx := c.Request.Context()
+	maxWait, maxDepth := modelQueueLimits(cfg, m)
+	start := time.Now()
+	if err := modelstate.AcquireModelQPS(ctx, m.ID, m.MaxQPS, maxWait, maxDepth); err != nil {
+		return nil, err
+	}
+
+	// 两段排队共用同一个等待上限
+	capWait := maxWait
+	if maxWait > 0 {
+		capWait = max(maxWait-time.Since(start), time.Millisecond)
+	}
+	r, err := modelstate.AcquireModelCapacity(ctx, m.ID, m.MaxTPM, m.MaxConcurrency, req.EstimatedTokens(), capWait, maxDepth)
+	if err != nil {
+		return nil, err
+	}
+	if r != nil {
+		c.Set(ctxCapacityReservation, r)
+	}
+	return r, nil
+}
+
+// tryAdmitModelRequest 同 admitModelRequest 但不排队也不等待额度，供对冲的备份请求使用：
+// 模型此刻没有 QPS 令牌或 TPM / 并发额度时返回 false（不占用任何额度）。
+func tryAdmitModelRequest(m *model.Model, req *combo.Request) (*modelstate.CapacityReservation, bool) {
+	r, ok := modelstate.TryReserveModelCapacity(m.ID, m.MaxTPM, m.MaxConcurrency, req.EstimatedTokens())
+	if !ok {
+		return nil, false
+	}
+	if !modelstate.TryAcquireModelQPS(m.ID, m.MaxQPS) {
+		r.Cancel()
+		return nil, false
+	}
+	return r, true
+}
+
+// settleModelCapacity 用实际 token 用量校正本次请求对 modelID 的预占。
+func settleModelCapacity(c *gin.Context, modelID string, tokens int64) {
+	v, ok := c.Get(ctxCapacityReservation)
+	if !ok {
+		return
+	}
+	if r, _ := v.(*modelstate.CapacityReservation); r != nil && r.ModelID() == modelID {
+		r.Settle(tokens)
+	}
 }
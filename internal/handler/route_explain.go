@@ -0,0 +1,285 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"awesomeProject/internal/combo"
+	appconfig "awesomeProject/internal/config"
+	"awesomeProject/internal/model"
+	"awesomeProject/internal/modelstate"
+)
+
+type routeExplainRequest struct {
+	Endpoint string            `json:"endpoint"` // /v1/messages、/v1/chat/completions 或 /v1/responses
+	Payload  map[string]any    `json:"payload"`  // 原样的请求体
+	User     string            `json:"user"`     // 可选：按该用户的 combo 白名单检查权限
+	Headers  map[string]string `json:"headers"`  // 可选：参与 header 路由规则的请求头
+}
+
+// payloadChange 发往上游前对请求体顶层字段的一处修改。
+type payloadChange struct {
+	Field  string `json:"field"`
+	Action string `json:"action"` // set / changed / removed
+	From   any    `json:"from,omitempty"`
+	To     any    `json:"to,omitempty"`
+}
+
+type routeExplainResponse struct {
+	Endpoint       string          `json:"endpoint"`
+	RequestedModel string          `json:"requested_model"`
+	User           string          `json:"user,omitempty"`
+	Features       *combo.Request  `json:"features"`
+	Combo          string          `json:"combo,omitempty"`
+	Trace          *combo.Trace    `json:"trace,omitempty"`
+	Model          string          `json:"model,omitempty"`
+	TempDisabled   bool            `json:"temp_disabled,omitempty"` // 直接请求的模型当前处于临时禁用
+	Operator       string          `json:"operator,omitempty"`
+	InterfaceType  string          `json:"interface_type,omitempty"`
+	UpstreamModel  string          `json:"upstream_model,omitempty"`
+	UpstreamURL    string          `json:"upstream_url,omitempty"`
+	Adapter        string          `json:"adapter,omitempty"`
+	Conversion     string          `json:"conversion,omitempty"` // 协议转换，如 anthropic -> openai_compatible
+	Transforms     []payloadChange `json:"transforms,omitempty"`
+	Error          string          `json:"error,omitempty"`
+}
+
+// explainRoute 路由解释：对一个真实的请求体完整执行模型解析（combo 过滤、关键词、规则、策略）
+// 与上游调用准备，但不调用上游，返回每一步的决策。不读取会话缓存，也不修改临时禁用状态。
+// 解析失败（如权限不足、没有可用模型）时仍返回 200，错误写在 error 字段并附带已有的 trace。
+func explainRoute(cfg *appconfig.Config) gin.HandlerFunc {
+	messagesHandler := NewMessagesHandler(cfg)
+	chatHandler := NewChatHandler(cfg)
+	responsesHandler := NewCodexProxyHandler(cfg)
+
+	return func(c *gin.Context) {
+		var req routeExplainRequest
+		if err := c.ShouldBindJSON(&req); err != nil || req.Payload == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
+			return
+		}
+		protocol := explainProtocol(req.Endpoint)
+		if protocol == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "endpoint must be /v1/messages, /v1/chat/completions or /v1/responses"})
+			return
+		}
+		requestedModel, _ := req.Payload["model"].(string)
+		requestedModel = strings.TrimSpace(requestedModel)
+		if requestedModel == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "payload.model is required"})
+			return
+		}
+
+		var inputText string
+		switch protocol {
+		case "messages":
+			inputText = extractAnthropicInputText(req.Payload)
+		case "chat":
+			inputText = extractChatInputText(req.Payload)
+		default:
+			inputText = extractResponsesInputText(req.Payload)
+		}
+		routeReq := buildRouteRequest(nil, req.Payload, inputText)
+		if len(req.Headers) > 0 {
+			routeReq.Header = make(http.Header, len(req.Headers))
+			for k, v := range req.Headers {
+				routeReq.Header.Set(k, v)
+			}
+		}
+
+		resp := &routeExplainResponse{
+			Endpoint:       req.Endpoint,
+			RequestedModel: requestedModel,
+			User:           strings.TrimSpace(req.User),
+			Features:       routeReq,
+		}
+		if resp.User != "" {
+			u, err := model.GetUser(resp.User)
+			if err != nil {
+				resp.Error = "user not found: " + resp.User
+				c.JSON(http.StatusOK, resp)
+				return
+			}
+			if !u.IsAdmin {
+				if err := checkUserModelPermission(u, requestedModel); err != nil {
+					resp.Error = err.Error()
+					c.JSON(http.StatusOK, resp)
+					return
+				}
+			}
+		}
+
+		var accept func(m *model.Model) bool
+		if protocol == "responses" {
+			accept = isCodexResponsesCandidate
+		}
+		target, err := explainResolveModel(resp, protocol, requestedModel, routeReq, accept)
+		if err != nil {
+			resp.Error = err.Error()
+			c.JSON(http.StatusOK, resp)
+			return
+		}
+		resp.Model = target.ID
+
+		payload, err := clonePayload(req.Payload)
+		if err != nil {
+			resp.Error = err.Error()
+			c.JSON(http.StatusOK, resp)
+			return
+		}
+		stripComboKeywords(resp.Combo, payload)
+		stream, _ := payload["stream"].(bool)
+		var call *upstreamCall
+		switch protocol {
+		case "messages":
+			call, err = messagesHandler.prepareUpstreamCall(target, payload, resp.Combo, stream)
+		case "chat":
+			call, err = chatHandler.prepareUpstreamCall(target, payload, resp.Combo, stream)
+		default:
+			call, err = responsesHandler.prepareUpstreamCall(target, payload, stream)
+		}
+		if err != nil {
+			resp.Error = err.Error()
+			c.JSON(http.StatusOK, resp)
+			return
+		}
+		resp.Operator = call.operatorID
+		resp.InterfaceType = call.interfaceType
+		resp.UpstreamModel = call.upstreamModel
+		resp.UpstreamURL = upstreamEndpointURL(call.interfaceType, call.baseURL)
+		resp.Adapter = call.adapter
+		resp.Conversion = explainConversion(protocol, call.interfaceType, target.ResponseFormat)
+		resp.Transforms = diffPayload(req.Payload, call.payload)
+		c.JSON(http.StatusOK, resp)
+	}
+}
+
+func explainProtocol(endpoint string) string {
+	p := strings.TrimRight(strings.TrimSpace(endpoint), "/")
+	p = strings.TrimPrefix(p, "/back")
+	switch p {
+	case "/v1/messages", "messages":
+		return "messages"
+	case "/v1/chat/completions", "/chat/completions", "chat":
+		return "chat"
+	case "/v1/responses", "/responses", "responses":
+		return "responses"
+	}
+	return ""
+}
+
+// explainResolveModel 按各入口的规则解析目标模型，combo 的决策过程写入 resp.Trace。
+func explainResolveModel(resp *routeExplainResponse, protocol, requestedModel string, routeReq *combo.Request, accept func(m *model.Model) bool) (*model.Model, error) {
+	if model.IsComboID(requestedModel) {
+		cb, err := model.GetCombo(requestedModel)
+		if err != nil || cb == nil {
+			return nil, errors.New("unknown model: " + requestedModel)
+		}
+		resp.Combo = cb.ID
+		if !cb.Enabled {
+			return nil, errors.New("model disabled: " + requestedModel)
+		}
+		resp.Trace = &combo.Trace{}
+		return combo.Resolve(cb, combo.ResolveOptions{Request: routeReq, Accept: accept, Trace: resp.Trace})
+	}
+	if protocol == "messages" {
+		// /v1/messages 只接受 combo id（具体模型只能来自会话缓存）
+		return nil, errors.New("unknown model: " + requestedModel)
+	}
+	m, err := model.GetModel(requestedModel)
+	if err != nil || m == nil {
+		return nil, errors.New("unknown model: " + requestedModel)
+	}
+	if !m.Enabled {
+		return nil, errors.New("model disabled: " + requestedModel)
+	}
+	if accept != nil && !accept(m) {
+		return nil, fmt.Errorf("model %s is not a responses candidate", m.ID)
+	}
+	resp.TempDisabled = modelstate.IsModelTemporarilyDisabled(m.ID)
+	return m, nil
+}
+
+// upstreamEndpointURL 按接口类型推断上游请求地址（运营商策略可能在此基础上有自己的回退地址）。
+func upstreamEndpointURL(interfaceType, baseURL string) string {
+	switch strings.ToLower(strings.TrimSpace(interfaceType)) {
+	case "anthropic", "":
+		return buildAnthropicMessagesURL(baseURL)
+	case "openai_responses", "codex":
+		return buildCodexResponsesURL(baseURL)
+	default:
+		return buildOpenAIChatCompletionsURL(baseURL)
+	}
+}
+
+func explainConversion(protocol, interfaceType, responseFormat string) string {
+	from := map[string]string{"messages": "anthropic", "chat": "openai", "responses": "openai_responses"}[protocol]
+	to := strings.ToLower(strings.TrimSpace(interfaceType))
+	if to == "" {
+		to = "anthropic"
+	}
+	native := from == to || (from == "openai" && to == "openai_compatible") || (from == "openai_responses" && to == "codex")
+	conv := ""
+	if !native {
+		conv = from + " -> " + to
+	}
+	if protocol == "messages" && strings.TrimSpace(responseFormat) != "" && !strings.EqualFold(responseFormat, "anthropic") {
+		if conv != "" {
+			conv += "; "
+		}
+		conv += "response as " + responseFormat
+	}
+	return conv
+}
+
+// diffPayload 比较原始请求体与发往上游的请求体的顶层字段；标量字段附带前后值，复杂字段只标记修改。
+func diffPayload(before, after map[string]any) []payloadChange {
+	keys := make(map[string]struct{}, len(before)+len(after))
+	for k := range before {
+		keys[k] = struct{}{}
+	}
+	for k := range after {
+		keys[k] = struct{}{}
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	var changes []payloadChange
+	for _, k := range sorted {
+		b, inBefore := before[k]
+		a, inAfter := after[k]
+		switch {
+		case inBefore && !inAfter:
+			changes = append(changes, payloadChange{Field: k, Action: "removed"})
+		case !inBefore && inAfter:
+			changes = append(changes, payloadChange{Field: k, Action: "set", To: scalarOrNil(a)})
+		case !jsonEqual(b, a):
+			changes = append(changes, payloadChange{Field: k, Action: "changed", From: scalarOrNil(b), To: scalarOrNil(a)})
+		}
+	}
+	return changes
+}
+
+func jsonEqual(a, b any) bool {
+	ja, errA := json.Marshal(a)
+	jb, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(ja, jb)
+}
+
+func scalarOrNil(v any) any {
+	switch v.(type) {
+	case string, bool, float64, int, int64:
+		return v
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"awesomeProject/internal/combo"
+	appconfig "awesomeProject/internal/config"
+	"awesomeProject/internal/model"
+)
+
+func TestExplainRouteTrace(t *testing.T) {
+	noVision := false
+	setupHandlerTestDB(t,
+		[]*model.Model{
+			{ID: "rx-fast", Name: "rx-fast", Enabled: true},
+			{ID: "rx-kw", Name: "rx-kw", Enabled: true},
+			{ID: "rx-tools", Name: "rx-tools", Enabled: true},
+			{ID: "rx-novision", Name: "rx-novision", Enabled: true, SupportsVision: &noVision},
+		},
+		&model.Combo{ID: "combo:rx", Name: "rx", Enabled: true, Strategy: combo.StrategyPriority, Items: []model.ComboItem{
+			{ModelID: "rx-fast", Weight: 5},
+			{ModelID: "rx-kw", Weight: 1, Keywords: model.StringSlice{"!deep"}},
+			{ModelID: "rx-tools", Weight: 1, Rules: model.RuleSlice{{Type: combo.RuleHasTools}}},
+			{ModelID: "rx-novision", Weight: 10},
+		}},
+	)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/route/explain", explainRoute(&appconfig.Config{}))
+
+	explain := func(t *testing.T, payload map[string]any) routeExplainResponse {
+		t.Helper()
+		raw, _ := json.Marshal(map[string]any{"endpoint": "/v1/chat/completions", "payload": payload})
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/route/explain", bytes.NewReader(raw)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status=%d body=%s", w.Code, w.Body.String())
+		}
+		var resp routeExplainResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if resp.Combo != "combo:rx" || resp.Trace == nil || len(resp.Trace.Steps) != 1 {
+			t.Fatalf("expect one combo step, got %+v", resp)
+		}
+		// 解释结果必须与实际路由使用的 combo.Resolve 一致
+		cb, _ := model.GetCombo("combo:rx")
+		m, err := combo.Resolve(cb, combo.ResolveOptions{Request: buildRouteRequest(nil, payload, extractChatInputText(payload))})
+		if err != nil || resp.Model != m.ID || resp.Trace.Steps[0].Chosen != m.ID {
+			t.Fatalf("explain chose %s (step %s), resolve chose %v err=%v", resp.Model, resp.Trace.Steps[0].Chosen, m, err)
+		}
+		return resp
+	}
+	userText := func(content any) map[string]any {
+		return map[string]any{"model": "combo:rx", "messages": []any{map[string]any{"role": "user", "content": content}}}
+	}
+	itemStatus := func(trace *combo.Trace, modelID string) combo.TraceItem {
+		for _, it := range trace.Items {
+			if it.ModelID == modelID {
+				return it
+			}
+		}
+		return combo.TraceItem{}
+	}
+
+	t.Run("keyword match", func(t *testing.T) {
+		resp := explain(t, userText("!deep think about this"))
+		step := resp.Trace.Steps[0]
+		if !slices.Equal(step.KeywordHits, []string{"rx-kw"}) || len(step.RuleHits) != 0 || resp.Model != "rx-kw" {
+			t.Fatalf("unexpected step %+v", step)
+		}
+	})
+
+	t.Run("rule match", func(t *testing.T) {
+		payload := userText("hello")
+		payload["tools"] = []any{map[string]any{"type": "function", "function": map[string]any{"name": "lookup"}}}
+		resp := explain(t, payload)
+		step := resp.Trace.Steps[0]
+		if len(step.KeywordHits) != 0 || !slices.Equal(step.RuleHits, []string{"rx-tools"}) || resp.Model != "rx-tools" {
+			t.Fatalf("unexpected step %+v", step)
+		}
+		if !resp.Features.HasTools {
+			t.Fatalf("expect has_tools feature, got %+v", resp.Features)
+		}
+	})
+
+	t.Run("capability filtered item", func(t *testing.T) {
+		resp := explain(t, userText([]any{
+			map[string]any{"type": "text", "text": "what is in this picture"},
+			map[string]any{"type": "image_url", "image_url": map[string]any{"url": "https://example.com/a.png"}},
+		}))
+		if it := itemStatus(resp.Trace, "rx-novision"); it.Status != combo.TraceCapability || it.Reason != "vision not supported" {
+			t.Fatalf("expect rx-novision filtered by capability, got %+v", it)
+		}
+		step := resp.Trace.Steps[0]
+		if slices.Contains(step.Candidates, "rx-novision") || resp.Model != "rx-fast" {
+			t.Fatalf("unexpected step %+v model=%s", step, resp.Model)
+		}
+		// 不支持图片的模型权重最高，只有在不带图片时才会被选中
+		if resp := explain(t, userText("plain text")); resp.Model != "rx-novision" {
+			t.Fatalf("expect rx-novision without images, got %s", resp.Model)
+		}
+	})
+}
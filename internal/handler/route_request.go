@@ -0,0 +1,257 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+
+	"awesomeProject/internal/combo"
+)
+
+// ctxRequestImages 本次请求最新一条 user 消息中的图片数（int），计费时用于按张计费规则。
+// 历史消息中的图片已在之前的轮次计费，不再重复计算。
+const ctxRequestImages = "request_images"
+
+// buildRouteRequest 从三种协议（Anthropic Messages / OpenAI Chat / OpenAI Responses）的 payload 中
+// 提取 combo 路由规则需要的请求特征。inputText 为各入口已提取的最后一条 user 消息。
+func buildRouteRequest(c *gin.Context, payload map[string]any, inputText string) *combo.Request {
+	req := &combo.Request{
+		InputText:    inputText,
+		SystemText:   extractSystemText(payload),
+		HasTools:     hasNonEmptyValue(payload["tools"]) || hasNonEmptyValue(payload["functions"]),
+		HasThinking:  hasThinkingConfig(payload),
+		HasImages:    containsContentType(payload, "image", "image_url", "input_image"),
+		ImageCount:   countContentType(lastUserMessage(payload), "image", "image_url", "input_image"),
+		HasPDF:       containsContentType(payload, "document", "file", "input_file"),
+		PromptTokens: estimatePromptTokens(payload),
+		MaxTokens:    requestedMaxTokens(payload),
+	}
+	if c != nil {
+		c.Set(ctxRequestImages, req.ImageCount)
+		if c.Request != nil {
+			req.Header = c.Request.Header
+		}
+	}
+	return req
+}
+
+// extractSystemText 合并 Anthropic system、Responses instructions 以及 role=system/developer 消息中的文本。
+func extractSystemText(payload map[string]any) string {
+	if payload == nil {
+		return ""
+	}
+	parts := make([]string, 0, 2)
+	if s := contentText(payload["system"]); s != "" {
+		parts = append(parts, s)
+	}
+	if s, _ := payload["instructions"].(string); strings.TrimSpace(s) != "" {
+		parts = append(parts, strings.TrimSpace(s))
+	}
+	for _, key := range []string{"messages", "input"} {
+		items, ok := payload[key].([]any)
+		if !ok {
+			continue
+		}
+		for _, item := range items {
+			m, ok := item.(map[string]any)
+			if !ok {
+				continue
+			}
+			role, _ := m["role"].(string)
+			role = strings.ToLower(strings.TrimSpace(role))
+			if role != "system" && role != "developer" {
+				continue
+			}
+			if s := contentText(m["content"]); s != "" {
+				parts = append(parts, s)
+			}
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// contentText 提取字符串或内容块数组中的文本。
+func contentText(v any) string {
+	switch content := v.(type) {
+	case string:
+		return strings.TrimSpace(content)
+	case []any:
+		var sb strings.Builder
+		for _, blk := range content {
+			bm, ok := blk.(map[string]any)
+			if !ok {
+				continue
+			}
+			if txt, ok := bm["text"].(string); ok && strings.TrimSpace(txt) != "" {
+				if sb.Len() > 0 {
+					sb.WriteString("\n")
+				}
+				sb.WriteString(strings.TrimSpace(txt))
+			}
+		}
+		return sb.String()
+	}
+	return ""
+}
+
+func hasNonEmptyValue(v any) bool {
+	switch x := v.(type) {
+	case nil:
+		return false
+	case []any:
+		return len(x) > 0
+	case map[string]any:
+		return len(x) > 0
+	case string:
+		return strings.TrimSpace(x) != ""
+	}
+	return true
+}
+
+// hasThinkingConfig Anthropic thinking（非 disabled）或 OpenAI reasoning / reasoning_effort。
+func hasThinkingConfig(payload map[string]any) bool {
+	if payload == nil {
+		return false
+	}
+	if t, ok := payload["thinking"].(map[string]any); ok {
+		typ, _ := t["type"].(string)
+		return !strings.EqualFold(strings.TrimSpace(typ), "disabled")
+	}
+	return hasNonEmptyValue(payload["reasoning"]) || hasNonEmptyValue(payload["reasoning_effort"])
+}
+
+// containsContentType 递归查找 type 为给定值之一的内容块（跳过工具定义）。
+func containsContentType(v any, types ...string) bool {
+	switch x := v.(type) {
+	case map[string]any:
+		if t, _ := x["type"].(string); t != "" {
+			for _, want := range types {
+				if t == want {
+					return true
+				}
+			}
+		}
+		for k, child := range x {
+			if k == "tools" || k == "functions" {
+				continue
+			}
+			if containsContentType(child, types...) {
+				return true
+			}
+		}
+	case []any:
+		for _, child := range x {
+			if containsContentType(child, types...) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// lastUserMessage 返回最后一条 user 消息（Anthropic / Chat 的 messages，Responses 的 input），没有时返回 nil。
+func lastUserMessage(payload map[string]any) any {
+	for _, key := range []string{"messages", "input"} {
+		items, ok := payload[key].([]any)
+		if !ok {
+			continue
+		}
+		for i := len(items) - 1; i >= 0; i-- {
+			m, ok := items[i].(map[string]any)
+			if !ok {
+				continue
+			}
+			role, _ := m["role"].(string)
+			if strings.EqualFold(strings.TrimSpace(role), "user") {
+				return m
+			}
+		}
+	}
+	return nil
+}
+
+// countContentType 递归统计 type 为给定值之一的内容块数（跳过工具定义，匹配的块内部不再统计）。
+func countContentType(v any, types ...string) int {
+	n := 0
+	switch x := v.(type) {
+	case map[string]any:
+		if t, _ := x["type"].(string); t != "" {
+			for _, want := range types {
+				if t == want {
+					return 1
+				}
+			}
+		}
+		for k, child := range x {
+			if k == "tools" || k == "functions" {
+				continue
+			}
+			n += countContentType(child, types...)
+		}
+	case []any:
+		for _, child := range x {
+			n += countContentType(child, types...)
+		}
+	}
+	return n
+}
+
+// requestedMaxTokens 读取 max_tokens / max_completion_tokens / max_output_tokens，未指定时返回 0。
+func requestedMaxTokens(payload map[string]any) int {
+	for _, key := range []string{"max_tokens", "max_completion_tokens", "max_output_tokens"} {
+		if v, ok := payload[key].(float64); ok && v > 0 {
+			return int(v)
+		}
+	}
+	return 0
+}
+
+// estimatePromptTokens 粗略估算 prompt token 数：ASCII 约 4 字符 1 token，其它字符（如中文）约 1 字符 1 token。
+// 跳过图片/文件的 base64 数据与 URL。
+func estimatePromptTokens(payload map[string]any) int {
+	ascii, other := 0, 0
+	var walk func(key string, v any)
+	walk = func(key string, v any) {
+		switch x := v.(type) {
+		case string:
+			switch key {
+			case "data", "url", "image_url", "file_data", "model", "type", "role":
+				return
+			}
+			for _, r := range x {
+				if r < utf8.RuneSelf {
+					ascii++
+				} else {
+					other++
+				}
+			}
+		case map[string]any:
+			for k, child := range x {
+				walk(k, child)
+			}
+		case []any:
+			for _, child := range x {
+				walk(key, child)
+			}
+		}
+	}
+	walk("", payload)
+	return ascii/4 + other
+}
+
+// openaiResolveError 以 OpenAI 格式返回 combo 解析失败；所有子模型都因上下文过长被跳过时带上 context_length_exceeded。
+func openaiResolveError(c *gin.Context, err error) {
+	var capErr *combo.CapabilityError
+	if errors.As(err, &capErr) && capErr.ContextExceeded() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": gin.H{
+			"type":    "invalid_request_error",
+			"code":    "context_length_exceeded",
+			"message": err.Error(),
+		}})
+		return
+	}
+	openaiError(c, http.StatusBadRequest, "invalid_request_error", err.Error())
+}
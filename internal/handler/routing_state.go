@@ -0,0 +1,110 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"awesomeProject/internal/combo"
+	"awesomeProject/internal/model"
+	"awesomeProject/internal/modelstate"
+)
+
+type disableModelRequest struct {
+	ModelID  string `json:"model_id"`
+	Duration string `json:"duration"` // 如 "10m"，为空时使用 model_disable.disable_ttl
+}
+
+type pinConversationRequest struct {
+	ModelID string `json:"model_id"`
+	ComboID string `json:"combo_id"` // 可选：对话所属的 combo，须包含 model_id
+}
+
+// listDisabledModels 列出当前临时禁用（含熔断）的模型及禁用截止时间。
+func listDisabledModels(c *gin.Context) {
+	items, err := modelstate.ListTemporarilyDisabledModels()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"models": items})
+}
+
+// disableModel 手动临时禁用一个模型。
+func disableModel(c *gin.Context) {
+	var req disableModelRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
+		return
+	}
+	req.ModelID = strings.TrimSpace(req.ModelID)
+	if _, err := model.GetModel(req.ModelID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "model not found: " + req.ModelID})
+		return
+	}
+	ttl := modelstate.DisableTTL
+	if v := strings.TrimSpace(req.Duration); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid duration"})
+			return
+		}
+		ttl = d
+	}
+	modelstate.DisableModelTemporarily(req.ModelID, ttl)
+	c.JSON(http.StatusOK, gin.H{"model_id": req.ModelID, "disabled_until": time.Now().Add(ttl)})
+}
+
+// enableModel 解除模型的临时禁用并关闭其熔断器。
+func enableModel(c *gin.Context) {
+	id := strings.TrimSpace(c.Param("id"))
+	modelstate.EnableModel(id)
+	c.Status(http.StatusNoContent)
+}
+
+// listConversationPins 列出未过期的对话级模型缓存。
+func listConversationPins(c *gin.Context) {
+	pins, err := modelstate.ListConversationModels()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"conversations": pins})
+}
+
+// pinConversation 把对话固定到指定模型（重新设置 last_seen）。
+func pinConversation(c *gin.Context) {
+	id := strings.TrimSpace(c.Param("id"))
+	var req pinConversationRequest
+	if err := c.ShouldBindJSON(&req); err != nil || id == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
+		return
+	}
+	req.ModelID = strings.TrimSpace(req.ModelID)
+	req.ComboID = strings.TrimSpace(req.ComboID)
+	if _, err := model.GetModel(req.ModelID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "model not found: " + req.ModelID})
+		return
+	}
+	if req.ComboID != "" {
+		cb, err := model.GetCombo(req.ComboID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "combo not found: " + req.ComboID})
+			return
+		}
+		if !combo.ContainsModel(cb, req.ModelID) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "combo " + req.ComboID + " does not contain model " + req.ModelID})
+			return
+		}
+	}
+	modelstate.SetConversationModelWithCombo(id, req.ModelID, req.ComboID)
+	c.JSON(http.StatusOK, gin.H{"conversation_id": id, "model_id": req.ModelID, "combo_id": req.ComboID})
+}
+
+// dropConversationPin 删除对话级模型缓存，下一次请求重新路由。
+func dropConversationPin(c *gin.Context) {
+	modelstate.ClearConversationModel(c.Param("id"))
+	c.Status(http.StatusNoContent)
+}
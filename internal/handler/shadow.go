@@ -0,0 +1,134 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"awesomeProject/internal/errclass"
+	"awesomeProject/internal/middleware"
+	"awesomeProject/internal/model"
+	"awesomeProject/pkg/utils"
+)
+
+const (
+	shadowTimeout       = 2 * time.Minute
+	maxShadowInFlight   = 32
+	maxShadowStreamBody = 4 << 20
+)
+
+var (
+	// shadowSlots 限制同时进行的影子请求数，满了直接丢弃本次镜像，避免拖垮上游或本进程。
+	shadowSlots = make(chan struct{}, maxShadowInFlight)
+	// shadowSample 返回 [0,1) 的抽样值，测试中可替换
+	shadowSample = rand.Float64
+)
+
+type shadowCallKey struct{}
+
+// withShadowCall 标记 ctx 上的调用为影子请求：executeWithKeyPool 据此跳过 key 用量、暂停与限流记录。
+func withShadowCall(ctx context.Context) context.Context {
+	return context.WithValue(ctx, shadowCallKey{}, true)
+}
+
+func isShadowCall(ctx context.Context) bool {
+	v, _ := ctx.Value(shadowCallKey{}).(bool)
+	return v
+}
+
+// shadowPreparer 为影子模型准备一次非流式上游调用（复用各入口的 prepareUpstreamCall）。
+type shadowPreparer func(m *model.Model, payload map[string]any) (*upstreamCall, error)
+
+// maybeMirrorShadow 按 combo 的 ShadowPercent 抽样，把请求异步镜像到 Combo.ShadowModelID。
+// 影子调用使用独立的 context（不受客户端断开影响），响应直接丢弃；不占用在途计数与模型/key 的 QPS、不计费、
+// 不触发临时禁用与 key 暂停、不记录限流信息，只把延迟、用量与状态写入 UsageLog/ErrorLog（shadow=true）。
+func maybeMirrorShadow(c *gin.Context, comboID, primaryModelID string, payload map[string]any, prepare shadowPreparer) {
+	comboID = strings.TrimSpace(comboID)
+	if !model.IsComboID(comboID) {
+		return
+	}
+	cb, err := model.GetCombo(comboID)
+	if err != nil || cb == nil || cb.ShadowPercent <= 0 {
+		return
+	}
+	shadowID := strings.TrimSpace(cb.ShadowModelID)
+	if shadowID == "" || shadowID == primaryModelID {
+		return
+	}
+	if shadowSample()*100 >= cb.ShadowPercent {
+		return
+	}
+	m, err := model.GetModel(shadowID)
+	if err != nil || m == nil || !m.Enabled {
+		return
+	}
+
+	// 影子请求与主请求并发执行，使用 payload 的深拷贝
+	shadowPayload, err := clonePayload(payload)
+	if err != nil {
+		return
+	}
+	call, err := prepare(m, shadowPayload)
+	if err != nil {
+		utils.Logger.Debugf("[ClaudeRouter] shadow: combo=%s model=%s prepare err=%v", comboID, m.ID, err)
+		return
+	}
+
+	select {
+	case shadowSlots <- struct{}{}:
+	default:
+		utils.Logger.Debugf("[ClaudeRouter] shadow: combo=%s model=%s dropped, too many in flight", comboID, m.ID)
+		return
+	}
+	username := ""
+	if u := middleware.CurrentUser(c); u != nil {
+		username = u.Username
+	}
+	go runShadow(*cb, m, call, username)
+}
+
+func runShadow(cb model.Combo, m *model.Model, call *upstreamCall, username string) {
+	defer func() { <-shadowSlots }()
+	defer func() {
+		if r := recover(); r != nil {
+			utils.Logger.Errorf("[ClaudeRouter] shadow: combo=%s model=%s panic=%v", cb.ID, m.ID, r)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(withShadowCall(context.Background()), shadowTimeout)
+	defer cancel()
+
+	start := time.Now()
+	statusCode, _, body, streamBody, err := call.execute(ctx)
+	if streamBody != nil {
+		data, _ := io.ReadAll(io.LimitReader(streamBody, maxShadowStreamBody))
+		_ = streamBody.Close()
+		if len(body) == 0 {
+			body = data
+		}
+	}
+	latencyMs := time.Since(start).Milliseconds()
+
+	if err != nil || statusCode < 200 || statusCode >= 300 {
+		msg := fmt.Sprintf("shadow upstream error status=%d latency_ms=%d", statusCode, latencyMs)
+		if err != nil {
+			msg = fmt.Sprintf("shadow: %v (latency_ms=%d)", err, latencyMs)
+		}
+		_ = model.RecordShadowErrorLog(m.ID, username, statusCode, string(errclass.Classify(statusCode, err, body)), msg)
+		utils.Logger.Debugf("[ClaudeRouter] shadow: combo=%s model=%s status=%d latency_ms=%d err=%v", cb.ID, m.ID, statusCode, latencyMs, err)
+		return
+	}
+
+	usage := extractUsageFromJSON(body)
+	recordedBody := ""
+	if cb.ShadowRecordBody {
+		recordedBody = string(body)
+	}
+	_ = model.RecordShadowUsageLog(username, cb, m.ID, usage, latencyMs, recordedBody)
+	utils.Logger.Debugf("[ClaudeRouter] shadow: combo=%s model=%s status=%d latency_ms=%d input=%d output=%d", cb.ID, m.ID, statusCode, latencyMs, usage.InputTokens, usage.OutputTokens)
+}
@@ -0,0 +1,174 @@
+package handler
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"awesomeProject/internal/errclass"
+	"awesomeProject/internal/keypool"
+	"awesomeProject/internal/model"
+	"awesomeProject/internal/modelstate"
+	"awesomeProject/internal/storage"
+	"awesomeProject/internal/translator/messages"
+)
+
+// stubShadowPreparer 返回固定状态码与响应体的上游调用，并统计 prepare 与 execute 的次数。
+type stubShadowPreparer struct {
+	status   int
+	body     string
+	prepared atomic.Int32
+	executed atomic.Int32
+}
+
+func (s *stubShadowPreparer) prepare(m *model.Model, _ map[string]any) (*upstreamCall, error) {
+	s.prepared.Add(1)
+	return &upstreamCall{
+		interfaceType: "anthropic",
+		execute: func(ctx context.Context) (int, string, []byte, io.ReadCloser, error) {
+			s.executed.Add(1)
+			return s.status, "application/json", []byte(s.body), nil, nil
+		},
+	}, nil
+}
+
+func waitShadowLogs(t *testing.T, dst any, want int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var n int64
+		storage.DB.Model(dst).Where("shadow = ?", true).Count(&n)
+		if int(n) >= want {
+			if err := storage.DB.Where("shadow = ?", true).Find(dst).Error; err != nil {
+				t.Fatalf("load shadow logs: %v", err)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expect %d shadow log rows, got %d", want, n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestMaybeMirrorShadow(t *testing.T) {
+	setupHandlerTestDB(t,
+		[]*model.Model{{ID: "sh-p", Name: "sh-p", Enabled: true}, {ID: "sh-s", Name: "sh-s", Enabled: true, MaxQPS: 0.001}},
+		&model.Combo{ID: "combo:sh", Name: "sh", Enabled: true, ShadowModelID: "sh-s", ShadowPercent: 50, ShadowRecordBody: true,
+			Items: []model.ComboItem{{ModelID: "sh-p", Weight: 1}}},
+	)
+	prevSample := shadowSample
+	t.Cleanup(func() { shadowSample = prevSample })
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	payload := map[string]any{"model": "combo:sh"}
+
+	t.Run("sampling follows shadow percent", func(t *testing.T) {
+		stub := &stubShadowPreparer{status: http.StatusOK}
+		shadowSample = func() float64 { return 0.5 }
+		maybeMirrorShadow(c, "combo:sh", "sh-p", payload, stub.prepare)
+		if n := stub.prepared.Load(); n != 0 {
+			t.Fatalf("sample at 50%% must be skipped, prepared=%d", n)
+		}
+	})
+
+	t.Run("skip when shadow model is the primary", func(t *testing.T) {
+		stub := &stubShadowPreparer{status: http.StatusOK}
+		shadowSample = func() float64 { return 0 }
+		maybeMirrorShadow(c, "combo:sh", "sh-s", payload, stub.prepare)
+		maybeMirrorShadow(c, "sh-p", "sh-p", payload, stub.prepare)
+		if n := stub.prepared.Load(); n != 0 {
+			t.Fatalf("expect no shadow, prepared=%d", n)
+		}
+	})
+
+	t.Run("drop when all slots are in use", func(t *testing.T) {
+		stub := &stubShadowPreparer{status: http.StatusOK}
+		shadowSample = func() float64 { return 0 }
+		for i := 0; i < cap(shadowSlots); i++ {
+			shadowSlots <- struct{}{}
+		}
+		maybeMirrorShadow(c, "combo:sh", "sh-p", payload, stub.prepare)
+		for i := 0; i < cap(shadowSlots); i++ {
+			<-shadowSlots
+		}
+		time.Sleep(20 * time.Millisecond)
+		if stub.executed.Load() != 0 {
+			t.Fatal("expect shadow dropped without executing")
+		}
+	})
+
+	t.Run("success writes shadow usage log", func(t *testing.T) {
+		stub := &stubShadowPreparer{status: http.StatusOK, body: `{"usage":{"input_tokens":12,"output_tokens":34,"completion_tokens_details":{"reasoning_tokens":5}}}`}
+		shadowSample = func() float64 { return 0.49 }
+		maybeMirrorShadow(c, "combo:sh", "sh-p", payload, stub.prepare)
+		var logs []model.UsageLog
+		waitShadowLogs(t, &logs, 1)
+		l := logs[0]
+		if l.ModelID != "combo:sh" || l.RealModelID != "sh-s" || l.InputTokens != 12 || l.OutputTokens != 34 || l.ReasoningTokens != 5 ||
+			l.TotalCost != 0 || l.ResponseBody != stub.body {
+			t.Fatalf("unexpected shadow usage log %+v", l)
+		}
+	})
+
+	t.Run("failure writes shadow error log", func(t *testing.T) {
+		stub := &stubShadowPreparer{status: http.StatusServiceUnavailable, body: `{"error":{"type":"overloaded_error"}}`}
+		shadowSample = func() float64 { return 0 }
+		maybeMirrorShadow(c, "combo:sh", "sh-p", payload, stub.prepare)
+		var logs []model.ErrorLog
+		waitShadowLogs(t, &logs, 1)
+		l := logs[0]
+		if l.ModelID != "sh-s" || l.StatusCode != http.StatusServiceUnavailable || l.ErrorClass != string(errclass.Upstream) {
+			t.Fatalf("unexpected shadow error log %+v", l)
+		}
+		var primaryErrors int64
+		storage.DB.Model(&model.ErrorLog{}).Where("shadow = ?", false).Count(&primaryErrors)
+		if primaryErrors != 0 {
+			t.Fatalf("shadow failure must not be logged as a primary error, got %d", primaryErrors)
+		}
+	})
+
+	t.Run("no key bench, rate limit record or qps use", func(t *testing.T) {
+		pool := &upstreamKeyPool{id: "shadow-test", keys: []keypool.Key{{Key: "sk-1"}, {Key: "sk-2"}}}
+		var executed atomic.Int32
+		prepare := func(m *model.Model, _ map[string]any) (*upstreamCall, error) {
+			return &upstreamCall{interfaceType: "anthropic", execute: func(ctx context.Context) (int, string, []byte, io.ReadCloser, error) {
+				return executeWithKeyPool(ctx, m.ID, pool, messages.ExecuteOptions{}, func(ctx context.Context, opts messages.ExecuteOptions) (int, string, []byte, io.ReadCloser, error) {
+					executed.Add(1)
+					if opts.OnResponseHeader != nil {
+						opts.OnResponseHeader(http.StatusTooManyRequests, http.Header{"Retry-After": []string{"30"}})
+					}
+					return http.StatusTooManyRequests, "application/json", []byte(`{"error":{"type":"rate_limit_error"}}`), nil, nil
+				})
+			}}, nil
+		}
+		shadowSample = func() float64 { return 0 }
+		maybeMirrorShadow(c, "combo:sh", "sh-p", payload, prepare)
+		var logs []model.ErrorLog
+		waitShadowLogs(t, &logs, 2)
+		if executed.Load() != 1 {
+			t.Fatalf("expect a single upstream call without key rotation, got %d", executed.Load())
+		}
+		for _, p := range keypool.Statuses() {
+			for _, k := range p.Keys {
+				if p.PoolID == pool.id && (k.Benches != 0 || k.Requests != 0) {
+					t.Fatalf("shadow call must not touch key state, got %+v", k)
+				}
+			}
+		}
+		for _, info := range modelstate.RateLimitSnapshots() {
+			if info.ModelID == "sh-s" {
+				t.Fatalf("shadow call must not record rate limits, got %+v", info)
+			}
+		}
+		if !modelstate.HasQPSHeadroom("sh-s", 0.001) {
+			t.Fatal("shadow call must not spend the model's qps tokens")
+		}
+	})
+}
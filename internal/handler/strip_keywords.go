@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"strings"
+
+	"awesomeProject/internal/combo"
+	"awesomeProject/internal/model"
+)
+
+// stripComboKeywords combo 开启 StripKeywords 时，从最后一条 user 消息中删除命中的 "!keyword"，返回是否有修改。
+// 支持 Anthropic / OpenAI Chat 的 messages（字符串或 text 内容块）以及 Responses 的 input（字符串或 input_text 内容块），
+// 其它消息与字段保持不变。须在路由选定模型之后调用，以免影响关键词路由。
+func stripComboKeywords(comboID string, payload map[string]any) bool {
+	if payload == nil || !model.IsComboID(comboID) {
+		return false
+	}
+	cb, err := model.GetCombo(comboID)
+	if err != nil || cb == nil || !cb.StripKeywords {
+		return false
+	}
+	keywords := combo.Keywords(cb)
+	if len(keywords) == 0 {
+		return false
+	}
+
+	if s, ok := payload["input"].(string); ok {
+		stripped := combo.StripBangKeywords(s, keywords)
+		payload["input"] = stripped
+		return stripped != s
+	}
+	for _, key := range []string{"messages", "input"} {
+		items, ok := payload[key].([]any)
+		if !ok {
+			continue
+		}
+		for i := len(items) - 1; i >= 0; i-- {
+			msg, ok := items[i].(map[string]any)
+			if !ok {
+				continue
+			}
+			if role, _ := msg["role"].(string); !strings.EqualFold(strings.TrimSpace(role), "user") {
+				continue
+			}
+			return stripContentKeywords(msg, keywords)
+		}
+	}
+	return false
+}
+
+func stripContentKeywords(msg map[string]any, keywords []string) bool {
+	switch content := msg["content"].(type) {
+	case string:
+		stripped := combo.StripBangKeywords(content, keywords)
+		msg["content"] = stripped
+		return stripped != content
+	case []any:
+		changed := false
+		for _, blk := range content {
+			bm, ok := blk.(map[string]any)
+			if !ok {
+				continue
+			}
+			switch bm["type"] {
+			case "text", "input_text":
+			default:
+				continue
+			}
+			if txt, ok := bm["text"].(string); ok {
+				if stripped := combo.StripBangKeywords(txt, keywords); stripped != txt {
+					bm["text"] = stripped
+					changed = true
+				}
+			}
+		}
+		return changed
+	}
+	return false
+}
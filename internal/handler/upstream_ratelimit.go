@@ -0,0 +1,46 @@
+package handler
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"awesomeProject/internal/modelstate"
+	"awesomeProject/internal/translator/messages"
+)
+
+// rateLimitObserver 收集一次上游调用响应头中的限流信息（SDK 内部重试时以最后一次响应为准）。
+type rateLimitObserver struct {
+	modelID string
+	key     string // key 池中 key 的展示名
+	info    modelstate.RateLimitInfo
+	seen    bool
+}
+
+// attach 返回设置了 OnResponseHeader 的 opts 副本。
+func (o *rateLimitObserver) attach(opts messages.ExecuteOptions) messages.ExecuteOptions {
+	opts.OnResponseHeader = func(statusCode int, header http.Header) {
+		o.info, o.seen = modelstate.ParseRateLimitHeaders(statusCode, header, time.Now())
+	}
+	return opts
+}
+
+// record 把收集到的限流信息写入 modelstate，返回被限流时的恢复时间（没有时为零值）。
+func (o *rateLimitObserver) record() time.Time {
+	if !o.seen {
+		return time.Time{}
+	}
+	o.info.ModelID = o.modelID
+	o.info.Key = o.key
+	modelstate.RecordRateLimit(o.info)
+	if o.info.StatusCode != http.StatusTooManyRequests {
+		return time.Time{}
+	}
+	return o.info.LimitedUntil(time.Now())
+}
+
+// listRateLimits 返回各模型/key 最近一次上游响应中的限流额度与重置时间。
+func listRateLimits(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"rate_limits": modelstate.RateLimitSnapshots()})
+}
@@ -0,0 +1,148 @@
+package handler
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"awesomeProject/internal/model"
+	"awesomeProject/internal/storage"
+)
+
+func TestExtractUsageCacheTokens(t *testing.T) {
+	// Anthropic：缓存 token 不包含在 input_tokens 中
+	got := extractUsageFromJSON([]byte(`{"usage":{"input_tokens":100,"output_tokens":20,"cache_creation_input_tokens":300,"cache_read_input_tokens":4000}}`))
+	want := model.TokenUsage{InputTokens: 100, OutputTokens: 20, CacheWriteTokens: 300, CacheReadTokens: 4000}
+	if got != want {
+		t.Fatalf("anthropic: got %+v want %+v", got, want)
+	}
+
+	// OpenAI：cached_tokens 包含在 prompt_tokens 中
+	got = extractUsageFromJSON([]byte(`{"usage":{"prompt_tokens":1000,"completion_tokens":50,"prompt_tokens_details":{"cached_tokens":800}}}`))
+	want = model.TokenUsage{InputTokens: 200, OutputTokens: 50, CacheReadTokens: 800}
+	if got != want {
+		t.Fatalf("openai: got %+v want %+v", got, want)
+	}
+
+	// Anthropic 流：message_start 与 message_delta 中的 usage 为累计值，不能相加
+	sse := "event: message_start\n" +
+		`data: {"type":"message_start","message":{"usage":{"input_tokens":10,"output_tokens":1,"cache_read_input_tokens":500}}}` + "\n\n" +
+		"event: message_delta\n" +
+		`data: {"type":"message_delta","usage":{"output_tokens":42}}` + "\n\n"
+	usage, ok := extractUsageFromSSEBody([]byte(sse))
+	want = model.TokenUsage{InputTokens: 10, OutputTokens: 42, CacheReadTokens: 500}
+	if !ok || usage != want {
+		t.Fatalf("stream: got %+v want %+v", usage, want)
+	}
+
+	// 缓存单价未配置时按输入单价
+	pricing := model.ModelPricing(&model.Model{InputPrice: 3, OutputPrice: 15, CacheReadPrice: 0.3})
+	if cost := pricing.Quote(model.TokenUsage{InputTokens: 1000000, CacheWriteTokens: 1000000, CacheReadTokens: 1000000}).Cost; cost < 6.29 || cost > 6.31 {
+		t.Fatalf("expect cost 6.3, got %v", cost)
+	}
+
+	// OpenAI 推理 token 包含在 completion_tokens 中
+	got = extractUsageFromJSON([]byte(`{"usage":{"prompt_tokens":10,"completion_tokens":500,"completion_tokens_details":{"reasoning_tokens":400}}}`))
+	want = model.TokenUsage{InputTokens: 10, OutputTokens: 500, ReasoningTokens: 400}
+	if got != want {
+		t.Fatalf("reasoning: got %+v want %+v", got, want)
+	}
+}
+
+func TestPricingRuleQuote(t *testing.T) {
+	pricing := model.ModelPricing(&model.Model{
+		InputPrice:  3,
+		OutputPrice: 15,
+		PricingRule: &model.PricingRule{
+			Tiers:          []model.PriceTier{{Name: "long_context", AbovePromptTokens: 200000, InputPrice: 6, OutputPrice: 22.5}},
+			ReasoningPrice: 30,
+			MinCharge:      0.01,
+			ImagePrice:     0.002,
+		},
+	})
+	near := func(a, b float64) bool { return a-b < 1e-9 && b-a < 1e-9 }
+
+	// 不超过阈值：基础单价，费用低于最低费用时按最低费用
+	charge := pricing.Quote(model.TokenUsage{InputTokens: 1000, OutputTokens: 100})
+	if !near(charge.Cost, 0.01) || charge.Rule != "min_charge" {
+		t.Fatalf("min charge: got %+v", charge)
+	}
+
+	// 超过 200k（含缓存 token）：整个请求按阶梯单价，推理 token 按推理单价，图片按张计费
+	charge = pricing.Quote(model.TokenUsage{InputTokens: 150000, CacheReadTokens: 60000, OutputTokens: 1000, ReasoningTokens: 400, Images: 2})
+	want := (150000*6.0+60000*3.0+600*22.5+400*30.0)/1000000 + 2*0.002
+	if !near(charge.Cost, want) || charge.Rule != "tier:long_context,reasoning,images:2" || charge.Prices.Input != 6 {
+		t.Fatalf("tier: got %+v want cost %v", charge, want)
+	}
+
+	// 没有任何用量（如失败请求）时不收取最低费用
+	if charge := pricing.Quote(model.TokenUsage{}); charge.Cost != 0 || charge.Rule != "" {
+		t.Fatalf("zero usage: got %+v", charge)
+	}
+
+	if err := (&model.PricingRule{Tiers: []model.PriceTier{{AbovePromptTokens: 0}}}).Validate(); err == nil {
+		t.Fatal("expect invalid tier threshold")
+	}
+}
+
+func TestImagesBilledOnlyForNewestUserMessage(t *testing.T) {
+	image := map[string]any{"type": "image_url", "image_url": map[string]any{"url": "https://example.com/a.png"}}
+	history := []any{
+		map[string]any{"role": "user", "content": []any{map[string]any{"type": "text", "text": "look"}, image, image}},
+		map[string]any{"role": "assistant", "content": "two cats"},
+	}
+
+	// 历史消息中的图片已在之前的轮次计费，追问时不再计费，但路由仍需要支持图片的模型
+	followUp := map[string]any{"messages": append(append([]any(nil), history...), map[string]any{"role": "user", "content": "which is bigger?"})}
+	req := buildRouteRequest(nil, followUp, "which is bigger?")
+	if req.ImageCount != 0 || !req.HasImages {
+		t.Fatalf("follow-up: image_count=%d has_images=%v", req.ImageCount, req.HasImages)
+	}
+
+	newImage := map[string]any{"messages": append(append([]any(nil), history...), map[string]any{"role": "user", "content": []any{image}})}
+	if req := buildRouteRequest(nil, newImage, ""); req.ImageCount != 1 {
+		t.Fatalf("new turn: expect 1 image, got %d", req.ImageCount)
+	}
+
+	responses := map[string]any{"input": []any{
+		map[string]any{"role": "user", "content": []any{map[string]any{"type": "input_image", "image_url": "data:..."}}},
+		map[string]any{"role": "assistant", "content": "ok"},
+		map[string]any{"role": "user", "content": []any{map[string]any{"type": "input_text", "text": "again"}}},
+	}}
+	if req := buildRouteRequest(nil, responses, "again"); req.ImageCount != 0 {
+		t.Fatalf("responses follow-up: expect 0 images, got %d", req.ImageCount)
+	}
+}
+
+func TestRecordUsageMinChargeSkipsZeroUsage(t *testing.T) {
+	setupHandlerTestDB(t, []*model.Model{{ID: "mc-model", Name: "mc-model", Enabled: true, InputPrice: 1, OutputPrice: 1,
+		PricingRule: &model.PricingRule{MinCharge: 0.5}}})
+	u := &model.User{Username: "mc-user", APIKey: "mc-key", Quota: 10}
+	if err := model.CreateUser(u); err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Set("current_user", u)
+
+	// 失败请求没有用量：不扣最低费用，也不写用量日志
+	recordUsageWithModel(c, model.TokenUsage{}, "mc-model", "")
+	got, _ := model.GetUser("mc-user")
+	var logs int64
+	storage.DB.Model(&model.UsageLog{}).Count(&logs)
+	if got.Quota != 10 || logs != 0 {
+		t.Fatalf("zero usage: quota=%v logs=%d", got.Quota, logs)
+	}
+
+	// 有用量但费用低于最低费用：按最低费用扣费并记录生效的规则
+	recordUsageWithModel(c, model.TokenUsage{InputTokens: 10, OutputTokens: 10}, "mc-model", "")
+	got, _ = model.GetUser("mc-user")
+	var log model.UsageLog
+	if err := storage.DB.First(&log).Error; err != nil {
+		t.Fatalf("load usage log: %v", err)
+	}
+	if got.Quota < 9.49 || got.Quota > 9.51 || log.PricingRule != "min_charge" || log.TotalCost != 0.5 {
+		t.Fatalf("min charge: quota=%v log=%+v", got.Quota, log)
+	}
+}
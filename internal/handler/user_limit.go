@@ -0,0 +1,239 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"awesomeProject/internal/combo"
+	appconfig "awesomeProject/internal/config"
+	"awesomeProject/internal/model"
+)
+
+const userLimitWindow = time.Minute
+
+// userLimitStates 按用户名的限流状态（进程内）：最近一分钟的请求时间、token 用量与进行中的请求数。
+var (
+	userLimitsMu    sync.Mutex
+	userLimitStates = make(map[string]*userLimitState)
+)
+
+type tokenSample struct {
+	at     time.Time
+	tokens int64
+}
+
+type userLimitState struct {
+	requests []time.Time
+	tokens   []*tokenSample // 窗口内的 token 用量（进行中请求为准入时的估算值，计费后校正为实际值）
+	inflight int
+	lastUsed time.Time
+}
+
+func (s *userLimitState) prune(now time.Time) {
+	cutoff := now.Add(-userLimitWindow)
+	i := 0
+	for i < len(s.requests) && !s.requests[i].After(cutoff) {
+		i++
+	}
+	s.requests = s.requests[i:]
+	j := 0
+	for j < len(s.tokens) && !s.tokens[j].at.After(cutoff) {
+		j++
+	}
+	s.tokens = s.tokens[j:]
+}
+
+// effectiveUserLimit 用户自己的限流覆盖分组默认值：0 使用分组（空分组为 default）的值，<0 表示不限制。
+func effectiveUserLimit(cfg *appconfig.Config, u *model.User) appconfig.UserLimit {
+	var limit appconfig.UserLimit
+	if cfg != nil {
+		group := strings.TrimSpace(u.Group)
+		if group == "" {
+			group = "default"
+		}
+		if g, ok := cfg.UserLimits.Groups[group]; ok {
+			limit = g
+		} else if g, ok := cfg.UserLimits.Groups["default"]; ok {
+			limit = g
+		}
+	}
+	if u.RPMLimit != 0 {
+		limit.RPM = max(u.RPMLimit, 0)
+	}
+	if u.TPMLimit != 0 {
+		limit.TPM = max(u.TPMLimit, 0)
+	}
+	if u.ConcurrencyLimit != 0 {
+		limit.Concurrency = max(u.ConcurrencyLimit, 0)
+	}
+	return limit
+}
+
+// userLimitLease 通过限流检查的一次请求：占用一个并发名额，配置了 TPM 时还按估算值预占 token 额度。
+type userLimitLease struct {
+	state    *userLimitState
+	sample   *tokenSample // TPM 预占，未配置 TPM 时为 nil
+	settled  bool
+	released bool
+}
+
+// acquireUserLimit 检查用户的并发 / RPM / TPM 限制，通过时占用一个请求名额并预占 estTokens 的 TPM 额度；
+// 超限时返回建议的重试等待时长与原因。窗口内没有 token 用量时总是放行，避免单个大请求永远等不到额度。
+func acquireUserLimit(username string, limit appconfig.UserLimit, now time.Time, estTokens int64) (lease *userLimitLease, retryAfter time.Duration, reason string) {
+	userLimitsMu.Lock()
+	defer userLimitsMu.Unlock()
+	s := userLimitStateLocked(username, now)
+	s.prune(now)
+
+	if limit.Concurrency > 0 && s.inflight >= limit.Concurrency {
+		return nil, time.Second, fmt.Sprintf("concurrency limit %d reached", limit.Concurrency)
+	}
+	if limit.RPM > 0 && len(s.requests) >= limit.RPM {
+		// 最早的请求离开窗口后即可再发
+		wait := s.requests[len(s.requests)-limit.RPM].Add(userLimitWindow).Sub(now)
+		return nil, wait, fmt.Sprintf("rate limit %d requests per minute reached", limit.RPM)
+	}
+	estTokens = max(estTokens, 0)
+	if limit.TPM > 0 {
+		var used int64
+		for _, t := range s.tokens {
+			used += t.tokens
+		}
+		if used > 0 && used+estTokens > limit.TPM {
+			// 等到足够多的 token 离开窗口，使用量加上本次估算不超过上限
+			var wait time.Duration
+			for _, t := range s.tokens {
+				used -= t.tokens
+				if used == 0 || used+estTokens <= limit.TPM {
+					wait = t.at.Add(userLimitWindow).Sub(now)
+					break
+				}
+			}
+			return nil, wait, fmt.Sprintf("rate limit %d tokens per minute reached", limit.TPM)
+		}
+	}
+
+	s.requests = append(s.requests, now)
+	s.inflight++
+	lease = &userLimitLease{state: s}
+	if limit.TPM > 0 {
+		lease.sample = &tokenSample{at: now, tokens: estTokens}
+		s.tokens = append(s.tokens, lease.sample)
+	}
+	return lease, 0, ""
+}
+
+func userLimitStateLocked(username string, now time.Time) *userLimitState {
+	s := userLimitStates[username]
+	if s == nil {
+		s = &userLimitState{}
+		userLimitStates[username] = s
+	}
+	s.lastUsed = now
+	return s
+}
+
+// settle 用实际 token 用量校正预占的估算值；请求已结束、预占已撤销时按新的用量计入。
+func (l *userLimitLease) settle(tokens int64) {
+	userLimitsMu.Lock()
+	defer userLimitsMu.Unlock()
+	l.settled = true
+	switch {
+	case l.sample != nil:
+		l.sample.tokens = max(tokens, 0)
+	case tokens > 0:
+		l.state.tokens = append(l.state.tokens, &tokenSample{at: time.Now(), tokens: tokens})
+	}
+}
+
+// release 请求结束时归还并发名额；没有计费（上游失败、客户端取消）的请求撤销 TPM 预占。重复调用只生效一次。
+func (l *userLimitLease) release() {
+	userLimitsMu.Lock()
+	defer userLimitsMu.Unlock()
+	if l.released {
+		return
+	}
+	l.released = true
+	l.state.inflight--
+	if !l.settled && l.sample != nil {
+		for i, t := range l.state.tokens {
+			if t == l.sample {
+				l.state.tokens = append(l.state.tokens[:i], l.state.tokens[i+1:]...)
+				break
+			}
+		}
+		l.sample = nil
+	}
+}
+
+// recordUserTokens 把一次请求的 token 用量计入用户的 TPM 窗口。
+func recordUserTokens(username string, tokens int64) {
+	if tokens <= 0 {
+		return
+	}
+	now := time.Now()
+	userLimitsMu.Lock()
+	defer userLimitsMu.Unlock()
+	s := userLimitStateLocked(username, now)
+	s.tokens = append(s.tokens, &tokenSample{at: now, tokens: tokens})
+}
+
+// ctxUserLimitLease 本次请求的用户限流名额（*userLimitLease），计费时据此校正 TPM 预占。
+const ctxUserLimitLease = "user_limit_lease"
+
+// settleUserTokens 计费时把实际 token 用量计入用户的 TPM 窗口：准入时有预占则校正预占，否则直接计入。
+func settleUserTokens(c *gin.Context, username string, tokens int64) {
+	if c != nil {
+		if v, ok := c.Get(ctxUserLimitLease); ok {
+			if l, _ := v.(*userLimitLease); l != nil {
+				l.settle(tokens)
+				return
+			}
+		}
+	}
+	recordUserTokens(username, tokens)
+}
+
+// checkUserLimits 对非管理员用户执行限流，TPM 按本次请求的估算 token（prompt + max_tokens）预占；
+// 超限时按入口协议返回 429 与 Retry-After，返回 false。通过时调用方须在请求结束后调用 release。
+func checkUserLimits(c *gin.Context, cfg *appconfig.Config, u *model.User, req *combo.Request, rl rateLimitResponder) (release func(), ok bool) {
+	if u == nil || u.IsAdmin || strings.TrimSpace(u.Username) == "" {
+		return func() {}, true
+	}
+	limit := effectiveUserLimit(cfg, u)
+	if limit.RPM <= 0 && limit.TPM <= 0 && limit.Concurrency <= 0 {
+		return func() {}, true
+	}
+	var estTokens int64
+	if req != nil {
+		estTokens = req.EstimatedTokens()
+	}
+	lease, retryAfter, reason := acquireUserLimit(u.Username, limit, time.Now(), estTokens)
+	if lease != nil {
+		c.Set(ctxUserLimitLease, lease)
+		return lease.release, true
+	}
+	rl.reject(c, retryAfter, fmt.Sprintf("user %s: %s", u.Username, reason))
+	return nil, false
+}
+
+// 定期清理超过 10 分钟未使用且没有进行中请求的用户限流状态。
+func init() {
+	go func() {
+		for {
+			time.Sleep(10 * time.Minute)
+			userLimitsMu.Lock()
+			now := time.Now()
+			for name, s := range userLimitStates {
+				if s.inflight == 0 && now.Sub(s.lastUsed) > 10*time.Minute {
+					delete(userLimitStates, name)
+				}
+			}
+			userLimitsMu.Unlock()
+		}
+	}()
+}
@@ -0,0 +1,84 @@
+package handler
+
+import (
+	"testing"
+	"time"
+
+	appconfig "awesomeProject/internal/config"
+	"awesomeProject/internal/model"
+)
+
+func TestEffectiveUserLimit(t *testing.T) {
+	cfg := &appconfig.Config{}
+	cfg.UserLimits.Groups = map[string]appconfig.UserLimit{
+		"default": {RPM: 10, TPM: 1000, Concurrency: 2},
+		"heavy":   {RPM: 100},
+	}
+	got := effectiveUserLimit(cfg, &model.User{Username: "a"})
+	if got != (appconfig.UserLimit{RPM: 10, TPM: 1000, Concurrency: 2}) {
+		t.Fatalf("default group: %+v", got)
+	}
+	got = effectiveUserLimit(cfg, &model.User{Username: "b", Group: "heavy", TPMLimit: 5000, ConcurrencyLimit: -1})
+	if got != (appconfig.UserLimit{RPM: 100, TPM: 5000}) {
+		t.Fatalf("heavy group with overrides: %+v", got)
+	}
+}
+
+func TestAcquireUserLimit(t *testing.T) {
+	now := time.Now()
+	limit := appconfig.UserLimit{RPM: 2, Concurrency: 1}
+	lease, _, _ := acquireUserLimit("limit-test", limit, now, 0)
+	if lease == nil {
+		t.Fatal("first request should pass")
+	}
+	if l, wait, _ := acquireUserLimit("limit-test", limit, now, 0); l != nil || wait <= 0 {
+		t.Fatal("second concurrent request should be rejected")
+	}
+	lease.release()
+	lease.release() // 重复调用不应多减
+	l2, _, _ := acquireUserLimit("limit-test", limit, now.Add(time.Second), 0)
+	if l2 == nil {
+		t.Fatal("request after release should pass")
+	}
+	l2.release()
+	_, wait, _ := acquireUserLimit("limit-test", limit, now.Add(2*time.Second), 0)
+	if wait != 58*time.Second {
+		t.Fatalf("rpm: expect retry after 58s, got %s", wait)
+	}
+
+	recordUserTokens("tpm-test", 600)
+	recordUserTokens("tpm-test", 600)
+	if l, wait, _ := acquireUserLimit("tpm-test", appconfig.UserLimit{TPM: 1000}, time.Now(), 0); l != nil || wait <= 0 {
+		t.Fatal("tpm limit should reject")
+	}
+}
+
+func TestUserTPMReservation(t *testing.T) {
+	limit := appconfig.UserLimit{TPM: 1000}
+	now := time.Now()
+
+	// 并发的请求在准入时就按估算值占用 TPM，而不是等响应结束后才计入
+	first, _, _ := acquireUserLimit("tpm-reserve", limit, now, 600)
+	if first == nil {
+		t.Fatal("first request should pass with an empty window")
+	}
+	if l, wait, _ := acquireUserLimit("tpm-reserve", limit, now, 600); l != nil || wait <= 0 {
+		t.Fatal("parallel request should be rejected by the reserved estimate")
+	}
+
+	// 计费后按实际用量校正
+	first.settle(100)
+	first.release()
+	second, _, _ := acquireUserLimit("tpm-reserve", limit, now, 600)
+	if second == nil {
+		t.Fatal("expect headroom after settling to actual usage")
+	}
+
+	// 没有计费就结束的请求撤销预占
+	second.release()
+	third, _, _ := acquireUserLimit("tpm-reserve", limit, now, 900)
+	if third == nil {
+		t.Fatal("expect unsettled reservation to be dropped on release")
+	}
+	third.release()
+}
@@ -0,0 +1,412 @@
+// Package keypool 管理模型/运营商的上游 API Key 池：按策略轮换 key，单个 key 遇到 401/403/429 时
+// 只暂停该 key（bench），不影响模型本身；每个 key 有独立的权重、QPS 限制与用量计数（进程内）。
+package keypool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// 轮换策略
+const (
+	StrategyRoundRobin = "round_robin" // 按权重平滑轮询（默认）
+	StrategyLeastUsed  = "least_used"  // 选择 请求数/权重 最小的 key
+)
+
+// ErrNoAvailableKey 池中所有 key 都被暂停或停用。
+var ErrNoAvailableKey = errors.New("no available api key in pool")
+
+// Key 池中的一个上游 API Key。
+type Key struct {
+	Key      string  `json:"key" yaml:"key"`
+	Name     string  `json:"name,omitempty" yaml:"name"`       // 展示名，为空时展示打码后的 key
+	Weight   float64 `json:"weight,omitempty" yaml:"weight"`   // 轮换权重，<=0 按 1
+	MaxQPS   float64 `json:"max_qps,omitempty" yaml:"max_qps"` // 该 key 的 QPS 上限，0 表示不限制
+	Disabled bool    `json:"disabled,omitempty" yaml:"disabled"`
+}
+
+func (k Key) weight() float64 {
+	if k.Weight <= 0 {
+		return 1
+	}
+	return k.Weight
+}
+
+// Label 用于日志与管理接口的 key 标识：Name，或打码后的 key。
+func (k Key) Label() string {
+	if n := strings.TrimSpace(k.Name); n != "" {
+		return n
+	}
+	return Mask(k.Key)
+}
+
+// Mask 只保留 key 的前 4 位与后 4 位。
+func Mask(key string) string {
+	key = strings.TrimSpace(key)
+	if len(key) <= 10 {
+		return "****"
+	}
+	return key[:4] + "…" + key[len(key)-4:]
+}
+
+var (
+	benchMu        sync.RWMutex
+	authBench      = 30 * time.Minute
+	rateLimitBench = time.Minute
+	poolsMu        sync.Mutex
+	pools          = make(map[string]*pool) // pool id（如 model:xxx、operator:xxx）-> 池
+)
+
+// Configure 从外部配置设置 key 被暂停的时长：authBench 用于 401/403（默认 30m），rateLimitBench 用于 429（默认 1m）；
+// 空字符串保持默认值。
+func Configure(authBenchRaw, rateLimitBenchRaw string) error {
+	auth, err := parseBench("auth_bench", authBenchRaw, 30*time.Minute)
+	if err != nil {
+		return err
+	}
+	rl, err := parseBench("rate_limit_bench", rateLimitBenchRaw, time.Minute)
+	if err != nil {
+		return err
+	}
+	benchMu.Lock()
+	authBench, rateLimitBench = auth, rl
+	benchMu.Unlock()
+	return nil
+}
+
+func parseBench(name, raw string, def time.Duration) (time.Duration, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid key_pool.%s %q", name, raw)
+	}
+	return d, nil
+}
+
+func benchDuration(statusCode int) time.Duration {
+	benchMu.RLock()
+	defer benchMu.RUnlock()
+	switch statusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return authBench
+	case http.StatusTooManyRequests:
+		return rateLimitBench
+	}
+	return 0
+}
+
+type pool struct {
+	mu    sync.Mutex
+	keys  map[string]*keyState // key -> 状态
+	order []string             // 当前配置中 key 的顺序
+}
+
+type keyState struct {
+	spec         Key
+	limiter      *rate.Limiter
+	current      float64 // 平滑加权轮询的当前权重
+	benchedUntil time.Time
+	benchReason  string
+	requests     int64
+	successes    int64
+	failures     int64
+	benches      int64
+	lastUsed     time.Time
+	lastStatus   int
+}
+
+// sync 用最新配置更新池中的 key：新增 key 初始化状态，已移除的 key 丢弃，保留仍在的 key 的计数与暂停状态。
+func (p *pool) sync(keys []Key) {
+	seen := make(map[string]struct{}, len(keys))
+	p.order = p.order[:0]
+	for _, k := range keys {
+		k.Key = strings.TrimSpace(k.Key)
+		if k.Key == "" {
+			continue
+		}
+		if _, dup := seen[k.Key]; dup {
+			continue
+		}
+		seen[k.Key] = struct{}{}
+		p.order = append(p.order, k.Key)
+		st := p.keys[k.Key]
+		if st == nil {
+			st = &keyState{}
+			p.keys[k.Key] = st
+		}
+		if st.limiter == nil || st.spec.MaxQPS != k.MaxQPS {
+			st.limiter = nil
+			if k.MaxQPS > 0 {
+				st.limiter = rate.NewLimiter(rate.Limit(k.MaxQPS), 1)
+			}
+		}
+		st.spec = k
+	}
+	for key := range p.keys {
+		if _, ok := seen[key]; !ok {
+			delete(p.keys, key)
+		}
+	}
+}
+
+func getPool(poolID string, keys []Key) *pool {
+	poolsMu.Lock()
+	p := pools[poolID]
+	if p == nil {
+		p = &pool{keys: make(map[string]*keyState)}
+		pools[poolID] = p
+	}
+	poolsMu.Unlock()
+	p.mu.Lock()
+	p.sync(keys)
+	p.mu.Unlock()
+	return p
+}
+
+// Lease 一次请求占用的 key，请求结束后必须调用 Done。
+type Lease struct {
+	p      *pool
+	poolID string
+	key    string
+	label  string
+}
+
+// Key 返回本次使用的上游 API Key。
+func (l *Lease) Key() string { return l.key }
+
+// Label 返回本次使用的 key 的展示名。
+func (l *Lease) Label() string { return l.label }
+
+// Acquire 按策略从池中选择一个 key。优先选择未达到 QPS 上限的 key；都达到上限时按策略选一个并等待其令牌。
+// 池中没有可用 key（全部暂停或停用）时返回 ErrNoAvailableKey。
+func Acquire(ctx context.Context, poolID, strategy string, keys []Key) (*Lease, error) {
+	p := getPool(poolID, keys)
+	now := time.Now()
+
+	p.mu.Lock()
+	var candidates []*keyState
+	for _, key := range p.order {
+		st := p.keys[key]
+		if st.spec.Disabled || now.Before(st.benchedUntil) {
+			continue
+		}
+		candidates = append(candidates, st)
+	}
+	if len(candidates) == 0 {
+		p.mu.Unlock()
+		return nil, ErrNoAvailableKey
+	}
+	var ready []*keyState
+	for _, st := range candidates {
+		if st.limiter == nil || st.limiter.Tokens() >= 1 {
+			ready = append(ready, st)
+		}
+	}
+	if len(ready) == 0 {
+		ready = candidates
+	}
+	st := pick(ready, strategy)
+	st.requests++
+	st.lastUsed = now
+	lim := st.limiter
+	lease := &Lease{p: p, poolID: poolID, key: st.spec.Key, label: st.spec.Label()}
+	p.mu.Unlock()
+
+	if lim != nil {
+		if err := lim.Wait(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return lease, nil
+}
+
+// Peek 返回池中一个当前可用的 key（优先选择还有 QPS 令牌的），不计入用量、不消耗令牌也不影响轮换顺序，
+// 用于不应影响 key 状态的请求（如影子请求）。没有可用 key 时返回 ErrNoAvailableKey。
+func Peek(poolID string, keys []Key) (key, label string, err error) {
+	p := getPool(poolID, keys)
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var fallback *keyState
+	for _, k := range p.order {
+		st := p.keys[k]
+		if st.spec.Disabled || now.Before(st.benchedUntil) {
+			continue
+		}
+		if st.limiter == nil || st.limiter.Tokens() >= 1 {
+			return st.spec.Key, st.spec.Label(), nil
+		}
+		if fallback == nil {
+			fallback = st
+		}
+	}
+	if fallback == nil {
+		return "", "", ErrNoAvailableKey
+	}
+	return fallback.spec.Key, fallback.spec.Label(), nil
+}
+
+func pick(candidates []*keyState, strategy string) *keyState {
+	if strings.EqualFold(strings.TrimSpace(strategy), StrategyLeastUsed) {
+		best := candidates[0]
+		for _, st := range candidates[1:] {
+			a, b := float64(st.requests)/st.spec.weight(), float64(best.requests)/best.spec.weight()
+			if a < b || (a == b && st.lastUsed.Before(best.lastUsed)) {
+				best = st
+			}
+		}
+		return best
+	}
+	// 平滑加权轮询（同 nginx）：每次所有候选加上自身权重，选当前权重最大的，再减去总权重
+	var best *keyState
+	total := 0.0
+	for _, st := range candidates {
+		w := st.spec.weight()
+		st.current += w
+		total += w
+		if best == nil || st.current > best.current {
+			best = st
+		}
+	}
+	best.current -= total
+	return best
+}
+
+// Done 记录请求结果；401/403/429 时暂停该 key，返回是否暂停（调用方可以换下一个 key 重试）。
+func (l *Lease) Done(statusCode int, err error) bool {
+	return l.DoneUntil(statusCode, err, time.Time{})
+}
+
+// DoneUntil 同 Done；429 且 retryAt 晚于当前时间（上游限流头给出的恢复时间）时暂停到 retryAt，而不是固定时长。
+func (l *Lease) DoneUntil(statusCode int, err error, retryAt time.Time) bool {
+	now := time.Now()
+	l.p.mu.Lock()
+	defer l.p.mu.Unlock()
+	st := l.p.keys[l.key]
+	if st == nil {
+		// 请求期间 key 已从配置中移除
+		return false
+	}
+	st.lastStatus = statusCode
+	if err == nil && statusCode >= 200 && statusCode < 300 {
+		st.successes++
+		return false
+	}
+	st.failures++
+	d := benchDuration(statusCode)
+	if d <= 0 {
+		return false
+	}
+	st.benches++
+	st.benchedUntil = now.Add(d)
+	if statusCode == http.StatusTooManyRequests && retryAt.After(now) {
+		st.benchedUntil = retryAt
+	}
+	st.benchReason = http.StatusText(statusCode)
+	st.current = 0
+	return true
+}
+
+// KeyStatus 单个 key 的状态与用量，供管理接口展示（key 已打码）。
+type KeyStatus struct {
+	Label        string    `json:"label"`
+	Weight       float64   `json:"weight"`
+	MaxQPS       float64   `json:"max_qps,omitempty"`
+	Disabled     bool      `json:"disabled,omitempty"`
+	BenchedUntil time.Time `json:"benched_until,omitempty"`
+	BenchReason  string    `json:"bench_reason,omitempty"`
+	Requests     int64     `json:"requests"`
+	Successes    int64     `json:"successes"`
+	Failures     int64     `json:"failures"`
+	Benches      int64     `json:"benches"`
+	LastUsed     time.Time `json:"last_used,omitempty"`
+	LastStatus   int       `json:"last_status,omitempty"`
+}
+
+// PoolStatus 一个 key 池的状态。
+type PoolStatus struct {
+	PoolID string      `json:"pool_id"`
+	Keys   []KeyStatus `json:"keys"`
+}
+
+// Statuses 返回所有已使用过的 key 池的状态，按 pool id 排序。
+func Statuses() []PoolStatus {
+	now := time.Now()
+	poolsMu.Lock()
+	ids := make([]string, 0, len(pools))
+	for id := range pools {
+		ids = append(ids, id)
+	}
+	snapshot := make(map[string]*pool, len(pools))
+	for id, p := range pools {
+		snapshot[id] = p
+	}
+	poolsMu.Unlock()
+	sort.Strings(ids)
+
+	out := make([]PoolStatus, 0, len(ids))
+	for _, id := range ids {
+		p := snapshot[id]
+		p.mu.Lock()
+		ps := PoolStatus{PoolID: id, Keys: make([]KeyStatus, 0, len(p.order))}
+		for _, key := range p.order {
+			st := p.keys[key]
+			ks := KeyStatus{
+				Label:      st.spec.Label(),
+				Weight:     st.spec.weight(),
+				MaxQPS:     st.spec.MaxQPS,
+				Disabled:   st.spec.Disabled,
+				Requests:   st.requests,
+				Successes:  st.successes,
+				Failures:   st.failures,
+				Benches:    st.benches,
+				LastUsed:   st.lastUsed,
+				LastStatus: st.lastStatus,
+			}
+			if now.Before(st.benchedUntil) {
+				ks.BenchedUntil = st.benchedUntil
+				ks.BenchReason = st.benchReason
+			}
+			ps.Keys = append(ps.Keys, ks)
+		}
+		p.mu.Unlock()
+		out = append(out, ps)
+	}
+	return out
+}
+
+// Unbench 解除池中 key 的暂停；label 为空时解除整个池，返回解除的 key 数。
+func Unbench(poolID, label string) int {
+	poolsMu.Lock()
+	p := pools[poolID]
+	poolsMu.Unlock()
+	if p == nil {
+		return 0
+	}
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for _, st := range p.keys {
+		if label != "" && st.spec.Label() != label {
+			continue
+		}
+		if now.Before(st.benchedUntil) {
+			n++
+		}
+		st.benchedUntil = time.Time{}
+		st.benchReason = ""
+	}
+	return n
+}
@@ -0,0 +1,68 @@
+package keypool
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestRoundRobinWeightsAndBench(t *testing.T) {
+	keys := []Key{{Key: "key-a", Weight: 2}, {Key: "key-b"}}
+	pool := "test:rr"
+	counts := map[string]int{}
+	for i := 0; i < 6; i++ {
+		l, err := Acquire(context.Background(), pool, StrategyRoundRobin, keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[l.Key()]++
+		l.Done(http.StatusOK, nil)
+	}
+	if counts["key-a"] != 4 || counts["key-b"] != 2 {
+		t.Fatalf("unexpected distribution %v", counts)
+	}
+
+	// 429 只暂停该 key，之后全部落到另一个 key
+	l, _ := Acquire(context.Background(), pool, StrategyRoundRobin, keys)
+	if !l.Done(http.StatusTooManyRequests, nil) {
+		t.Fatal("429 should bench the key")
+	}
+	benched := l.Key()
+	for i := 0; i < 3; i++ {
+		l, err := Acquire(context.Background(), pool, StrategyRoundRobin, keys)
+		if err != nil || l.Key() == benched {
+			t.Fatalf("benched key %s still selected (err=%v)", benched, err)
+		}
+		// 其他失败不暂停 key
+		if l.Done(http.StatusInternalServerError, nil) {
+			t.Fatal("500 should not bench the key")
+		}
+	}
+
+	l, _ = Acquire(context.Background(), pool, StrategyRoundRobin, keys)
+	l.Done(http.StatusUnauthorized, nil)
+	if _, err := Acquire(context.Background(), pool, StrategyRoundRobin, keys); err != ErrNoAvailableKey {
+		t.Fatalf("expect ErrNoAvailableKey, got %v", err)
+	}
+	if n := Unbench(pool, ""); n != 2 {
+		t.Fatalf("expect 2 keys unbenched, got %d", n)
+	}
+	if _, err := Acquire(context.Background(), pool, StrategyRoundRobin, keys); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLeastUsed(t *testing.T) {
+	keys := []Key{{Key: "key-a"}, {Key: "key-b", Weight: 3}}
+	counts := map[string]int{}
+	for i := 0; i < 8; i++ {
+		l, err := Acquire(context.Background(), "test:lu", StrategyLeastUsed, keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[l.Key()]++
+	}
+	if counts["key-a"] != 2 || counts["key-b"] != 6 {
+		t.Fatalf("unexpected distribution %v", counts)
+	}
+}
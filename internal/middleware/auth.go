@@ -73,7 +73,8 @@ func APIKeyAuth(apiKey string) gin.HandlerFunc {
 				return
 			}
 
-			if user.Quota <= 0.01 && user.Quota >= 0 {
+			// 可用额度需扣除进行中请求的预占
+			if user.Quota >= 0 && user.Quota-user.QuotaHeld <= 0.01 {
 				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
 					"code":    http.StatusForbidden,
 					"success": false,
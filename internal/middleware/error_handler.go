@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"awesomeProject/internal/errclass"
 	"awesomeProject/internal/model"
 	"awesomeProject/internal/modelstate"
 	"awesomeProject/pkg/utils"
@@ -10,6 +11,10 @@ import (
 	"strings"
 )
 
+// ErrorClassKey 处理器对上游失败分类后写入上下文的 key（值为 errclass.Class），
+// 表示该失败已由处理器计入模型禁用与错误日志。
+const ErrorClassKey = "error_class"
+
 // responseWriter 包装 gin.ResponseWriter 来捕获状态码
 type responseWriter struct {
 	gin.ResponseWriter
@@ -21,7 +26,9 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
-// ErrorHandler 中间件：捕获错误状态码并禁用模型
+// ErrorHandler 中间件：捕获错误状态码，按失败分类决定是否禁用模型。
+// 处理器已分类的上游失败（见 ErrorClassKey）不再重复计数；其余错误响应由本地产生
+// （权限不足、缺少参数、响应转换失败等），只记录日志，不禁用模型。
 func ErrorHandler() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// 包装 ResponseWriter
@@ -34,31 +41,40 @@ func ErrorHandler() gin.HandlerFunc {
 		// 检查响应状态码
 		statusCode := rw.statusCode
 
-		shouldDisable := statusCode >= 400
-
-		if shouldDisable {
-			// 从请求中提取模型 ID
-			modelID := extractModelIDFromRequest(c)
-			if modelID != "" {
-				// 禁用模型 15 分钟
-				modelstate.DisableModelTemporarily(modelID, modelstate.DisableTTL)
-				utils.Logger.Printf("[ClaudeRouter] error_handler: model_disabled model=%s status=%d", modelID, statusCode)
-			}
+		if statusCode >= 400 {
 			conversionID := extractConversationIDFromRequest(c)
 			if conversionID != "" {
 				modelstate.ClearConversationModel(conversionID)
 
 			}
+			if _, handled := c.Get(ErrorClassKey); handled {
+				return
+			}
+			// 从请求中提取模型 ID
+			modelID := extractModelIDFromRequest(c)
+			class := localErrorClass(statusCode)
+			if modelID != "" && class.DisablesModel() {
+				modelstate.RecordModelFailure(modelID)
+				utils.Logger.Printf("[ClaudeRouter] error_handler: model_disabled model=%s status=%d class=%s", modelID, statusCode, class)
+			}
 			var username string
 			if u := CurrentUser(c); u != nil {
 				username = u.Username
 			}
-			_ = model.RecordErrorLog(modelID, username, statusCode, fmt.Sprintf("UpStream Error:%v", rw.statusCode))
+			_ = model.RecordErrorLogWithClass(modelID, username, statusCode, 0, string(class), fmt.Sprintf("UpStream Error:%v", rw.statusCode))
 
 		}
 	}
 }
 
+// localErrorClass 未经处理器分类的错误响应：4xx 为客户端错误，5xx 为本地转换/处理失败，都不归咎于上游模型。
+func localErrorClass(statusCode int) errclass.Class {
+	if statusCode >= http.StatusInternalServerError {
+		return errclass.Protocol
+	}
+	return errclass.Client
+}
+
 // extractModelIDFromRequest 从请求中提取模型 ID
 func extractModelIDFromRequest(c *gin.Context) string {
 	// 从 Gin 上下文中获取（如果在处理器中设置过）
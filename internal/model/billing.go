@@ -0,0 +1,260 @@
+package model
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// TokenUsage 一次请求各类 token 的数量。InputTokens 为按普通输入单价计费的部分，不含缓存写入与缓存读取。
+type TokenUsage struct {
+	InputTokens      int64
+	OutputTokens     int64
+	CacheWriteTokens int64 // Anthropic cache_creation_input_tokens
+	CacheReadTokens  int64 // Anthropic cache_read_input_tokens / OpenAI cached_tokens
+	ReasoningTokens  int64 // 推理 token，包含在 OutputTokens 中（OpenAI reasoning_tokens）
+	Images           int64 // 请求中的图片数，供按张计费的规则使用
+}
+
+// Total 所有类别的 token 合计。
+func (u TokenUsage) Total() int64 {
+	return u.InputTokens + u.OutputTokens + u.CacheWriteTokens + u.CacheReadTokens
+}
+
+// PromptTokens 输入侧 token 合计（含缓存写入与缓存读取）。
+func (u TokenUsage) PromptTokens() int64 {
+	return u.InputTokens + u.CacheWriteTokens + u.CacheReadTokens
+}
+
+// Add 返回两次用量之和。
+func (u TokenUsage) Add(o TokenUsage) TokenUsage {
+	return TokenUsage{
+		InputTokens:      u.InputTokens + o.InputTokens,
+		OutputTokens:     u.OutputTokens + o.OutputTokens,
+		CacheWriteTokens: u.CacheWriteTokens + o.CacheWriteTokens,
+		CacheReadTokens:  u.CacheReadTokens + o.CacheReadTokens,
+		ReasoningTokens:  u.ReasoningTokens + o.ReasoningTokens,
+		Images:           u.Images + o.Images,
+	}
+}
+
+// clamp 负数按 0 处理。
+func (u TokenUsage) clamp() TokenUsage {
+	return TokenUsage{
+		InputTokens:      max(u.InputTokens, 0),
+		OutputTokens:     max(u.OutputTokens, 0),
+		CacheWriteTokens: max(u.CacheWriteTokens, 0),
+		CacheReadTokens:  max(u.CacheReadTokens, 0),
+		ReasoningTokens:  min(max(u.ReasoningTokens, 0), max(u.OutputTokens, 0)),
+		Images:           max(u.Images, 0),
+	}
+}
+
+// TokenPrices 各类 token 的单价（元/百万 token）。
+type TokenPrices struct {
+	Input      float64
+	Output     float64
+	CacheWrite float64
+	CacheRead  float64
+	Reasoning  float64 // 0 表示按输出单价
+}
+
+// ModelPricing 模型的计费单价与规则；缓存单价为 0 时按输入单价。
+func ModelPricing(m *Model) Pricing {
+	if m == nil {
+		return Pricing{}
+	}
+	return Pricing{Prices: newTokenPrices(m.InputPrice, m.OutputPrice, m.CacheWritePrice, m.CacheReadPrice), Rule: m.PricingRule}
+}
+
+// ComboPricing combo 的计费单价与规则；缓存单价为 0 时按输入单价。
+func ComboPricing(cb *Combo) Pricing {
+	if cb == nil {
+		return Pricing{}
+	}
+	return Pricing{Prices: newTokenPrices(cb.InputPrice, cb.OutputPrice, cb.CacheWritePrice, cb.CacheReadPrice), Rule: cb.PricingRule}
+}
+
+func newTokenPrices(input, output, cacheWrite, cacheRead float64) TokenPrices {
+	if cacheWrite == 0 {
+		cacheWrite = input
+	}
+	if cacheRead == 0 {
+		cacheRead = input
+	}
+	return TokenPrices{Input: input, Output: output, CacheWrite: cacheWrite, CacheRead: cacheRead}.clamp()
+}
+
+func (p TokenPrices) clamp() TokenPrices {
+	return TokenPrices{
+		Input:      max(p.Input, 0),
+		Output:     max(p.Output, 0),
+		CacheWrite: max(p.CacheWrite, 0),
+		CacheRead:  max(p.CacheRead, 0),
+		Reasoning:  max(p.Reasoning, 0),
+	}
+}
+
+// Cost 按各类 token 的单价计算费用；推理 token 从输出中拆出按推理单价计算。
+func (p TokenPrices) Cost(u TokenUsage) float64 {
+	reasoning := p.Reasoning
+	if reasoning == 0 {
+		reasoning = p.Output
+	}
+	return (float64(u.InputTokens)*p.Input +
+		float64(u.OutputTokens-u.ReasoningTokens)*p.Output +
+		float64(u.ReasoningTokens)*reasoning +
+		float64(u.CacheWriteTokens)*p.CacheWrite +
+		float64(u.CacheReadTokens)*p.CacheRead) / 1000000
+}
+
+// PriceTier 阶梯单价：prompt（含缓存 token）超过 AbovePromptTokens 时整个请求按该阶梯计费，未设置（0）的单价沿用基础单价。
+type PriceTier struct {
+	Name              string  `json:"name,omitempty"`
+	AbovePromptTokens int64   `json:"above_prompt_tokens"`
+	InputPrice        float64 `json:"input_price,omitempty"`
+	OutputPrice       float64 `json:"output_price,omitempty"`
+	CacheWritePrice   float64 `json:"cache_write_price,omitempty"`
+	CacheReadPrice    float64 `json:"cache_read_price,omitempty"`
+}
+
+func (t PriceTier) label() string {
+	if t.Name != "" {
+		return t.Name
+	}
+	return fmt.Sprintf(">%d", t.AbovePromptTokens)
+}
+
+func (t PriceTier) apply(p TokenPrices) TokenPrices {
+	if t.InputPrice > 0 {
+		p.Input = t.InputPrice
+	}
+	if t.OutputPrice > 0 {
+		p.Output = t.OutputPrice
+	}
+	if t.CacheWritePrice > 0 {
+		p.CacheWrite = t.CacheWritePrice
+	}
+	if t.CacheReadPrice > 0 {
+		p.CacheRead = t.CacheReadPrice
+	}
+	return p
+}
+
+// PricingRule 在基础单价之上的计费规则（Model / Combo 的 pricing_rule，JSON 存入 TEXT 字段）。
+type PricingRule struct {
+	Tiers          []PriceTier `json:"tiers,omitempty"`           // 长上下文等阶梯单价，取阈值最高的生效阶梯
+	ReasoningPrice float64     `json:"reasoning_price,omitempty"` // 推理 token 单价（元/百万 token），0 表示按输出单价
+	MinCharge      float64     `json:"min_charge,omitempty"`      // 每次请求的最低费用（元），没有任何用量的请求（如失败请求）不收取
+	ImagePrice     float64     `json:"image_price,omitempty"`     // 每张输入图片的附加费用（元）
+}
+
+func (r PricingRule) Value() (driver.Value, error) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (r *PricingRule) Scan(value any) error {
+	*r = PricingRule{}
+	var data []byte
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return fmt.Errorf("unsupported Scan type: %T", value)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, r)
+}
+
+// Validate 检查单价非负、阶梯阈值为正且互不相同；r 为 nil 时返回 nil。
+func (r *PricingRule) Validate() error {
+	if r == nil {
+		return nil
+	}
+	if r.ReasoningPrice < 0 || r.MinCharge < 0 || r.ImagePrice < 0 {
+		return errors.New("prices must be >= 0")
+	}
+	seen := make(map[int64]struct{}, len(r.Tiers))
+	for _, t := range r.Tiers {
+		if t.AbovePromptTokens <= 0 {
+			return errors.New("tier above_prompt_tokens must be > 0")
+		}
+		if _, dup := seen[t.AbovePromptTokens]; dup {
+			return fmt.Errorf("duplicate tier above_prompt_tokens %d", t.AbovePromptTokens)
+		}
+		seen[t.AbovePromptTokens] = struct{}{}
+		if t.InputPrice < 0 || t.OutputPrice < 0 || t.CacheWritePrice < 0 || t.CacheReadPrice < 0 {
+			return fmt.Errorf("tier %s: prices must be >= 0", t.label())
+		}
+	}
+	return nil
+}
+
+// tierFor 返回 promptTokens 超过其阈值的阶梯中阈值最高的一个，没有时返回 nil。
+func (r *PricingRule) tierFor(promptTokens int64) *PriceTier {
+	tiers := make([]PriceTier, len(r.Tiers))
+	copy(tiers, r.Tiers)
+	sort.Slice(tiers, func(i, j int) bool { return tiers[i].AbovePromptTokens > tiers[j].AbovePromptTokens })
+	for i := range tiers {
+		if promptTokens > tiers[i].AbovePromptTokens {
+			return &tiers[i]
+		}
+	}
+	return nil
+}
+
+// Pricing 基础单价加可选的计费规则。
+type Pricing struct {
+	Prices TokenPrices
+	Rule   *PricingRule
+}
+
+// Charge 一次请求的计费结果。
+type Charge struct {
+	Cost   float64
+	Prices TokenPrices // 实际使用的单价（阶梯生效时为阶梯单价）
+	Rule   string      // 生效的规则，如 "tier:long_context,reasoning,images:2,min_charge"；只按基础单价计费时为空
+}
+
+// Quote 按规则计算费用：先选阶梯单价与推理单价计算 token 费用，再加图片费用，最后应用最低费用。
+// u 中没有任何 token 与图片时费用为 0，不应用最低费用。
+func (p Pricing) Quote(u TokenUsage) Charge {
+	u = u.clamp()
+	prices := p.Prices.clamp()
+	r := p.Rule
+	if r == nil {
+		return Charge{Cost: prices.Cost(u), Prices: prices}
+	}
+	var applied []string
+	if t := r.tierFor(u.PromptTokens()); t != nil {
+		prices = t.apply(prices)
+		applied = append(applied, "tier:"+t.label())
+	}
+	if r.ReasoningPrice > 0 && u.ReasoningTokens > 0 {
+		prices.Reasoning = r.ReasoningPrice
+		applied = append(applied, "reasoning")
+	}
+	cost := prices.Cost(u)
+	if r.ImagePrice > 0 && u.Images > 0 {
+		cost += float64(u.Images) * r.ImagePrice
+		applied = append(applied, fmt.Sprintf("images:%d", u.Images))
+	}
+	if r.MinCharge > 0 && cost < r.MinCharge && (u.Total() > 0 || u.Images > 0) {
+		cost = r.MinCharge
+		applied = append(applied, "min_charge")
+	}
+	return Charge{Cost: cost, Prices: prices, Rule: strings.Join(applied, ",")}
+}
@@ -4,6 +4,7 @@ import (
 	"database/sql/driver"
 	"encoding/json"
 	"fmt"
+	"time"
 )
 
 // StringSlice 用于将 []string 以 JSON 形式存入数据库 TEXT 字段。
@@ -46,6 +47,113 @@ func (s *StringSlice) Scan(value any) error {
 	return nil
 }
 
+// ComboRule 组合模型子模型的路由规则，命中时该子模型优先被选中（见 combo.ChooseModelIDForRequest）。
+//
+// Type 取值：
+//   - last_user_regex：Pattern 正则匹配最后一条 user 消息
+//   - system_regex：Pattern 正则匹配系统提示词
+//   - has_images / has_tools / has_thinking：请求包含图片 / 工具定义 / thinking 配置
+//   - tokens_above / tokens_below：估算的 prompt token 数大于 / 小于 Threshold
+//   - header：请求头 Header 存在，且 Pattern 非空时其值匹配 Pattern 正则
+type ComboRule struct {
+	Type      string `json:"type"`
+	Pattern   string `json:"pattern,omitempty"`
+	Header    string `json:"header,omitempty"`
+	Threshold int    `json:"threshold,omitempty"`
+	Priority  int    `json:"priority,omitempty"` // 越大越先评估
+}
+
+// RuleSlice 用于将 []ComboRule 以 JSON 形式存入数据库 TEXT 字段。
+type RuleSlice []ComboRule
+
+func (s RuleSlice) Value() (driver.Value, error) {
+	b, err := json.Marshal([]ComboRule(s))
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (s *RuleSlice) Scan(value any) error {
+	if value == nil {
+		*s = nil
+		return nil
+	}
+
+	var data []byte
+	switch v := value.(type) {
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return fmt.Errorf("unsupported Scan type: %T", value)
+	}
+
+	if len(data) == 0 {
+		*s = nil
+		return nil
+	}
+
+	var out []ComboRule
+	if err := json.Unmarshal(data, &out); err != nil {
+		return err
+	}
+	*s = out
+	return nil
+}
+
+// ScheduleWindow 生效时间窗口，ComboItem / Model 配置了窗口时只在任一窗口打开期间参与 combo 路由（见 combo.ScheduleOpen）。
+//   - Days：生效的星期（0=周日 … 6=周六），为空表示每天
+//   - Start / End："HH:MM"，End 不大于 Start 时表示跨零点（如 22:00-06:00，归属 Start 所在的那一天）；都为空表示全天
+//   - Timezone：IANA 时区名（如 Asia/Shanghai），为空使用服务器本地时区
+type ScheduleWindow struct {
+	Days     []int  `json:"days,omitempty"`
+	Start    string `json:"start,omitempty"`
+	End      string `json:"end,omitempty"`
+	Timezone string `json:"timezone,omitempty"`
+}
+
+// ScheduleSlice 用于将 []ScheduleWindow 以 JSON 形式存入数据库 TEXT 字段。
+type ScheduleSlice []ScheduleWindow
+
+func (s ScheduleSlice) Value() (driver.Value, error) {
+	b, err := json.Marshal([]ScheduleWindow(s))
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (s *ScheduleSlice) Scan(value any) error {
+	if value == nil {
+		*s = nil
+		return nil
+	}
+
+	var data []byte
+	switch v := value.(type) {
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return fmt.Errorf("unsupported Scan type: %T", value)
+	}
+
+	if len(data) == 0 {
+		*s = nil
+		return nil
+	}
+
+	var out []ScheduleWindow
+	if err := json.Unmarshal(data, &out); err != nil {
+		return err
+	}
+	*s = out
+	return nil
+}
+
 // ComboItem 表示组合模型中的一个子模型及其权重、关键词等。
 type ComboItem struct {
 	ID      uint   `json:"-" gorm:"primaryKey"`
@@ -54,7 +162,9 @@ type ComboItem struct {
 	ModelID         string      `json:"model_id"`
 	Weight          float64     `json:"weight"`
 	Keywords        StringSlice `json:"keywords,omitempty" gorm:"type:text"`
+	Rules           RuleSlice   `json:"rules,omitempty" gorm:"type:text"` // 路由规则，优先级低于关键词
 	AutoWeightUpdate *bool      `json:"auto_weight_update" gorm:"not null;default:true"` // 是否参与自动权重更新
+	Schedule         ScheduleSlice `json:"schedule,omitempty" gorm:"type:text"` // 生效时间窗口，为空表示始终生效
 }
 
 // Combo 表示一个组合模型（虚拟模型），对外表现为一个普通模型 ID。
@@ -66,7 +176,54 @@ type Combo struct {
 	Items       []ComboItem `json:"items" gorm:"foreignKey:ComboID;references:ID;constraint:OnDelete:CASCADE"`
 	Enabled     bool        `json:"enabled"`
 
+	// Strategy 子模型选择策略：weighted_random（默认）、smooth_weighted_rr、least_in_flight、lowest_latency、cheapest、priority
+	Strategy string `json:"strategy" gorm:"size:32;not null;default:''"`
+
+	// 故障转移：上游连接错误/5xx/429/overloaded 且尚未向客户端写出任何字节时，改用下一个子模型重试
+	MaxAttempts       int `json:"max_attempts" gorm:"not null;default:0"`        // 最多尝试的子模型数，0 表示默认（3），1 表示关闭故障转移
+	FailoverTimeoutMs int `json:"failover_timeout_ms" gorm:"not null;default:0"` // 整个请求的故障转移截止时间（毫秒），超过后不再发起新的尝试，0 表示默认（90s）
+
+	// 影子流量：按比例把真实请求异步镜像到 ShadowModelID，响应丢弃，仅记录延迟/用量/状态用于对比，不计入用户额度
+	ShadowModelID    string  `json:"shadow_model_id" gorm:"size:100;not null;default:''"`
+	ShadowPercent    float64 `json:"shadow_percent" gorm:"not null;default:0"`           // 镜像比例（0-100）
+	ShadowRecordBody bool    `json:"shadow_record_body" gorm:"not null;default:false"` // 是否保存影子模型的完整响应
+
+	// 对冲请求：所选子模型 HedgeAfterMs 毫秒内仍未返回首个 token 时，向下一个子模型发出同样的请求，
+	// 先响应者胜出，另一路通过 context 取消，只对胜出的一路计费。0 表示关闭
+	HedgeAfterMs int `json:"hedge_after_ms" gorm:"not null;default:0"`
+
+	// StripKeywords 转发前从最后一条 user 消息中删除命中的 "!keyword"，避免路由关键词污染对话
+	StripKeywords bool `json:"strip_keywords" gorm:"not null;default:false"`
+
 	// 输入/输出 token 单价（单位：元/百万 token）
 	InputPrice  float64 `json:"input_price" gorm:"not null;default:0"`
 	OutputPrice float64 `json:"output_price" gorm:"not null;default:0"`
+	// 提示缓存写入/读取的 token 单价，0 表示按输入单价计费
+	CacheWritePrice float64 `json:"cache_write_price" gorm:"not null;default:0"`
+	CacheReadPrice  float64 `json:"cache_read_price" gorm:"not null;default:0"`
+	// PricingRule 阶梯 / 推理 token / 最低费用 / 按张图片等计费规则，为空时只按上面的单价计费
+	PricingRule *PricingRule `json:"pricing_rule,omitempty" gorm:"type:text"`
+}
+
+// 权重变更来源（ComboWeightHistory.Source）。
+const (
+	WeightSourceAuto    = "auto"    // 权重自动调整任务
+	WeightSourceManual  = "manual"  // 管理员编辑 combo
+	WeightSourceRestore = "restore" // 从历史快照恢复
+)
+
+// ComboWeightHistory 记录一次 combo 子模型权重变更。同一次调整（任务的一轮、一次编辑或一次恢复）中的所有 item 共享 BatchID，
+// 一个 batch 即一个可恢复的快照。
+type ComboWeightHistory struct {
+	ID        int64     `json:"id" gorm:"primaryKey;autoIncrement"`
+	BatchID   string    `json:"batch_id" gorm:"index;size:64;not null"`
+	ComboID   string    `json:"combo_id" gorm:"index;size:100;not null"`
+	ModelID   string    `json:"model_id" gorm:"size:100;not null"`
+	OldWeight float64   `json:"old_weight" gorm:"not null;default:0"`
+	NewWeight float64   `json:"new_weight" gorm:"not null;default:0"`
+	Source    string    `json:"source" gorm:"size:20;not null;default:''"`
+	Reason    string    `json:"reason" gorm:"size:255;not null;default:''"`
+	Inputs    string    `json:"inputs,omitempty" gorm:"type:text"`           // 计算新权重时使用的数据（JSON），如错误数、延迟、目标分数
+	DryRun    bool      `json:"dry_run" gorm:"index;not null;default:false"` // 仅记录建议值，未实际写入
+	CreatedAt time.Time `json:"created_at" gorm:"index"`
 }
@@ -1,6 +1,13 @@
 package model
 
-import "time"
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"awesomeProject/internal/keypool"
+)
 
 // Model 表示一个可用的底层模型（OpenAI / Anthropic 等），可被直接调用或被组合模型引用。
 type Model struct {
@@ -20,6 +27,14 @@ type Model struct {
 
 	// 该模型最大 QPS，0 表示不限制
 	MaxQPS float64 `json:"max_qps"`
+	// 每分钟 token 数（输入+输出）与同时进行中的请求数上限，0 表示不限制；
+	// 请求发出前按 prompt + max_tokens 预占，完成后按实际用量校正
+	MaxTPM         int64 `json:"max_tpm" gorm:"not null;default:0"`
+	MaxConcurrency int   `json:"max_concurrency" gorm:"not null;default:0"`
+	// 等待 QPS / TPM / 并发额度的排队上限：最长等待与最多排队请求数，超出时立即返回 429（combo 请求先换其它子模型）；
+	// 0 使用 model_queue 配置，<0 表示不限制
+	QueueMaxWaitMs int `json:"queue_max_wait_ms" gorm:"not null;default:0"`
+	QueueMaxDepth  int `json:"queue_max_depth" gorm:"not null;default:0"`
 
 	// 若不为空，表示该模型归属该运营商，请求走运营商专属 API（BaseURL、APIKey 以运营商为准）
 	OperatorID string `json:"operator_id"`
@@ -30,6 +45,72 @@ type Model struct {
 	// 输入/输出 token 单价（单位：元/千 token）
 	InputPrice  float64 `json:"input_price" gorm:"not null;default:0"`
 	OutputPrice float64 `json:"output_price" gorm:"not null;default:0"`
+	// 提示缓存写入/读取的 token 单价，0 表示按输入单价计费
+	CacheWritePrice float64 `json:"cache_write_price" gorm:"not null;default:0"`
+	CacheReadPrice  float64 `json:"cache_read_price" gorm:"not null;default:0"`
+	// PricingRule 阶梯 / 推理 token / 最低费用 / 按张图片等计费规则，为空时只按上面的单价计费
+	PricingRule *PricingRule `json:"pricing_rule,omitempty" gorm:"type:text"`
+
+	// 能力元数据：combo 路由时跳过无法处理当前请求的模型。0 / null 表示未知，按不限制 / 支持处理
+	ContextWindow    int   `json:"context_window" gorm:"not null;default:0"`    // 上下文窗口（token）
+	MaxOutputTokens  int   `json:"max_output_tokens" gorm:"not null;default:0"` // 单次最大输出 token
+	SupportsVision   *bool `json:"supports_vision"`                             // 是否支持图片输入
+	SupportsTools    *bool `json:"supports_tools"`                              // 是否支持工具调用
+	SupportsThinking *bool `json:"supports_thinking"`                           // 是否支持 extended thinking / reasoning
+	SupportsPDF      *bool `json:"supports_pdf"`                                // 是否支持 PDF 文档输入
+
+	// 生效时间窗口（如只在低峰期可用的上游、按天限额的 key），为空表示始终可用；仅影响 combo 路由
+	Schedule ScheduleSlice `json:"schedule,omitempty" gorm:"type:text"`
+
+	// 主动健康检查（tasks.health_check）：0 / 空使用全局默认值，HealthCheckIntervalSec < 0 表示不检查该模型
+	HealthCheckIntervalSec int    `json:"health_check_interval_sec" gorm:"not null;default:0"`
+	HealthCheckTimeoutSec  int    `json:"health_check_timeout_sec" gorm:"not null;default:0"`
+	HealthCheckPrompt      string `json:"health_check_prompt" gorm:"size:1024;not null;default:''"`
+
+	// 上游 key 池：配置多个 key 时按 KeyStrategy（round_robin / least_used）轮换，单个 key 遇到 401/403/429 只暂停该 key；
+	// APIKey 不为空时作为池中的第一个 key
+	APIKeys     APIKeySlice `json:"api_keys,omitempty" gorm:"type:text"`
+	KeyStrategy string      `json:"key_strategy"`
+}
+
+// APIKeySlice 用于将 []keypool.Key 以 JSON 形式存入数据库 TEXT 字段。
+type APIKeySlice []keypool.Key
+
+func (s APIKeySlice) Value() (driver.Value, error) {
+	b, err := json.Marshal([]keypool.Key(s))
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (s *APIKeySlice) Scan(value any) error {
+	if value == nil {
+		*s = nil
+		return nil
+	}
+
+	var data []byte
+	switch v := value.(type) {
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return fmt.Errorf("unsupported Scan type: %T", value)
+	}
+
+	if len(data) == 0 {
+		*s = nil
+		return nil
+	}
+
+	var out []keypool.Key
+	if err := json.Unmarshal(data, &out); err != nil {
+		return err
+	}
+	*s = out
+	return nil
 }
 
 // User 平台用户。
@@ -50,6 +131,14 @@ type User struct {
 	TotalRequests int64 `json:"total_requests" gorm:"not null;default:0"`
 	// AllowedCombos 逗号分隔的允许使用的 combo ID 列表，空表示不限制
 	AllowedCombos string    `json:"allowed_combos" gorm:"size:2048;not null;default:''"`
+	// 限流：Group 对应 user_limits.groups 中的分组（空为 default）；以下各项 0 表示使用分组默认值，<0 表示不限制
+	Group            string `json:"group" gorm:"column:user_group;size:100;not null;default:''"`
+	RPMLimit         int    `json:"rpm_limit" gorm:"not null;default:0"`         // 每分钟请求数
+	TPMLimit         int64  `json:"tpm_limit" gorm:"not null;default:0"`         // 每分钟 token 数（输入+输出）
+	ConcurrencyLimit int    `json:"concurrency_limit" gorm:"not null;default:0"` // 同时进行中的请求数
+	// QuotaHeld 进行中请求预占的额度合计（见 QuotaHold），可用额度为 Quota - QuotaHeld
+	QuotaHeld float64 `json:"quota_held" gorm:"not null;default:0"`
+
 	CreatedAt     time.Time `json:"created_at"`
 	UpdatedAt     time.Time `json:"updated_at"`
 }
@@ -64,12 +153,27 @@ type UsageLog struct {
 	OutputTokens  int64     `json:"output_tokens" gorm:"not null;default:0"`
 	InputPrice    float64   `json:"-" gorm:"not null;default:0"`  // 输入单价（元/千 token），不返回给前端
 	OutputPrice   float64   `json:"-" gorm:"not null;default:0"` // 输出单价（元/千 token），不返回给前端
+	// 提示缓存的 token 单独记录：InputTokens 不含缓存写入与缓存读取
+	CacheWriteTokens int64   `json:"cache_write_tokens" gorm:"not null;default:0"`
+	CacheReadTokens  int64   `json:"cache_read_tokens" gorm:"not null;default:0"`
+	CacheWritePrice  float64 `json:"-" gorm:"not null;default:0"` // 缓存写入单价，不返回给前端
+	CacheReadPrice   float64 `json:"-" gorm:"not null;default:0"` // 缓存读取单价，不返回给前端
+	ReasoningTokens  int64   `json:"reasoning_tokens" gorm:"not null;default:0"` // 推理 token，包含在 OutputTokens 中
+	ReasoningPrice   float64 `json:"-" gorm:"not null;default:0"`                // 推理 token 单价，不返回给前端
+	ImageCount       int64   `json:"image_count" gorm:"not null;default:0"`
+	PricingRule      string  `json:"pricing_rule,omitempty" gorm:"size:255;not null;default:''"` // 生效的计费规则，见 Charge.Rule
 	TotalCost     float64   `json:"total_cost" gorm:"not null;default:0"` // 总费用（元）
 	// 计费模式：token=按token计费，request=按次数计费
 	BillingMode string  `json:"billing_mode" gorm:"size:20;not null;default:'token'"`
 	// 按次计费相关
 	RequestCount  int64   `json:"request_count" gorm:"not null;default:0"`   // 请求次数（每次请求=1）
 	RequestPrice  float64 `json:"request_price" gorm:"not null;default:0"`   // 按次单价（元/次）
+	RealModelID  string `json:"real_model_id" gorm:"index;size:100;not null;default:''"` // 实际调用的底层模型（ModelID 为 combo 时）
+	// 影子流量记录（见 Combo.ShadowModelID）：不计费，不出现在用户的使用记录中
+	Shadow       bool   `json:"shadow" gorm:"index;not null;default:false"`
+	LatencyMs    int64  `json:"latency_ms" gorm:"not null;default:0"`   // 上游耗时（毫秒）
+	TTFTMs       int64  `json:"ttft_ms" gorm:"not null;default:0"`      // 首字节耗时（毫秒），非流式请求与 LatencyMs 相同
+	ResponseBody string `json:"response_body,omitempty" gorm:"type:text"` // 影子模型的完整响应（Combo.ShadowRecordBody 开启时）
 	CreatedAt     time.Time `json:"created_at" gorm:"index"`
 }
 
@@ -79,6 +183,9 @@ type ErrorLog struct {
 	ModelID    string    `json:"model_id" gorm:"index;size:100;not null"`
 	Username   string    `json:"username" gorm:"index;size:100;not null"`
 	StatusCode int       `json:"status_code" gorm:"not null;default:0"`
+	Attempt    int       `json:"attempt" gorm:"not null;default:0"` // 本次请求内的第几次尝试（故障转移时递增），0 表示未知
+	Shadow     bool      `json:"shadow" gorm:"index;not null;default:false"` // 影子流量的失败记录
+	ErrorClass string    `json:"error_class" gorm:"index;size:32;not null;default:''"` // 失败分类（client/auth/rate_limit/upstream/protocol），空为分类前的旧记录
 	ErrorMsg   string    `json:"error_msg" gorm:"size:2048;not null;default:''"`
 	CreatedAt  time.Time `json:"created_at" gorm:"index"`
 }
@@ -105,3 +212,39 @@ type RedeemLog struct {
 	Quota     float64   `json:"quota" gorm:"not null"`                   // 兑换的额度
 	CreatedAt time.Time `json:"created_at" gorm:"index"`                 // 兑换时间
 }
+
+// ModelDisableState 模型临时禁用状态（model_disable.store=sql 时使用，多实例共享）
+type ModelDisableState struct {
+	ModelID       string    `json:"model_id" gorm:"primaryKey;size:100"`
+	DisabledUntil time.Time `json:"disabled_until" gorm:"index"`
+}
+
+// ConversationState 对话（metadata.user_id）粘滞的模型（model_disable.store=sql 时使用，多实例共享）
+type ConversationState struct {
+	ConversationID string    `json:"conversation_id" gorm:"primaryKey;size:255"`
+	ModelID        string    `json:"model_id" gorm:"size:100;not null"`
+	ComboID        string    `json:"combo_id" gorm:"size:100;not null;default:''"`
+	LastSeen       time.Time `json:"last_seen" gorm:"index"`
+}
+
+// QuotaHold 请求开始时按最大可能费用预占的用户额度，请求结束时结算或释放；
+// 实例崩溃遗留的预占在 ExpiresAt 之后由清理任务释放。
+type QuotaHold struct {
+	ID        int64     `json:"id" gorm:"primaryKey;autoIncrement"`
+	Username  string    `json:"username" gorm:"index;size:100;not null"`
+	Amount    float64   `json:"amount" gorm:"not null"`
+	ExpiresAt time.Time `json:"expires_at" gorm:"index"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ModelHealthCheck 主动健康检查的探测记录
+type ModelHealthCheck struct {
+	ID         int64     `json:"id" gorm:"primaryKey;autoIncrement"`
+	ModelID    string    `json:"model_id" gorm:"index;size:100;not null"`
+	OK         bool      `json:"ok" gorm:"not null;default:false"`
+	StatusCode int       `json:"status_code" gorm:"not null;default:0"`
+	ErrorClass string    `json:"error_class,omitempty" gorm:"size:32;not null;default:''"` // 失败分类，见 errclass
+	LatencyMs  int64     `json:"latency_ms" gorm:"not null;default:0"`
+	ErrorMsg   string    `json:"error_msg,omitempty" gorm:"size:1024;not null;default:''"`
+	CreatedAt  time.Time `json:"created_at" gorm:"index"`
+}
@@ -2,8 +2,10 @@ package model
 
 import (
 	"errors"
+	"fmt"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"awesomeProject/internal/storage"
@@ -13,6 +15,8 @@ import (
 var (
 	// ErrNotFound 在指定 ID 不存在时返回。
 	ErrNotFound = errors.New("not found")
+	// ErrInsufficientQuota 用户可用额度（余额减去进行中请求的预占）不足以预占本次请求。
+	ErrInsufficientQuota = errors.New("insufficient quota")
 
 	comboIDCache   map[string]struct{}
 	comboIDCacheMu sync.RWMutex
@@ -242,23 +246,19 @@ func DeleteUser(username string) error {
 	return nil
 }
 
+// AddUserUsage 累计用户用量并按输入/输出单价扣费（不区分缓存 token）。
 func AddUserUsage(username string, inputTokens, outputTokens int64, inputPrice, outputPrice float64) error {
+	return AddUserTokenUsage(username, TokenUsage{InputTokens: inputTokens, OutputTokens: outputTokens},
+		Pricing{Prices: TokenPrices{Input: inputPrice, Output: outputPrice}})
+}
+
+// AddUserTokenUsage 累计用户用量并扣费：按次计费扣单次价格，按 token 计费按 pricing 的单价与规则（阶梯、推理 token、
+// 图片、最低费用）计算。缓存写入与缓存读取的 token 计入用户的 input_tokens。
+func AddUserTokenUsage(username string, usage TokenUsage, pricing Pricing) error {
 	if strings.TrimSpace(username) == "" {
 		return nil
 	}
-	if inputTokens < 0 {
-		inputTokens = 0
-	}
-	if outputTokens < 0 {
-		outputTokens = 0
-	}
-	if inputPrice < 0 {
-		inputPrice = 0
-	}
-	if outputPrice < 0 {
-		outputPrice = 0
-	}
-	total := inputTokens + outputTokens
+	usage = usage.clamp()
 
 	// 先获取用户的计费模式
 	var user User
@@ -278,14 +278,14 @@ func AddUserUsage(username string, inputTokens, outputTokens int64, inputPrice,
 		totalCost = user.RequestPrice
 	} else {
 		// 按 token 计费
-		totalCost = (float64(inputTokens)/1000000)*inputPrice + (float64(outputTokens)/1000000)*outputPrice
+		totalCost = pricing.Quote(usage).Cost
 	}
 
 	updates := map[string]any{
-		"input_tokens":    gorm.Expr("input_tokens + ?", inputTokens),
-		"output_tokens":   gorm.Expr("output_tokens + ?", outputTokens),
-		"total_tokens":    gorm.Expr("total_tokens + ?", total),
-		"total_requests":  gorm.Expr("total_requests + 1"), // 每次请求都累计
+		"input_tokens":   gorm.Expr("input_tokens + ?", usage.PromptTokens()),
+		"output_tokens":  gorm.Expr("output_tokens + ?", usage.OutputTokens),
+		"total_tokens":   gorm.Expr("total_tokens + ?", usage.Total()),
+		"total_requests": gorm.Expr("total_requests + 1"), // 每次请求都累计
 		"quota": gorm.Expr(`
     CASE
         WHEN quota < 0 THEN -1
@@ -299,23 +299,97 @@ func AddUserUsage(username string, inputTokens, outputTokens int64, inputPrice,
 	return storage.DB.Model(&User{}).Where("username = ?", username).Updates(updates).Error
 }
 
-// RecordUsageLog 记录单次请求的 token 使用日志。
-func RecordUsageLog(username string, m Model, inputTokens, outputTokens int64, inputPrice, outputPrice float64, combo Combo) error {
-	if strings.TrimSpace(username) == "" || strings.TrimSpace(m.ID) == "" {
-		return nil
+// ReserveQuota 为用户预占 amount 额度，ttl 后未结算的预占由 ReleaseExpiredQuotaHolds 释放。
+// 额度无限（Quota < 0）或 amount <= 0 时不预占，返回 nil；余额减去已有预占不足 amount 时返回 ErrInsufficientQuota。
+// 判断与预占在一条条件 UPDATE 中完成，多实例并发时也不会超额。
+func ReserveQuota(username string, amount float64, ttl time.Duration) (*QuotaHold, error) {
+	if strings.TrimSpace(username) == "" || amount <= 0 {
+		return nil, nil
 	}
-	if inputTokens < 0 {
-		inputTokens = 0
+	var hold *QuotaHold
+	err := storage.DB.Transaction(func(tx *gorm.DB) error {
+		var user User
+		if err := tx.Where("username = ?", username).First(&user).Error; err != nil {
+			return err
+		}
+		if user.Quota < 0 {
+			return nil
+		}
+		res := tx.Model(&User{}).
+			Where("username = ? AND quota >= 0 AND quota - quota_held >= ?", username, amount).
+			Update("quota_held", gorm.Expr("quota_held + ?", amount))
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrInsufficientQuota
+		}
+		now := time.Now()
+		h := &QuotaHold{Username: username, Amount: amount, ExpiresAt: now.Add(ttl), CreatedAt: now}
+		if err := tx.Create(h).Error; err != nil {
+			return err
+		}
+		hold = h
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	if outputTokens < 0 {
-		outputTokens = 0
+	return hold, nil
+}
+
+// ReleaseQuotaHold 释放一笔预占（结算后或请求失败时调用）；重复释放或预占已被清理任务释放时不做任何事。
+func ReleaseQuotaHold(id int64) error {
+	return storage.DB.Transaction(func(tx *gorm.DB) error {
+		var h QuotaHold
+		if err := tx.Where("id = ?", id).First(&h).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil
+			}
+			return err
+		}
+		res := tx.Where("id = ?", id).Delete(&QuotaHold{})
+		if res.Error != nil || res.RowsAffected == 0 {
+			return res.Error
+		}
+		return tx.Model(&User{}).Where("username = ?", h.Username).Update("quota_held", gorm.Expr(`
+    CASE
+        WHEN quota_held - ? < 0 THEN 0
+        ELSE quota_held - ?
+    END
+`, h.Amount, h.Amount)).Error
+	})
+}
+
+// ReleaseExpiredQuotaHolds 释放 before 之前到期的预占（实例崩溃或请求异常退出时遗留），返回释放的条数。
+func ReleaseExpiredQuotaHolds(before time.Time) (int, error) {
+	var ids []int64
+	if err := storage.DB.Model(&QuotaHold{}).Where("expires_at < ?", before).Pluck("id", &ids).Error; err != nil {
+		return 0, err
 	}
-	if inputPrice < 0 {
-		inputPrice = 0
+	for i, id := range ids {
+		if err := ReleaseQuotaHold(id); err != nil {
+			return i, err
+		}
 	}
-	if outputPrice < 0 {
-		outputPrice = 0
+	return len(ids), nil
+}
+
+// RecordUsageLog 记录单次请求的 token 使用日志。
+func RecordUsageLog(username string, m Model, inputTokens, outputTokens int64, inputPrice, outputPrice float64, combo Combo) error {
+	return RecordUsageLogWithTiming(username, m, TokenUsage{InputTokens: inputTokens, OutputTokens: outputTokens},
+		Pricing{Prices: TokenPrices{Input: inputPrice, Output: outputPrice}}, combo, 0, 0)
+}
+
+// RecordUsageLogWithTiming 同 RecordUsageLog，各类 token（含缓存写入/读取、推理）、实际生效的单价与计费规则分别记录，
+// 并记录实际调用的模型、首字节耗时与总耗时（毫秒，未知时为 0），供 combo 权重任务按延迟与成功率调整权重。
+func RecordUsageLogWithTiming(username string, m Model, usage TokenUsage, pricing Pricing, combo Combo, ttftMs, latencyMs int64) error {
+	if strings.TrimSpace(username) == "" || strings.TrimSpace(m.ID) == "" {
+		return nil
 	}
+	usage = usage.clamp()
+	charge := pricing.Quote(usage)
+	prices := charge.Prices
 
 	// 先获取用户的计费模式
 	var user User
@@ -332,6 +406,7 @@ func RecordUsageLog(username string, m Model, inputTokens, outputTokens int64, i
 	var totalCost float64
 	var requestCount int64
 	var requestPrice float64
+	var pricingRule string
 
 	if billingMode == "request" {
 		// 按次数计费
@@ -340,22 +415,34 @@ func RecordUsageLog(username string, m Model, inputTokens, outputTokens int64, i
 		totalCost = requestPrice
 	} else {
 		// 按 token 计费
-		totalCost = (float64(inputTokens)/1000000)*inputPrice + (float64(outputTokens)/1000000)*outputPrice
+		totalCost = charge.Cost
+		pricingRule = charge.Rule
 	}
 
 	log := &UsageLog{
-		Username:      username,
-		ModelID:       combo.ID,
-		InputTokens:   inputTokens,
-		OutputTokens:  outputTokens,
-		InputPrice:    inputPrice,
-		OutputPrice:   outputPrice,
-		TotalCost:     totalCost,
-		Provider:      combo.Provider,
-		BillingMode:   billingMode,
-		RequestCount:  requestCount,
-		RequestPrice:  requestPrice,
-		CreatedAt:     time.Now(),
+		Username:         username,
+		ModelID:          combo.ID,
+		InputTokens:      usage.InputTokens,
+		OutputTokens:     usage.OutputTokens,
+		CacheWriteTokens: usage.CacheWriteTokens,
+		CacheReadTokens:  usage.CacheReadTokens,
+		ReasoningTokens:  usage.ReasoningTokens,
+		ImageCount:       usage.Images,
+		InputPrice:       prices.Input,
+		OutputPrice:      prices.Output,
+		CacheWritePrice:  prices.CacheWrite,
+		CacheReadPrice:   prices.CacheRead,
+		ReasoningPrice:   prices.Reasoning,
+		PricingRule:      pricingRule,
+		TotalCost:        totalCost,
+		Provider:         combo.Provider,
+		BillingMode:      billingMode,
+		RequestCount:     requestCount,
+		RequestPrice:     requestPrice,
+		RealModelID:      m.ID,
+		TTFTMs:           ttftMs,
+		LatencyMs:        latencyMs,
+		CreatedAt:        time.Now(),
 	}
 	return storage.DB.Create(log).Error
 }
@@ -370,13 +457,13 @@ func GetUsageLogsByUsername(username string, page, pageSize int) ([]UsageLog, in
 	var total int64
 
 	// 查询总数
-	if err := storage.DB.Where("username = ?", username).Model(&UsageLog{}).Count(&total).Error; err != nil {
+	if err := storage.DB.Where("username = ? AND shadow = ?", username, false).Model(&UsageLog{}).Count(&total).Error; err != nil {
 		return nil, 0, err
 	}
 
 	// 查询分页数据
 	offset := (page - 1) * pageSize
-	if err := storage.DB.Where("username = ?", username).
+	if err := storage.DB.Where("username = ? AND shadow = ?", username, false).
 		Order("created_at DESC").
 		Limit(pageSize).
 		Offset(offset).
@@ -504,12 +591,23 @@ func UpdateCombo(id string, c *Combo) error {
 	err := storage.DB.Transaction(func(tx *gorm.DB) error {
 		// 先更新 combo 主表
 		if err := tx.Model(&Combo{}).Where("id = ?", id).Updates(map[string]any{
-			"name":         c.Name,
-			"description":  c.Description,
-			"enabled":      c.Enabled,
-			"provider":     c.Provider,
-			"input_price":  c.InputPrice,
-			"output_price": c.OutputPrice,
+			"name":                c.Name,
+			"description":         c.Description,
+			"enabled":             c.Enabled,
+			"provider":            c.Provider,
+			"strategy":            c.Strategy,
+			"max_attempts":        c.MaxAttempts,
+			"failover_timeout_ms": c.FailoverTimeoutMs,
+			"shadow_model_id":     c.ShadowModelID,
+			"shadow_percent":      c.ShadowPercent,
+			"shadow_record_body":  c.ShadowRecordBody,
+			"hedge_after_ms":      c.HedgeAfterMs,
+			"strip_keywords":      c.StripKeywords,
+			"input_price":         c.InputPrice,
+			"output_price":        c.OutputPrice,
+			"cache_write_price":   c.CacheWritePrice,
+			"cache_read_price":    c.CacheReadPrice,
+			"pricing_rule":        c.PricingRule,
 		}).Error; err != nil {
 			return err
 		}
@@ -551,6 +649,16 @@ func DeleteCombo(id string) error {
 
 // RecordErrorLog 记录一条模型调用失败日志。
 func RecordErrorLog(modelID, username string, statusCode int, errMsg string) error {
+	return RecordErrorLogWithAttempt(modelID, username, statusCode, 0, errMsg)
+}
+
+// RecordErrorLogWithAttempt 记录一条模型调用失败日志，attempt 为本次请求内的第几次尝试（从 1 开始，0 表示未知）。
+func RecordErrorLogWithAttempt(modelID, username string, statusCode, attempt int, errMsg string) error {
+	return RecordErrorLogWithClass(modelID, username, statusCode, attempt, "", errMsg)
+}
+
+// RecordErrorLogWithClass 与 RecordErrorLogWithAttempt 相同，另外记录失败分类（见 errclass）。
+func RecordErrorLogWithClass(modelID, username string, statusCode, attempt int, errorClass, errMsg string) error {
 	if strings.TrimSpace(modelID) == "" {
 		return nil
 	}
@@ -562,12 +670,60 @@ func RecordErrorLog(modelID, username string, statusCode int, errMsg string) err
 		ModelID:    modelID,
 		Username:   username,
 		StatusCode: statusCode,
+		Attempt:    attempt,
+		ErrorClass: errorClass,
 		ErrorMsg:   msg,
 		CreatedAt:  time.Now(),
 	}
 	return storage.DB.Create(entry).Error
 }
 
+// RecordShadowUsageLog 记录一次成功的影子请求：不计费（TotalCost 为 0），body 非空时保存完整响应。
+func RecordShadowUsageLog(username string, combo Combo, shadowModelID string, usage TokenUsage, latencyMs int64, body string) error {
+	if strings.TrimSpace(shadowModelID) == "" {
+		return nil
+	}
+	log := &UsageLog{
+		Username:         username,
+		ModelID:          combo.ID,
+		RealModelID:      shadowModelID,
+		Provider:         combo.Provider,
+		InputTokens:      usage.InputTokens,
+		OutputTokens:     usage.OutputTokens,
+		CacheWriteTokens: usage.CacheWriteTokens,
+		CacheReadTokens:  usage.CacheReadTokens,
+		ReasoningTokens:  usage.ReasoningTokens,
+		ImageCount:       usage.Images,
+		BillingMode:      "shadow",
+		Shadow:           true,
+		LatencyMs:        latencyMs,
+		ResponseBody:     body,
+		CreatedAt:        time.Now(),
+	}
+	return storage.DB.Create(log).Error
+}
+
+// RecordShadowErrorLog 记录一次失败的影子请求。
+func RecordShadowErrorLog(shadowModelID, username string, statusCode int, errorClass, errMsg string) error {
+	if strings.TrimSpace(shadowModelID) == "" {
+		return nil
+	}
+	msg := errMsg
+	if len(msg) > 2048 {
+		msg = msg[:2000]
+	}
+	entry := &ErrorLog{
+		ModelID:    shadowModelID,
+		Username:   username,
+		StatusCode: statusCode,
+		ErrorClass: errorClass,
+		ErrorMsg:   msg,
+		Shadow:     true,
+		CreatedAt:  time.Now(),
+	}
+	return storage.DB.Create(entry).Error
+}
+
 // ListErrorLogs 查询错误日志，支持按 modelID 筛选和分页。
 func ListErrorLogs(modelID string, page, pageSize int) ([]ErrorLog, int64, error) {
 	if page < 1 {
@@ -772,3 +928,252 @@ func ListRedeemLogsByUsername(username string, page, pageSize int) ([]RedeemLog,
 
 	return logs, total, nil
 }
+
+// ==================== combo 权重历史 ====================
+
+// NewWeightBatchID 生成一次权重变更的批次 ID。
+func NewWeightBatchID() string {
+	return fmt.Sprintf("%s-%04d", time.Now().Format("20060102150405.000000"), weightBatchSeq.Add(1)%10000)
+}
+
+var weightBatchSeq atomic.Int64
+
+// RecordComboWeightHistory 批量写入权重变更记录。
+func RecordComboWeightHistory(rows []ComboWeightHistory) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	now := time.Now()
+	for i := range rows {
+		if rows[i].CreatedAt.IsZero() {
+			rows[i].CreatedAt = now
+		}
+	}
+	return storage.DB.Create(&rows).Error
+}
+
+// ListComboWeightHistory 分页查询某个 combo 的权重变更记录（按时间倒序）；dryRun 为 nil 时不过滤。
+func ListComboWeightHistory(comboID string, dryRun *bool, page, pageSize int) ([]ComboWeightHistory, int64, error) {
+	if page < 1 {
+		page = 1
+	}
+	if pageSize < 1 || pageSize > 200 {
+		pageSize = 50
+	}
+	query := storage.DB.Model(&ComboWeightHistory{}).Where("combo_id = ?", strings.TrimSpace(comboID))
+	if dryRun != nil {
+		query = query.Where("dry_run = ?", *dryRun)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	var rows []ComboWeightHistory
+	offset := (page - 1) * pageSize
+	if err := query.Order("id DESC").Limit(pageSize).Offset(offset).Find(&rows).Error; err != nil {
+		return nil, 0, err
+	}
+	return rows, total, nil
+}
+
+// ComboWeightChanges 比较修改前后的 item 列表（按 model_id 匹配），有权重变化时返回同一批次的完整快照：
+// 修改前后都存在的子模型各一条记录（未变化的 OldWeight == NewWeight），没有任何变化时返回 nil。
+// 新增或删除的子模型不算权重变更。
+func ComboWeightChanges(comboID string, before, after []ComboItem, source, reason string) []ComboWeightHistory {
+	oldWeights := make(map[string]float64, len(before))
+	for _, it := range before {
+		oldWeights[strings.TrimSpace(it.ModelID)] = it.Weight
+	}
+	batchID := NewWeightBatchID()
+	var out []ComboWeightHistory
+	changed := false
+	for _, it := range after {
+		id := strings.TrimSpace(it.ModelID)
+		old, ok := oldWeights[id]
+		if !ok {
+			continue
+		}
+		changed = changed || old != it.Weight
+		out = append(out, ComboWeightHistory{
+			BatchID:   batchID,
+			ComboID:   comboID,
+			ModelID:   id,
+			OldWeight: old,
+			NewWeight: it.Weight,
+			Source:    source,
+			Reason:    reason,
+		})
+	}
+	if !changed {
+		return nil
+	}
+	return out
+}
+
+// RestoreComboWeights 把 combo 的子模型权重恢复到批次 batchID 时的完整快照：before=true 恢复为该批次变更前的权重，
+// 否则恢复为变更后的权重（dry-run 批次即应用当时的建议值）。批次中没有记录的子模型按其它批次的实际变更推算当时的权重
+// （该批次之前最后一次变更后的值，没有时取之后第一次变更前的值），从未变更过的保持不变。按 model_id 匹配当前的 item，
+// 已不存在的子模型会被跳过。有权重变化时恢复本身也记录为一个新批次（source=restore，完整快照），返回写入的记录。
+func RestoreComboWeights(comboID, batchID string, before bool) ([]ComboWeightHistory, error) {
+	comboID = strings.TrimSpace(comboID)
+	batchID = strings.TrimSpace(batchID)
+	var snapshot []ComboWeightHistory
+	if err := storage.DB.Where("combo_id = ? AND batch_id = ?", comboID, batchID).Order("id").Find(&snapshot).Error; err != nil {
+		return nil, err
+	}
+	if len(snapshot) == 0 {
+		return nil, ErrNotFound
+	}
+
+	newBatch := NewWeightBatchID()
+	var restored []ComboWeightHistory
+	err := storage.DB.Transaction(func(tx *gorm.DB) error {
+		var items []ComboItem
+		if err := tx.Where("combo_id = ?", comboID).Order("id").Find(&items).Error; err != nil {
+			return err
+		}
+		var history []ComboWeightHistory
+		if err := tx.Where("combo_id = ? AND batch_id <> ? AND dry_run = ?", comboID, batchID, false).Order("id").Find(&history).Error; err != nil {
+			return err
+		}
+		targets := comboWeightsAt(snapshot, history, before)
+
+		changed := false
+		for _, it := range items {
+			target, ok := targets[it.ModelID]
+			if !ok {
+				continue
+			}
+			if it.Weight != target {
+				changed = true
+				if err := tx.Model(&ComboItem{}).Where("id = ?", it.ID).Update("weight", target).Error; err != nil {
+					return err
+				}
+			}
+			restored = append(restored, ComboWeightHistory{
+				BatchID:   newBatch,
+				ComboID:   comboID,
+				ModelID:   it.ModelID,
+				OldWeight: it.Weight,
+				NewWeight: target,
+				Source:    WeightSourceRestore,
+				Reason:    "restore batch " + batchID,
+				CreatedAt: time.Now(),
+			})
+		}
+		if !changed {
+			restored = nil
+			return nil
+		}
+		return tx.Create(&restored).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return restored, nil
+}
+
+// comboWeightsAt 推算批次 snapshot 时各子模型的权重（model_id -> weight）。history 为同一 combo 其它批次的实际变更，按 id 升序。
+func comboWeightsAt(snapshot, history []ComboWeightHistory, before bool) map[string]float64 {
+	first, last := snapshot[0].ID, snapshot[len(snapshot)-1].ID
+	out := make(map[string]float64, len(snapshot))
+	for _, h := range history {
+		switch {
+		case h.ID < first:
+			out[h.ModelID] = h.NewWeight // 之前最后一次变更后的值
+		case h.ID > last:
+			if _, ok := out[h.ModelID]; !ok {
+				out[h.ModelID] = h.OldWeight // 之后第一次变更前的值
+			}
+		}
+	}
+	for _, snap := range snapshot {
+		if before {
+			out[snap.ModelID] = snap.OldWeight
+		} else {
+			out[snap.ModelID] = snap.NewWeight
+		}
+	}
+	return out
+}
+
+// ==================== 模型健康检查 ====================
+
+// ModelHealthSummary 模型当前的健康状态：最近一次探测结果与统计窗口内的成功率。
+type ModelHealthSummary struct {
+	ModelID     string            `json:"model_id"`
+	Last        *ModelHealthCheck `json:"last"`
+	Checks      int64             `json:"checks"`       // 窗口内探测次数
+	Failures    int64             `json:"failures"`     // 窗口内失败次数
+	SuccessRate float64           `json:"success_rate"` // 窗口内成功率
+}
+
+// RecordModelHealthCheck 写入一条探测记录。
+func RecordModelHealthCheck(h *ModelHealthCheck) error {
+	if h == nil || strings.TrimSpace(h.ModelID) == "" {
+		return nil
+	}
+	if len(h.ErrorMsg) > 1000 {
+		h.ErrorMsg = h.ErrorMsg[:1000]
+	}
+	if h.CreatedAt.IsZero() {
+		h.CreatedAt = time.Now()
+	}
+	return storage.DB.Create(h).Error
+}
+
+// ListModelHealth 返回每个探测过的模型的最近一次结果，以及 since 之后的探测统计，按 model_id 排序。
+func ListModelHealth(since time.Time) ([]ModelHealthSummary, error) {
+	var latest []ModelHealthCheck
+	sub := storage.DB.Model(&ModelHealthCheck{}).Select("MAX(id)").Group("model_id")
+	if err := storage.DB.Where("id IN (?)", sub).Order("model_id").Find(&latest).Error; err != nil {
+		return nil, err
+	}
+	type stat struct {
+		ModelID  string
+		Checks   int64
+		Failures int64
+	}
+	var stats []stat
+	if err := storage.DB.Model(&ModelHealthCheck{}).
+		Select("model_id as model_id, COUNT(1) as checks, SUM(CASE WHEN ok THEN 0 ELSE 1 END) as failures").
+		Where("created_at >= ?", since).
+		Group("model_id").
+		Scan(&stats).Error; err != nil {
+		return nil, err
+	}
+	byID := make(map[string]stat, len(stats))
+	for _, st := range stats {
+		byID[st.ModelID] = st
+	}
+
+	out := make([]ModelHealthSummary, 0, len(latest))
+	for i := range latest {
+		st := byID[latest[i].ModelID]
+		sum := ModelHealthSummary{ModelID: latest[i].ModelID, Last: &latest[i], Checks: st.Checks, Failures: st.Failures}
+		if st.Checks > 0 {
+			sum.SuccessRate = float64(st.Checks-st.Failures) / float64(st.Checks)
+		}
+		out = append(out, sum)
+	}
+	return out, nil
+}
+
+// ListModelHealthHistory 返回模型最近的 limit 条探测记录（按时间倒序）。
+func ListModelHealthHistory(modelID string, limit int) ([]ModelHealthCheck, error) {
+	if limit < 1 || limit > 500 {
+		limit = 50
+	}
+	var rows []ModelHealthCheck
+	if err := storage.DB.Where("model_id = ?", strings.TrimSpace(modelID)).Order("id DESC").Limit(limit).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// CleanupModelHealthChecks 删除 before 之前的探测记录。
+func CleanupModelHealthChecks(before time.Time) (int64, error) {
+	res := storage.DB.Where("created_at < ?", before).Delete(&ModelHealthCheck{})
+	return res.RowsAffected, res.Error
+}
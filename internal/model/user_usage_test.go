@@ -1,7 +1,9 @@
 package model
 
 import (
+	"errors"
 	"testing"
+	"time"
 
 	"github.com/glebarez/sqlite"
 	"gorm.io/gorm"
@@ -15,7 +17,7 @@ func setupUserStoreTestDB(t *testing.T) {
 	if err != nil {
 		t.Fatalf("open db: %v", err)
 	}
-	if err := db.AutoMigrate(&User{}); err != nil {
+	if err := db.AutoMigrate(&User{}, &QuotaHold{}); err != nil {
 		t.Fatalf("migrate: %v", err)
 	}
 	storage.DB = db
@@ -54,3 +56,53 @@ func TestAddUserUsage_Accumulates(t *testing.T) {
 		t.Fatalf("total tokens expect 165, got %d", got.TotalTokens)
 	}
 }
+
+func TestReserveQuota_HoldsBlockConcurrentOverspend(t *testing.T) {
+	setupUserStoreTestDB(t)
+
+	if err := CreateUser(&User{Username: "hold-u1", APIKey: "hold-key-1", Quota: 1}); err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	h1, err := ReserveQuota("hold-u1", 0.6, time.Minute)
+	if err != nil || h1 == nil {
+		t.Fatalf("first hold: %v", err)
+	}
+	// 余额 1，已预占 0.6，剩余 0.4 不足以再预占 0.6
+	if _, err := ReserveQuota("hold-u1", 0.6, time.Minute); !errors.Is(err, ErrInsufficientQuota) {
+		t.Fatalf("expect ErrInsufficientQuota, got %v", err)
+	}
+
+	// 结算：扣除实际费用后释放预占，重复释放不影响结果
+	if err := AddUserUsage("hold-u1", 1000000, 0, 0.2, 0); err != nil {
+		t.Fatalf("add usage: %v", err)
+	}
+	if err := ReleaseQuotaHold(h1.ID); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	if err := ReleaseQuotaHold(h1.ID); err != nil {
+		t.Fatalf("release twice: %v", err)
+	}
+	got, _ := GetUser("hold-u1")
+	if got.QuotaHeld != 0 || got.Quota < 0.79 || got.Quota > 0.81 {
+		t.Fatalf("expect quota 0.8 with nothing held, got quota=%v held=%v", got.Quota, got.QuotaHeld)
+	}
+
+	// 到期未结算的预占由清理任务释放
+	if _, err := ReserveQuota("hold-u1", 0.5, -time.Second); err != nil {
+		t.Fatalf("expired hold: %v", err)
+	}
+	if n, err := ReleaseExpiredQuotaHolds(time.Now()); err != nil || n != 1 {
+		t.Fatalf("expect 1 expired hold released, got %d err=%v", n, err)
+	}
+	if got, _ := GetUser("hold-u1"); got.QuotaHeld != 0 {
+		t.Fatalf("expect nothing held, got %v", got.QuotaHeld)
+	}
+
+	// 无限额度不预占
+	if err := CreateUser(&User{Username: "hold-u2", APIKey: "hold-key-2", Quota: -1}); err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	if h, err := ReserveQuota("hold-u2", 100, time.Minute); err != nil || h != nil {
+		t.Fatalf("expect no hold for unlimited user, got %v %v", h, err)
+	}
+}
@@ -0,0 +1,98 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+
+	"awesomeProject/internal/storage"
+)
+
+func TestRestoreComboWeights(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	if err := db.AutoMigrate(&Combo{}, &ComboItem{}, &ComboWeightHistory{}); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	storage.DB = db
+
+	cb := &Combo{ID: "combo:w", Name: "w", Enabled: true, Items: []ComboItem{{ModelID: "a", Weight: 0.5}, {ModelID: "b", Weight: 0.5}}}
+	if err := CreateCombo(cb); err != nil {
+		t.Fatalf("create combo: %v", err)
+	}
+	old := append([]ComboItem(nil), cb.Items...)
+
+	// 手动修改：重建 item 后按 model_id 记录差异
+	updated := &Combo{ID: cb.ID, Name: "w", Enabled: true, Items: []ComboItem{{ModelID: "a", Weight: 0.8}, {ModelID: "b", Weight: 0.5}, {ModelID: "c", Weight: 0.1}}}
+	if err := UpdateCombo(cb.ID, updated); err != nil {
+		t.Fatalf("update combo: %v", err)
+	}
+	changes := ComboWeightChanges(cb.ID, old, updated.Items, WeightSourceManual, "test")
+	// 完整快照：未变化的 b 也记录，新增的 c 不算
+	if len(changes) != 2 || changes[0].ModelID != "a" || changes[0].OldWeight != 0.5 || changes[0].NewWeight != 0.8 ||
+		changes[1].ModelID != "b" || changes[1].OldWeight != 0.5 || changes[1].NewWeight != 0.5 {
+		t.Fatalf("unexpected changes %+v", changes)
+	}
+	if err := RecordComboWeightHistory(changes); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+	if same := ComboWeightChanges(cb.ID, updated.Items, updated.Items, WeightSourceManual, "noop"); same != nil {
+		t.Fatalf("expect no batch without changes, got %+v", same)
+	}
+	firstBatch := changes[0].BatchID
+
+	// 之后的批次只记录了 b 与 c：恢复第一个批次时 c 按其后第一次变更前的值推算
+	if err := RecordComboWeightHistory([]ComboWeightHistory{
+		{BatchID: "later", ComboID: cb.ID, ModelID: "b", OldWeight: 0.5, NewWeight: 0.2, Source: WeightSourceAuto},
+		{BatchID: "later", ComboID: cb.ID, ModelID: "c", OldWeight: 0.1, NewWeight: 0.9, Source: WeightSourceAuto},
+	}); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+	setWeights := func(weights map[string]float64) {
+		for id, w := range weights {
+			storage.DB.Model(&ComboItem{}).Where("combo_id = ? AND model_id = ?", cb.ID, id).Update("weight", w)
+		}
+	}
+	expectWeights := func(want map[string]float64) {
+		t.Helper()
+		got, err := GetCombo(cb.ID)
+		if err != nil {
+			t.Fatalf("get combo: %v", err)
+		}
+		for _, it := range got.Items {
+			if it.Weight != want[it.ModelID] {
+				t.Fatalf("expect %s=%v, got %v (all %+v)", it.ModelID, want[it.ModelID], it.Weight, got.Items)
+			}
+		}
+	}
+	setWeights(map[string]float64{"b": 0.2, "c": 0.9})
+
+	restored, err := RestoreComboWeights(cb.ID, firstBatch, false)
+	if err != nil || len(restored) != 3 || restored[0].Source != WeightSourceRestore {
+		t.Fatalf("restore: %+v %v", restored, err)
+	}
+	expectWeights(map[string]float64{"a": 0.8, "b": 0.5, "c": 0.1})
+
+	// 恢复到较晚批次：a 取该批次之前最后一次变更后的值
+	setWeights(map[string]float64{"a": 0.3})
+	if _, err := RestoreComboWeights(cb.ID, "later", false); err != nil {
+		t.Fatalf("restore later: %v", err)
+	}
+	expectWeights(map[string]float64{"a": 0.8, "b": 0.2, "c": 0.9})
+
+	if _, err := RestoreComboWeights(cb.ID, firstBatch, true); err != nil {
+		t.Fatalf("restore before: %v", err)
+	}
+	expectWeights(map[string]float64{"a": 0.5, "b": 0.5, "c": 0.1})
+
+	rows, total, err := ListComboWeightHistory(cb.ID, nil, 1, 10)
+	if err != nil || total != 13 || rows[0].Source != WeightSourceRestore {
+		t.Fatalf("list: total=%d rows=%+v err=%v", total, rows, err)
+	}
+	if _, err := RestoreComboWeights(cb.ID, "missing", false); err != ErrNotFound {
+		t.Fatalf("expect ErrNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,346 @@
+package modelstate
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"awesomeProject/pkg/utils"
+)
+
+// 熔断器状态
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+// BreakerConfig 模型熔断器配置。
+type BreakerConfig struct {
+	Enabled         bool
+	Window          time.Duration // 统计失败率的滑动窗口
+	MinRequests     int           // 窗口内至少有这么多次请求才判断失败率
+	FailureRate     float64       // 失败率达到该值时打开熔断
+	OpenDuration    time.Duration // 第一次打开的时长，之后每次连续打开翻倍
+	MaxOpenDuration time.Duration // 打开时长上限
+}
+
+var (
+	breakerMu     sync.Mutex
+	breakerConfig = BreakerConfig{
+		Window:          time.Minute,
+		MinRequests:     5,
+		FailureRate:     0.5,
+		OpenDuration:    time.Minute,
+		MaxOpenDuration: 10 * time.Minute,
+	}
+	breakers = make(map[string]*breakerEntry) // model_id -> 熔断器
+)
+
+type breakerOutcome struct {
+	at     time.Time
+	failed bool
+}
+
+type breakerEntry struct {
+	state      string
+	outcomes   []breakerOutcome // 窗口内的请求结果
+	trips      int              // 连续打开次数，关闭后清零
+	openUntil  time.Time
+	trialAt    time.Time // 半开状态下试探请求的发出时间，零值表示尚未发出
+	lastChange time.Time
+	lastReason string
+	totalTrips int64
+}
+
+// BreakerStatus 单个模型熔断器的当前状态，供管理接口展示。
+type BreakerStatus struct {
+	ModelID     string    `json:"model_id"`
+	State       string    `json:"state"`
+	Requests    int       `json:"requests"`     // 窗口内请求数
+	Failures    int       `json:"failures"`     // 窗口内失败数
+	FailureRate float64   `json:"failure_rate"` // 窗口内失败率
+	Trips       int       `json:"trips"`        // 连续打开次数（决定下一次打开时长）
+	TotalTrips  int64     `json:"total_trips"`
+	OpenUntil   time.Time `json:"open_until,omitempty"`
+	TrialInUse  bool      `json:"trial_in_use,omitempty"` // 半开状态下试探请求正在进行
+	LastChange  time.Time `json:"last_change"`
+	LastReason  string    `json:"last_reason,omitempty"`
+}
+
+// ConfigureBreaker 从外部配置加载熔断器参数；空字符串与非正数使用默认值，openDuration 默认为 DisableTTL。
+func ConfigureBreaker(enabled bool, window, openDuration, maxOpenDuration string, minRequests int, failureRate float64) error {
+	cfg := BreakerConfig{
+		Enabled:         enabled,
+		Window:          time.Minute,
+		MinRequests:     5,
+		FailureRate:     0.5,
+		OpenDuration:    DisableTTL,
+		MaxOpenDuration: 10 * time.Minute,
+	}
+	for _, f := range []struct {
+		name string
+		raw  string
+		dst  *time.Duration
+	}{
+		{"window", window, &cfg.Window},
+		{"open_duration", openDuration, &cfg.OpenDuration},
+		{"max_open_duration", maxOpenDuration, &cfg.MaxOpenDuration},
+	} {
+		raw := strings.TrimSpace(f.raw)
+		if raw == "" {
+			continue
+		}
+		d, err := time.ParseDuration(raw)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid circuit_breaker.%s %q", f.name, raw)
+		}
+		*f.dst = d
+	}
+	if minRequests > 0 {
+		cfg.MinRequests = minRequests
+	}
+	if failureRate > 0 {
+		if failureRate > 1 {
+			return fmt.Errorf("circuit_breaker.failure_rate must be in (0, 1], got %v", failureRate)
+		}
+		cfg.FailureRate = failureRate
+	}
+	if cfg.MaxOpenDuration < cfg.OpenDuration {
+		cfg.MaxOpenDuration = cfg.OpenDuration
+	}
+	breakerMu.Lock()
+	breakerConfig = cfg
+	breakerMu.Unlock()
+	return nil
+}
+
+func breakerEnabled() bool {
+	breakerMu.Lock()
+	defer breakerMu.Unlock()
+	return breakerConfig.Enabled
+}
+
+// RecordModelFailure 记录一次上游失败。开启熔断器时计入失败率，可能打开熔断；
+// 否则按 DisableTTL 临时禁用模型（旧行为）。
+func RecordModelFailure(modelID string) {
+	id := strings.TrimSpace(modelID)
+	if id == "" {
+		return
+	}
+	if !breakerEnabled() {
+		DisableModelTemporarily(id, DisableTTL)
+		return
+	}
+	recordBreakerOutcome(id, true, time.Now())
+}
+
+// RecordModelSuccess 记录一次上游成功；半开状态下的成功会关闭熔断。
+func RecordModelSuccess(modelID string) {
+	id := strings.TrimSpace(modelID)
+	if id == "" || !breakerEnabled() {
+		return
+	}
+	recordBreakerOutcome(id, false, time.Now())
+}
+
+func recordBreakerOutcome(id string, failed bool, now time.Time) {
+	breakerMu.Lock()
+	cfg := breakerConfig
+	b := breakers[id]
+	if b == nil {
+		b = &breakerEntry{state: BreakerClosed, lastChange: now}
+		breakers[id] = b
+	}
+	b.refresh(id, cfg, now)
+
+	var openUntil time.Time
+	switch b.state {
+	case BreakerHalfOpen:
+		if failed {
+			openUntil = b.trip(id, cfg, now, "half-open trial failed")
+		} else {
+			b.trips = 0
+			b.outcomes = nil
+			b.transition(id, BreakerClosed, now, "half-open trial succeeded")
+		}
+	case BreakerOpen:
+		// 打开期间仍可能有此前发出的请求返回，只计入窗口
+		b.observe(cfg, failed, now)
+	default:
+		b.observe(cfg, failed, now)
+		if failed {
+			total, failures := len(b.outcomes), b.failures()
+			if total >= cfg.MinRequests && float64(failures)/float64(total) >= cfg.FailureRate {
+				openUntil = b.trip(id, cfg, now, fmt.Sprintf("failure rate %d/%d in %s", failures, total, cfg.Window))
+			}
+		}
+	}
+	breakerMu.Unlock()
+
+	if !openUntil.IsZero() {
+		// 写入共享存储，使其他实例在打开期间同样跳过该模型
+		if err := currentStore().SetDisabled(id, openUntil); err != nil {
+			utils.Logger.Printf("[ClaudeRouter] circuit_breaker: store open state failed model=%s err=%v", id, err)
+		}
+	}
+}
+
+// breakerRejects 熔断器是否拒绝向该模型发请求：打开期间，或半开状态下试探请求已发出。
+func breakerRejects(id string, now time.Time) bool {
+	breakerMu.Lock()
+	defer breakerMu.Unlock()
+	if !breakerConfig.Enabled {
+		return false
+	}
+	b := breakers[id]
+	if b == nil {
+		return false
+	}
+	b.refresh(id, breakerConfig, now)
+	switch b.state {
+	case BreakerOpen:
+		return true
+	case BreakerHalfOpen:
+		return !b.trialAt.IsZero()
+	}
+	return false
+}
+
+// claimBreakerTrial 向半开状态的模型发出请求时占用试探名额。
+// 过滤候选与发出请求之间没有加锁，并发时可能有极少数额外请求通过。
+func claimBreakerTrial(id string, now time.Time) {
+	breakerMu.Lock()
+	defer breakerMu.Unlock()
+	if !breakerConfig.Enabled {
+		return
+	}
+	if b := breakers[id]; b != nil {
+		b.refresh(id, breakerConfig, now)
+		if b.state == BreakerHalfOpen && b.trialAt.IsZero() {
+			b.trialAt = now
+		}
+	}
+}
+
+// refresh 打开时长到期后进入半开；试探请求超过一个窗口仍无结果（如客户端取消）时允许重新试探。
+func (b *breakerEntry) refresh(id string, cfg BreakerConfig, now time.Time) {
+	switch b.state {
+	case BreakerOpen:
+		if !now.Before(b.openUntil) {
+			b.trialAt = time.Time{}
+			b.transition(id, BreakerHalfOpen, now, "open duration elapsed")
+		}
+	case BreakerHalfOpen:
+		if !b.trialAt.IsZero() && now.Sub(b.trialAt) > cfg.Window {
+			b.trialAt = time.Time{}
+		}
+	}
+}
+
+func (b *breakerEntry) observe(cfg BreakerConfig, failed bool, now time.Time) {
+	b.outcomes = append(b.outcomes, breakerOutcome{at: now, failed: failed})
+	b.prune(cfg, now)
+}
+
+// prune 丢弃窗口之外的请求结果。
+func (b *breakerEntry) prune(cfg BreakerConfig, now time.Time) {
+	cutoff := now.Add(-cfg.Window)
+	i := 0
+	for i < len(b.outcomes) && b.outcomes[i].at.Before(cutoff) {
+		i++
+	}
+	b.outcomes = b.outcomes[i:]
+}
+
+func (b *breakerEntry) failures() int {
+	n := 0
+	for _, o := range b.outcomes {
+		if o.failed {
+			n++
+		}
+	}
+	return n
+}
+
+// trip 打开熔断，打开时长按连续打开次数指数增长。
+func (b *breakerEntry) trip(id string, cfg BreakerConfig, now time.Time, reason string) time.Time {
+	b.trips++
+	b.totalTrips++
+	d := cfg.OpenDuration
+	for i := 1; i < b.trips && d < cfg.MaxOpenDuration; i++ {
+		d *= 2
+	}
+	if d > cfg.MaxOpenDuration {
+		d = cfg.MaxOpenDuration
+	}
+	b.openUntil = now.Add(d)
+	b.outcomes = nil
+	b.trialAt = time.Time{}
+	b.transition(id, BreakerOpen, now, fmt.Sprintf("%s, open for %s", reason, d))
+	return b.openUntil
+}
+
+func (b *breakerEntry) transition(id, state string, now time.Time, reason string) {
+	from := b.state
+	b.state = state
+	b.lastChange = now
+	b.lastReason = reason
+	utils.Logger.Printf("[ClaudeRouter] circuit_breaker: model=%s %s -> %s reason=%s", id, from, state, reason)
+}
+
+// BreakerStatuses 返回所有模型熔断器的状态，按 model_id 排序。
+func BreakerStatuses() []BreakerStatus {
+	now := time.Now()
+	breakerMu.Lock()
+	cfg := breakerConfig
+	out := make([]BreakerStatus, 0, len(breakers))
+	for id, b := range breakers {
+		b.refresh(id, cfg, now)
+		b.prune(cfg, now)
+		st := BreakerStatus{
+			ModelID:    id,
+			State:      b.state,
+			Requests:   len(b.outcomes),
+			Failures:   b.failures(),
+			Trips:      b.trips,
+			TotalTrips: b.totalTrips,
+			TrialInUse: b.state == BreakerHalfOpen && !b.trialAt.IsZero(),
+			LastChange: b.lastChange,
+			LastReason: b.lastReason,
+		}
+		if st.Requests > 0 {
+			st.FailureRate = float64(st.Failures) / float64(st.Requests)
+		}
+		if b.state == BreakerOpen {
+			st.OpenUntil = b.openUntil
+		}
+		out = append(out, st)
+	}
+	breakerMu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].ModelID < out[j].ModelID })
+	return out
+}
+
+// ResetBreaker 手动关闭模型的熔断器并清除其临时禁用状态，返回模型是否存在熔断记录。
+func ResetBreaker(modelID string) bool {
+	id := strings.TrimSpace(modelID)
+	now := time.Now()
+	breakerMu.Lock()
+	b, ok := breakers[id]
+	if ok {
+		b.trips = 0
+		b.outcomes = nil
+		b.trialAt = time.Time{}
+		if b.state != BreakerClosed {
+			b.transition(id, BreakerClosed, now, "reset via admin api")
+		}
+	}
+	breakerMu.Unlock()
+	if err := currentStore().DeleteDisabled(id); err != nil {
+		utils.Logger.Printf("[ClaudeRouter] circuit_breaker: clear store state failed model=%s err=%v", id, err)
+	}
+	return ok
+}
@@ -0,0 +1,77 @@
+package modelstate
+
+import (
+	"testing"
+	"time"
+
+	"awesomeProject/pkg/utils"
+)
+
+func TestBreaker(t *testing.T) {
+	utils.InitLogger("error")
+	prevStore := currentStore()
+	SetStore(NewMemoryStore())
+	breakerMu.Lock()
+	prevCfg := breakerConfig
+	breakerConfig = BreakerConfig{Enabled: true, Window: time.Minute, MinRequests: 4, FailureRate: 0.5, OpenDuration: time.Second, MaxOpenDuration: 3 * time.Second}
+	breakerMu.Unlock()
+	defer func() {
+		breakerMu.Lock()
+		breakerConfig = prevCfg
+		delete(breakers, "m")
+		breakerMu.Unlock()
+		SetStore(prevStore)
+	}()
+
+	now := time.Now()
+	state := func() string {
+		breakerMu.Lock()
+		defer breakerMu.Unlock()
+		return breakers["m"].state
+	}
+
+	// 请求数不足时不打开
+	recordBreakerOutcome("m", true, now)
+	recordBreakerOutcome("m", false, now)
+	recordBreakerOutcome("m", true, now)
+	if state() != BreakerClosed || breakerRejects("m", now) {
+		t.Fatalf("expect closed below min_requests, got %s", state())
+	}
+	recordBreakerOutcome("m", true, now)
+	if state() != BreakerOpen || !breakerRejects("m", now) {
+		t.Fatalf("expect open at 3/4 failures, got %s", state())
+	}
+
+	// 到期后半开，只放行一个试探请求
+	now = now.Add(time.Second)
+	if breakerRejects("m", now) || state() != BreakerHalfOpen {
+		t.Fatalf("expect half-open after open duration, got %s", state())
+	}
+	claimBreakerTrial("m", now)
+	if !breakerRejects("m", now) {
+		t.Fatal("expect half-open to reject while trial in flight")
+	}
+
+	// 试探失败：再次打开，时长翻倍
+	recordBreakerOutcome("m", true, now)
+	if state() != BreakerOpen || !breakerRejects("m", now.Add(1500*time.Millisecond)) {
+		t.Fatalf("expect reopened with doubled duration, got %s", state())
+	}
+	now = now.Add(2 * time.Second)
+	if breakerRejects("m", now) {
+		t.Fatal("expect half-open after backoff")
+	}
+
+	// 试探成功：关闭并清零连续打开次数
+	claimBreakerTrial("m", now)
+	recordBreakerOutcome("m", false, now)
+	if state() != BreakerClosed || breakerRejects("m", now) {
+		t.Fatalf("expect closed after successful trial, got %s", state())
+	}
+	breakerMu.Lock()
+	trips := breakers["m"].trips
+	breakerMu.Unlock()
+	if trips != 0 {
+		t.Fatalf("expect trips reset, got %d", trips)
+	}
+}
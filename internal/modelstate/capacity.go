@@ -0,0 +1,279 @@
+package modelstate
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// capacityWindow 模型 TPM 的统计窗口。
+const capacityWindow = time.Minute
+
+var (
+	capacityMu sync.Mutex
+	capacities = make(map[string]*capacityEntry) // model_id -> TPM / 并发占用
+	// capacityChanged 有额度被释放时关闭并替换，唤醒等待额度的请求
+	capacityChanged = make(chan struct{})
+)
+
+type capacitySample struct {
+	at     time.Time
+	tokens int64
+}
+
+type capacityEntry struct {
+	inFlight int
+	waiting  int               // 正在等待额度的请求数
+	samples  []*capacitySample // 窗口内的 token 占用（预占的估算值，请求完成后校正为实际值）
+}
+
+func (e *capacityEntry) prune(now time.Time) {
+	cutoff := now.Add(-capacityWindow)
+	i := 0
+	for i < len(e.samples) && !e.samples[i].at.After(cutoff) {
+		i++
+	}
+	e.samples = e.samples[i:]
+}
+
+func (e *capacityEntry) usedTokens() int64 {
+	var n int64
+	for _, s := range e.samples {
+		n += s.tokens
+	}
+	return n
+}
+
+// fits 判断再发一个估算 estTokens 的请求是否超出限制；窗口内没有占用时总是放行，避免单个大请求永远等不到额度。
+func (e *capacityEntry) fits(maxTPM int64, maxConcurrency int, estTokens int64) bool {
+	if maxConcurrency > 0 && e.inFlight >= maxConcurrency {
+		return false
+	}
+	if maxTPM > 0 {
+		if used := e.usedTokens(); used > 0 && used+estTokens > maxTPM {
+			return false
+		}
+	}
+	return true
+}
+
+// nextExpiry 窗口内最早的一条 token 占用离开窗口的时刻，没有占用时为零值。
+func (e *capacityEntry) nextExpiry() time.Time {
+	if len(e.samples) == 0 {
+		return time.Time{}
+	}
+	return e.samples[0].at.Add(capacityWindow)
+}
+
+func capacityEntryLocked(id string, now time.Time) *capacityEntry {
+	e := capacities[id]
+	if e == nil {
+		e = &capacityEntry{}
+		capacities[id] = e
+	}
+	e.prune(now)
+	return e
+}
+
+func notifyCapacityLocked() {
+	close(capacityChanged)
+	capacityChanged = make(chan struct{})
+}
+
+// HasModelCapacity 模型在 MaxTPM / MaxConcurrency 限制下是否还能立即接受一个估算 estTokens 的请求；
+// 两个限制都为 0 时总是返回 true。
+func HasModelCapacity(modelID string, maxTPM int64, maxConcurrency int, estTokens int64) bool {
+	if maxTPM <= 0 && maxConcurrency <= 0 {
+		return true
+	}
+	id := strings.TrimSpace(modelID)
+	capacityMu.Lock()
+	defer capacityMu.Unlock()
+	return capacityEntryLocked(id, time.Now()).fits(maxTPM, maxConcurrency, estTokens)
+}
+
+// CapacityReservation 一次请求对模型 TPM 与并发名额的预占。方法对 nil 安全（模型未配置限制时为 nil）。
+type CapacityReservation struct {
+	modelID string
+	sample  *capacitySample
+	done    bool // 并发名额已归还
+}
+
+// ModelID 返回预占的模型 ID。
+func (r *CapacityReservation) ModelID() string {
+	if r == nil {
+		return ""
+	}
+	return r.modelID
+}
+
+// ReserveModelCapacity 预占一个并发名额与 estTokens 的 TPM 额度，额度不足时等待直到有额度或 ctx 结束（不限排队）。
+// 模型未配置 MaxTPM / MaxConcurrency 时返回 nil, nil。
+func ReserveModelCapacity(ctx context.Context, modelID string, maxTPM int64, maxConcurrency int, estTokens int64) (*CapacityReservation, error) {
+	return AcquireModelCapacity(ctx, modelID, maxTPM, maxConcurrency, estTokens, 0, 0)
+}
+
+// AcquireModelCapacity 同 ReserveModelCapacity，但限制排队：maxDepth > 0 时已有 maxDepth 个请求在等待额度、
+// maxWait > 0 时等待超过该值，返回 *QueueFullError；ctx 结束时返回 ctx.Err()。
+func AcquireModelCapacity(ctx context.Context, modelID string, maxTPM int64, maxConcurrency int, estTokens int64, maxWait time.Duration, maxDepth int) (*CapacityReservation, error) {
+	if maxTPM <= 0 && maxConcurrency <= 0 {
+		return nil, nil
+	}
+	id := strings.TrimSpace(modelID)
+	var deadline time.Time
+	if maxWait > 0 {
+		deadline = time.Now().Add(maxWait)
+	}
+	var queued *capacityEntry // 已计入排队数的条目
+	leave := func() {
+		if queued != nil {
+			queued.waiting--
+			queued = nil
+		}
+	}
+	for {
+		now := time.Now()
+		capacityMu.Lock()
+		e := capacityEntryLocked(id, now)
+		// 已有请求在排队时新请求不插队
+		if (queued != nil || e.waiting == 0) && e.fits(maxTPM, maxConcurrency, estTokens) {
+			leave()
+			r := e.reserveLocked(id, now, estTokens)
+			capacityMu.Unlock()
+			return r, nil
+		}
+		wait := time.Second
+		if exp := e.nextExpiry(); !exp.IsZero() && exp.Sub(now) < wait {
+			wait = max(exp.Sub(now), time.Millisecond)
+		}
+		if queued == nil {
+			if maxDepth > 0 && e.waiting >= maxDepth {
+				n := e.waiting
+				capacityMu.Unlock()
+				return nil, &QueueFullError{ModelID: id, RetryAfter: wait, Reason: fmt.Sprintf("%d requests already waiting for tpm/concurrency headroom", n)}
+			}
+			e.waiting++
+			queued = e
+		}
+		if !deadline.IsZero() {
+			left := deadline.Sub(now)
+			if left <= 0 {
+				// 退出排队后唤醒其它请求：排在后面的请求可能已经不用再让位
+				leave()
+				notifyCapacityLocked()
+				capacityMu.Unlock()
+				return nil, &QueueFullError{ModelID: id, RetryAfter: wait, Reason: fmt.Sprintf("no tpm/concurrency headroom within %s", maxWait)}
+			}
+			wait = min(wait, left)
+		}
+		changed := capacityChanged
+		capacityMu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			capacityMu.Lock()
+			leave()
+			notifyCapacityLocked()
+			capacityMu.Unlock()
+			return nil, ctx.Err()
+		case <-changed:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// TryReserveModelCapacity 同 ReserveModelCapacity 但不等待：已有请求在等待或额度不足时立即返回 false。
+// 模型未配置 MaxTPM / MaxConcurrency 时返回 nil, true。
+func TryReserveModelCapacity(modelID string, maxTPM int64, maxConcurrency int, estTokens int64) (*CapacityReservation, bool) {
+	if maxTPM <= 0 && maxConcurrency <= 0 {
+		return nil, true
+	}
+	id := strings.TrimSpace(modelID)
+	now := time.Now()
+	capacityMu.Lock()
+	defer capacityMu.Unlock()
+	e := capacityEntryLocked(id, now)
+	if e.waiting > 0 || !e.fits(maxTPM, maxConcurrency, estTokens) {
+		return nil, false
+	}
+	return e.reserveLocked(id, now, estTokens), true
+}
+
+func (e *capacityEntry) reserveLocked(id string, now time.Time, estTokens int64) *CapacityReservation {
+	r := &CapacityReservation{modelID: id, sample: &capacitySample{at: now, tokens: max(estTokens, 0)}}
+	e.inFlight++
+	e.samples = append(e.samples, r.sample)
+	return r
+}
+
+// Settle 用实际 token 用量校正预占的估算值（可在 Release 之后调用）。
+func (r *CapacityReservation) Settle(actualTokens int64) {
+	if r == nil {
+		return
+	}
+	capacityMu.Lock()
+	defer capacityMu.Unlock()
+	if r.sample == nil {
+		return
+	}
+	shrunk := actualTokens < r.sample.tokens
+	r.sample.tokens = max(actualTokens, 0)
+	if shrunk {
+		notifyCapacityLocked()
+	}
+}
+
+// Release 请求结束时归还并发名额，token 占用保留在窗口内。重复调用只生效一次。
+func (r *CapacityReservation) Release() {
+	r.finish(false)
+}
+
+// Cancel 请求未被该模型处理（失败、客户端取消、对冲的其它请求胜出）时归还并发名额并撤销 token 预占。
+func (r *CapacityReservation) Cancel() {
+	r.finish(true)
+}
+
+func (r *CapacityReservation) finish(dropTokens bool) {
+	if r == nil {
+		return
+	}
+	capacityMu.Lock()
+	defer capacityMu.Unlock()
+	e := capacities[r.modelID]
+	if !r.done {
+		r.done = true
+		if e != nil && e.inFlight > 0 {
+			e.inFlight--
+		}
+	}
+	if dropTokens && r.sample != nil {
+		if e != nil {
+			for i, s := range e.samples {
+				if s == r.sample {
+					e.samples = append(e.samples[:i], e.samples[i+1:]...)
+					break
+				}
+			}
+		}
+		r.sample = nil
+	}
+	notifyCapacityLocked()
+}
+
+// ModelCapacityUsage 返回模型当前的并发数与窗口内的 token 占用（含未完成请求的估算值）。
+func ModelCapacityUsage(modelID string) (inFlight int, tokens int64) {
+	id := strings.TrimSpace(modelID)
+	capacityMu.Lock()
+	defer capacityMu.Unlock()
+	e := capacities[id]
+	if e == nil {
+		return 0, 0
+	}
+	e.prune(time.Now())
+	return e.inFlight, e.usedTokens()
+}
@@ -0,0 +1,115 @@
+package modelstate
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReserveModelCapacity(t *testing.T) {
+	ctx := context.Background()
+	if r, err := ReserveModelCapacity(ctx, "cap-unlimited", 0, 0, 100); r != nil || err != nil {
+		t.Fatalf("unlimited model should not reserve, got %v %v", r, err)
+	}
+
+	// 并发：名额占满后等待，归还后放行
+	r1, err := ReserveModelCapacity(ctx, "cap-conc", 0, 1, 0)
+	if err != nil || r1 == nil {
+		t.Fatal(err)
+	}
+	if HasModelCapacity("cap-conc", 0, 1, 0) {
+		t.Fatal("expect no headroom while the only slot is taken")
+	}
+	got := make(chan *CapacityReservation, 1)
+	go func() {
+		r, _ := ReserveModelCapacity(ctx, "cap-conc", 0, 1, 0)
+		got <- r
+	}()
+	select {
+	case <-got:
+		t.Fatal("second reservation should wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+	r1.Release()
+	select {
+	case r2 := <-got:
+		r2.Release()
+	case <-time.After(time.Second):
+		t.Fatal("second reservation should proceed after release")
+	}
+
+	// TPM：估算值计入窗口，校正后按实际用量计算；取消会撤销预占
+	r3, _ := ReserveModelCapacity(ctx, "cap-tpm", 1000, 0, 800)
+	if HasModelCapacity("cap-tpm", 1000, 0, 300) {
+		t.Fatal("expect 800 + 300 to exceed 1000 tpm")
+	}
+	r3.Settle(200)
+	r3.Release()
+	if !HasModelCapacity("cap-tpm", 1000, 0, 300) {
+		t.Fatal("expect headroom after settling to actual usage")
+	}
+	r4, _ := ReserveModelCapacity(ctx, "cap-tpm", 1000, 0, 700)
+	r4.Cancel()
+	if _, tokens := ModelCapacityUsage("cap-tpm"); tokens != 200 {
+		t.Fatalf("expect cancelled reservation to be dropped, got %d tokens", tokens)
+	}
+
+	cctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := ReserveModelCapacity(cctx, "cap-tpm", 1000, 0, 900); err == nil {
+		t.Fatal("expect ctx error while waiting for tpm headroom")
+	}
+}
+
+func TestAcquireModelCapacityBounded(t *testing.T) {
+	ctx := context.Background()
+	r1, _ := ReserveModelCapacity(ctx, "cap-bounded", 0, 1, 0)
+
+	// 等待超过 maxWait 返回 QueueFullError
+	start := time.Now()
+	_, err := AcquireModelCapacity(ctx, "cap-bounded", 0, 1, 0, 30*time.Millisecond, 0)
+	var qf *QueueFullError
+	if !errors.As(err, &qf) || time.Since(start) > time.Second {
+		t.Fatalf("expect queue full after max wait, got %v", err)
+	}
+
+	// 已有 maxDepth 个请求在等待时立即拒绝
+	got := make(chan *CapacityReservation, 1)
+	go func() {
+		r, _ := AcquireModelCapacity(ctx, "cap-bounded", 0, 1, 0, 0, 1)
+		got <- r
+	}()
+	deadline := time.Now().Add(time.Second)
+	for capacityWaiting("cap-bounded") != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("expect one waiter")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := AcquireModelCapacity(ctx, "cap-bounded", 0, 1, 0, 0, 1); !errors.As(err, &qf) {
+		t.Fatalf("expect queue full at max depth, got %v", err)
+	}
+	// 排队中的请求先于不等待的请求拿到名额
+	r1.Release()
+	if _, ok := TryReserveModelCapacity("cap-bounded", 0, 1, 0); ok {
+		t.Fatal("try reservation must not jump the queue")
+	}
+	select {
+	case r2 := <-got:
+		if r2 != nil {
+			r2.Release()
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiter should proceed after release")
+	}
+}
+
+func capacityWaiting(id string) int {
+	capacityMu.Lock()
+	defer capacityMu.Unlock()
+	if e := capacities[id]; e != nil {
+		return e.waiting
+	}
+	return 0
+}
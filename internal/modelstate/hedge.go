@@ -0,0 +1,63 @@
+package modelstate
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	hedgeStatsMu sync.Mutex
+	hedgeStats   = make(map[string]*HedgeStat) // combo_id -> 对冲统计
+)
+
+// HedgeStat 单个 combo 的对冲统计（进程内累计，重启清零）。
+type HedgeStat struct {
+	ComboID       string  `json:"combo_id"`
+	Requests      int64   `json:"requests"`        // 开启对冲的上游尝试次数
+	Hedged        int64   `json:"hedged"`          // 超过 hedge_after_ms 未出首个 token、发出备份请求的次数
+	BackupWins    int64   `json:"backup_wins"`     // 备份请求先响应的次数
+	HedgeRate     float64 `json:"hedge_rate"`      // Hedged / Requests
+	BackupWinRate float64 `json:"backup_win_rate"` // BackupWins / Hedged
+}
+
+// RecordHedge 记录一次开启对冲的上游尝试：hedged 表示是否发出了备份请求，backupWon 表示备份请求是否胜出。
+func RecordHedge(comboID string, hedged, backupWon bool) {
+	id := strings.TrimSpace(comboID)
+	if id == "" {
+		return
+	}
+	hedgeStatsMu.Lock()
+	defer hedgeStatsMu.Unlock()
+	st := hedgeStats[id]
+	if st == nil {
+		st = &HedgeStat{ComboID: id}
+		hedgeStats[id] = st
+	}
+	st.Requests++
+	if hedged {
+		st.Hedged++
+	}
+	if backupWon {
+		st.BackupWins++
+	}
+}
+
+// HedgeStats 返回所有 combo 的对冲统计，按 combo_id 排序。
+func HedgeStats() []HedgeStat {
+	hedgeStatsMu.Lock()
+	out := make([]HedgeStat, 0, len(hedgeStats))
+	for _, st := range hedgeStats {
+		s := *st
+		if s.Requests > 0 {
+			s.HedgeRate = float64(s.Hedged) / float64(s.Requests)
+		}
+		if s.Hedged > 0 {
+			s.BackupWinRate = float64(s.BackupWins) / float64(s.Hedged)
+		}
+		out = append(out, s)
+	}
+	hedgeStatsMu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].ComboID < out[j].ComboID })
+	return out
+}
@@ -3,20 +3,11 @@ package modelstate
 import (
 	"fmt"
 	"strings"
-	"sync"
 	"time"
 
 	"awesomeProject/pkg/utils"
 )
 
-var (
-	temporarilyDisabledModelMu sync.RWMutex
-	temporarilyDisabledModel   = make(map[string]time.Time) // model_id -> disabled_until
-
-	conversationModelMu sync.RWMutex
-	conversationModel   = make(map[string]ConversationModelEntry) // metadata.user_id -> (model_id, last_seen)
-)
-
 type ConversationModelEntry struct {
 	ModelID  string
 	ComboID  string
@@ -76,54 +67,50 @@ func DisableModelTemporarily(modelID string, ttl time.Duration) {
 		return
 	}
 	disabledUntil := time.Now().Add(ttl)
-	temporarilyDisabledModelMu.Lock()
-	temporarilyDisabledModel[id] = disabledUntil
-	temporarilyDisabledModelMu.Unlock()
+	if err := currentStore().SetDisabled(id, disabledUntil); err != nil {
+		utils.Logger.Printf("[ClaudeRouter] model_disable failed: model=%s err=%v", id, err)
+		return
+	}
 	utils.Logger.Printf("[ClaudeRouter] model_disable: model=%s disabled_until=%s ttl=%s", id, disabledUntil.Format(time.RFC3339), ttl)
 }
 
-// IsModelTemporarilyDisabled 检查模型是否被临时禁用
+// IsModelTemporarilyDisabled 检查模型是否被临时禁用或熔断（打开，或半开且试探请求已发出）；存储出错时视为未禁用
 func IsModelTemporarilyDisabled(modelID string) bool {
 	id := strings.TrimSpace(modelID)
 	if id == "" {
 		return false
 	}
 	now := time.Now()
-	temporarilyDisabledModelMu.RLock()
-	disabledUntil, ok := temporarilyDisabledModel[id]
-	temporarilyDisabledModelMu.RUnlock()
-	if !ok {
+	s := currentStore()
+	disabledUntil, ok, err := s.DisabledUntil(id)
+	if err != nil {
+		utils.Logger.Printf("[ClaudeRouter] model_disable lookup failed: model=%s err=%v", id, err)
 		return false
 	}
-	if now.Before(disabledUntil) {
+	if ok && now.Before(disabledUntil) {
 		return true
 	}
-	temporarilyDisabledModelMu.Lock()
-	if currentUntil, currentOK := temporarilyDisabledModel[id]; currentOK && !now.Before(currentUntil) {
-		delete(temporarilyDisabledModel, id)
+	if ok {
+		_ = s.DeleteDisabledBefore(id, now)
 	}
-	temporarilyDisabledModelMu.Unlock()
-	return false
+	return breakerRejects(id, now)
 }
 
 // CleanupTemporarilyDisabledModels 清理过期的临时禁用模型
 func CleanupTemporarilyDisabledModels() {
-	now := time.Now()
-	temporarilyDisabledModelMu.Lock()
-	for k, until := range temporarilyDisabledModel {
-		if !now.Before(until) {
-			delete(temporarilyDisabledModel, k)
-		}
+	if err := currentStore().DeleteDisabledBefore("", time.Now()); err != nil {
+		utils.Logger.Printf("[ClaudeRouter] model_disable cleanup failed: %v", err)
 	}
-	temporarilyDisabledModelMu.Unlock()
 }
 
-// ClearAllTemporarilyDisabledModels 清除所有临时禁用的模型（当没有可用模型时调用）
+// ClearAllTemporarilyDisabledModels 清除所有临时禁用的模型（当没有可用模型时调用）。
+// 熔断器的状态不受影响：它只在本次选择中被忽略，仍按各自的打开时长恢复。
 func ClearAllTemporarilyDisabledModels() {
-	temporarilyDisabledModelMu.Lock()
-	count := len(temporarilyDisabledModel)
-	temporarilyDisabledModel = make(map[string]time.Time)
-	temporarilyDisabledModelMu.Unlock()
+	count, err := currentStore().ClearDisabled()
+	if err != nil {
+		utils.Logger.Printf("[ClaudeRouter] model_disable clear failed: %v", err)
+		return
+	}
 	if count > 0 {
 		utils.Logger.Printf("[ClaudeRouter] model_disable_cleared: cleared_count=%d reason=no_available_models", count)
 	}
@@ -136,25 +123,23 @@ func GetConversationModel(conversationID string) (string, bool) {
 		return "", false
 	}
 	now := time.Now()
-	conversationModelMu.RLock()
-	ent := conversationModel[id]
-	conversationModelMu.RUnlock()
+	s := currentStore()
+	ent, _, err := s.GetConversation(id)
+	if err != nil {
+		utils.Logger.Printf("[ClaudeRouter] conversation_model lookup failed: conversation_id=%s err=%v", id, err)
+		return "", false
+	}
 
 	if ent.ModelID == "" {
 		return "", false
 	}
 	// TTL 过期视为未缓存
 	if ent.LastSeen.IsZero() || now.Sub(ent.LastSeen) > ConversationModelTTL {
-		conversationModelMu.Lock()
-		delete(conversationModel, id)
-		conversationModelMu.Unlock()
+		_ = s.DeleteConversation(id)
 		return "", false
 	}
 	// 更新 last_seen
-	conversationModelMu.Lock()
-	ent.LastSeen = now
-	conversationModel[id] = ent
-	conversationModelMu.Unlock()
+	_ = s.TouchConversation(id, now)
 	return ent.ModelID, true
 }
 
@@ -164,11 +149,8 @@ func GetConversationCombo(conversationID string) (string, bool) {
 	if id == "" {
 		return "", false
 	}
-	conversationModelMu.RLock()
-	ent := conversationModel[id]
-	conversationModelMu.RUnlock()
-
-	if ent.ComboID == "" {
+	ent, _, err := currentStore().GetConversation(id)
+	if err != nil || ent.ComboID == "" {
 		return "", false
 	}
 	return ent.ComboID, true
@@ -186,13 +168,14 @@ func SetConversationModelWithCombo(conversationID, modelID, comboID string) {
 	if cid == "" || mid == "" {
 		return
 	}
-	conversationModelMu.Lock()
-	conversationModel[cid] = ConversationModelEntry{
+	if err := currentStore().SetConversation(cid, ConversationModelEntry{
 		ModelID:  mid,
 		ComboID:  comboID,
 		LastSeen: time.Now(),
+	}); err != nil {
+		utils.Logger.Printf("[ClaudeRouter] conversation_model_set failed: conversation_id=%s err=%v", cid, err)
+		return
 	}
-	conversationModelMu.Unlock()
 	if comboID != "" {
 		utils.Logger.Printf("[ClaudeRouter] conversation_model_set: conversation_id=%s model=%s combo=%s", cid, mid, comboID)
 	} else {
@@ -206,21 +189,17 @@ func ClearConversationModel(conversationID string) {
 	if id == "" {
 		return
 	}
-	conversationModelMu.Lock()
-	delete(conversationModel, id)
-	conversationModelMu.Unlock()
+	if err := currentStore().DeleteConversation(id); err != nil {
+		utils.Logger.Printf("[ClaudeRouter] conversation_model_clear failed: conversation_id=%s err=%v", id, err)
+		return
+	}
 	utils.Logger.Printf("[ClaudeRouter] conversation_model_cleared: conversation_id=%s", id)
 }
 
 // CleanupConversationModels 清理过期的对话级模型缓存
 func CleanupConversationModels() {
-	now := time.Now()
-	cutoff := now.Add(-ConversationModelTTL)
-	conversationModelMu.Lock()
-	for k, v := range conversationModel {
-		if v.ModelID == "" || v.LastSeen.Before(cutoff) {
-			delete(conversationModel, k)
-		}
+	cutoff := time.Now().Add(-ConversationModelTTL)
+	if err := currentStore().DeleteConversationsBefore(cutoff); err != nil {
+		utils.Logger.Printf("[ClaudeRouter] conversation_model cleanup failed: %v", err)
 	}
-	conversationModelMu.Unlock()
 }
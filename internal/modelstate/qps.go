@@ -0,0 +1,146 @@
+package modelstate
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// qpsLimiters 按模型 ID 的 QPS 令牌桶与排队数；MaxQPS 变更时重建对应 limiter。
+var (
+	qpsMu       sync.Mutex
+	qpsLimiters = make(map[string]*qpsEntry)
+)
+
+type qpsEntry struct {
+	limiter  *rate.Limiter
+	qps      float64
+	waiting  int // 正在排队等待令牌的请求数
+	lastUsed time.Time
+}
+
+// QueueFullError 模型的等待队列已满或预计等待超过上限，请求应立即以 429 拒绝（或换其它模型）。
+type QueueFullError struct {
+	ModelID    string
+	RetryAfter time.Duration
+	Reason     string
+}
+
+func (e *QueueFullError) Error() string {
+	return fmt.Sprintf("model %s is busy: %s", e.ModelID, e.Reason)
+}
+
+func qpsEntryLocked(id string, maxQPS float64, now time.Time) *qpsEntry {
+	e, ok := qpsLimiters[id]
+	if !ok || e.qps != maxQPS {
+		e = &qpsEntry{limiter: rate.NewLimiter(rate.Limit(maxQPS), 1), qps: maxQPS}
+		qpsLimiters[id] = e
+	}
+	e.lastUsed = now
+	return e
+}
+
+// AcquireModelQPS 若 maxQPS > 0，按令牌桶排队直到可以发出请求。
+// maxWait > 0 时预计等待超过该值、maxDepth > 0 时已有 maxDepth 个请求在排队，立即返回 *QueueFullError；
+// ctx 结束时返回 ctx.Err()。
+func AcquireModelQPS(ctx context.Context, modelID string, maxQPS float64, maxWait time.Duration, maxDepth int) error {
+	if maxQPS <= 0 {
+		return nil
+	}
+	id := strings.TrimSpace(modelID)
+	now := time.Now()
+	qpsMu.Lock()
+	e := qpsEntryLocked(id, maxQPS, now)
+	r := e.limiter.ReserveN(now, 1)
+	delay := r.DelayFrom(now)
+	if delay <= 0 {
+		qpsMu.Unlock()
+		return nil
+	}
+	switch {
+	case maxWait > 0 && delay > maxWait:
+		r.CancelAt(now)
+		qpsMu.Unlock()
+		return &QueueFullError{ModelID: id, RetryAfter: delay, Reason: fmt.Sprintf("queue wait %s exceeds %s", delay.Round(time.Millisecond), maxWait)}
+	case maxDepth > 0 && e.waiting >= maxDepth:
+		queued := e.waiting
+		r.CancelAt(now)
+		qpsMu.Unlock()
+		return &QueueFullError{ModelID: id, RetryAfter: delay, Reason: fmt.Sprintf("%d requests already queued", queued)}
+	}
+	e.waiting++
+	qpsMu.Unlock()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		r.Cancel()
+		err = ctx.Err()
+	}
+	qpsMu.Lock()
+	e.waiting--
+	qpsMu.Unlock()
+	return err
+}
+
+// TryAcquireModelQPS 不排队地获取一个 QPS 令牌：已有请求在排队或令牌不足时返回 false（未配置 QPS 时总是 true）。
+func TryAcquireModelQPS(modelID string, maxQPS float64) bool {
+	if maxQPS <= 0 {
+		return true
+	}
+	id := strings.TrimSpace(modelID)
+	now := time.Now()
+	qpsMu.Lock()
+	defer qpsMu.Unlock()
+	e := qpsEntryLocked(id, maxQPS, now)
+	return e.waiting == 0 && e.limiter.AllowN(now, 1)
+}
+
+// HasQPSHeadroom 模型此刻是否无需排队即可发出请求（未配置 QPS 时总是 true）。
+func HasQPSHeadroom(modelID string, maxQPS float64) bool {
+	if maxQPS <= 0 {
+		return true
+	}
+	id := strings.TrimSpace(modelID)
+	qpsMu.Lock()
+	defer qpsMu.Unlock()
+	e, ok := qpsLimiters[id]
+	if !ok || e.qps != maxQPS {
+		return true
+	}
+	return e.waiting == 0 && e.limiter.Tokens() >= 1
+}
+
+// QueuedRequests 返回模型当前排队等待 QPS 令牌的请求数。
+func QueuedRequests(modelID string) int {
+	qpsMu.Lock()
+	defer qpsMu.Unlock()
+	if e := qpsLimiters[strings.TrimSpace(modelID)]; e != nil {
+		return e.waiting
+	}
+	return 0
+}
+
+// 定期清理超过 1 小时未使用的 limiter 以防内存泄漏。
+func init() {
+	go func() {
+		for {
+			time.Sleep(10 * time.Minute)
+			qpsMu.Lock()
+			now := time.Now()
+			for id, e := range qpsLimiters {
+				if e.waiting == 0 && now.Sub(e.lastUsed) > time.Hour {
+					delete(qpsLimiters, id)
+				}
+			}
+			qpsMu.Unlock()
+		}
+	}()
+}
@@ -0,0 +1,41 @@
+package modelstate
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAcquireModelQPSBounded(t *testing.T) {
+	ctx := context.Background()
+	// 1 QPS：第一个请求立即通过，第二个需要约 1s
+	if err := AcquireModelQPS(ctx, "qps-bounded", 1, 100*time.Millisecond, 0); err != nil {
+		t.Fatal(err)
+	}
+	if HasQPSHeadroom("qps-bounded", 1) {
+		t.Fatal("expect no headroom right after the only token was taken")
+	}
+	var full *QueueFullError
+	err := AcquireModelQPS(ctx, "qps-bounded", 1, 100*time.Millisecond, 0)
+	if !errors.As(err, &full) || full.RetryAfter <= 100*time.Millisecond {
+		t.Fatalf("expect queue wait to exceed max wait, got %v", err)
+	}
+
+	// 排队深度：一个请求在排队时，第二个立即被拒
+	if err := AcquireModelQPS(ctx, "qps-depth", 5, 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- AcquireModelQPS(ctx, "qps-depth", 5, 0, 1) }()
+	deadline := time.Now().Add(time.Second)
+	for QueuedRequests("qps-depth") == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if err := AcquireModelQPS(ctx, "qps-depth", 5, 0, 1); !errors.As(err, &full) {
+		t.Fatalf("expect queue depth to be exceeded, got %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("queued request should proceed, got %v", err)
+	}
+}
@@ -0,0 +1,239 @@
+package modelstate
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"awesomeProject/pkg/utils"
+)
+
+var (
+	// MaxRateLimitDisable 按上游限流头禁用模型或暂停 key 的最长时间，避免按天重置的额度把模型禁用太久
+	MaxRateLimitDisable = time.Hour
+	// rateLimitFreshness 429 响应的限流信息在多长时间内可用于禁用模型
+	rateLimitFreshness = time.Minute
+)
+
+// RateLimitBucket 一类限流额度（requests / tokens / input_tokens / output_tokens）的上游数值，未返回的字段为 nil。
+type RateLimitBucket struct {
+	Limit     *int64     `json:"limit,omitempty"`
+	Remaining *int64     `json:"remaining,omitempty"`
+	Reset     *time.Time `json:"reset,omitempty"`
+}
+
+// RateLimitInfo 一次上游响应头中的限流信息：Retry-After、anthropic-ratelimit-* 与 x-ratelimit-*。
+type RateLimitInfo struct {
+	ModelID    string                      `json:"model_id"`
+	Key        string                      `json:"key,omitempty"` // key 池中 key 的展示名，单 key 时为空
+	StatusCode int                         `json:"status_code"`
+	RetryAt    time.Time                   `json:"retry_at,omitempty"` // 由 Retry-After 得出
+	Buckets    map[string]*RateLimitBucket `json:"buckets,omitempty"`
+	ObservedAt time.Time                   `json:"observed_at"`
+}
+
+var rateLimitBucketNames = []string{"requests", "tokens", "input-tokens", "output-tokens"}
+
+// ParseRateLimitHeaders 解析上游响应头中的限流信息，没有任何限流头时返回 false。支持：
+//   - Retry-After（秒数或 HTTP 日期）与 retry-after-ms
+//   - anthropic-ratelimit-{requests,tokens,input-tokens,output-tokens}-{limit,remaining,reset}，reset 为 RFC3339 时间
+//   - x-ratelimit-{limit,remaining,reset}-{requests,tokens}，reset 为时长（如 "1s"、"6m0s"、"20ms"）、秒数或 unix 时间戳
+func ParseRateLimitHeaders(statusCode int, h http.Header, now time.Time) (RateLimitInfo, bool) {
+	info := RateLimitInfo{StatusCode: statusCode, ObservedAt: now}
+	if h == nil {
+		return info, false
+	}
+	found := false
+	if ms, err := strconv.ParseFloat(strings.TrimSpace(h.Get("retry-after-ms")), 64); err == nil && ms >= 0 {
+		info.RetryAt = now.Add(time.Duration(ms * float64(time.Millisecond)))
+		found = true
+	} else if t, ok := parseRetryAfter(h.Get("Retry-After"), now); ok {
+		info.RetryAt = t
+		found = true
+	}
+
+	bucket := func(name string) *RateLimitBucket {
+		key := strings.ReplaceAll(name, "-", "_")
+		if info.Buckets == nil {
+			info.Buckets = make(map[string]*RateLimitBucket)
+		}
+		if info.Buckets[key] == nil {
+			info.Buckets[key] = &RateLimitBucket{}
+		}
+		found = true
+		return info.Buckets[key]
+	}
+	for _, name := range rateLimitBucketNames {
+		for _, hdr := range []struct {
+			limit, remaining, reset string
+		}{
+			{"anthropic-ratelimit-" + name + "-limit", "anthropic-ratelimit-" + name + "-remaining", "anthropic-ratelimit-" + name + "-reset"},
+			{"x-ratelimit-limit-" + name, "x-ratelimit-remaining-" + name, "x-ratelimit-reset-" + name},
+		} {
+			if v, ok := parseHeaderInt(h.Get(hdr.limit)); ok {
+				bucket(name).Limit = &v
+			}
+			if v, ok := parseHeaderInt(h.Get(hdr.remaining)); ok {
+				bucket(name).Remaining = &v
+			}
+			if t, ok := parseResetTime(h.Get(hdr.reset), now); ok {
+				bucket(name).Reset = &t
+			}
+		}
+	}
+	return info, found
+}
+
+// LimitedUntil 被限流时的恢复时间：优先使用 Retry-After；否则取剩余额度为 0 的各类额度中最晚的重置时间，
+// 没有剩余额度信息时取所有重置时间中最晚的。结果不超过 now+MaxRateLimitDisable，已过去或无信息时返回零值。
+func (r RateLimitInfo) LimitedUntil(now time.Time) time.Time {
+	until := r.RetryAt
+	if until.IsZero() {
+		var exhausted, latest time.Time
+		for _, b := range r.Buckets {
+			if b.Reset == nil {
+				continue
+			}
+			if b.Reset.After(latest) {
+				latest = *b.Reset
+			}
+			if b.Remaining != nil && *b.Remaining <= 0 && b.Reset.After(exhausted) {
+				exhausted = *b.Reset
+			}
+		}
+		until = exhausted
+		if until.IsZero() {
+			until = latest
+		}
+	}
+	if !until.After(now) {
+		return time.Time{}
+	}
+	if limit := now.Add(MaxRateLimitDisable); until.After(limit) {
+		until = limit
+	}
+	return until
+}
+
+func parseRetryAfter(v string, now time.Time) (time.Time, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return time.Time{}, false
+	}
+	if secs, err := strconv.ParseFloat(v, 64); err == nil && secs >= 0 {
+		return now.Add(time.Duration(secs * float64(time.Second))), true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+func parseResetTime(v string, now time.Time) (time.Time, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return time.Time{}, false
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, true
+	}
+	if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+		return now.Add(d), true
+	}
+	if n, err := strconv.ParseFloat(v, 64); err == nil && n >= 0 {
+		// 部分上游返回 unix 时间戳而不是剩余秒数
+		if n > 1e9 {
+			sec, frac := math.Modf(n)
+			return time.Unix(int64(sec), int64(frac*1e9)), true
+		}
+		return now.Add(time.Duration(n * float64(time.Second))), true
+	}
+	return time.Time{}, false
+}
+
+func parseHeaderInt(v string) (int64, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, false
+	}
+	if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return n, true
+	}
+	if f, err := strconv.ParseFloat(v, 64); err == nil {
+		return int64(f), true
+	}
+	return 0, false
+}
+
+var (
+	rateLimitMu sync.Mutex
+	rateLimits  = make(map[string]RateLimitInfo) // model_id + "\x00" + key -> 最近一次的限流信息
+)
+
+// RecordRateLimit 记录模型（及 key）最近一次响应的限流信息，供管理接口展示与 RecordRateLimitFailure 使用。
+func RecordRateLimit(info RateLimitInfo) {
+	id := strings.TrimSpace(info.ModelID)
+	if id == "" {
+		return
+	}
+	info.ModelID = id
+	rateLimitMu.Lock()
+	rateLimits[id+"\x00"+info.Key] = info
+	rateLimitMu.Unlock()
+}
+
+// RateLimitSnapshots 返回各模型/key 最近一次的限流信息，按 model_id、key 排序。
+func RateLimitSnapshots() []RateLimitInfo {
+	rateLimitMu.Lock()
+	out := make([]RateLimitInfo, 0, len(rateLimits))
+	for _, info := range rateLimits {
+		out = append(out, info)
+	}
+	rateLimitMu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].ModelID != out[j].ModelID {
+			return out[i].ModelID < out[j].ModelID
+		}
+		return out[i].Key < out[j].Key
+	})
+	return out
+}
+
+// rateLimitedUntil 该模型最近的 429 响应给出的恢复时间；使用 key 池时取各 key 中最早恢复的时间。
+func rateLimitedUntil(id string, now time.Time) time.Time {
+	rateLimitMu.Lock()
+	defer rateLimitMu.Unlock()
+	var until time.Time
+	for _, info := range rateLimits {
+		if info.ModelID != id || info.StatusCode != http.StatusTooManyRequests || now.Sub(info.ObservedAt) > rateLimitFreshness {
+			continue
+		}
+		if t := info.LimitedUntil(now); !t.IsZero() && (until.IsZero() || t.Before(until)) {
+			until = t
+		}
+	}
+	return until
+}
+
+// RecordRateLimitFailure 记录一次上游限流失败：最近的 429 响应头给出了恢复时间时禁用模型到该时间（不计入熔断），
+// 否则与其他失败一样交给 RecordModelFailure。
+func RecordRateLimitFailure(modelID string) {
+	id := strings.TrimSpace(modelID)
+	if id == "" {
+		return
+	}
+	until := rateLimitedUntil(id, time.Now())
+	if until.IsZero() {
+		RecordModelFailure(id)
+		return
+	}
+	if err := currentStore().SetDisabled(id, until); err != nil {
+		utils.Logger.Printf("[ClaudeRouter] model_disable failed: model=%s err=%v", id, err)
+		return
+	}
+	utils.Logger.Printf("[ClaudeRouter] model_disable: model=%s disabled_until=%s reason=upstream rate limit reset", id, until.Format(time.RFC3339))
+}
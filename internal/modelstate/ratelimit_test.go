@@ -0,0 +1,68 @@
+package modelstate
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimitHeaders(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	h := http.Header{}
+	h.Set("anthropic-ratelimit-tokens-limit", "80000")
+	h.Set("anthropic-ratelimit-tokens-remaining", "0")
+	h.Set("anthropic-ratelimit-tokens-reset", "2026-01-01T12:00:30Z")
+	h.Set("anthropic-ratelimit-requests-remaining", "12")
+	h.Set("anthropic-ratelimit-requests-reset", "2026-01-01T12:05:00Z")
+	info, ok := ParseRateLimitHeaders(http.StatusTooManyRequests, h, now)
+	if !ok || *info.Buckets["tokens"].Limit != 80000 || *info.Buckets["requests"].Remaining != 12 {
+		t.Fatalf("unexpected info: %+v", info)
+	}
+	// 只有 tokens 用完，恢复时间取 tokens 的重置时间
+	if got := info.LimitedUntil(now); !got.Equal(now.Add(30 * time.Second)) {
+		t.Fatalf("expect tokens reset, got %s", got)
+	}
+
+	h = http.Header{}
+	h.Set("x-ratelimit-remaining-requests", "0")
+	h.Set("x-ratelimit-reset-requests", "6m0s")
+	h.Set("x-ratelimit-reset-tokens", "20ms")
+	info, _ = ParseRateLimitHeaders(http.StatusTooManyRequests, h, now)
+	if got := info.LimitedUntil(now); !got.Equal(now.Add(6 * time.Minute)) {
+		t.Fatalf("expect requests reset, got %s", got)
+	}
+
+	// Retry-After 优先，且不超过 MaxRateLimitDisable
+	h.Set("Retry-After", "7")
+	info, _ = ParseRateLimitHeaders(http.StatusTooManyRequests, h, now)
+	if got := info.LimitedUntil(now); !got.Equal(now.Add(7 * time.Second)) {
+		t.Fatalf("expect retry-after, got %s", got)
+	}
+	h.Set("Retry-After", now.Add(48*time.Hour).Format(http.TimeFormat))
+	info, _ = ParseRateLimitHeaders(http.StatusTooManyRequests, h, now)
+	if got := info.LimitedUntil(now); !got.Equal(now.Add(MaxRateLimitDisable)) {
+		t.Fatalf("expect capped retry-after, got %s", got)
+	}
+
+	if _, ok := ParseRateLimitHeaders(http.StatusOK, http.Header{"Content-Type": {"application/json"}}, now); ok {
+		t.Fatal("expect no rate limit info")
+	}
+}
+
+func TestRecordRateLimitFailureDisablesUntilReset(t *testing.T) {
+	now := time.Now()
+	h := http.Header{}
+	h.Set("Retry-After", "120")
+	info, _ := ParseRateLimitHeaders(http.StatusTooManyRequests, h, now)
+	info.ModelID = "rl-model"
+	RecordRateLimit(info)
+
+	RecordRateLimitFailure("rl-model")
+	if !IsModelTemporarilyDisabled("rl-model") {
+		t.Fatal("expect model disabled until retry-after")
+	}
+	if got := RateLimitSnapshots(); len(got) == 0 || got[0].ModelID != "rl-model" {
+		t.Fatalf("expect snapshot recorded, got %+v", got)
+	}
+}
@@ -0,0 +1,88 @@
+package modelstate
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"awesomeProject/pkg/utils"
+)
+
+// DisabledModel 一个处于临时禁用（或熔断打开）状态的模型。
+type DisabledModel struct {
+	ModelID       string    `json:"model_id"`
+	DisabledUntil time.Time `json:"disabled_until"`
+	Breaker       string    `json:"breaker,omitempty"` // 熔断器状态（开启熔断器时）
+}
+
+// ConversationPin 一条对话级模型缓存。
+type ConversationPin struct {
+	ConversationID string    `json:"conversation_id"`
+	ModelID        string    `json:"model_id"`
+	ComboID        string    `json:"combo_id,omitempty"`
+	LastSeen       time.Time `json:"last_seen"`
+	ExpiresAt      time.Time `json:"expires_at"` // 之后没有新请求则缓存失效
+}
+
+// ListTemporarilyDisabledModels 返回当前被临时禁用的模型（含熔断打开与半开试探中的模型），按 model_id 排序。
+func ListTemporarilyDisabledModels() ([]DisabledModel, error) {
+	now := time.Now()
+	disabled, err := currentStore().ListDisabled()
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]*DisabledModel, len(disabled))
+	for id, until := range disabled {
+		if now.Before(until) {
+			byID[id] = &DisabledModel{ModelID: id, DisabledUntil: until}
+		}
+	}
+	for _, st := range BreakerStatuses() {
+		if st.State == BreakerClosed || (st.State == BreakerHalfOpen && !st.TrialInUse) {
+			continue
+		}
+		d := byID[st.ModelID]
+		if d == nil {
+			d = &DisabledModel{ModelID: st.ModelID, DisabledUntil: st.OpenUntil}
+			byID[st.ModelID] = d
+		}
+		d.Breaker = st.State
+	}
+	out := make([]DisabledModel, 0, len(byID))
+	for _, d := range byID {
+		out = append(out, *d)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ModelID < out[j].ModelID })
+	return out, nil
+}
+
+// EnableModel 手动解除模型的临时禁用，并关闭其熔断器。
+func EnableModel(modelID string) {
+	id := strings.TrimSpace(modelID)
+	if id == "" {
+		return
+	}
+	ResetBreaker(id)
+	utils.Logger.Printf("[ClaudeRouter] model_enable: model=%s", id)
+}
+
+// ListConversationModels 返回未过期的对话级模型缓存，按 last_seen 倒序。
+func ListConversationModels() ([]ConversationPin, error) {
+	ttl := ConversationModelTTL
+	entries, err := currentStore().ListConversations(time.Now().Add(-ttl))
+	if err != nil {
+		return nil, err
+	}
+	out := make([]ConversationPin, 0, len(entries))
+	for id, ent := range entries {
+		out = append(out, ConversationPin{
+			ConversationID: id,
+			ModelID:        ent.ModelID,
+			ComboID:        ent.ComboID,
+			LastSeen:       ent.LastSeen,
+			ExpiresAt:      ent.LastSeen.Add(ttl),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].LastSeen.After(out[j].LastSeen) })
+	return out, nil
+}
@@ -0,0 +1,97 @@
+package modelstate
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyEWMAAlpha 延迟指数滑动平均的平滑系数，越大越偏向最近的观测值。
+const latencyEWMAAlpha = 0.3
+
+var (
+	modelStatsMu sync.RWMutex
+	modelStats   = make(map[string]*modelStatsEntry) // model_id -> 运行时统计
+)
+
+type modelStatsEntry struct {
+	inFlight    int64
+	latencyMs   float64 // 观测延迟的 EWMA（毫秒）
+	samples     int64
+	lastUpdated time.Time
+}
+
+// BeginModelRequest 记录一次发往该模型的在途请求，返回的 release 在请求结束时调用（可重复调用，仅第一次生效）。
+func BeginModelRequest(modelID string) func() {
+	id := strings.TrimSpace(modelID)
+	if id == "" {
+		return func() {}
+	}
+	modelStatsMu.Lock()
+	ent := modelStats[id]
+	if ent == nil {
+		ent = &modelStatsEntry{}
+		modelStats[id] = ent
+	}
+	ent.inFlight++
+	ent.lastUpdated = time.Now()
+	modelStatsMu.Unlock()
+	claimBreakerTrial(id, time.Now())
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			modelStatsMu.Lock()
+			if e := modelStats[id]; e != nil && e.inFlight > 0 {
+				e.inFlight--
+			}
+			modelStatsMu.Unlock()
+		})
+	}
+}
+
+// InFlight 返回该模型当前的在途请求数。
+func InFlight(modelID string) int64 {
+	id := strings.TrimSpace(modelID)
+	modelStatsMu.RLock()
+	defer modelStatsMu.RUnlock()
+	if ent := modelStats[id]; ent != nil {
+		return ent.inFlight
+	}
+	return 0
+}
+
+// ObserveModelLatency 记录一次成功请求的上游延迟（流式为首包时间，非流式为完整响应时间）。
+func ObserveModelLatency(modelID string, d time.Duration) {
+	id := strings.TrimSpace(modelID)
+	if id == "" || d < 0 {
+		return
+	}
+	ms := float64(d) / float64(time.Millisecond)
+	modelStatsMu.Lock()
+	ent := modelStats[id]
+	if ent == nil {
+		ent = &modelStatsEntry{}
+		modelStats[id] = ent
+	}
+	if ent.samples == 0 {
+		ent.latencyMs = ms
+	} else {
+		ent.latencyMs = ent.latencyMs*(1-latencyEWMAAlpha) + ms*latencyEWMAAlpha
+	}
+	ent.samples++
+	ent.lastUpdated = time.Now()
+	modelStatsMu.Unlock()
+}
+
+// ModelLatency 返回该模型的观测延迟（EWMA），尚无样本时 ok=false。
+func ModelLatency(modelID string) (time.Duration, bool) {
+	id := strings.TrimSpace(modelID)
+	modelStatsMu.RLock()
+	defer modelStatsMu.RUnlock()
+	ent := modelStats[id]
+	if ent == nil || ent.samples == 0 {
+		return 0, false
+	}
+	return time.Duration(ent.latencyMs * float64(time.Millisecond)), true
+}
@@ -0,0 +1,203 @@
+package modelstate
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Store 保存模型临时禁用状态与对话级模型缓存。默认使用进程内存；
+// 多个实例部署在负载均衡后面时使用 SQL 实现共享同一份路由状态。
+// 过期判断由调用方完成，Store 只负责读写与按时间清理。
+type Store interface {
+	// SetDisabled 设置模型的禁用截止时间
+	SetDisabled(modelID string, until time.Time) error
+	// DisabledUntil 返回模型的禁用截止时间，未禁用时 ok=false
+	DisabledUntil(modelID string) (until time.Time, ok bool, err error)
+	// DeleteDisabledBefore 删除截止时间早于等于 now 的禁用记录；modelID 非空时只处理该模型
+	DeleteDisabledBefore(modelID string, now time.Time) error
+	// DeleteDisabled 删除模型的禁用记录（无论是否过期）
+	DeleteDisabled(modelID string) error
+	// ClearDisabled 清除所有禁用记录，返回清除的数量
+	ClearDisabled() (int64, error)
+	// ListDisabled 返回所有禁用记录（含已过期但尚未清理的）
+	ListDisabled() (map[string]time.Time, error)
+
+	// GetConversation 获取对话缓存
+	GetConversation(conversationID string) (ConversationModelEntry, bool, error)
+	// SetConversation 写入对话缓存
+	SetConversation(conversationID string, ent ConversationModelEntry) error
+	// TouchConversation 更新对话缓存的 last_seen
+	TouchConversation(conversationID string, lastSeen time.Time) error
+	// DeleteConversation 删除对话缓存
+	DeleteConversation(conversationID string) error
+	// DeleteConversationsBefore 删除 last_seen 早于 cutoff 的对话缓存
+	DeleteConversationsBefore(cutoff time.Time) error
+	// ListConversations 返回 last_seen 不早于 since 的对话缓存
+	ListConversations(since time.Time) (map[string]ConversationModelEntry, error)
+}
+
+var (
+	storeMu sync.RWMutex
+	store   Store = NewMemoryStore()
+)
+
+// SetStore 替换路由状态的存储实现（启动时调用）。
+func SetStore(s Store) {
+	if s == nil {
+		return
+	}
+	storeMu.Lock()
+	store = s
+	storeMu.Unlock()
+}
+
+func currentStore() Store {
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	return store
+}
+
+// NewStore 按配置创建存储：memory（默认）或 sql（使用 db，需已迁移 ModelDisableState/ConversationState）。
+func NewStore(kind string, db *gorm.DB) (Store, error) {
+	switch strings.ToLower(strings.TrimSpace(kind)) {
+	case "", "memory":
+		return NewMemoryStore(), nil
+	case "sql", "db", "database":
+		if db == nil {
+			return nil, fmt.Errorf("model_disable.store=%s requires a database", kind)
+		}
+		return NewSQLStore(db), nil
+	}
+	return nil, fmt.Errorf("unknown model_disable.store %q, expect memory or sql", kind)
+}
+
+// memoryStore 进程内实现，重启后状态丢失。
+type memoryStore struct {
+	disabledMu sync.RWMutex
+	disabled   map[string]time.Time // model_id -> disabled_until
+
+	conversationMu sync.RWMutex
+	conversations  map[string]ConversationModelEntry // metadata.user_id -> (model_id, last_seen)
+}
+
+// NewMemoryStore 创建进程内存储。
+func NewMemoryStore() Store {
+	return &memoryStore{
+		disabled:      make(map[string]time.Time),
+		conversations: make(map[string]ConversationModelEntry),
+	}
+}
+
+func (s *memoryStore) SetDisabled(modelID string, until time.Time) error {
+	s.disabledMu.Lock()
+	s.disabled[modelID] = until
+	s.disabledMu.Unlock()
+	return nil
+}
+
+func (s *memoryStore) DisabledUntil(modelID string) (time.Time, bool, error) {
+	s.disabledMu.RLock()
+	until, ok := s.disabled[modelID]
+	s.disabledMu.RUnlock()
+	return until, ok, nil
+}
+
+func (s *memoryStore) DeleteDisabledBefore(modelID string, now time.Time) error {
+	s.disabledMu.Lock()
+	defer s.disabledMu.Unlock()
+	if modelID != "" {
+		if until, ok := s.disabled[modelID]; ok && !now.Before(until) {
+			delete(s.disabled, modelID)
+		}
+		return nil
+	}
+	for k, until := range s.disabled {
+		if !now.Before(until) {
+			delete(s.disabled, k)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) DeleteDisabled(modelID string) error {
+	s.disabledMu.Lock()
+	delete(s.disabled, modelID)
+	s.disabledMu.Unlock()
+	return nil
+}
+
+func (s *memoryStore) ClearDisabled() (int64, error) {
+	s.disabledMu.Lock()
+	count := len(s.disabled)
+	s.disabled = make(map[string]time.Time)
+	s.disabledMu.Unlock()
+	return int64(count), nil
+}
+
+func (s *memoryStore) ListDisabled() (map[string]time.Time, error) {
+	s.disabledMu.RLock()
+	out := make(map[string]time.Time, len(s.disabled))
+	for k, v := range s.disabled {
+		out[k] = v
+	}
+	s.disabledMu.RUnlock()
+	return out, nil
+}
+
+func (s *memoryStore) GetConversation(conversationID string) (ConversationModelEntry, bool, error) {
+	s.conversationMu.RLock()
+	ent, ok := s.conversations[conversationID]
+	s.conversationMu.RUnlock()
+	return ent, ok, nil
+}
+
+func (s *memoryStore) SetConversation(conversationID string, ent ConversationModelEntry) error {
+	s.conversationMu.Lock()
+	s.conversations[conversationID] = ent
+	s.conversationMu.Unlock()
+	return nil
+}
+
+func (s *memoryStore) TouchConversation(conversationID string, lastSeen time.Time) error {
+	s.conversationMu.Lock()
+	if ent, ok := s.conversations[conversationID]; ok {
+		ent.LastSeen = lastSeen
+		s.conversations[conversationID] = ent
+	}
+	s.conversationMu.Unlock()
+	return nil
+}
+
+func (s *memoryStore) DeleteConversation(conversationID string) error {
+	s.conversationMu.Lock()
+	delete(s.conversations, conversationID)
+	s.conversationMu.Unlock()
+	return nil
+}
+
+func (s *memoryStore) DeleteConversationsBefore(cutoff time.Time) error {
+	s.conversationMu.Lock()
+	for k, v := range s.conversations {
+		if v.ModelID == "" || v.LastSeen.Before(cutoff) {
+			delete(s.conversations, k)
+		}
+	}
+	s.conversationMu.Unlock()
+	return nil
+}
+
+func (s *memoryStore) ListConversations(since time.Time) (map[string]ConversationModelEntry, error) {
+	s.conversationMu.RLock()
+	out := make(map[string]ConversationModelEntry)
+	for k, v := range s.conversations {
+		if v.ModelID != "" && !v.LastSeen.Before(since) {
+			out[k] = v
+		}
+	}
+	s.conversationMu.RUnlock()
+	return out, nil
+}
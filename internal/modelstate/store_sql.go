@@ -0,0 +1,115 @@
+package modelstate
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"awesomeProject/internal/model"
+)
+
+// sqlStore 基于 gorm 的实现，状态保存在 ModelDisableState / ConversationState 表中，多个实例可共享。
+type sqlStore struct {
+	db *gorm.DB
+}
+
+// NewSQLStore 创建 SQL 存储，db 需已迁移 model.ModelDisableState 与 model.ConversationState。
+func NewSQLStore(db *gorm.DB) Store {
+	return &sqlStore{db: db}
+}
+
+func (s *sqlStore) SetDisabled(modelID string, until time.Time) error {
+	return s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "model_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"disabled_until"}),
+	}).Create(&model.ModelDisableState{ModelID: modelID, DisabledUntil: until}).Error
+}
+
+func (s *sqlStore) DisabledUntil(modelID string) (time.Time, bool, error) {
+	var row model.ModelDisableState
+	if err := s.db.Where("model_id = ?", modelID).First(&row).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return time.Time{}, false, nil
+		}
+		return time.Time{}, false, err
+	}
+	return row.DisabledUntil, true, nil
+}
+
+func (s *sqlStore) DeleteDisabledBefore(modelID string, now time.Time) error {
+	q := s.db.Where("disabled_until <= ?", now)
+	if modelID != "" {
+		q = q.Where("model_id = ?", modelID)
+	}
+	return q.Delete(&model.ModelDisableState{}).Error
+}
+
+func (s *sqlStore) DeleteDisabled(modelID string) error {
+	return s.db.Where("model_id = ?", modelID).Delete(&model.ModelDisableState{}).Error
+}
+
+func (s *sqlStore) ClearDisabled() (int64, error) {
+	res := s.db.Where("1 = 1").Delete(&model.ModelDisableState{})
+	return res.RowsAffected, res.Error
+}
+
+func (s *sqlStore) ListDisabled() (map[string]time.Time, error) {
+	var rows []model.ModelDisableState
+	if err := s.db.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	out := make(map[string]time.Time, len(rows))
+	for _, r := range rows {
+		out[r.ModelID] = r.DisabledUntil
+	}
+	return out, nil
+}
+
+func (s *sqlStore) GetConversation(conversationID string) (ConversationModelEntry, bool, error) {
+	var row model.ConversationState
+	if err := s.db.Where("conversation_id = ?", conversationID).First(&row).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ConversationModelEntry{}, false, nil
+		}
+		return ConversationModelEntry{}, false, err
+	}
+	return ConversationModelEntry{ModelID: row.ModelID, ComboID: row.ComboID, LastSeen: row.LastSeen}, true, nil
+}
+
+func (s *sqlStore) SetConversation(conversationID string, ent ConversationModelEntry) error {
+	return s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "conversation_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"model_id", "combo_id", "last_seen"}),
+	}).Create(&model.ConversationState{
+		ConversationID: conversationID,
+		ModelID:        ent.ModelID,
+		ComboID:        ent.ComboID,
+		LastSeen:       ent.LastSeen,
+	}).Error
+}
+
+func (s *sqlStore) TouchConversation(conversationID string, lastSeen time.Time) error {
+	return s.db.Model(&model.ConversationState{}).Where("conversation_id = ?", conversationID).Update("last_seen", lastSeen).Error
+}
+
+func (s *sqlStore) DeleteConversation(conversationID string) error {
+	return s.db.Where("conversation_id = ?", conversationID).Delete(&model.ConversationState{}).Error
+}
+
+func (s *sqlStore) DeleteConversationsBefore(cutoff time.Time) error {
+	return s.db.Where("last_seen < ? OR model_id = ''", cutoff).Delete(&model.ConversationState{}).Error
+}
+
+func (s *sqlStore) ListConversations(since time.Time) (map[string]ConversationModelEntry, error) {
+	var rows []model.ConversationState
+	if err := s.db.Where("last_seen >= ? AND model_id <> ''", since).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	out := make(map[string]ConversationModelEntry, len(rows))
+	for _, r := range rows {
+		out[r.ConversationID] = ConversationModelEntry{ModelID: r.ModelID, ComboID: r.ComboID, LastSeen: r.LastSeen}
+	}
+	return out, nil
+}
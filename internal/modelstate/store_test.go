@@ -0,0 +1,81 @@
+package modelstate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+
+	"awesomeProject/internal/model"
+	"awesomeProject/pkg/utils"
+)
+
+func TestStores(t *testing.T) {
+	utils.InitLogger("error")
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	if err := db.AutoMigrate(&model.ModelDisableState{}, &model.ConversationState{}); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	stores := map[string]Store{"memory": NewMemoryStore(), "sql": NewSQLStore(db)}
+
+	prev := currentStore()
+	defer SetStore(prev)
+	for name, s := range stores {
+		SetStore(s)
+
+		DisableModelTemporarily("m1", time.Hour)
+		DisableModelTemporarily("m2", time.Hour)
+		if !IsModelTemporarilyDisabled("m1") {
+			t.Fatalf("%s: expect m1 disabled", name)
+		}
+		// 过期记录在读取与清理时删除
+		_ = s.SetDisabled("m2", time.Now().Add(-time.Second))
+		if IsModelTemporarilyDisabled("m2") {
+			t.Fatalf("%s: expect m2 expired", name)
+		}
+		if _, ok, _ := s.DisabledUntil("m2"); ok {
+			t.Fatalf("%s: expect expired m2 removed", name)
+		}
+		if list, err := ListTemporarilyDisabledModels(); err != nil || len(list) != 1 || list[0].ModelID != "m1" {
+			t.Fatalf("%s: expect only m1 listed, got %+v %v", name, list, err)
+		}
+		EnableModel("m1")
+		if IsModelTemporarilyDisabled("m1") {
+			t.Fatalf("%s: expect m1 enabled", name)
+		}
+		DisableModelTemporarily("m1", time.Hour)
+		ClearAllTemporarilyDisabledModels()
+		if IsModelTemporarilyDisabled("m1") {
+			t.Fatalf("%s: expect m1 cleared", name)
+		}
+
+		SetConversationModelWithCombo("conv", "m1", "combo:c")
+		SetConversationModelWithCombo("conv", "m3", "combo:c")
+		if m, ok := GetConversationModel("conv"); !ok || m != "m3" {
+			t.Fatalf("%s: expect conv -> m3, got %q %v", name, m, ok)
+		}
+		if cb, ok := GetConversationCombo("conv"); !ok || cb != "combo:c" {
+			t.Fatalf("%s: expect combo:c, got %q", name, cb)
+		}
+		_ = s.SetConversation("stale", ConversationModelEntry{ModelID: "m1", LastSeen: time.Now().Add(-2 * ConversationModelTTL)})
+		if _, ok := GetConversationModel("stale"); ok {
+			t.Fatalf("%s: expect stale conversation expired", name)
+		}
+		_ = s.SetConversation("stale", ConversationModelEntry{ModelID: "m1", LastSeen: time.Now().Add(-2 * ConversationModelTTL)})
+		CleanupConversationModels()
+		if _, ok, _ := s.GetConversation("stale"); ok {
+			t.Fatalf("%s: expect cleanup to remove stale conversation", name)
+		}
+		if pins, err := ListConversationModels(); err != nil || len(pins) != 1 || pins[0].ConversationID != "conv" || pins[0].ComboID != "combo:c" {
+			t.Fatalf("%s: expect conv listed, got %+v %v", name, pins, err)
+		}
+		ClearConversationModel("conv")
+		if _, ok := GetConversationModel("conv"); ok {
+			t.Fatalf("%s: expect conv cleared", name)
+		}
+	}
+}
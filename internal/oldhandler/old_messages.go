@@ -3,6 +3,7 @@ package oldhandler
 import (
 	"awesomeProject/internal/combo"
 	appconfig "awesomeProject/internal/config"
+	"awesomeProject/internal/errclass"
 	"awesomeProject/internal/middleware"
 	"awesomeProject/internal/model"
 	"awesomeProject/internal/modelstate"
@@ -11,6 +12,7 @@ import (
 	"awesomeProject/pkg/utils"
 	"bufio"
 	"encoding/json"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"io"
 	"net/http"
@@ -369,7 +371,7 @@ func (h *MessagesHandler) handleMessages(c *gin.Context) {
 		if conversationID != "" {
 			modelstate.ClearConversationModel(conversationID)
 		}
-		modelstate.DisableModelTemporarily(targetModel.ID, modelstate.DisableTTL)
+		recordUpstreamFailure(c, targetModel.ID, statusCode, err, body)
 
 		if c.Request.Context().Err() != nil {
 			utils.Logger.Printf("[ClaudeRouter] messages: client_gone, skip error response")
@@ -398,13 +400,14 @@ func (h *MessagesHandler) handleMessages(c *gin.Context) {
 		if conversationID != "" {
 			modelstate.ClearConversationModel(conversationID)
 		}
-		modelstate.DisableModelTemporarily(targetModel.ID, modelstate.DisableTTL)
+		recordUpstreamFailure(c, targetModel.ID, statusCode, err, body)
 
 		upstreamMsg := extractUpstreamErrorMessage(body)
 		utils.Logger.Printf("[ClaudeRouter] messages: step=upstream_error status=%d message=%s", statusCode, upstreamMsg)
 		anthropicErrorFromBody(c, statusCode, body)
 		return
 	}
+	modelstate.RecordModelSuccess(targetModel.ID)
 
 	if stream && streamBody != nil {
 		utils.Logger.Printf("[ClaudeRouter] messages: step=stream_write interface_type=%s response_format=%s", interfaceType, targetModel.ResponseFormat)
@@ -676,3 +679,21 @@ func recordUsageWithModel(c *gin.Context, input, output int64, modelID string) {
 	//	}
 	//}
 }
+
+// recordUpstreamFailure 对上游失败分类，只有上游/key/限流类失败禁用模型，并写入带分类的错误日志。
+func recordUpstreamFailure(c *gin.Context, modelID string, statusCode int, err error, body []byte) {
+	class := errclass.Classify(statusCode, err, body)
+	c.Set(middleware.ErrorClassKey, class)
+	if class.DisablesModel() {
+		modelstate.RecordModelFailure(modelID)
+	}
+	username := ""
+	if u := middleware.CurrentUser(c); u != nil {
+		username = u.Username
+	}
+	msg := fmt.Sprintf("UpStream Error:%v", statusCode)
+	if err != nil {
+		msg = err.Error()
+	}
+	_ = model.RecordErrorLogWithClass(modelID, username, statusCode, 0, string(class), msg)
+}
@@ -14,6 +14,8 @@ const (
 
 	defaultErrorLogCleanupInterval = 30 * time.Minute
 	defaultErrorLogRetention       = 12 * time.Hour
+
+	quotaHoldCleanupInterval = time.Minute
 )
 
 // CleanupOldUsageLogs 删除过期的使用日志。
@@ -67,6 +69,8 @@ func StartTasks(cfg *config.Config) {
 	startUsageLogCleanup(cfg)
 	startErrorLogCleanup(cfg)
 	startComboWeightAdjust(cfg)
+	startHealthCheck(cfg)
+	startQuotaHoldCleanup()
 }
 
 func startUsageLogCleanup(cfg *config.Config) {
@@ -121,3 +125,24 @@ func startErrorLogCleanup(cfg *config.Config) {
 	}()
 	utils.Logger.Printf("[CleanupTask] error log cleanup task started (runs every %s, retention=%s)", interval, retention)
 }
+
+// startQuotaHoldCleanup 定期释放到期未结算的额度预占（实例崩溃或请求异常退出时遗留）。
+func startQuotaHoldCleanup() {
+	runOnce := func() {
+		n, err := model.ReleaseExpiredQuotaHolds(time.Now())
+		if err != nil {
+			utils.Logger.Printf("[CleanupTask] release expired quota holds failed: %v", err)
+		} else if n > 0 {
+			utils.Logger.Printf("[CleanupTask] released %d expired quota holds", n)
+		}
+	}
+	ticker := time.NewTicker(quotaHoldCleanupInterval)
+	go func() {
+		defer ticker.Stop()
+		runOnce()
+		for range ticker.C {
+			runOnce()
+		}
+	}()
+	utils.Logger.Printf("[CleanupTask] quota hold cleanup task started (runs every %s)", quotaHoldCleanupInterval)
+}
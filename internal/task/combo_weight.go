@@ -2,9 +2,12 @@ package task
 
 import (
 	"awesomeProject/internal/config"
+	"awesomeProject/internal/errclass"
 	"awesomeProject/internal/model"
 	"awesomeProject/internal/storage"
 	"awesomeProject/pkg/utils"
+	"encoding/json"
+	"fmt"
 	"math"
 	"sort"
 	"strings"
@@ -24,8 +27,30 @@ const (
 	// 严重错误（429/404/403/400）惩罚倍率默认 3.0，其他错误默认 0.3
 	defaultSevereErrorWeight = 3.0
 	defaultMildErrorWeight   = 0.3
+	// 使用延迟/成功率前每个模型至少需要的请求数
+	defaultComboWeightMinSamples = int64(5)
 )
 
+// ComboWeightBlend 目标权重各组成部分的比例（按比例混合，不要求和为 1）；全为 0 时等价于只看错误数。
+type ComboWeightBlend struct {
+	Errors  float64 // 加权错误数，score=1/(err+1)
+	TTFT    float64 // 平均首字节耗时，score=组内最快/自身
+	Latency float64 // 平均总耗时，score=组内最快/自身
+	Success float64 // 成功率，score=成功/(成功+错误)
+}
+
+func (b ComboWeightBlend) usesUsageStats() bool {
+	return b.TTFT > 0 || b.Latency > 0 || b.Success > 0
+}
+
+// modelPerf 统计窗口内某个模型的请求表现（来自 UsageLog 与 ErrorLog，不含影子流量）。
+type modelPerf struct {
+	Samples      int64   // 成功请求数
+	Errors       int64   // 失败次数（不加权）
+	AvgTTFTMs    float64 // 平均首字节耗时，0 表示无数据
+	AvgLatencyMs float64 // 平均总耗时，0 表示无数据
+}
+
 type modelErrCount struct {
 	ModelID    string
 	Cnt        int64
@@ -51,6 +76,9 @@ func startComboWeightAdjust(cfg *config.Config) {
 	maxStep := defaultComboWeightMaxStep
 	severeErrorWeight := defaultSevereErrorWeight
 	mildErrorWeight := defaultMildErrorWeight
+	var blend ComboWeightBlend
+	minSamples := defaultComboWeightMinSamples
+	dryRun := false
 
 	if cfg != nil {
 		enabled = boolOrDefault(cfg.Tasks.ComboWeight.Enabled, false)
@@ -75,6 +103,12 @@ func startComboWeightAdjust(cfg *config.Config) {
 		if cfg.Tasks.ComboWeight.MildErrorWeight > 0 {
 			mildErrorWeight = cfg.Tasks.ComboWeight.MildErrorWeight
 		}
+		b := cfg.Tasks.ComboWeight.Blend
+		blend = ComboWeightBlend{Errors: b.Errors, TTFT: b.TTFT, Latency: b.Latency, Success: b.Success}
+		if cfg.Tasks.ComboWeight.MinSamples > 0 {
+			minSamples = cfg.Tasks.ComboWeight.MinSamples
+		}
+		dryRun = boolOrDefault(cfg.Tasks.ComboWeight.DryRun, false)
 	}
 
 	if !enabled {
@@ -94,7 +128,7 @@ func startComboWeightAdjust(cfg *config.Config) {
 	}
 
 	runOnce := func() {
-		if err := AdjustComboWeightsByGlobalErrorLogs(window, minErrors, lr, minWeight, normalize, maxStep, severeErrorWeight, mildErrorWeight); err != nil {
+		if err := AdjustComboWeightsByStats(window, minErrors, lr, minWeight, normalize, maxStep, severeErrorWeight, mildErrorWeight, blend, minSamples, dryRun); err != nil {
 			utils.Logger.Printf("[ComboWeightTask] adjust failed: %v", err)
 		}
 	}
@@ -107,21 +141,38 @@ func startComboWeightAdjust(cfg *config.Config) {
 			runOnce()
 		}
 	}()
-	utils.Logger.Printf("[ComboWeightTask] started (interval=%s, window=%s, minErrors=%d)", interval, window, minErrors)
+	utils.Logger.Printf("[ComboWeightTask] started (interval=%s, window=%s, minErrors=%d, blend=%+v, dryRun=%v)", interval, window, minErrors, blend, dryRun)
 }
 
 // AdjustComboWeightsByGlobalErrorLogs 按全局 ErrorLog(model_id) 的错误数调整每个 combo 的 item 权重。
 // 规则：错误越少，权重越高，使用 score=1/(err+1) 并归一化。
 // 严重错误（429/404/403/400）按 severeErrorWeight 倍计，其他错误按 mildErrorWeight 倍计。
+// 客户端错误（errclass.Client）不计入。
 func AdjustComboWeightsByGlobalErrorLogs(window time.Duration, minErrorsToAdjust int64, lr, minWeight float64, normalize bool, maxStep float64, severeErrorWeight, mildErrorWeight float64) error {
+	return AdjustComboWeightsByStats(window, minErrorsToAdjust, lr, minWeight, normalize, maxStep, severeErrorWeight, mildErrorWeight, ComboWeightBlend{Errors: 1}, 0, false)
+}
+
+// AdjustComboWeightsByStats 在错误数之外，按 blend 混合 UsageLog 中的首字节耗时、总耗时与成功率计算目标权重。
+// 请求数少于 minSamples 的模型在延迟/成功率上取同组已知模型的平均分，避免样本太少时大幅波动。
+// 仍然只调整 AutoWeightUpdate 开启的 item，并遵守 min_weight 与 max_step。
+// 每次变更都写入 ComboWeightHistory；dryRun 时只记录建议值，不修改权重。
+func AdjustComboWeightsByStats(window time.Duration, minErrorsToAdjust int64, lr, minWeight float64, normalize bool, maxStep float64, severeErrorWeight, mildErrorWeight float64, blend ComboWeightBlend, minSamples int64, dryRun bool) error {
 	since := time.Now().Add(-window)
 
 	errMap, totalErr, err := loadGlobalErrorCountsSince(since, severeErrorWeight, mildErrorWeight)
 	if err != nil {
 		return err
 	}
-	if totalErr < float64(minErrorsToAdjust) {
-		utils.Logger.Printf("[ComboWeightTask] skip: total errors=%.2f < minErrorsToAdjust=%d (since %s)", totalErr, minErrorsToAdjust, since.Format(time.RFC3339))
+	var perf map[string]modelPerf
+	var totalSamples int64
+	if blend.usesUsageStats() {
+		perf, totalSamples, err = loadModelPerfSince(since)
+		if err != nil {
+			return err
+		}
+	}
+	if totalErr < float64(minErrorsToAdjust) && totalSamples == 0 {
+		utils.Logger.Printf("[ComboWeightTask] skip: total errors=%.2f < minErrorsToAdjust=%d and no usage samples (since %s)", totalErr, minErrorsToAdjust, since.Format(time.RFC3339))
 		return nil
 	}
 
@@ -156,12 +207,27 @@ func AdjustComboWeightsByGlobalErrorLogs(window time.Duration, minErrorsToAdjust
 			continue
 		}
 
-		newWeights := computeNewWeights(items, errMap, lr, minWeight, normalize, maxStep)
+		target := computeTargetScores(items, errMap, perf, blend, minSamples)
+		newWeights := computeNewWeights(items, target, lr, minWeight, normalize, maxStep)
 		if len(newWeights) == 0 {
 			continue
 		}
 
-		changed, err := applyComboItemWeights(cb.ID, newWeights)
+		reason := fmt.Sprintf("window=%s lr=%g max_step=%g blend=%+v", window, lr, maxStep, blend)
+		inputs := make(map[uint]weightInputs, len(items))
+		for i, it := range items {
+			id := strings.TrimSpace(it.ModelID)
+			p := perf[id]
+			inputs[it.ID] = weightInputs{
+				WeightedErrors: errMap[id],
+				Samples:        p.Samples,
+				Errors:         p.Errors,
+				AvgTTFTMs:      p.AvgTTFTMs,
+				AvgLatencyMs:   p.AvgLatencyMs,
+				Target:         target[i],
+			}
+		}
+		changed, err := applyComboItemWeights(cb.ID, items, newWeights, inputs, reason, dryRun)
 		if err != nil {
 			utils.Logger.Printf("[ComboWeightTask] apply weights failed combo=%s: %v", cb.ID, err)
 			continue
@@ -172,7 +238,7 @@ func AdjustComboWeightsByGlobalErrorLogs(window time.Duration, minErrorsToAdjust
 		}
 	}
 
-	utils.Logger.Printf("[ComboWeightTask] adjusted combos=%d items=%d (since %s, totalWeightedErrors=%.2f)", adjustedCombos, adjustedItems, since.Format(time.RFC3339), totalErr)
+	utils.Logger.Printf("[ComboWeightTask] adjusted combos=%d items=%d (since %s, totalWeightedErrors=%.2f, dryRun=%v)", adjustedCombos, adjustedItems, since.Format(time.RFC3339), totalErr, dryRun)
 	return nil
 }
 
@@ -180,7 +246,8 @@ func loadGlobalErrorCountsSince(since time.Time, severeErrorWeight, mildErrorWei
 	var rows []modelErrCount
 	q := storage.DB.Model(&model.ErrorLog{}).
 		Select("model_id as model_id, status_code as status_code, COUNT(1) as cnt").
-		Where("created_at >= ?", since).
+		Where("created_at >= ? AND shadow = ?", since, false).
+		Where("error_class IN ?", errclass.PenalizedClasses()).
 		Group("model_id, status_code")
 	if err := q.Scan(&rows).Error; err != nil {
 		return nil, 0, err
@@ -211,17 +278,94 @@ func loadGlobalErrorCountsSince(since time.Time, severeErrorWeight, mildErrorWei
 	return m, total, nil
 }
 
-func computeNewWeights(items []model.ComboItem, errMap map[string]float64, lr, minWeight float64, normalize bool, maxStep float64) map[uint]float64 {
-	// 目标权重 = 1/(err+1)，错误越少越大
-	target := make([]float64, 0, len(items))
-	for _, it := range items {
-		e := errMap[strings.TrimSpace(it.ModelID)]
+// computeTargetScores 计算每个 item 的目标分数（未归一化），见 ComboWeightBlend。
+func computeTargetScores(items []model.ComboItem, errMap map[string]float64, perf map[string]modelPerf, blend ComboWeightBlend, minSamples int64) []float64 {
+	if !blend.usesUsageStats() && blend.Errors <= 0 {
+		blend.Errors = 1
+	}
+	n := len(items)
+	errScore := make([]float64, n)
+	ttft := make([]float64, n)
+	latency := make([]float64, n)
+	success := make([]float64, n)
+	for i, it := range items {
+		id := strings.TrimSpace(it.ModelID)
+		// 目标权重 = 1/(err+1)，错误越少越大
+		e := errMap[id]
 		if e < 0 {
 			e = 0
 		}
-		score := 1.0 / (e + 1)
-		target = append(target, score)
+		errScore[i] = 1.0 / (e + 1)
+
+		p := perf[id]
+		ttft[i], latency[i], success[i] = -1, -1, -1
+		if p.Samples >= minSamples {
+			if p.AvgTTFTMs > 0 {
+				ttft[i] = p.AvgTTFTMs
+			}
+			if p.AvgLatencyMs > 0 {
+				latency[i] = p.AvgLatencyMs
+			}
+		}
+		if total := p.Samples + p.Errors; total > 0 && total >= minSamples {
+			success[i] = float64(p.Samples) / float64(total)
+		}
+	}
+	ttftScore := relativeSpeedScores(ttft)
+	latencyScore := relativeSpeedScores(latency)
+	successScore := fillUnknownWithMean(success)
+
+	sum := blend.Errors + blend.TTFT + blend.Latency + blend.Success
+	target := make([]float64, n)
+	for i := range items {
+		target[i] = (blend.Errors*errScore[i] + blend.TTFT*ttftScore[i] + blend.Latency*latencyScore[i] + blend.Success*successScore[i]) / sum
+	}
+	return target
+}
+
+// relativeSpeedScores 把耗时（<0 表示未知）转换为 组内最快/自身 的分数，未知项取已知项的平均分。
+func relativeSpeedScores(ms []float64) []float64 {
+	fastest := 0.0
+	for _, v := range ms {
+		if v > 0 && (fastest == 0 || v < fastest) {
+			fastest = v
+		}
+	}
+	out := make([]float64, len(ms))
+	for i, v := range ms {
+		out[i] = -1
+		if v > 0 {
+			out[i] = fastest / v
+		}
 	}
+	return fillUnknownWithMean(out)
+}
+
+// fillUnknownWithMean 把 <0 的未知项替换为已知项的平均值；全部未知时为 1。
+func fillUnknownWithMean(scores []float64) []float64 {
+	sum, cnt := 0.0, 0
+	for _, v := range scores {
+		if v >= 0 {
+			sum += v
+			cnt++
+		}
+	}
+	mean := 1.0
+	if cnt > 0 {
+		mean = sum / float64(cnt)
+	}
+	out := make([]float64, len(scores))
+	for i, v := range scores {
+		if v < 0 {
+			v = mean
+		}
+		out[i] = v
+	}
+	return out
+}
+
+func computeNewWeights(items []model.ComboItem, target []float64, lr, minWeight float64, normalize bool, maxStep float64) map[uint]float64 {
+	target = append([]float64(nil), target...)
 	if normalize {
 		normInPlace(target)
 	}
@@ -271,6 +415,53 @@ func computeNewWeights(items []model.ComboItem, errMap map[string]float64, lr, m
 	return out
 }
 
+type modelUsageStat struct {
+	RealModelID string
+	Cnt         int64
+	AvgTTFT     float64
+	AvgLatency  float64
+}
+
+// loadModelPerfSince 汇总窗口内每个实际调用模型的成功请求数、平均耗时与失败次数。
+func loadModelPerfSince(since time.Time) (map[string]modelPerf, int64, error) {
+	var usage []modelUsageStat
+	if err := storage.DB.Model(&model.UsageLog{}).
+		Select("real_model_id as real_model_id, COUNT(1) as cnt, "+
+			"COALESCE(AVG(CASE WHEN ttft_ms > 0 THEN ttft_ms END), 0) as avg_ttft, "+
+			"COALESCE(AVG(CASE WHEN latency_ms > 0 THEN latency_ms END), 0) as avg_latency").
+		Where("created_at >= ? AND shadow = ? AND real_model_id <> ''", since, false).
+		Group("real_model_id").
+		Scan(&usage).Error; err != nil {
+		return nil, 0, err
+	}
+	var errs []modelErrCount
+	if err := storage.DB.Model(&model.ErrorLog{}).
+		Select("model_id as model_id, COUNT(1) as cnt").
+		Where("created_at >= ? AND shadow = ?", since, false).
+		Where("error_class IN ?", errclass.PenalizedClasses()).
+		Group("model_id").
+		Scan(&errs).Error; err != nil {
+		return nil, 0, err
+	}
+
+	out := make(map[string]modelPerf, len(usage))
+	var total int64
+	for _, u := range usage {
+		id := strings.TrimSpace(u.RealModelID)
+		p := out[id]
+		p.Samples, p.AvgTTFTMs, p.AvgLatencyMs = u.Cnt, u.AvgTTFT, u.AvgLatency
+		out[id] = p
+		total += u.Cnt
+	}
+	for _, e := range errs {
+		id := strings.TrimSpace(e.ModelID)
+		p := out[id]
+		p.Errors = e.Cnt
+		out[id] = p
+	}
+	return out, total, nil
+}
+
 func normInPlace(ws []float64) {
 	sum := 0.0
 	for _, w := range ws {
@@ -297,34 +488,77 @@ func normInPlace(ws []float64) {
 	}
 }
 
-func applyComboItemWeights(comboID string, newWeights map[uint]float64) (int, error) {
+// weightInputs 计算某个 item 新权重时使用的数据，序列化后写入 ComboWeightHistory.Inputs。
+type weightInputs struct {
+	WeightedErrors float64 `json:"weighted_errors"`
+	Samples        int64   `json:"samples"`
+	Errors         int64   `json:"errors"`
+	AvgTTFTMs      float64 `json:"avg_ttft_ms,omitempty"`
+	AvgLatencyMs   float64 `json:"avg_latency_ms,omitempty"`
+	Target         float64 `json:"target"`
+}
+
+// applyComboItemWeights 写入新权重并记录权重历史（同一批次），返回权重有变化的 item 数；
+// dryRun 时只记录建议值，不修改 ComboItem。
+func applyComboItemWeights(comboID string, items []model.ComboItem, newWeights map[uint]float64, inputs map[uint]weightInputs, reason string, dryRun bool) (int, error) {
 	if strings.TrimSpace(comboID) == "" || len(newWeights) == 0 {
 		return 0, nil
 	}
 
 	// 为了输出更稳定，按 id 排序
-	ids := make([]uint, 0, len(newWeights))
-	for id := range newWeights {
-		ids = append(ids, id)
+	sorted := make([]model.ComboItem, 0, len(items))
+	for _, it := range items {
+		if _, ok := newWeights[it.ID]; ok {
+			sorted = append(sorted, it)
+		}
 	}
-	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
 
+	// 批次记录参与本轮计算的所有 item（未变化的 OldWeight == NewWeight），作为可恢复的完整快照；没有任何变化时不写入
+	batchID := model.NewWeightBatchID()
+	var history []model.ComboWeightHistory
 	changed := 0
 	err := storage.DB.Transaction(func(tx *gorm.DB) error {
-		for _, id := range ids {
-			w := newWeights[id]
+		for _, it := range sorted {
+			w := newWeights[it.ID]
 			if w < 0 {
 				w = 0
 			}
-			res := tx.Model(&model.ComboItem{}).Where("id = ? AND combo_id = ?", id, comboID).Update("weight", w)
-			if res.Error != nil {
-				return res.Error
-			}
-			if res.RowsAffected > 0 {
+			if math.Abs(w-it.Weight) < 1e-9 {
+				w = it.Weight
+			} else {
+				if !dryRun {
+					res := tx.Model(&model.ComboItem{}).Where("id = ? AND combo_id = ?", it.ID, comboID).Update("weight", w)
+					if res.Error != nil {
+						return res.Error
+					}
+					if res.RowsAffected == 0 {
+						continue
+					}
+				}
 				changed++
 			}
+			raw, _ := json.Marshal(inputs[it.ID])
+			history = append(history, model.ComboWeightHistory{
+				BatchID:   batchID,
+				ComboID:   comboID,
+				ModelID:   it.ModelID,
+				OldWeight: it.Weight,
+				NewWeight: w,
+				Source:    model.WeightSourceAuto,
+				Reason:    reason,
+				Inputs:    string(raw),
+				DryRun:    dryRun,
+				CreatedAt: time.Now(),
+			})
+		}
+		if changed > 0 {
+			return tx.Create(&history).Error
 		}
 		return nil
 	})
-	return changed, err
+	if err != nil {
+		return 0, err
+	}
+	return changed, nil
 }
@@ -0,0 +1,42 @@
+package task
+
+import (
+	"math"
+	"testing"
+
+	"awesomeProject/internal/model"
+)
+
+func TestComputeTargetScores(t *testing.T) {
+	items := []model.ComboItem{{ID: 1, ModelID: "fast"}, {ID: 2, ModelID: "slow"}, {ID: 3, ModelID: "new"}}
+	errMap := map[string]float64{"slow": 1}
+	perf := map[string]modelPerf{
+		"fast": {Samples: 20, AvgTTFTMs: 500, AvgLatencyMs: 4000},
+		"slow": {Samples: 20, Errors: 5, AvgTTFTMs: 2000, AvgLatencyMs: 8000},
+		"new":  {Samples: 1, AvgTTFTMs: 100},
+	}
+
+	// 只看错误数（旧行为）
+	got := computeTargetScores(items, errMap, perf, ComboWeightBlend{}, 5)
+	want := []float64{1, 0.5, 1}
+	for i := range want {
+		if math.Abs(got[i]-want[i]) > 1e-9 {
+			t.Fatalf("errors only: expect %v, got %v", want, got)
+		}
+	}
+
+	// 只看首字节耗时：slow 为 fast 的 1/4，样本不足的 new 取已知平均
+	got = computeTargetScores(items, errMap, perf, ComboWeightBlend{TTFT: 1}, 5)
+	want = []float64{1, 0.25, 0.625}
+	for i := range want {
+		if math.Abs(got[i]-want[i]) > 1e-9 {
+			t.Fatalf("ttft only: expect %v, got %v", want, got)
+		}
+	}
+
+	// 混合：成功率 slow=20/25
+	got = computeTargetScores(items, errMap, perf, ComboWeightBlend{Errors: 1, Success: 1}, 5)
+	if math.Abs(got[1]-(0.5+0.8)/2) > 1e-9 || got[0] <= got[1] {
+		t.Fatalf("blend: unexpected %v", got)
+	}
+}
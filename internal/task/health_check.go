@@ -0,0 +1,225 @@
+package task
+
+import (
+	"awesomeProject/internal/config"
+	"awesomeProject/internal/errclass"
+	"awesomeProject/internal/model"
+	"awesomeProject/internal/modelstate"
+	"awesomeProject/pkg/utils"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHealthCheckInterval    = 5 * time.Minute
+	defaultHealthCheckTimeout     = 30 * time.Second
+	defaultHealthCheckPrompt      = "ping"
+	defaultHealthCheckConcurrency = 4
+	defaultHealthCheckRetention   = 72 * time.Hour
+	// 检查哪些模型到期的频率；各模型的实际探测间隔由 interval / Model.HealthCheckIntervalSec 决定
+	healthCheckTick = 15 * time.Second
+)
+
+// ModelProber 向模型发送一次非流式探测请求（走与真实请求相同的适配器/运营商转发逻辑），
+// 返回上游状态码与响应体；streamBody 非空时由调用方关闭。
+type ModelProber func(ctx context.Context, m *model.Model, prompt string) (statusCode int, body []byte, streamBody io.ReadCloser, err error)
+
+type healthCheckOptions struct {
+	interval    time.Duration
+	timeout     time.Duration
+	prompt      string
+	concurrency int
+	retention   time.Duration
+}
+
+var (
+	proberMu sync.RWMutex
+	prober   ModelProber
+
+	healthOptsMu sync.RWMutex
+	healthOpts   = healthCheckOptions{
+		interval:    defaultHealthCheckInterval,
+		timeout:     defaultHealthCheckTimeout,
+		prompt:      defaultHealthCheckPrompt,
+		concurrency: defaultHealthCheckConcurrency,
+		retention:   defaultHealthCheckRetention,
+	}
+)
+
+// SetModelProber 设置健康检查使用的探测函数（由 handler 提供，需在 StartTasks 之前调用）。
+func SetModelProber(p ModelProber) {
+	proberMu.Lock()
+	prober = p
+	proberMu.Unlock()
+}
+
+func currentProber() ModelProber {
+	proberMu.RLock()
+	defer proberMu.RUnlock()
+	return prober
+}
+
+func startHealthCheck(cfg *config.Config) {
+	enabled := false
+	opts := healthCheckOptions{
+		interval:    defaultHealthCheckInterval,
+		timeout:     defaultHealthCheckTimeout,
+		prompt:      defaultHealthCheckPrompt,
+		concurrency: defaultHealthCheckConcurrency,
+		retention:   defaultHealthCheckRetention,
+	}
+	if cfg != nil {
+		hc := cfg.Tasks.HealthCheck
+		enabled = boolOrDefault(hc.Enabled, false)
+		opts.interval = parseDurationOrDefault(hc.Interval, defaultHealthCheckInterval)
+		opts.timeout = parseDurationOrDefault(hc.Timeout, defaultHealthCheckTimeout)
+		opts.retention = parseDurationOrDefault(hc.Retention, defaultHealthCheckRetention)
+		if p := strings.TrimSpace(hc.Prompt); p != "" {
+			opts.prompt = p
+		}
+		if hc.Concurrency > 0 {
+			opts.concurrency = hc.Concurrency
+		}
+	}
+	healthOptsMu.Lock()
+	healthOpts = opts
+	healthOptsMu.Unlock()
+
+	if !enabled {
+		utils.Logger.Printf("[HealthCheckTask] model health check task disabled")
+		return
+	}
+
+	lastProbe := make(map[string]time.Time)
+	lastCleanup := time.Time{}
+	runOnce := func() {
+		now := time.Now()
+		runDueHealthChecks(opts, lastProbe, now)
+		if now.Sub(lastCleanup) >= time.Hour {
+			lastCleanup = now
+			if n, err := model.CleanupModelHealthChecks(now.Add(-opts.retention)); err != nil {
+				utils.Logger.Printf("[HealthCheckTask] cleanup failed: %v", err)
+			} else if n > 0 {
+				utils.Logger.Printf("[HealthCheckTask] deleted %d old health checks", n)
+			}
+		}
+	}
+
+	ticker := time.NewTicker(healthCheckTick)
+	go func() {
+		defer ticker.Stop()
+		runOnce()
+		for range ticker.C {
+			runOnce()
+		}
+	}()
+	utils.Logger.Printf("[HealthCheckTask] started (interval=%s, timeout=%s, concurrency=%d)", opts.interval, opts.timeout, opts.concurrency)
+}
+
+// runDueHealthChecks 探测所有到期的已启用模型（lastProbe 记录每个模型上次探测时间，会被更新），并发数受 opts.concurrency 限制。
+func runDueHealthChecks(opts healthCheckOptions, lastProbe map[string]time.Time, now time.Time) {
+	var due []*model.Model
+	for _, m := range model.ListModels() {
+		if m == nil || !m.Enabled {
+			continue
+		}
+		interval := opts.interval
+		if m.HealthCheckIntervalSec < 0 {
+			continue
+		}
+		if m.HealthCheckIntervalSec > 0 {
+			interval = time.Duration(m.HealthCheckIntervalSec) * time.Second
+		}
+		if last, ok := lastProbe[m.ID]; ok && now.Sub(last) < interval {
+			continue
+		}
+		lastProbe[m.ID] = now
+		due = append(due, m)
+	}
+	if len(due) == 0 {
+		return
+	}
+
+	sem := make(chan struct{}, max(opts.concurrency, 1))
+	var wg sync.WaitGroup
+	for _, m := range due {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(m *model.Model) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if _, err := probeModel(m, opts); err != nil {
+				utils.Logger.Printf("[HealthCheckTask] probe model=%s: %v", m.ID, err)
+			}
+		}(m)
+	}
+	wg.Wait()
+}
+
+// ProbeModelNow 立即探测一个模型并记录结果，使用全局配置与模型自身的覆盖值。
+func ProbeModelNow(m *model.Model) (*model.ModelHealthCheck, error) {
+	healthOptsMu.RLock()
+	opts := healthOpts
+	healthOptsMu.RUnlock()
+	return probeModel(m, opts)
+}
+
+// probeModel 发送探测请求，结果写入健康记录并反馈给模型禁用状态（熔断器）：
+// 成功计为一次成功请求，失败按 errclass 分类，只有上游/key/限流类失败计入禁用。
+func probeModel(m *model.Model, opts healthCheckOptions) (*model.ModelHealthCheck, error) {
+	p := currentProber()
+	if p == nil {
+		return nil, errors.New("model prober not configured")
+	}
+	timeout := opts.timeout
+	if m.HealthCheckTimeoutSec > 0 {
+		timeout = time.Duration(m.HealthCheckTimeoutSec) * time.Second
+	}
+	prompt := opts.prompt
+	if s := strings.TrimSpace(m.HealthCheckPrompt); s != "" {
+		prompt = s
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+	statusCode, body, streamBody, err := p(ctx, m, prompt)
+	if streamBody != nil {
+		_ = streamBody.Close()
+	}
+	rec := &model.ModelHealthCheck{
+		ModelID:    m.ID,
+		StatusCode: statusCode,
+		LatencyMs:  time.Since(start).Milliseconds(),
+		CreatedAt:  start,
+	}
+	if err == nil && statusCode >= 200 && statusCode < 300 {
+		rec.OK = true
+		modelstate.RecordModelSuccess(m.ID)
+	} else {
+		class := errclass.Classify(statusCode, err, body)
+		rec.ErrorClass = string(class)
+		rec.ErrorMsg = fmt.Sprintf("status=%d", statusCode)
+		if err != nil {
+			rec.ErrorMsg = err.Error()
+		} else if len(body) > 0 {
+			rec.ErrorMsg = string(body)
+		}
+		switch {
+		case class == errclass.RateLimit:
+			modelstate.RecordRateLimitFailure(m.ID)
+		case class.DisablesModel():
+			modelstate.RecordModelFailure(m.ID)
+		}
+		utils.Logger.Printf("[HealthCheckTask] model=%s unhealthy status=%d class=%s", m.ID, statusCode, class)
+	}
+	if err := model.RecordModelHealthCheck(rec); err != nil {
+		return rec, err
+	}
+	return rec, nil
+}
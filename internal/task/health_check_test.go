@@ -0,0 +1,78 @@
+package task
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+
+	"awesomeProject/internal/model"
+	"awesomeProject/internal/modelstate"
+	"awesomeProject/internal/storage"
+	"awesomeProject/pkg/utils"
+)
+
+func TestProbeModelRecordsHealth(t *testing.T) {
+	utils.InitLogger("error")
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&model.ModelHealthCheck{}); err != nil {
+		t.Fatal(err)
+	}
+	storage.DB = db
+	modelstate.SetStore(modelstate.NewMemoryStore())
+	t.Cleanup(func() { SetModelProber(nil) })
+
+	opts := healthCheckOptions{timeout: time.Second, prompt: "ping", concurrency: 1}
+	var gotPrompt string
+	SetModelProber(func(ctx context.Context, m *model.Model, prompt string) (int, []byte, io.ReadCloser, error) {
+		gotPrompt = prompt
+		switch m.ID {
+		case "ok":
+			return http.StatusOK, []byte(`{}`), nil, nil
+		case "bad-request":
+			return http.StatusBadRequest, []byte(`{"error":"prompt is too long"}`), nil, nil
+		}
+		return 0, nil, nil, errors.New("connection refused")
+	})
+
+	rec, err := probeModel(&model.Model{ID: "ok", HealthCheckPrompt: "hi"}, opts)
+	if err != nil || !rec.OK || gotPrompt != "hi" {
+		t.Fatalf("ok probe: rec=%+v err=%v prompt=%q", rec, err, gotPrompt)
+	}
+
+	// 客户端类失败只记录，不禁用模型
+	rec, _ = probeModel(&model.Model{ID: "bad-request"}, opts)
+	if rec.OK || rec.ErrorClass != "client" || gotPrompt != "ping" {
+		t.Fatalf("bad-request probe: rec=%+v prompt=%q", rec, gotPrompt)
+	}
+	if modelstate.IsModelTemporarilyDisabled("bad-request") {
+		t.Fatal("client error should not disable model")
+	}
+
+	// 连接失败属于上游故障，禁用模型
+	rec, _ = probeModel(&model.Model{ID: "down"}, opts)
+	if rec.OK || rec.ErrorClass != "upstream" {
+		t.Fatalf("down probe: rec=%+v", rec)
+	}
+	if !modelstate.IsModelTemporarilyDisabled("down") {
+		t.Fatal("upstream failure should disable model")
+	}
+
+	summary, err := model.ListModelHealth(time.Now().Add(-time.Hour))
+	if err != nil || len(summary) != 3 {
+		t.Fatalf("summary: %+v err=%v", summary, err)
+	}
+	for _, s := range summary {
+		if s.Checks != 1 || s.Last == nil || (s.ModelID == "ok") != s.Last.OK {
+			t.Fatalf("unexpected summary %+v", s)
+		}
+	}
+}
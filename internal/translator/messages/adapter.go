@@ -4,6 +4,7 @@ import (
 	"awesomeProject/pkg/utils"
 	"context"
 	"io"
+	"net/http"
 )
 
 // ExecuteOptions 上游请求所需配置（由 handler 从模型配置填入）。
@@ -16,6 +17,42 @@ type ExecuteOptions struct {
 	MinimalOpenAI bool
 	// UserAgent 上游请求时使用的 User-Agent header
 	UserAgent string
+	// OnResponseHeader 不为 nil 时，每收到一次上游响应都回调其状态码与响应头（用于读取限流头）
+	OnResponseHeader func(statusCode int, header http.Header)
+}
+
+// ReportResponse 把上游响应的状态码与响应头交给 OnResponseHeader；resp 为 nil 时忽略。
+func (o ExecuteOptions) ReportResponse(resp *http.Response) {
+	if o.OnResponseHeader != nil && resp != nil {
+		o.OnResponseHeader(resp.StatusCode, resp.Header)
+	}
+}
+
+// WrapTransport 为 SDK 使用的 http.Client 包一层 Transport，使其每次收到响应时调用 OnResponseHeader；
+// 没有设置 OnResponseHeader 时原样返回 base。
+func (o ExecuteOptions) WrapTransport(base http.RoundTripper) http.RoundTripper {
+	if o.OnResponseHeader == nil {
+		return base
+	}
+	return &responseHeaderTransport{base: base, hook: o.OnResponseHeader}
+}
+
+// responseHeaderTransport SDK 内部会重试，每次响应都会回调，调用方以最后一次为准。
+type responseHeaderTransport struct {
+	base http.RoundTripper
+	hook func(statusCode int, header http.Header)
+}
+
+func (t *responseHeaderTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	resp, err := base.RoundTrip(req)
+	if err == nil && resp != nil {
+		t.hook(resp.StatusCode, resp.Header)
+	}
+	return resp, err
 }
 
 // Adapter 协议适配器：入口为 Anthropic /v1/messages 格式，通过 SDK 请求上游并返回 Anthropic 格式。
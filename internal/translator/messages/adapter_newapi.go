@@ -101,6 +101,7 @@ func (a *NewAPIAdapter) Execute(ctx context.Context, payload map[string]any, opt
 		logStep("newapi adapter: do err=%v", err)
 		return 0, "", nil, nil, err
 	}
+	opts.ReportResponse(resp)
 	statusCode = resp.StatusCode
 	contentType = resp.Header.Get("Content-Type")
 	if contentType == "" {
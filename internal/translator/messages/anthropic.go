@@ -39,6 +39,7 @@ func (a *AnthropicAdapter) Execute(ctx context.Context, payload map[string]any,
 	logStep("anthropic adapter: creating client baseURL=%s", baseURL)
 
 	httpClient := &http.Client{Timeout: 600 * time.Second}
+	httpClient.Transport = opts.WrapTransport(nil)
 	// 如果提供了 User-Agent，使用自定义 Transport 添加
 	if strings.TrimSpace(opts.UserAgent) != "" {
 		httpClient.Transport = &userAgentTransport{
@@ -128,7 +128,7 @@ func (a *OpenAIAdapter) Execute(ctx context.Context, payload map[string]any, opt
 
 	cfg := openai.DefaultConfig(opts.APIKey)
 	cfg.BaseURL = baseURL
-	cfg.HTTPClient = &http.Client{Timeout: 600 * time.Second}
+	cfg.HTTPClient = &http.Client{Timeout: 600 * time.Second, Transport: opts.WrapTransport(nil)}
 
 	// 如果提供了 User-Agent，使用自定义 Transport 添加
 	//if strings.TrimSpace(opts.UserAgent) != "" {
@@ -58,6 +58,7 @@ func (a *OpenAICompatibleSDKAdapter) Execute(ctx context.Context, payload map[st
 	if err != nil {
 		return 0, "", nil, nil, fmt.Errorf("openai_compatible sdk adapter: upstream request failed: %w", err)
 	}
+	opts.ReportResponse(resp)
 
 	statusCode = resp.StatusCode
 	contentType = resp.Header.Get("Content-Type")
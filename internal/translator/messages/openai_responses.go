@@ -199,6 +199,7 @@ func (a *OpenAIResponsesAdapter) Execute(ctx context.Context, payload map[string
 
 	// 使用 OpenAI SDK 客户端,与 chat_test_handler 完全一致
 	httpClient := &http.Client{Timeout: 30 * time.Minute}
+	httpClient.Transport = opts.WrapTransport(nil)
 	// 如果提供了 User-Agent，使用自定义 Transport 添加
 	if strings.TrimSpace(opts.UserAgent) != "" {
 		httpClient.Transport = &userAgentTransport{
@@ -433,7 +434,7 @@ func (a *OpenAIResponsesAdapter) handleSDKError(err error) (statusCode int, cont
 
 		// 安全地获取响应体
 		body = []byte(`{"error":"upstream service error"}`) // 默认错误消息
-		if apiErr.DumpResponse != nil {
+		if apiErr.Response != nil {
 			if dumpBody := apiErr.DumpResponse(false); len(dumpBody) > 0 {
 				body = dumpBody
 			}
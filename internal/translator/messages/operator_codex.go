@@ -68,6 +68,7 @@ func (s *CodexStrategy) Execute(ctx context.Context, payload map[string]any, opt
 	if err != nil {
 		return 0, "", nil, nil, fmt.Errorf("operator codex: upstream request failed: %w", err)
 	}
+	opts.ReportResponse(resp)
 
 	statusCode = resp.StatusCode
 	contentType = resp.Header.Get("Content-Type")
@@ -69,6 +69,7 @@ func (s *MinimaxStrategy) Execute(ctx context.Context, payload map[string]any, o
 		logStep("operator minimax: err=do request %v", err)
 		return 0, "", nil, nil, err
 	}
+	opts.ReportResponse(resp)
 	statusCode = resp.StatusCode
 	contentType = resp.Header.Get("Content-Type")
 